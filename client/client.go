@@ -0,0 +1,310 @@
+// Package client reads and verifies itko logs, and other logs serving the monitoring
+// side of c2sp.org/static-ct-api.
+//
+// Checkpoints, tiles, and issuers are fetched from the log's monitoring prefix, which is
+// the monitor's URL or the bucket behind it. Entries are checked against the tree they
+// are read for, and inclusion and consistency proofs are computed locally from the
+// tiles, so the log doesn't have to be trusted to compute them. The RFC 6962 endpoints
+// are available through RFC6962.
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ct "github.com/google/certificate-transparency-go"
+	ctclient "github.com/google/certificate-transparency-go/client"
+	"github.com/google/certificate-transparency-go/jsonclient"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// LogEntry is an entry read from a data tile.
+type LogEntry = sunlight.LogEntry
+
+// Tile coordinates, as used in the paths of the tiles.
+const (
+	TileHeight = sunlight.TileHeight
+	TileWidth  = sunlight.TileWidth
+)
+
+// ErrNotFound is returned when the log doesn't have the object asked for.
+var ErrNotFound = errors.New("not found")
+
+type Config struct {
+	// The monitoring prefix of the log, such as https://ct2025.itko.dev/
+	URL string
+	// The log's public key. If set, checkpoints and STHs are verified against it.
+	PublicKey crypto.PublicKey
+	// The checkpoint origin of the log. Defaults to the host and path of URL.
+	Origin string
+	// Set for a mirror of a RFC 6962 log, or a log migrated from Trillian, whose entries
+	// have no leaf_index extension. Their LeafIndex is taken from their position.
+	MirroredEntries bool
+	// Defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	prefix   string
+	origin   string
+	mirrored bool
+	verifier note.Verifier
+	http     *http.Client
+	rfc6962  *ctclient.LogClient
+}
+
+func New(c Config) (*Client, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log URL: %w", err)
+	}
+	prefix := strings.TrimSuffix(u.String(), "/") + "/"
+
+	client := &Client{
+		prefix:   prefix,
+		origin:   c.Origin,
+		mirrored: c.MirroredEntries,
+		http:     c.HTTPClient,
+	}
+	if client.http == nil {
+		client.http = http.DefaultClient
+	}
+	if client.origin == "" {
+		client.origin = strings.TrimSuffix(u.Host+u.Path, "/")
+	}
+
+	opts := jsonclient.Options{UserAgent: "itko-client"}
+	if c.PublicKey != nil {
+		client.verifier, err = sunlight.NewRFC6962Verifier(client.origin, c.PublicKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create checkpoint verifier: %w", err)
+		}
+		opts.PublicKeyDER, err = x509.MarshalPKIXPublicKey(c.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal public key: %w", err)
+		}
+	}
+	client.rfc6962, err = ctclient.New(prefix, client.http, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create RFC 6962 client: %w", err)
+	}
+	return client, nil
+}
+
+// RFC6962 returns a client for the log's RFC 6962 endpoints. If the log's public key
+// was given, the STHs and SCTs it returns are verified.
+func (c *Client) RFC6962() *ctclient.LogClient {
+	return c.rfc6962
+}
+
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.prefix+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: unexpected status %s", path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Checkpoint is a parsed checkpoint.
+type Checkpoint struct {
+	Origin string
+	Tree   tlog.Tree
+	// The signed note, including any cosignatures
+	Raw []byte
+}
+
+// Checkpoint fetches the latest checkpoint. If the log's public key was given, its
+// signature is verified, and its origin must match.
+func (c *Client) Checkpoint(ctx context.Context) (Checkpoint, error) {
+	raw, err := c.get(ctx, "checkpoint")
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	text := string(raw)
+	if c.verifier != nil {
+		n, err := note.Open(raw, note.VerifierList(c.verifier))
+		if err != nil {
+			return Checkpoint{}, fmt.Errorf("unable to verify checkpoint: %w", err)
+		}
+		text = n.Text
+	} else {
+		body, _, _ := strings.Cut(text, "\n\n")
+		text = body + "\n"
+	}
+
+	cp, err := sunlight.ParseCheckpoint(text)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("unable to parse checkpoint: %w", err)
+	}
+	if c.verifier != nil && cp.Origin != c.origin {
+		return Checkpoint{}, fmt.Errorf("checkpoint origin %q does not match %q", cp.Origin, c.origin)
+	}
+	return Checkpoint{Origin: cp.Origin, Tree: cp.Tree, Raw: raw}, nil
+}
+
+// STH fetches the latest STH from get-sth, verifying it if the log's public key was given.
+func (c *Client) STH(ctx context.Context) (*ct.SignedTreeHead, error) {
+	return c.rfc6962.GetSTH(ctx)
+}
+
+// ArchivedSTH fetches the first STH the log issued for a tree size from the monitor's
+// /sth endpoint, verifying it if the log's public key was given. A tree size with no
+// archived STH returns ErrNotFound.
+func (c *Client) ArchivedSTH(ctx context.Context, treeSize uint64) (*ct.SignedTreeHead, error) {
+	data, err := c.get(ctx, "sth?tree_size="+strconv.FormatUint(treeSize, 10))
+	if err != nil {
+		return nil, err
+	}
+	var resp ct.GetSTHResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("unable to parse STH of size %d: %w", treeSize, err)
+	}
+	sth, err := resp.ToSignedTreeHead()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse STH of size %d: %w", treeSize, err)
+	}
+	if sth.TreeSize != treeSize {
+		return nil, fmt.Errorf("STH archived for size %d has size %d", treeSize, sth.TreeSize)
+	}
+	if err := c.rfc6962.VerifySTHSignature(*sth); err != nil {
+		return nil, fmt.Errorf("unable to verify STH of size %d: %w", treeSize, err)
+	}
+	return sth, nil
+}
+
+// Tile fetches a tile. A partial tile that has since been replaced by a wider one is
+// cut down from the full tile.
+func (c *Client) Tile(ctx context.Context, tile tlog.Tile) ([]byte, error) {
+	data, err := c.get(ctx, sunlight.Path(tile))
+	if !errors.Is(err, ErrNotFound) || tile.W == TileWidth {
+		return data, err
+	}
+
+	full := tile
+	full.W = TileWidth
+	data, err = c.get(ctx, sunlight.Path(full))
+	if err != nil {
+		return nil, err
+	}
+	if tile.L >= 0 {
+		if len(data) < tile.W*tlog.HashSize {
+			return nil, fmt.Errorf("tile %s is too short", sunlight.Path(full))
+		}
+		return data[:tile.W*tlog.HashSize], nil
+	}
+	// Data tiles have to be parsed to find where the first W entries end
+	read := sunlight.ReadTileLeaf
+	if c.mirrored {
+		read = sunlight.ReadMirroredTileLeaf
+	}
+	rest := data
+	for i := 0; i < tile.W; i++ {
+		_, rest, err = read(rest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", sunlight.Path(full), err)
+		}
+	}
+	return data[:len(data)-len(rest)], nil
+}
+
+// Issuer fetches an issuer by the SHA-256 fingerprint of its certificate.
+func (c *Client) Issuer(ctx context.Context, fp [32]byte) ([]byte, error) {
+	data, err := c.get(ctx, fmt.Sprintf("issuer/%x", fp))
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(data) != fp {
+		return nil, fmt.Errorf("issuer %x does not match its fingerprint", fp)
+	}
+	return data, nil
+}
+
+// HashReader returns a reader for the hashes of a tree, which checks every tile it reads
+// against the tree's root hash.
+func (c *Client) HashReader(ctx context.Context, tree tlog.Tree) tlog.HashReader {
+	return tlog.TileHashReader(tree, &sunlight.TileReader{
+		Fetch: func(key string) ([]byte, error) {
+			return c.get(ctx, key)
+		},
+		SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {},
+	})
+}
+
+// Entries reads the entries from start up to end out of the data tiles, and checks each
+// of them against the tree.
+func (c *Client) Entries(ctx context.Context, tree tlog.Tree, start, end int64) ([]*LogEntry, error) {
+	if start < 0 || start > end || end > tree.N {
+		return nil, fmt.Errorf("range [%d, %d) is not in a tree of size %d", start, end, tree.N)
+	}
+	reader := c.HashReader(ctx, tree)
+
+	var entries []*LogEntry
+	for n := start / TileWidth; n*TileWidth < end; n++ {
+		tile := tlog.Tile{H: TileHeight, L: -1, N: n, W: int(min(tree.N-n*TileWidth, TileWidth))}
+		data, err := c.Tile(ctx, tile)
+		if err != nil {
+			return nil, err
+		}
+
+		parse := sunlight.ParseTileEntries
+		if c.mirrored {
+			parse = sunlight.ParseMirroredTileEntries
+		}
+		i := n*TileWidth - 1
+		for entry, err := range parse(tile, data) {
+			if err != nil {
+				return nil, fmt.Errorf("invalid data tile %s: %w", sunlight.Path(tile), err)
+			}
+			i++
+			if i < start || i >= end {
+				continue
+			}
+			if entry.LeafIndex != uint64(i) {
+				return nil, fmt.Errorf("entry %d has leaf index %d", i, entry.LeafIndex)
+			}
+			hashes, err := reader.ReadHashes([]int64{tlog.StoredHashIndex(0, i)})
+			if err != nil {
+				return nil, fmt.Errorf("unable to read hash of entry %d: %w", i, err)
+			}
+			if tlog.RecordHash(entry.MerkleTreeLeaf()) != hashes[0] {
+				return nil, fmt.Errorf("entry %d does not match the tree", i)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// InclusionProof computes the proof that the entry at index is in the tree.
+func (c *Client) InclusionProof(ctx context.Context, tree tlog.Tree, index int64) (tlog.RecordProof, error) {
+	return tlog.ProveRecord(tree.N, index, c.HashReader(ctx, tree))
+}
+
+// ConsistencyProof computes the proof that the tree of size oldSize is a prefix of the tree.
+func (c *Client) ConsistencyProof(ctx context.Context, tree tlog.Tree, oldSize int64) (tlog.TreeProof, error) {
+	return tlog.ProveTree(tree.N, oldSize, c.HashReader(ctx, tree))
+}
@@ -0,0 +1,297 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// testLog serves the tiles, issuers and checkpoint of a small log from memory.
+type testLog struct {
+	key     *ecdsa.PrivateKey
+	tree    tlog.Tree
+	entries []*LogEntry
+	stored  []tlog.Hash
+	objects map[string][]byte
+	url     string
+}
+
+// newTestLog serves a log of n entries. The entries of a mirrored log have no leaf_index
+// extension.
+func newTestLog(t *testing.T, n int64, mirrored bool) *testLog {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sunlight.NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testLog{key: key, objects: map[string][]byte{}}
+	issuer := []byte("issuer")
+	l.objects[fmt.Sprintf("issuer/%x", sha256.Sum256(issuer))] = issuer
+
+	for i := range n {
+		entry := &LogEntry{
+			Certificate: []byte(fmt.Sprintf("certificate %d", i)),
+			ChainFp:     [][32]byte{sha256.Sum256(issuer)},
+			Timestamp:   1700000000000 + i,
+			LeafIndex:   uint64(i),
+			Mirrored:    mirrored,
+		}
+		entry.CertificateFp = sha256.Sum256(entry.Certificate)
+		l.entries = append(l.entries, entry)
+		hashes, err := tlog.StoredHashesForRecordHash(i, tlog.RecordHash(entry.MerkleTreeLeaf()), l.reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.stored = append(l.stored, hashes...)
+	}
+	root, err := tlog.TreeHash(n, l.reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.tree = tlog.Tree{N: n, Hash: root}
+
+	for _, tile := range tlog.NewTiles(TileHeight, 0, n) {
+		l.objects[sunlight.Path(tile)], err = tlog.ReadTileData(tile, l.reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tile.L == 0 {
+			var leaves []byte
+			for _, entry := range l.entries[tile.N*TileWidth : tile.N*TileWidth+int64(tile.W)] {
+				leaves = sunlight.AppendTileLeaf(leaves, entry)
+			}
+			tile.L = -1
+			l.objects[sunlight.Path(tile)] = leaves
+		}
+	}
+
+	l.objects["checkpoint"], err = sunlight.SignTreeHeadCheckpoint("example.com/log", signer, n, 1700000001000, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := l.objects[strings.TrimPrefix(r.URL.Path, "/log/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	l.url = srv.URL + "/log/"
+	return l
+}
+
+func (l *testLog) reader() tlog.HashReader {
+	return tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+		hashes := make([]tlog.Hash, len(indexes))
+		for i, index := range indexes {
+			hashes[i] = l.stored[index]
+		}
+		return hashes, nil
+	})
+}
+
+func (l *testLog) client(t *testing.T, c Config) *Client {
+	t.Helper()
+	c.URL = l.url
+	client, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestCheckpoint(t *testing.T) {
+	l := newTestLog(t, 300, false)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{"verified", Config{PublicKey: l.key.Public(), Origin: "example.com/log"}, true},
+		{"not verified", Config{}, true},
+		{"other key", Config{PublicKey: other.Public(), Origin: "example.com/log"}, false},
+		{"other origin", Config{PublicKey: l.key.Public(), Origin: "example.com/other"}, false},
+		// The origin defaults to the host and path of the URL
+		{"default origin", Config{PublicKey: l.key.Public()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp, err := l.client(t, tt.config).Checkpoint(context.Background())
+			if (err == nil) != tt.ok {
+				t.Fatalf("Checkpoint = %v", err)
+			}
+			if tt.ok && (cp.Tree != l.tree || cp.Origin != "example.com/log") {
+				t.Errorf("Checkpoint = %s %d %s, want %d %s", cp.Origin, cp.Tree.N, cp.Tree.Hash, l.tree.N, l.tree.Hash)
+			}
+		})
+	}
+
+	delete(l.objects, "checkpoint")
+	if _, err := l.client(t, Config{}).Checkpoint(context.Background()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Checkpoint of a log without one = %v, want ErrNotFound", err)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end int64
+		ok         bool
+	}{
+		{"all", 0, 300, true},
+		{"last", 299, 300, true},
+		{"across tiles", 250, 260, true},
+		{"empty", 5, 5, true},
+		{"backwards", 5, 4, false},
+		{"past the tree", 0, 301, false},
+	}
+	for _, mirrored := range []bool{false, true} {
+		l := newTestLog(t, 300, mirrored)
+		c := l.client(t, Config{MirroredEntries: mirrored})
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s mirrored %v", tt.name, mirrored), func(t *testing.T) {
+				entries, err := c.Entries(context.Background(), l.tree, tt.start, tt.end)
+				if (err == nil) != tt.ok {
+					t.Fatalf("Entries = %v", err)
+				}
+				if !tt.ok {
+					return
+				}
+				if int64(len(entries)) != tt.end-tt.start {
+					t.Fatalf("Entries returned %d entries, want %d", len(entries), tt.end-tt.start)
+				}
+				for i, entry := range entries {
+					want := l.entries[tt.start+int64(i)]
+					if entry.LeafIndex != want.LeafIndex || !bytes.Equal(entry.Certificate, want.Certificate) {
+						t.Errorf("entry %d = %d %q, want %d %q", i, entry.LeafIndex, entry.Certificate, want.LeafIndex, want.Certificate)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestEntriesInvalid(t *testing.T) {
+	l := newTestLog(t, 300, false)
+	tile := l.objects["tile/data/000"]
+	l.objects["tile/data/000"] = bytes.Replace(tile, []byte("certificate 7"), []byte("certificate 8"), 1)
+	if _, err := l.client(t, Config{}).Entries(context.Background(), l.tree, 0, 10); err == nil {
+		t.Error("Entries accepted an entry that doesn't match the tree")
+	}
+
+	mirrored := newTestLog(t, 10, true)
+	if _, err := mirrored.client(t, Config{}).Entries(context.Background(), mirrored.tree, 0, 10); err == nil {
+		t.Error("Entries read entries without a leaf_index from a log that isn't mirrored")
+	}
+}
+
+func TestTile(t *testing.T) {
+	l := newTestLog(t, 300, false)
+	c := l.client(t, Config{})
+	var leaves []byte
+	for _, entry := range l.entries[:10] {
+		leaves = sunlight.AppendTileLeaf(leaves, entry)
+	}
+
+	tests := []struct {
+		name string
+		tile tlog.Tile
+		want []byte
+	}{
+		{"full", tlog.Tile{H: TileHeight, L: 0, N: 0, W: TileWidth}, l.objects["tile/0/000"]},
+		{"partial", tlog.Tile{H: TileHeight, L: 0, N: 1, W: 44}, l.objects["tile/0/001.p/44"]},
+		{"replaced partial", tlog.Tile{H: TileHeight, L: 0, N: 0, W: 10}, l.objects["tile/0/000"][:10*tlog.HashSize]},
+		{"replaced partial data", tlog.Tile{H: TileHeight, L: -1, N: 0, W: 10}, leaves},
+		{"missing", tlog.Tile{H: TileHeight, L: 0, N: 2, W: 10}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := c.Tile(context.Background(), tt.tile)
+			if tt.want == nil {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("Tile = %v, want ErrNotFound", err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(data, tt.want) {
+				t.Errorf("Tile = %d bytes, %v, want %d bytes", len(data), err, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestIssuer(t *testing.T) {
+	l := newTestLog(t, 1, false)
+	c := l.client(t, Config{})
+	issuer := []byte("issuer")
+	fp := sha256.Sum256(issuer)
+	if data, err := c.Issuer(context.Background(), fp); err != nil || !bytes.Equal(data, issuer) {
+		t.Errorf("Issuer = %q, %v", data, err)
+	}
+
+	l.objects[fmt.Sprintf("issuer/%x", fp)] = []byte("another issuer")
+	if _, err := c.Issuer(context.Background(), fp); err == nil {
+		t.Error("Issuer accepted an issuer that doesn't match its fingerprint")
+	}
+	if _, err := c.Issuer(context.Background(), sha256.Sum256(nil)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Issuer of a missing fingerprint = %v, want ErrNotFound", err)
+	}
+}
+
+func TestProofs(t *testing.T) {
+	l := newTestLog(t, 300, false)
+	c := l.client(t, Config{})
+	ctx := context.Background()
+
+	for _, index := range []int64{0, 1, 255, 256, 299} {
+		proof, err := c.InclusionProof(ctx, l.tree, index)
+		if err != nil {
+			t.Fatalf("InclusionProof(%d) = %v", index, err)
+		}
+		leaf := tlog.RecordHash(l.entries[index].MerkleTreeLeaf())
+		if err := tlog.CheckRecord(proof, l.tree.N, l.tree.Hash, index, leaf); err != nil {
+			t.Errorf("inclusion proof of %d: %v", index, err)
+		}
+	}
+	if _, err := c.InclusionProof(ctx, l.tree, 300); err == nil {
+		t.Error("InclusionProof of an entry past the tree succeeded")
+	}
+
+	for _, n := range []int64{1, 255, 256, 257, 299, 300} {
+		proof, err := c.ConsistencyProof(ctx, l.tree, n)
+		if err != nil {
+			t.Fatalf("ConsistencyProof(%d) = %v", n, err)
+		}
+		old, err := tlog.TreeHash(n, l.reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tlog.CheckTree(proof, l.tree.N, l.tree.Hash, n, old); err != nil {
+			t.Errorf("consistency proof from %d: %v", n, err)
+		}
+	}
+}
@@ -1,25 +1,101 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"itko.dev/internal/alert"
+	"itko.dev/internal/coordination"
 	"itko.dev/internal/ctmonitor"
+	"itko.dev/internal/server"
+	"itko.dev/internal/telemetry"
 )
 
 func main() {
 	// Parse the command-line flags
+	kvpath := flag.String("kv-path", "", "Consul KV path of the log. If set, the mask size, body limit, and bucket are read from the log's config, and the flags for them are optional.")
+	var coord coordination.Config
+	coord.RegisterFlags(flag.CommandLine)
+	var tlsConfig server.TLS
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	var service coordination.Service
+	service.RegisterFlags(flag.CommandLine)
 	storeDirectory := flag.String("store-directory", "", "Tile storage directory. Must not have a trailing slash.")
 	storeAddress := flag.String("store-address", "", "Tile storage url. Must end with a trailing slash.")
-	listenAddress := flag.String("listen-address", "", "IP and port to listen on for incoming connections.")
+	storeTimeout := flag.Duration("store-timeout", 10*time.Second, "Time allowed for each request to the tile storage url.")
+	storeRetries := flag.Int("store-retries", 2, "Number of times a request to the tile storage url is retried after a 5xx or network error.")
+	storeCAFile := flag.String("store-ca-file", "", "PEM file of root CAs to trust for the tile storage url, instead of the system roots.")
+	storeHeaders := map[string]string{}
+	flag.Func("store-header", "Header to send with requests to the tile storage url, as 'Name: value'. Can be repeated.", func(v string) error {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok {
+			return fmt.Errorf("header must be in the form 'Name: value'")
+		}
+		storeHeaders[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		return nil
+	})
+	storeCacheDirectory := flag.String("store-cache-directory", "", "Keep full tiles and issuers fetched from the tile storage url in this directory, so they survive restarts.")
+	storeCacheMaxBytes := flag.Int64("store-cache-max-bytes", 10<<30, "Maximum size of -store-cache-directory. The least recently used objects are evicted above this.")
+	s3Bucket := flag.String("s3-bucket", "", "Read tiles from this S3 bucket with credentials, instead of a public url. The credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	s3Region := flag.String("s3-region", "", "Region of the S3 bucket.")
+	s3EndpointUrl := flag.String("s3-endpoint-url", "", "Endpoint of the S3 bucket.")
+	s3AddressingStyle := flag.String("s3-addressing-style", "path", "Addressing style of the S3 bucket, path or virtual.")
+	s3UseAccelerate := flag.Bool("s3-use-accelerate", false, "Read from the S3 bucket through S3 Transfer Acceleration. Needs -s3-addressing-style virtual.")
+	logJSON := flag.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	otelProtocol := flag.String("otel-protocol", "", "If set to grpc or http, export OpenTelemetry traces over OTLP.")
+	otelEndpoint := flag.String("otel-endpoint", "", "URL of the OTLP collector for traces. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT.")
+	otelSampleRate := flag.Float64("otel-sample-rate", 1, "Fraction of requests to trace, between 0 and 1.")
+	otelServiceName := flag.String("otel-service-name", "itko-monitor", "Service name attached to exported traces.")
+	metricsAddress := flag.String("metrics-address", "", "IP and port to serve Prometheus metrics on. Metrics are not served if this is not set.")
+	listenAddress := flag.String("listen-address", "", "IP and port to listen on for incoming connections, unix:<path> for a Unix socket, or systemd for a socket passed in by systemd.")
 	maskSize := flag.Int("mask-size", 0, "Mask size for the quadtree.")
+	indexLayoutVersion := flag.Int("index-layout-version", 0, "Layout version of the k-anon index paths, matching the log's indexLayoutVersion.")
+	indexSegmentSize := flag.Int("index-segment-size", 0, "Hex digits per directory of the k-anon index paths, matching the log's indexSegmentSize. Only used from layout version 1.")
+	mirroredEntries := flag.Bool("mirrored-entries", false, "Set for a log written by itko mirror or itko migrate trillian, whose entries have no leaf_index extension. Read from the log's config with -kv-path.")
+	maxGetEntries := flag.Int("max-get-entries", ctmonitor.DefaultMaxGetEntries, "Maximum number of entries returned by one get-entries request.")
+	maxGetEntriesBytes := flag.Int("max-get-entries-bytes", ctmonitor.DefaultMaxGetEntriesBytes, "Maximum size in bytes of one get-entries response, before compression. Fewer entries are returned to stay under it.")
+	maxBodyBytes := flag.Int64("max-body-bytes", 128*1024, "Maximum request body size in bytes.")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 0, "Time allowed to read request headers. Defaults to 10s.")
+	readTimeout := flag.Duration("read-timeout", 0, "Time allowed to read the whole request. Defaults to 30s.")
+	writeTimeout := flag.Duration("write-timeout", 0, "Time allowed to write the response. Defaults to 60s.")
+	drainTimeout := flag.Duration("drain-timeout", 60*time.Second, "Time in-flight requests are given to finish after a SIGTERM. Should be at least -write-timeout, so get-entries downloads aren't cut off.")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Time an idle keep-alive connection is kept open. Defaults to 120s.")
+	sthCacheTTL := flag.Duration("sth-cache-ttl", 2*time.Second, "How long the latest STH is cached for. Set to 0 to fetch it on every request.")
+	proofCacheTTL := flag.Duration("proof-cache-ttl", 5*time.Second, "How long computed inclusion and consistency proofs are cached for. Set to 0 to compute them on every request.")
+	proofCacheSize := flag.Int("proof-cache-size", ctmonitor.DefaultProofCacheSize, "Maximum number of proofs kept in the proof cache.")
+	publicKey := flag.String("public-key", "", "Path to the log's PEM encoded public key. If set, STHs are verified before they are cached, and the bucket is checked periodically.")
+	origin := flag.String("origin", "", "Checkpoint origin of the log, which the checkpoint is verified for with -public-key. Defaults to the one in the log's config with -kv-path.")
+	integrityCheckInterval := flag.Duration("integrity-check-interval", time.Minute, "How often the STH and checkpoint in the bucket are verified against -public-key.")
+	startupCheck := flag.String("startup-check", ctmonitor.StartupCheckWarn, "Check the STH, checkpoint, and edge tiles in storage at startup. One of off, warn to log a failure, or fail to refuse to start.")
+	auditInterval := flag.Duration("audit-interval", 0, "How often to look for a new STH and audit the tiles it adds. The audit is off if not set.")
+	alertWebhookUrl := flag.String("alert-webhook-url", "", "URL to POST a JSON alert to when the bucket fails verification.")
+	alertPagerDutyKey := flag.String("alert-pagerduty-routing-key", "", "PagerDuty Events API v2 routing key to alert when the bucket fails verification.")
+	readyTimeout := flag.Duration("ready-timeout", ctmonitor.DefaultReadyTimeout, "How long GET /readyz waits for the STH and an edge tile from the tile storage before reporting the monitor as not ready.")
+	certificateLookup := flag.Bool("certificate-lookup", false, "Serve GET /certificate/<fingerprint>, which returns the leaf index of a certificate from the dedupe index.")
+	corsOrigins := flag.String("cors-origins", "", "Comma separated list of origins allowed to call the monitor from a browser, or * for any origin.")
+	compressMinBytes := flag.Int("compress-min-bytes", 1024, "Compress responses of at least this many bytes with zstd or gzip. Set to 0 to disable compression.")
+	rateLimitIP := flag.Float64("rate-limit-ip", 0, "Requests per second allowed from each client IP. get-entries costs one request per tile it reads. Unlimited if not set.")
+	rateLimitIPBurst := flag.Int("rate-limit-ip-burst", 20, "Requests a client IP can make at once above -rate-limit-ip.")
+	rateLimitGlobal := flag.Float64("rate-limit-global", 0, "Requests per second allowed across all clients. Unlimited if not set.")
+	rateLimitGlobalBurst := flag.Int("rate-limit-global-burst", 200, "Requests that can be made at once above -rate-limit-global.")
+	rateLimitIPHeader := flag.String("rate-limit-ip-header", "", "Header to take the client IP from, such as X-Forwarded-For, when behind a load balancer.")
+	maxConnections := flag.Int("max-connections", 0, "Maximum number of simultaneous connections. Unlimited if not set.")
 	flag.Parse()
 
-	if *storeDirectory == "" && *storeAddress == "" {
-		fmt.Println("Error: -store-directory or -store-address flag must be set")
+	server.SetupLogging(*logJSON, logLevel)
+
+	if *kvpath == "" && *storeDirectory == "" && *storeAddress == "" && *s3Bucket == "" {
+		fmt.Println("Error: -kv-path, -store-directory, -store-address, or -s3-bucket flag must be set")
 		flag.Usage() // Print the usage message
 		os.Exit(1)   // Exit with a non-zero status
 	}
@@ -30,16 +106,122 @@ func main() {
 		os.Exit(1)   // Exit with a non-zero status
 	}
 
-	if *maskSize == 0 {
+	if *kvpath == "" && *maskSize == 0 {
 		fmt.Println("Error: -mask-size flag must be set")
 		flag.Usage() // Print the usage message
 		os.Exit(1)   // Exit with a non-zero status
 	}
 
-	listener, err := net.Listen("tcp", *listenAddress)
+	listener, err := server.Listen(*listenAddress)
 	if err != nil {
 		log.Fatalf("failed to bind to address: %v", err)
 	}
+	listener, err = tlsConfig.Listener(listener)
+	if err != nil {
+		log.Fatalf("failed to set up TLS: %v", err)
+	}
+
+	if service.Name != "" {
+		service.TLS = tlsConfig.Enabled()
+		deregister, err := coordination.RegisterService(coord, service, listener.Addr().String())
+		if err != nil {
+			log.Fatalf("failed to register service: %v", err)
+		}
+		defer deregister()
+	}
+
+	// Metrics are served on their own listener so they aren't exposed alongside the log
+	if *metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", promhttp.Handler())
+			log.Fatal(http.ListenAndServe(*metricsAddress, mux))
+		}()
+	}
+
+	c := ctmonitor.Config{
+		KVPath:       *kvpath,
+		Coordination: coord,
+
+		StoreDirectory: *storeDirectory,
+		StoreAddress:   *storeAddress,
+		UrlStorage: ctmonitor.UrlStorageConfig{
+			Timeout: *storeTimeout,
+			Retries: *storeRetries,
+			Headers: storeHeaders,
+			CAFile:  *storeCAFile,
+
+			CacheDirectory: *storeCacheDirectory,
+			CacheMaxBytes:  *storeCacheMaxBytes,
+		},
+
+		S3Bucket:                   *s3Bucket,
+		S3Region:                   *s3Region,
+		S3EndpointUrl:              *s3EndpointUrl,
+		S3StaticCredentialUserName: os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3StaticCredentialPassword: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		S3SessionToken:             os.Getenv("AWS_SESSION_TOKEN"),
+		S3AddressingStyle:          *s3AddressingStyle,
+		S3UseAccelerate:            *s3UseAccelerate,
+
+		MaskSize:           *maskSize,
+		IndexLayoutVersion: *indexLayoutVersion,
+		IndexSegmentSize:   *indexSegmentSize,
+		MirroredEntries:    *mirroredEntries,
+		MaxBodyBytes:       *maxBodyBytes,
+		MaxGetEntries:      *maxGetEntries,
+		MaxGetEntriesBytes: *maxGetEntriesBytes,
+		Server: server.Config{
+			ReadHeaderTimeoutMs: int(readHeaderTimeout.Milliseconds()),
+			ReadTimeoutMs:       int(readTimeout.Milliseconds()),
+			WriteTimeoutMs:      int(writeTimeout.Milliseconds()),
+			IdleTimeoutMs:       int(idleTimeout.Milliseconds()),
+			MaxConnections:      *maxConnections,
+			DrainTimeoutMs:      int(drainTimeout.Milliseconds()),
+		},
+		STHCacheTTL:            *sthCacheTTL,
+		ProofCacheTTL:          *proofCacheTTL,
+		ProofCacheSize:         *proofCacheSize,
+		IntegrityCheckInterval: *integrityCheckInterval,
+		Origin:                 *origin,
+		StartupCheck:           *startupCheck,
+		AuditInterval:          *auditInterval,
+		Alerts: alert.Config{
+			WebhookUrl:          *alertWebhookUrl,
+			PagerDutyRoutingKey: *alertPagerDutyKey,
+		},
+		RateLimit: ctmonitor.RateLimitConfig{
+			PerIP:       *rateLimitIP,
+			PerIPBurst:  *rateLimitIPBurst,
+			Global:      *rateLimitGlobal,
+			GlobalBurst: *rateLimitGlobalBurst,
+			IPHeader:    *rateLimitIPHeader,
+		},
+		CompressMinBytes:  *compressMinBytes,
+		CertificateLookup: *certificateLookup,
+		ReadyTimeout:      *readyTimeout,
+	}
+	if *corsOrigins != "" {
+		c.CORSOrigins = strings.Split(*corsOrigins, ",")
+	}
+	if *publicKey != "" {
+		c.PublicKey, err = ctmonitor.LoadPublicKey(*publicKey)
+		if err != nil {
+			log.Fatalf("failed to load public key: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	shutdownTraces, err := telemetry.SetupTraces(ctx, telemetry.TraceConfig{
+		Protocol:    *otelProtocol,
+		Endpoint:    *otelEndpoint,
+		SampleRate:  *otelSampleRate,
+		ServiceName: *otelServiceName,
+	})
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+	defer shutdownTraces(ctx)
 
-	ctmonitor.MainMain(listener, *storeDirectory, *storeAddress, *maskSize, nil)
+	ctmonitor.MainMain(listener, c, nil)
 }
@@ -1,5 +1,44 @@
 package main
 
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/ctsetup"
+	"itko.dev/internal/ctsubmit"
+)
+
 func main() {
+	kvpath := flag.String("kv-path", "", "Consul KV path to store the log's config under.")
+	var coord coordination.Config
+	coord.RegisterFlags(flag.CommandLine)
+	logConfig := flag.String("log-config", "", "Path of the log's config, as JSON.")
+	rootCerts := flag.String("root-certs", "", "Roots the log accepts, as a comma separated list of PEM files, directories of .pem and .crt files, and https URLs of PEM bundles.")
+	signingKey := flag.String("signing-key", "", "Path of the log's key to sign the empty STH with. Defaults to keyPath in the config.")
+	force := flag.Bool("force", false, "Replace the STH of an existing log with an empty tree, and its config even if it is of another key. This throws away every entry in the log.")
+	dryRun := flag.Bool("dry-run", false, "Check the key, config, and roots, and that the KV store and bucket can be read, then print what would be written without writing it.")
+	provisionBucket := flag.Bool("provision-bucket", false, "Create the S3 bucket if it doesn't exist, allow public reads of the log's objects, and set up CORS and a lifecycle rule for abandoned uploads.")
+	flag.Parse()
+
+	if *kvpath == "" || *logConfig == "" || *rootCerts == "" {
+		fmt.Println("Error: -kv-path, -log-config, and -root-certs flags must be set")
+		flag.Usage() // Print the usage message
+		os.Exit(1)   // Exit with a non-zero status
+	}
+
+	configBytes, err := os.ReadFile(*logConfig)
+	if err != nil {
+		log.Fatalf("failed to read config: %v", err)
+	}
+	var gc ctsubmit.GlobalConfig
+	if err := json.Unmarshal(configBytes, &gc); err != nil {
+		log.Fatalf("failed to parse config: %v", err)
+	}
 
+	ctsetup.MainMain(context.Background(), coord, *kvpath, *rootCerts, *signingKey, gc, ctsetup.Options{Force: *force, DryRun: *dryRun, ProvisionBucket: *provisionBucket})
 }
@@ -5,30 +5,50 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"log/slog"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
-	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/trace"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/ctshard"
 	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+	"itko.dev/internal/telemetry"
 )
 
 func main() {
-	// Setup OpenTelemetry
-	// shutdownOtel := configureOtel()
-	// defer shutdownOtel()
-
 	// Parse the command-line flags
-	kvpath := flag.String("kv-path", "", "Consul KV path")
-	listenAddress := flag.String("listen-address", "", "IP and port to listen on for incoming connections.")
+	kvpath := flag.String("kv-path", "", "Consul KV path. Multiple shards can be served from one process by passing a comma separated list.")
+	shardTemplate := flag.String("shard-template", "", "Consul KV key of a shard template. If set, yearly shards are created and served automatically instead of -kv-path.")
+	sequencerURL := flag.String("sequencer-url", "", "If set, run as a stateless front-end that sends entries to the sequencer at this URL instead of sequencing them itself.")
+	var coord coordination.Config
+	coord.RegisterFlags(flag.CommandLine)
+	var tlsConfig server.TLS
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	var service coordination.Service
+	service.RegisterFlags(flag.CommandLine)
+	frontend := flag.Bool("frontend", false, "Run as a stateless front-end. Implied by -sequencer-url, and needed when entries are sent through the NATS queue configured by natsUrl.")
+	logJSON := flag.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	metricsAddress := flag.String("metrics-address", "", "IP and port to serve Prometheus metrics on. Metrics are not served if this is not set.")
+	otelProtocol := flag.String("otel-protocol", "", "If set to grpc or http, export OpenTelemetry traces over OTLP.")
+	otelEndpoint := flag.String("otel-endpoint", "", "URL of the OTLP collector for traces. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT.")
+	otelSampleRate := flag.Float64("otel-sample-rate", 1, "Fraction of requests to trace, between 0 and 1.")
+	otelServiceName := flag.String("otel-service-name", "itko-submit", "Service name attached to exported traces.")
+	otelMetrics := flag.String("otel-metrics-protocol", "", "If set to grpc or http, export OpenTelemetry metrics over OTLP. The endpoint is taken from OTEL_EXPORTER_OTLP_ENDPOINT.")
+	otelMetricsInterval := flag.Duration("otel-metrics-interval", time.Minute, "How often OpenTelemetry metrics are exported.")
+	listenAddress := flag.String("listen-address", "", "IP and port to listen on for incoming connections, unix:<path> for a Unix socket, or systemd for a socket passed in by systemd.")
 	flag.Parse()
 
-	if *kvpath == "" {
-		fmt.Println("Error: -kv-path flag must be set")
+	server.SetupLogging(*logJSON, logLevel)
+
+	if *kvpath == "" && *shardTemplate == "" {
+		fmt.Println("Error: -kv-path or -shard-template flag must be set")
 		flag.Usage() // Print the usage message
 		os.Exit(1)   // Exit with a non-zero status
 	}
@@ -39,45 +59,59 @@ func main() {
 		os.Exit(1)   // Exit with a non-zero status
 	}
 
-	listener, err := net.Listen("tcp", *listenAddress)
+	// Bound with SO_REUSEPORT, so a new version can be started before this one is stopped
+	listener, err := server.Listen(*listenAddress)
 	if err != nil {
 		log.Fatalf("failed to bind to address: %v", err)
 	}
+	listener, err = tlsConfig.Listener(listener)
+	if err != nil {
+		log.Fatalf("failed to set up TLS: %v", err)
+	}
 
-	ctx := context.Background()
-	ctsubmit.MainMain(ctx, listener, *kvpath, "127.0.0.1:8500", nil)
-}
+	if service.Name != "" {
+		service.TLS = tlsConfig.Enabled()
+		deregister, err := coordination.RegisterService(coord, service, listener.Addr().String())
+		if err != nil {
+			log.Fatalf("failed to register service: %v", err)
+		}
+		defer deregister()
+	}
+
+	// Metrics are served on their own listener so they aren't exposed alongside the log
+	if *metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", promhttp.Handler())
+			log.Fatal(http.ListenAndServe(*metricsAddress, mux))
+		}()
+	}
 
-func configureOtel() func() {
 	ctx := context.Background()
 
-	// Configure a new OTLP exporter using environment variables for sending data to Honeycomb over gRPC
-	client := otlptracegrpc.NewClient()
-	exp, err := otlptrace.New(ctx, client)
+	shutdownTraces, err := telemetry.SetupTraces(ctx, telemetry.TraceConfig{
+		Protocol:    *otelProtocol,
+		Endpoint:    *otelEndpoint,
+		SampleRate:  *otelSampleRate,
+		ServiceName: *otelServiceName,
+	})
 	if err != nil {
-		log.Fatalf("failed to initialize exporter: %e", err)
+		log.Fatalf("failed to set up tracing: %v", err)
 	}
+	defer shutdownTraces(ctx)
 
-	// Create a new tracer provider with a batch span processor and the otlp exporter
-	tp := trace.NewTracerProvider(
-		trace.WithBatcher(exp),
-	)
-
-	// Register the global Tracer provider
-	otel.SetTracerProvider(tp)
-
-	// Register the W3C trace context and baggage propagators so data is propagated across services/processes
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{},
-		),
-	)
-
-	// Return a function to handle shutdown
-	// Handle shutdown to ensure all sub processes are closed correctly and telemetry is exported
-	return func() {
-		_ = exp.Shutdown(ctx)
-		_ = tp.Shutdown(ctx)
+	shutdownMetrics, err := telemetry.SetupMetrics(ctx, *otelMetrics, *otelMetricsInterval)
+	if err != nil {
+		log.Fatalf("failed to set up metrics: %v", err)
+	}
+	defer shutdownMetrics(ctx)
+	if *sequencerURL != "" || *frontend {
+		ctsubmit.FrontendMain(ctx, listener, *kvpath, coord, *sequencerURL, nil)
+		return
+	}
+	if *shardTemplate != "" {
+		ctshard.MainMain(ctx, listener, *shardTemplate, coord, nil)
+		return
 	}
+	ctsubmit.MainMain(ctx, listener, strings.Split(*kvpath, ","), coord, nil)
 }
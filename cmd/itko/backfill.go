@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+	"itko.dev/internal/sunlight"
+)
+
+func backfillIndexes(args []string) {
+	flags := flag.NewFlagSet("backfill-indexes", flag.ExitOnError)
+	var bf bucketFlags
+	bf.register(flags)
+	newMaskSize := flags.Int("new-mask-size", 0, "Mask size to build the indexes with. Defaults to the log's current index layout, to rebuild it in place.")
+	newIndexLayoutVersion := flags.Int("new-index-layout-version", 0, "Layout version to build the indexes with. Only used with -new-mask-size.")
+	newIndexSegmentSize := flags.Int("new-index-segment-size", 0, "Hex digits per directory to build the indexes with. Only used with -new-mask-size, from layout version 1.")
+	concurrency := flags.Int("concurrency", 16, "Number of objects read or written at once.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if err := bf.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	gc, unlock := bf.config(ctx, true)
+	defer unlock()
+
+	layout := sunlight.IndexLayout{Version: gc.IndexLayoutVersion, Mask: gc.MaskSize, SegmentSize: gc.IndexSegmentSize}
+	if *newMaskSize != 0 {
+		layout = sunlight.IndexLayout{Version: *newIndexLayoutVersion, Mask: *newMaskSize, SegmentSize: *newIndexSegmentSize}
+	}
+	hashFiles, dedupeFiles, err := ctsubmit.BackfillIndexes(ctx, gc, layout, *concurrency)
+	if err != nil {
+		unlock()
+		log.Fatalf("failed to backfill the indexes: %v", err)
+	}
+	slog.Info("Indexes written", "mask_size", layout.Mask, "index_layout_version", layout.Version, "index_segment_size", layout.SegmentSize, "hash_files", hashFiles, "dedupe_files", dedupeFiles)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/ctsubmit"
+)
+
+// bucketFlags are the flags of the commands that work on a log's bucket directly. The log
+// is either read from its config in the KV store, or given with the storage flags, as for
+// a mirror, which has no config.
+type bucketFlags struct {
+	kvpath string
+	coord  coordination.Config
+
+	rootDirectory     string
+	s3Bucket          string
+	s3Region          string
+	s3EndpointUrl     string
+	s3AddressingStyle string
+
+	mirroredEntries bool
+
+	maskSize           int
+	indexLayoutVersion int
+	indexSegmentSize   int
+
+	// withoutIndexes is set for the commands that don't use the indexes, which then have
+	// no flags for their layout
+	withoutIndexes bool
+}
+
+func (f *bucketFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.kvpath, "kv-path", "", "Consul KV path of the log. If set, the bucket and index layout are read from the log's config, and the other flags for them are ignored.")
+	f.coord.RegisterFlags(fs)
+	fs.StringVar(&f.rootDirectory, "root-directory", "", "Directory of the log. Must not have a trailing slash.")
+	fs.StringVar(&f.s3Bucket, "s3-bucket", "", "S3 bucket of the log. The credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	fs.StringVar(&f.s3Region, "s3-region", "", "Region of the S3 bucket.")
+	fs.StringVar(&f.s3EndpointUrl, "s3-endpoint-url", "", "Endpoint of the S3 bucket.")
+	fs.StringVar(&f.s3AddressingStyle, "s3-addressing-style", "path", "Addressing style of the S3 bucket, path or virtual.")
+	fs.BoolVar(&f.mirroredEntries, "mirrored-entries", false, "Set for a log written by itko mirror or itko migrate trillian, whose entries have no leaf_index extension. Ignored with -kv-path, where it is read from the log's config.")
+	if f.withoutIndexes {
+		return
+	}
+	fs.IntVar(&f.maskSize, "mask-size", 0, "Mask size for the quadtree.")
+	fs.IntVar(&f.indexLayoutVersion, "index-layout-version", 0, "Layout version of the k-anon index paths.")
+	fs.IntVar(&f.indexSegmentSize, "index-segment-size", 0, "Hex digits per directory of the k-anon index paths. Only used from layout version 1.")
+}
+
+func (f *bucketFlags) validate() error {
+	if f.kvpath != "" {
+		return nil
+	}
+	if (f.rootDirectory == "") == (f.s3Bucket == "") {
+		return errors.New("-kv-path, or exactly one of -root-directory or -s3-bucket, must be set")
+	}
+	if f.maskSize == 0 && !f.withoutIndexes {
+		return errors.New("-mask-size must be set without -kv-path")
+	}
+	return nil
+}
+
+// config returns the config of the log. If lock is set and the log is in the KV store,
+// its lock is taken, so the sequencer can't run while the bucket is changed. The
+// returned function releases it.
+func (f *bucketFlags) config(ctx context.Context, lock bool) (ctsubmit.GlobalConfig, func()) {
+	if f.kvpath == "" {
+		return ctsubmit.GlobalConfig{
+			RootDirectory:              f.rootDirectory,
+			S3Bucket:                   f.s3Bucket,
+			S3Region:                   f.s3Region,
+			S3EndpointUrl:              f.s3EndpointUrl,
+			S3StaticCredentialUserName: os.Getenv("AWS_ACCESS_KEY_ID"),
+			S3StaticCredentialPassword: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			S3AddressingStyle:          f.s3AddressingStyle,
+			MirroredEntries:            f.mirroredEntries,
+			MaskSize:                   f.maskSize,
+			IndexLayoutVersion:         f.indexLayoutVersion,
+			IndexSegmentSize:           f.indexSegmentSize,
+		}, func() {}
+	}
+
+	if !lock {
+		gc, err := ctsubmit.FetchConfig(ctx, f.kvpath, f.coord)
+		if err != nil {
+			log.Fatalf("failed to fetch config: %v", err)
+		}
+		return gc, func() {}
+	}
+	slog.Info("Waiting for the log's lock. The sequencer must be stopped for this to go ahead", "kv_path", f.kvpath)
+	gc, l, err := ctsubmit.LockLog(ctx, f.kvpath, f.coord)
+	if err != nil {
+		log.Fatalf("failed to lock the log: %v", err)
+	}
+	return gc, func() {
+		if err := l.Unlock(); err != nil {
+			slog.Error("Unable to release lock", "kv_path", f.kvpath, "error", err)
+		}
+	}
+}
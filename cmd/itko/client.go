@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/jsonclient"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/x509"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/client"
+	"itko.dev/internal/ctmonitor"
+	"itko.dev/internal/server"
+	"itko.dev/internal/sunlight"
+)
+
+const clientUsage = `Usage: itko client <command> [flags]
+
+Commands:
+  submit        Submit a chain to add-chain or add-pre-chain, and verify the SCT the log returns
+  inclusion     Fetch and verify the inclusion proof of an entry against a signed tree head
+  consistency   Fetch and verify the consistency proof between two signed tree heads
+`
+
+func clientCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Print(clientUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "submit":
+		clientSubmit(args[1:])
+	case "inclusion":
+		clientInclusion(args[1:])
+	case "consistency":
+		clientConsistency(args[1:])
+	default:
+		fmt.Printf("Unknown command %q\n\n%s", args[0], clientUsage)
+		os.Exit(1)
+	}
+}
+
+// clientFlags are the flags for the log that every client command talks to.
+type clientFlags struct {
+	logUrl    string
+	publicKey string
+	timeout   time.Duration
+	logJSON   bool
+	logLevel  slog.Level
+}
+
+func (cf *clientFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&cf.logUrl, "log-url", "", "Prefix of the log's RFC 6962 and monitoring endpoints, such as https://ct2025.itko.dev/.")
+	flags.StringVar(&cf.publicKey, "public-key", "", "Path to the log's PEM encoded public key, which the SCTs, STHs, and proofs are verified against.")
+	flags.DurationVar(&cf.timeout, "timeout", time.Minute, "How long the command may take, including waiting for the log.")
+	flags.BoolVar(&cf.logJSON, "log-json", false, "Log in JSON instead of logfmt.")
+	flags.TextVar(&cf.logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+}
+
+// client sets up logging, and returns a client for the log and its key, with a context
+// that ends after the timeout.
+func (cf *clientFlags) client(flags *flag.FlagSet) (context.Context, context.CancelFunc, *client.Client, crypto.PublicKey) {
+	server.SetupLogging(cf.logJSON, cf.logLevel)
+
+	if cf.logUrl == "" || cf.publicKey == "" {
+		fmt.Println("Error: -log-url and -public-key flags must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	key, err := ctmonitor.LoadPublicKey(cf.publicKey)
+	if err != nil {
+		log.Fatalf("failed to load public key: %v", err)
+	}
+	c, err := client.New(client.Config{URL: cf.logUrl, PublicKey: key})
+	if err != nil {
+		log.Fatalf("failed to create client: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cf.timeout)
+	return ctx, cancel, c, key
+}
+
+// submitReport is what itko client submit prints.
+type submitReport struct {
+	Endpoint  string `json:"endpoint"`
+	LogID     []byte `json:"logId"`
+	Timestamp uint64 `json:"timestamp"`
+	// The extensions of the SCT, which for itko and other static logs hold the
+	// leaf_index extension
+	Extensions []byte  `json:"extensions"`
+	LeafIndex  *uint64 `json:"leafIndex,omitempty"`
+	LeafHash   []byte  `json:"leafHash"`
+
+	SignatureVerified bool             `json:"signatureVerified"`
+	Inclusion         *inclusionReport `json:"inclusion,omitempty"`
+
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems"`
+}
+
+// inclusionReport is what itko client inclusion prints, and the inclusion check of
+// itko client submit.
+type inclusionReport struct {
+	TreeSize  uint64 `json:"treeSize"`
+	RootHash  []byte `json:"rootHash"`
+	LeafIndex int64  `json:"leafIndex"`
+	LeafHash  []byte `json:"leafHash"`
+	AuditPath int    `json:"auditPathLength"`
+
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems"`
+}
+
+// consistencyReport is what itko client consistency prints.
+type consistencyReport struct {
+	FirstSize      uint64 `json:"firstSize"`
+	FirstRootHash  []byte `json:"firstRootHash"`
+	SecondSize     uint64 `json:"secondSize"`
+	SecondRootHash []byte `json:"secondRootHash"`
+	Proof          int    `json:"proofLength"`
+
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems"`
+}
+
+func clientSubmit(args []string) {
+	flags := flag.NewFlagSet("client submit", flag.ExitOnError)
+	var cf clientFlags
+	cf.register(flags)
+	submitUrl := flags.String("submit-url", "", "Prefix of the log's add-chain endpoint, if it isn't served under -log-url.")
+	chainFile := flags.String("chain", "", "Path to the PEM encoded chain to submit, leaf first. A leaf with the CT poison extension is submitted to add-pre-chain.")
+	wait := flags.Bool("wait", false, "Wait for the entry to be sequenced, and verify its inclusion proof against the log's latest STH.")
+	flags.Parse(args)
+
+	if *chainFile == "" {
+		fmt.Println("Error: -chain flag must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	ctx, cancel, c, key := cf.client(flags)
+	defer cancel()
+
+	chain, err := readChain(*chainFile)
+	if err != nil {
+		log.Fatalf("failed to read chain: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0].Data)
+	if x509.IsFatal(err) {
+		log.Fatalf("failed to parse leaf certificate: %v", err)
+	}
+	etype, endpoint := ct.X509LogEntryType, ct.AddChainPath
+	if leaf.IsPrecertificate() {
+		etype, endpoint = ct.PrecertLogEntryType, ct.AddPreChainPath
+	}
+
+	prefix := strings.TrimSuffix(cf.logUrl, "/")
+	if *submitUrl != "" {
+		prefix = strings.TrimSuffix(*submitUrl, "/")
+	}
+	resp, err := postChain(ctx, prefix+endpoint, chain)
+	if err != nil {
+		log.Fatalf("failed to submit the chain: %v", err)
+	}
+	sct, err := resp.ToSignedCertificateTimestamp()
+	if err != nil {
+		log.Fatalf("failed to parse the SCT: %v", err)
+	}
+
+	report := submitReport{
+		Endpoint:   endpoint,
+		LogID:      resp.ID,
+		Timestamp:  sct.Timestamp,
+		Extensions: sct.Extensions,
+		Problems:   []string{},
+	}
+	problem := func(format string, a ...any) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, a...))
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		log.Fatalf("failed to marshal public key: %v", err)
+	}
+	if logID := sha256.Sum256(der); !bytes.Equal(resp.ID, logID[:]) {
+		problem("SCT has log ID %x, but the public key's is %x", resp.ID, logID)
+	}
+
+	// The entry the log signed is the chain's, with the timestamp and extensions of the SCT
+	entry, err := ct.MerkleTreeLeafFromRawChain(chain, etype, sct.Timestamp)
+	if err != nil {
+		log.Fatalf("failed to build the log entry: %v", err)
+	}
+	entry.TimestampedEntry.Extensions = sct.Extensions
+	verifier, err := ct.NewSignatureVerifier(key)
+	if err != nil {
+		log.Fatalf("failed to create SCT verifier: %v", err)
+	}
+	if err := verifier.VerifySCTSignature(*sct, ct.LogEntry{Leaf: *entry}); err != nil {
+		problem("SCT signature doesn't verify: %v", err)
+	} else {
+		report.SignatureVerified = true
+	}
+	leafData, err := tls.Marshal(*entry)
+	if err != nil {
+		log.Fatalf("failed to marshal the log entry: %v", err)
+	}
+	leafHash := tlog.RecordHash(leafData)
+	report.LeafHash = leafHash[:]
+
+	extensions, err := sunlight.ParseExtensions(sct.Extensions)
+	if err != nil {
+		problem("SCT has no valid leaf_index extension: %v", err)
+	} else {
+		report.LeafIndex = &extensions.LeafIndex
+	}
+
+	if *wait && report.LeafIndex != nil {
+		// The SCT is returned once the entry is sequenced, but the STH that includes it
+		// may only be published after the next checkpoint
+		sth, err := c.STH(ctx)
+		for err == nil && sth.TreeSize <= *report.LeafIndex {
+			slog.Info("Waiting for the entry to be included", "leaf_index", *report.LeafIndex, "tree_size", sth.TreeSize)
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-time.After(time.Second):
+				sth, err = c.STH(ctx)
+			}
+		}
+		if err != nil {
+			log.Fatalf("failed to get an STH that includes the entry: %v", err)
+		}
+		inclusion := checkInclusion(ctx, c, sth, leafHash)
+		if inclusion.OK && inclusion.LeafIndex != int64(*report.LeafIndex) {
+			inclusion.OK = false
+			inclusion.Problems = append(inclusion.Problems, fmt.Sprintf("the proof is for leaf index %d, but the SCT has %d", inclusion.LeafIndex, *report.LeafIndex))
+		}
+		report.Inclusion = &inclusion
+		for _, p := range inclusion.Problems {
+			problem("%s", p)
+		}
+	}
+
+	report.OK = len(report.Problems) == 0
+	printReport(report, report.Problems)
+}
+
+func clientInclusion(args []string) {
+	flags := flag.NewFlagSet("client inclusion", flag.ExitOnError)
+	var cf clientFlags
+	cf.register(flags)
+	index := flags.Int64("index", -1, "Index of the entry, which is read with get-entries to compute its leaf hash.")
+	hash := flags.String("hash", "", "Base64 leaf hash of the entry, as printed by itko client submit, instead of -index.")
+	treeSize := flags.Uint64("tree-size", 0, "Size of the tree to prove the entry is in, which must have an archived STH. Defaults to the latest STH.")
+	flags.Parse(args)
+
+	if (*index < 0) == (*hash == "") {
+		fmt.Println("Error: exactly one of -index or -hash must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	ctx, cancel, c, _ := cf.client(flags)
+	defer cancel()
+
+	sth := fetchSTH(ctx, c, *treeSize)
+	var leafHash tlog.Hash
+	if *hash != "" {
+		data, err := base64.StdEncoding.DecodeString(*hash)
+		if err != nil || len(data) != tlog.HashSize {
+			log.Fatalf("invalid leaf hash %q", *hash)
+		}
+		copy(leafHash[:], data)
+	} else {
+		if uint64(*index) >= sth.TreeSize {
+			log.Fatalf("entry %d is not in the tree of size %d", *index, sth.TreeSize)
+		}
+		entries, err := c.RFC6962().GetRawEntries(ctx, *index, *index)
+		if err != nil {
+			log.Fatalf("failed to get entry %d: %v", *index, err)
+		}
+		if len(entries.Entries) != 1 {
+			log.Fatalf("get-entries returned %d entries for entry %d", len(entries.Entries), *index)
+		}
+		leafHash = tlog.RecordHash(entries.Entries[0].LeafInput)
+	}
+
+	report := checkInclusion(ctx, c, sth, leafHash)
+	if report.OK && *index >= 0 && report.LeafIndex != *index {
+		report.OK = false
+		report.Problems = append(report.Problems, fmt.Sprintf("the proof is for leaf index %d, not %d", report.LeafIndex, *index))
+	}
+	printReport(report, report.Problems)
+}
+
+func clientConsistency(args []string) {
+	flags := flag.NewFlagSet("client consistency", flag.ExitOnError)
+	var cf clientFlags
+	cf.register(flags)
+	first := flags.Uint64("first", 0, "Size of the older tree, which must have an archived STH.")
+	second := flags.Uint64("second", 0, "Size of the newer tree, which must have an archived STH. Defaults to the latest STH.")
+	flags.Parse(args)
+
+	if *first == 0 {
+		fmt.Println("Error: -first flag must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	ctx, cancel, c, _ := cf.client(flags)
+	defer cancel()
+
+	older := fetchSTH(ctx, c, *first)
+	newer := fetchSTH(ctx, c, *second)
+	if newer.TreeSize < older.TreeSize {
+		log.Fatalf("tree of size %d is older than the tree of size %d", newer.TreeSize, older.TreeSize)
+	}
+
+	report := consistencyReport{
+		FirstSize:      older.TreeSize,
+		FirstRootHash:  older.SHA256RootHash[:],
+		SecondSize:     newer.TreeSize,
+		SecondRootHash: newer.SHA256RootHash[:],
+		Problems:       []string{},
+	}
+	var proof tlog.TreeProof
+	if older.TreeSize < newer.TreeSize {
+		raw, err := c.RFC6962().GetSTHConsistency(ctx, older.TreeSize, newer.TreeSize)
+		if err != nil {
+			log.Fatalf("failed to get consistency proof: %v", err)
+		}
+		proof = make(tlog.TreeProof, len(raw))
+		for i, h := range raw {
+			copy(proof[i][:], h)
+		}
+	}
+	report.Proof = len(proof)
+	if err := tlog.CheckTree(proof, int64(newer.TreeSize), tlog.Hash(newer.SHA256RootHash), int64(older.TreeSize), tlog.Hash(older.SHA256RootHash)); err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("consistency proof doesn't verify: %v", err))
+	}
+	report.OK = len(report.Problems) == 0
+	printReport(report, report.Problems)
+}
+
+// fetchSTH returns the verified STH of treeSize, or the latest one if treeSize is zero.
+func fetchSTH(ctx context.Context, c *client.Client, treeSize uint64) *ct.SignedTreeHead {
+	if treeSize == 0 {
+		sth, err := c.STH(ctx)
+		if err != nil {
+			log.Fatalf("failed to get the latest STH: %v", err)
+		}
+		return sth
+	}
+	sth, err := c.ArchivedSTH(ctx, treeSize)
+	if err != nil {
+		log.Fatalf("failed to get the STH of size %d: %v", treeSize, err)
+	}
+	return sth
+}
+
+// checkInclusion fetches the inclusion proof of leafHash with get-proof-by-hash, and
+// verifies it against the root hash of sth.
+func checkInclusion(ctx context.Context, c *client.Client, sth *ct.SignedTreeHead, leafHash tlog.Hash) inclusionReport {
+	report := inclusionReport{
+		TreeSize: sth.TreeSize,
+		RootHash: sth.SHA256RootHash[:],
+		LeafHash: leafHash[:],
+		Problems: []string{},
+	}
+	resp, err := c.RFC6962().GetProofByHash(ctx, leafHash[:], sth.TreeSize)
+	if rspErr := (jsonclient.RspError{}); errors.As(err, &rspErr) && rspErr.StatusCode == http.StatusNotFound {
+		report.LeafIndex = -1
+		report.Problems = append(report.Problems, fmt.Sprintf("the log has no entry with this leaf hash in the tree of size %d", sth.TreeSize))
+		return report
+	} else if err != nil {
+		log.Fatalf("failed to get inclusion proof: %v", err)
+	}
+	report.LeafIndex = resp.LeafIndex
+	report.AuditPath = len(resp.AuditPath)
+
+	proof := make(tlog.RecordProof, len(resp.AuditPath))
+	for i, h := range resp.AuditPath {
+		copy(proof[i][:], h)
+	}
+	if err := tlog.CheckRecord(proof, int64(sth.TreeSize), tlog.Hash(sth.SHA256RootHash), resp.LeafIndex, leafHash); err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("inclusion proof doesn't verify: %v", err))
+	}
+	report.OK = len(report.Problems) == 0
+	return report
+}
+
+// printReport writes the report as JSON to stdout, and exits with status 2 if it has
+// any problems, as itko verify does.
+func printReport(report any, problems []string) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("failed to marshal report: %v", err)
+	}
+	os.Stdout.Write(append(data, '\n'))
+	if len(problems) > 0 {
+		slog.Error("Verification failed", "problems", len(problems))
+		os.Exit(2)
+	}
+}
+
+func readChain(path string) ([]ct.ASN1Cert, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var chain []ct.ASN1Cert
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, ct.ASN1Cert{Data: block.Bytes})
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return chain, nil
+}
+
+// postChain submits the chain without retrying, unlike the ct-go client, which backs
+// off on a 503 or 429 until its context ends, and drops the response. The status,
+// Retry-After, and body of a rejection are in the error, which is what a CA debugging
+// a failed submission needs to see.
+func postChain(ctx context.Context, url string, chain []ct.ASN1Cert) (*ct.AddChainResponse, error) {
+	var body ct.AddChainRequest
+	for _, cert := range chain {
+		body.Chain = append(body.Chain, cert.Data)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "itko-client")
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Submitted chain", "url", url, "status", resp.StatusCode, "duration", time.Since(start))
+	if resp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("%s returned %s", url, resp.Status)
+		if retry := resp.Header.Get("Retry-After"); retry != "" {
+			msg += ", Retry-After " + retry
+		}
+		return nil, fmt.Errorf("%s: %s", msg, strings.TrimSpace(string(data)))
+	}
+
+	var sct ct.AddChainResponse
+	if err := json.Unmarshal(data, &sct); err != nil {
+		return nil, fmt.Errorf("unable to parse response: %w", err)
+	}
+	return &sct, nil
+}
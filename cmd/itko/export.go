@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+)
+
+const exportUsage = `Usage: itko export <format> [flags]
+
+Formats:
+  static-ct  Write a snapshot of the log as a c2sp.org/static-ct-api monitoring prefix
+`
+
+func export(args []string) {
+	if len(args) < 1 {
+		fmt.Print(exportUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "static-ct":
+		exportStaticCT(args[1:])
+	default:
+		fmt.Printf("Unknown format %q\n\n%s", args[0], exportUsage)
+		os.Exit(1)
+	}
+}
+
+func exportStaticCT(args []string) {
+	flags := flag.NewFlagSet("export static-ct", flag.ExitOnError)
+	bf := bucketFlags{withoutIndexes: true}
+	bf.register(flags)
+	out := flags.String("out", "", "Directory to write the snapshot to.")
+	link := flags.Bool("link", false, "Hard link the tiles and issuers instead of copying them. The log must be in -root-directory, on the same filesystem as -out.")
+	concurrency := flags.Int("concurrency", 16, "Number of objects read or written at once.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if *out == "" {
+		fmt.Println("Error: -out flag must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := bf.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	gc, _ := bf.config(ctx, false)
+	result, err := ctsubmit.ExportStaticCT(ctx, gc, ctsubmit.StaticCTExportConfig{Directory: *out, Link: *link, Concurrency: *concurrency})
+	if err != nil {
+		log.Fatalf("failed to export the log: %v", err)
+	}
+	slog.Info("Log exported", "tree_size", result.TreeSize, "tiles", result.Tiles, "issuers", result.Issuers, "directory", *out)
+}
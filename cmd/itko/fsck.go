@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+)
+
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	var bf bucketFlags
+	bf.register(flags)
+	dryRun := flags.Bool("dry-run", false, "Only log the index files that need repair. The log's lock isn't taken, so the sequencer can keep running.")
+	concurrency := flags.Int("concurrency", 16, "Number of objects read or written at once.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if err := bf.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	gc, unlock := bf.config(ctx, !*dryRun)
+	result, err := ctsubmit.Fsck(ctx, gc, ctsubmit.FsckConfig{DryRun: *dryRun, Concurrency: *concurrency})
+	unlock()
+	if err != nil {
+		log.Fatalf("failed to check the indexes: %v", err)
+	}
+
+	if *dryRun && len(result.Repaired) > 0 {
+		slog.Warn("Index files need repair", "tree_size", result.TreeSize, "hash_files", result.HashFiles, "dedupe_files", result.DedupeFiles, "needs_repair", len(result.Repaired))
+		os.Exit(2)
+	}
+	slog.Info("Indexes checked", "tree_size", result.TreeSize, "hash_files", result.HashFiles, "dedupe_files", result.DedupeFiles, "repaired", len(result.Repaired))
+}
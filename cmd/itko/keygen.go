@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/sunlight"
+)
+
+func keygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := flags.String("out", "", "Path to write the PEM private key to. It must not exist yet.")
+	in := flags.String("in", "", "Path of an existing log key to print the log ID and public key of, instead of generating one.")
+	algorithm := flags.String("algorithm", "p256", "Key to generate, p256 for a log key or ed25519 for a cosigner key.")
+	passphraseFile := flags.String("passphrase-file", "", "File holding the passphrase to encrypt a log key with, unless it is set in ITKO_KEY_PASSPHRASE.")
+	publicOut := flags.String("public-out", "", "Path to also write the DER public key to.")
+	name := flags.String("name", "", "Name of the cosigner, to print its verifier key.")
+	flags.Parse(args)
+
+	if (*out == "") == (*in == "") {
+		fmt.Println("Error: exactly one of -out or -in must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	var public crypto.PublicKey
+	switch {
+	case *in != "":
+		key, err := ctsubmit.ReadSigningKey(*in, *passphraseFile)
+		if err != nil {
+			log.Fatalf("failed to read key: %v", err)
+		}
+		public = key.Public()
+	case *algorithm == "p256":
+		key, err := ctsubmit.GenerateSigningKey(*out, *passphraseFile)
+		if err != nil {
+			log.Fatalf("failed to generate key: %v", err)
+		}
+		public = key.Public()
+	case *algorithm == "ed25519":
+		// Cosigner keys are read unencrypted
+		if *passphraseFile != "" {
+			log.Fatal("ed25519 cosigner keys can't be encrypted")
+		}
+		key, err := ctsubmit.GenerateCosignerKey(*out)
+		if err != nil {
+			log.Fatalf("failed to generate key: %v", err)
+		}
+		public = key.Public()
+	default:
+		log.Fatalf("unknown algorithm %q, expected p256 or ed25519", *algorithm)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		log.Fatalf("failed to marshal public key: %v", err)
+	}
+	if *publicOut != "" {
+		if err := os.WriteFile(*publicOut, der, 0644); err != nil {
+			log.Fatalf("failed to write public key: %v", err)
+		}
+	}
+
+	if *out != "" {
+		fmt.Printf("Wrote key to %s\n", *out)
+	}
+	// The log ID goes in logID of the config and log_id of a log list entry, and the
+	// public key in key of the log list entry
+	if edKey, ok := public.(ed25519.PublicKey); ok {
+		fmt.Printf("Public key:   %s\n", base64.StdEncoding.EncodeToString(der))
+		if *name != "" {
+			fmt.Printf("Verifier key: %s\n", sunlight.CosignatureVerifierKey(*name, edKey))
+		}
+		return
+	}
+	logID, err := ctsubmit.LogIDForKey(public)
+	if err != nil {
+		log.Fatalf("failed to compute log ID: %v", err)
+	}
+	fmt.Printf("Log ID:     %s\n", logID)
+	fmt.Printf("Public key: %s\n", base64.StdEncoding.EncodeToString(der))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"itko.dev/internal/combined"
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/ctmonitor"
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+)
+
+const usage = `Usage: itko <command> [flags]
+
+Commands:
+  serve    Run the submit pipeline and the monitor for one log behind one listener
+  keygen   Generate a log or cosigner key, and print its log ID and public key
+  mirror   Copy an RFC 6962 log into tile storage, to serve it with the monitor
+  verify   Check every tile, issuer, and index record of a log, and print a JSON report
+  fsck     Rebuild the hash and dedupe index files that don't match the data tiles
+  backfill-indexes
+           Write the hash and dedupe indexes from scratch, such as for a new mask size
+  migrate  Convert another log implementation's storage into itko's, such as Sunlight's
+  export   Write a snapshot of the log in another format, such as static-ct-api
+  client   Submit a chain and verify the SCT, or check proofs, for smoke tests and debugging
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		serve(os.Args[2:])
+	case "keygen":
+		keygen(os.Args[2:])
+	case "mirror":
+		mirror(os.Args[2:])
+	case "verify":
+		verify(os.Args[2:])
+	case "fsck":
+		fsck(os.Args[2:])
+	case "backfill-indexes":
+		backfillIndexes(os.Args[2:])
+	case "migrate":
+		migrate(os.Args[2:])
+	case "export":
+		export(os.Args[2:])
+	case "client":
+		clientCommand(os.Args[2:])
+	default:
+		fmt.Printf("Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(1)
+	}
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	kvpath := flags.String("kv-path", "", "Consul KV path of the log.")
+	var coord coordination.Config
+	coord.RegisterFlags(flags)
+	var tlsConfig server.TLS
+	tlsConfig.RegisterFlags(flags)
+	metricsAddress := flags.String("metrics-address", "", "IP and port to serve Prometheus metrics on. Metrics are not served if this is not set.")
+	listenAddress := flags.String("listen-address", "", "IP and port to listen on for incoming connections, unix:<path> for a Unix socket, or systemd for a socket passed in by systemd.")
+	maxGetEntries := flags.Int("max-get-entries", ctmonitor.DefaultMaxGetEntries, "Maximum number of entries returned by one get-entries request.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if *kvpath == "" {
+		fmt.Println("Error: -kv-path flag must be set")
+		flags.Usage() // Print the usage message
+		os.Exit(1)    // Exit with a non-zero status
+	}
+
+	if *listenAddress == "" {
+		fmt.Println("Error: -listen-address flag must be set")
+		flags.Usage() // Print the usage message
+		os.Exit(1)    // Exit with a non-zero status
+	}
+
+	listener, err := server.Listen(*listenAddress)
+	if err != nil {
+		log.Fatalf("failed to bind to address: %v", err)
+	}
+	listener, err = tlsConfig.Listener(listener)
+	if err != nil {
+		log.Fatalf("failed to set up TLS: %v", err)
+	}
+
+	// Metrics are served on their own listener so they aren't exposed alongside the log
+	if *metricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", promhttp.Handler())
+			log.Fatal(http.ListenAndServe(*metricsAddress, mux))
+		}()
+	}
+
+	monitor := ctmonitor.Config{
+		MaxGetEntries:    *maxGetEntries,
+		MaxBodyBytes:     ctsubmit.DefaultMaxBodyBytes,
+		STHCacheTTL:      2 * time.Second,
+		ProofCacheTTL:    5 * time.Second,
+		CompressMinBytes: 1024,
+	}
+
+	combined.MainMain(context.Background(), listener, *kvpath, coord, monitor, nil)
+}
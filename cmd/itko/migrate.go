@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	_ "github.com/go-sql-driver/mysql"
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+)
+
+const migrateUsage = `Usage: itko migrate <source> [flags]
+
+Sources:
+  sunlight   Copy a Sunlight log's bucket into itko's layout, and rebuild its indexes
+  trillian   Rebuild a Trillian-backed CT log's tree from its CTFE or MySQL database
+`
+
+func migrate(args []string) {
+	if len(args) < 1 {
+		fmt.Print(migrateUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "sunlight":
+		migrateSunlight(args[1:])
+	case "trillian":
+		migrateTrillian(args[1:])
+	default:
+		fmt.Printf("Unknown source %q\n\n%s", args[0], migrateUsage)
+		os.Exit(1)
+	}
+}
+
+func migrateSunlight(args []string) {
+	flags := flag.NewFlagSet("migrate sunlight", flag.ExitOnError)
+	sourceUrl := flags.String("source-url", "", "Monitoring prefix of the Sunlight log, such as https://rome2025h1.sunlight.example/.")
+	sourceDirectory := flags.String("source-directory", "", "Directory with the contents of the Sunlight log's bucket, read instead of -source-url.")
+	sourceKey := flags.String("source-key", "", "Public key of the Sunlight log, as the base64 DER key from a log list.")
+	var bf bucketFlags
+	bf.register(flags)
+	concurrency := flags.Int("concurrency", 16, "Number of objects read or written at once.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if (*sourceUrl == "") == (*sourceDirectory == "") || *sourceKey == "" {
+		fmt.Println("Error: -source-key, and exactly one of -source-url or -source-directory, must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := bf.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(*sourceKey)
+	if err != nil {
+		log.Fatalf("failed to decode source key: %v", err)
+	}
+
+	ctx := context.Background()
+	gc, unlock := bf.config(ctx, true)
+	mc := ctsubmit.SunlightMigrationConfig{
+		SourceUrl:       *sourceUrl,
+		SourceDirectory: *sourceDirectory,
+		SourceKey:       key,
+		Concurrency:     *concurrency,
+	}
+	err = ctsubmit.MigrateSunlight(ctx, gc, mc)
+	unlock()
+	if err != nil {
+		log.Fatalf("failed to migrate the Sunlight log: %v", err)
+	}
+}
+
+func migrateTrillian(args []string) {
+	flags := flag.NewFlagSet("migrate trillian", flag.ExitOnError)
+	sourceUrl := flags.String("source-url", "", "Prefix of the CTFE's RFC 6962 endpoints, such as https://ct.example.com/2025/. Can be left out if -mysql-dsn and -source-sth are set.")
+	sourceKey := flags.String("source-key", "", "Public key of the log, as the base64 DER key from a log list.")
+	sourceSth := flags.String("source-sth", "", "File with the get-sth response to migrate up to, such as the last one the log issued before it was frozen. Defaults to the CTFE's latest STH.")
+	mysqlDsn := flags.String("mysql-dsn", "", "DSN of Trillian's MySQL database, or one restored from a dump of it, such as user:password@tcp(localhost:3306)/trillian. If set, the entries are read from it instead of get-entries.")
+	treeId := flags.Int64("tree-id", 0, "ID of the log's tree in the Trillian database.")
+	origin := flags.String("origin", "", "Checkpoint origin of the migrated log. Defaults to the log's config, or -source-url without its scheme and trailing slash.")
+	var bf bucketFlags
+	bf.register(flags)
+	batchSize := flags.Int("batch-size", 1000, "Entries read in each get-entries request or database query.")
+	concurrency := flags.Int("concurrency", 4, "Number of get-entries requests or database queries made at once.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if *sourceKey == "" || (*sourceUrl == "" && (*mysqlDsn == "" || *sourceSth == "")) {
+		fmt.Println("Error: -source-key, and -source-url unless both -mysql-dsn and -source-sth are set, must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *mysqlDsn != "" && *treeId == 0 {
+		fmt.Println("Error: -tree-id must be set with -mysql-dsn")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := bf.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(*sourceKey)
+	if err != nil {
+		log.Fatalf("failed to decode source key: %v", err)
+	}
+	tc := ctsubmit.TrillianMigrationConfig{
+		SourceUrl:   *sourceUrl,
+		SourceKey:   key,
+		TreeID:      *treeId,
+		Origin:      *origin,
+		BatchSize:   *batchSize,
+		Concurrency: *concurrency,
+	}
+	if *sourceSth != "" {
+		tc.STH, err = os.ReadFile(*sourceSth)
+		if err != nil {
+			log.Fatalf("failed to read source STH: %v", err)
+		}
+	}
+	if *mysqlDsn != "" {
+		tc.DB, err = sql.Open("mysql", *mysqlDsn)
+		if err != nil {
+			log.Fatalf("failed to open Trillian database: %v", err)
+		}
+		defer tc.DB.Close()
+	}
+
+	ctx := context.Background()
+	gc, unlock := bf.config(ctx, true)
+	err = ctsubmit.MigrateTrillian(ctx, gc, tc)
+	unlock()
+	if err != nil {
+		log.Fatalf("failed to migrate the Trillian log: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+)
+
+func mirror(args []string) {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	sourceUrl := flags.String("source-url", "", "Prefix of the RFC 6962 endpoints of the log to mirror, such as https://ct.example.com/2025/.")
+	sourceKey := flags.String("source-key", "", "Public key of the log to mirror, as the base64 DER key from a log list.")
+	origin := flags.String("origin", "", "Checkpoint origin of the mirror. Defaults to -source-url without its scheme and trailing slash.")
+	rootDirectory := flags.String("root-directory", "", "Directory to write the mirror to. Must not have a trailing slash.")
+	s3Bucket := flags.String("s3-bucket", "", "S3 bucket to write the mirror to. The credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	s3Region := flags.String("s3-region", "", "Region of the S3 bucket.")
+	s3EndpointUrl := flags.String("s3-endpoint-url", "", "Endpoint of the S3 bucket.")
+	s3AddressingStyle := flags.String("s3-addressing-style", "path", "Addressing style of the S3 bucket, path or virtual.")
+	maskSize := flags.Int("mask-size", 0, "Mask size for the quadtree.")
+	indexLayoutVersion := flags.Int("index-layout-version", 0, "Layout version of the k-anon index paths.")
+	indexSegmentSize := flags.Int("index-segment-size", 0, "Hex digits per directory of the k-anon index paths. Only used from layout version 1.")
+	batchSize := flags.Int("batch-size", 1000, "Entries asked for in each get-entries request. Logs return fewer if it is over their limit.")
+	concurrency := flags.Int("concurrency", 4, "Number of get-entries requests made at once.")
+	follow := flags.Duration("follow", 0, "Keep mirroring new STHs of the source at this interval, instead of exiting once caught up.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if *sourceUrl == "" || *sourceKey == "" || *maskSize == 0 {
+		fmt.Println("Error: -source-url, -source-key, and -mask-size flags must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if (*rootDirectory == "") == (*s3Bucket == "") {
+		fmt.Println("Error: exactly one of -root-directory or -s3-bucket must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(*sourceKey)
+	if err != nil {
+		log.Fatalf("failed to decode source key: %v", err)
+	}
+
+	gc := ctsubmit.GlobalConfig{
+		RootDirectory:              *rootDirectory,
+		S3Bucket:                   *s3Bucket,
+		S3Region:                   *s3Region,
+		S3EndpointUrl:              *s3EndpointUrl,
+		S3StaticCredentialUserName: os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3StaticCredentialPassword: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		S3AddressingStyle:          *s3AddressingStyle,
+		MaskSize:                   *maskSize,
+		IndexLayoutVersion:         *indexLayoutVersion,
+		IndexSegmentSize:           *indexSegmentSize,
+	}
+	mc := ctsubmit.MirrorConfig{
+		SourceUrl:   *sourceUrl,
+		SourceKey:   key,
+		Origin:      *origin,
+		BatchSize:   *batchSize,
+		Concurrency: *concurrency,
+		Follow:      *follow,
+	}
+	if err := ctsubmit.Mirror(context.Background(), gc, mc); err != nil {
+		log.Fatalf("failed to mirror %s: %v", *sourceUrl, err)
+	}
+}
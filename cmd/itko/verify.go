@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/ctmonitor"
+	"itko.dev/internal/server"
+)
+
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	kvpath := flags.String("kv-path", "", "Consul KV path of the log. If set, the mask size and, unless another storage is given, the bucket are read from the log's config.")
+	var coord coordination.Config
+	coord.RegisterFlags(flags)
+	storeDirectory := flags.String("store-directory", "", "Tile storage directory. Must not have a trailing slash.")
+	storeAddress := flags.String("store-address", "", "Tile storage url. Must end with a trailing slash.")
+	s3Bucket := flags.String("s3-bucket", "", "S3 bucket of the log. The credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	s3Region := flags.String("s3-region", "", "Region of the S3 bucket.")
+	s3EndpointUrl := flags.String("s3-endpoint-url", "", "Endpoint of the S3 bucket.")
+	s3AddressingStyle := flags.String("s3-addressing-style", "path", "Addressing style of the S3 bucket, path or virtual.")
+	maskSize := flags.Int("mask-size", 0, "Mask size for the quadtree.")
+	indexLayoutVersion := flags.Int("index-layout-version", 0, "Layout version of the k-anon index paths, matching the log's indexLayoutVersion.")
+	indexSegmentSize := flags.Int("index-segment-size", 0, "Hex digits per directory of the k-anon index paths, matching the log's indexSegmentSize. Only used from layout version 1.")
+	publicKey := flags.String("public-key", "", "Path to the log's PEM encoded public key. If set, the STH and checkpoint signatures are verified.")
+	origin := flags.String("origin", "", "Checkpoint origin of the log, which the checkpoint is verified for with -public-key. Defaults to the one in the log's config with -kv-path.")
+	skipIndexes := flags.Bool("skip-indexes", false, "Don't check the hash and dedupe indexes. Checking them needs about 40 bytes of memory per entry.")
+	concurrency := flags.Int("concurrency", 16, "Number of objects read from the storage at once.")
+	out := flags.String("out", "", "File to write the JSON report to. Defaults to stdout.")
+	logJSON := flags.Bool("log-json", false, "Log in JSON instead of logfmt.")
+	var logLevel slog.Level
+	flags.TextVar(&logLevel, "log-level", slog.LevelInfo, "Minimum level to log, one of debug, info, warn, or error.")
+	flags.Parse(args)
+
+	server.SetupLogging(*logJSON, logLevel)
+
+	if *kvpath == "" && *storeDirectory == "" && *storeAddress == "" && *s3Bucket == "" {
+		fmt.Println("Error: -kv-path, -store-directory, -store-address, or -s3-bucket flag must be set")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *kvpath == "" && *maskSize == 0 && !*skipIndexes {
+		fmt.Println("Error: -mask-size flag must be set, unless -skip-indexes is")
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	c := ctmonitor.Config{
+		KVPath:       *kvpath,
+		Coordination: coord,
+
+		StoreDirectory: *storeDirectory,
+		StoreAddress:   *storeAddress,
+
+		S3Bucket:                   *s3Bucket,
+		S3Region:                   *s3Region,
+		S3EndpointUrl:              *s3EndpointUrl,
+		S3StaticCredentialUserName: os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3StaticCredentialPassword: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		S3SessionToken:             os.Getenv("AWS_SESSION_TOKEN"),
+		S3AddressingStyle:          *s3AddressingStyle,
+
+		MaskSize:           *maskSize,
+		IndexLayoutVersion: *indexLayoutVersion,
+		IndexSegmentSize:   *indexSegmentSize,
+		Origin:             *origin,
+	}
+	if *publicKey != "" {
+		var err error
+		c.PublicKey, err = ctmonitor.LoadPublicKey(*publicKey)
+		if err != nil {
+			log.Fatalf("failed to load public key: %v", err)
+		}
+	}
+
+	report, err := ctmonitor.FullAudit(context.Background(), c, *concurrency, !*skipIndexes)
+	if err != nil {
+		log.Fatalf("failed to audit the log: %v", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("failed to marshal report: %v", err)
+	}
+	data = append(data, '\n')
+	if *out == "" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(*out, data, 0644); err != nil {
+		log.Fatalf("failed to write report: %v", err)
+	}
+
+	if !report.OK {
+		slog.Error("Log failed verification", "problems", report.ProblemCount)
+		os.Exit(2)
+	}
+	slog.Info("Log passed verification", "tree_size", report.TreeSize, "leaves", report.Leaves)
+}
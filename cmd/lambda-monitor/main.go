@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdaurl"
+	"itko.dev/internal/ctmonitor"
+	"itko.dev/internal/server"
+)
+
+// Serves the read path from a Lambda function URL, with the bucket as the origin, so the
+// log can be served from CloudFront without running any itko-monitor servers. Lambda has
+// no command line, so the config is taken from the environment.
+
+func main() {
+	server.SetupLogging(true, slog.LevelInfo)
+
+	bucket := os.Getenv("ITKO_S3_BUCKET")
+	if bucket == "" {
+		log.Fatal("ITKO_S3_BUCKET must be set")
+	}
+	maskSize, err := strconv.Atoi(os.Getenv("ITKO_MASK_SIZE"))
+	if err != nil || maskSize == 0 {
+		log.Fatal("ITKO_MASK_SIZE must be set")
+	}
+	region := os.Getenv("ITKO_S3_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+
+	c := ctmonitor.Config{
+		S3Bucket:      bucket,
+		S3Region:      region,
+		S3EndpointUrl: os.Getenv("ITKO_S3_ENDPOINT_URL"),
+		// The function's role credentials are passed in the environment
+		S3StaticCredentialUserName: os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3StaticCredentialPassword: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		S3SessionToken:             os.Getenv("AWS_SESSION_TOKEN"),
+		S3AddressingStyle:          os.Getenv("ITKO_S3_ADDRESSING_STYLE"),
+
+		MaskSize:           maskSize,
+		IndexLayoutVersion: envInt("ITKO_INDEX_LAYOUT_VERSION", 0),
+		IndexSegmentSize:   envInt("ITKO_INDEX_SEGMENT_SIZE", 0),
+		MirroredEntries:    os.Getenv("ITKO_MIRRORED_ENTRIES") == "true",
+		MaxBodyBytes:       128 * 1024,
+		MaxGetEntries:      envInt("ITKO_MAX_GET_ENTRIES", ctmonitor.DefaultMaxGetEntries),
+		MaxGetEntriesBytes: envInt("ITKO_MAX_GET_ENTRIES_BYTES", ctmonitor.DefaultMaxGetEntriesBytes),
+
+		// An instance only lives as long as it keeps getting requests, and is frozen in
+		// between, so the caches are kept but the startup check, integrity checks, and
+		// audit are left to an itko-monitor that runs all the time.
+		STHCacheTTL:   2 * time.Second,
+		ProofCacheTTL: 5 * time.Second,
+		StartupCheck:  ctmonitor.StartupCheckOff,
+
+		CertificateLookup: os.Getenv("ITKO_CERTIFICATE_LOOKUP") == "true",
+		CompressMinBytes:  1024,
+	}
+	if origins := os.Getenv("ITKO_CORS_ORIGINS"); origins != "" {
+		c.CORSOrigins = strings.Split(origins, ",")
+	}
+
+	handler, err := ctmonitor.Start(context.Background(), c)
+	if err != nil {
+		log.Fatalf("failed to start monitor: %v", err)
+	}
+	lambdaurl.Start(handler)
+}
+
+func envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", name, err)
+	}
+	return i
+}
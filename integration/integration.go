@@ -13,6 +13,7 @@ import (
 	tcConsul "github.com/testcontainers/testcontainers-go/modules/consul"
 	"github.com/testcontainers/testcontainers-go/modules/minio"
 
+	"itko.dev/internal/coordination"
 	"itko.dev/internal/ctmonitor"
 	"itko.dev/internal/ctsetup"
 	"itko.dev/internal/ctsubmit"
@@ -50,7 +51,7 @@ func setup(partialConfig ctsubmit.GlobalConfig, startSignal chan<- struct{}, con
 		ctmonitortileurl = minioEndpoint + "/" + minioBucket + "/"
 	}
 
-	ctsetup.MainMain(ctx, consulEndpoint, logName, "./testdata/fake-ca.cert", "./testdata/ct-http-server.privkey.plaintext.pem", config)
+	ctsetup.MainMain(ctx, coordination.Config{Address: consulEndpoint}, logName, "./testdata/fake-ca.cert", "./testdata/ct-http-server.privkey.plaintext.pem", config, ctsetup.Options{})
 
 	configChan <- config
 
@@ -64,8 +65,13 @@ func setup(partialConfig ctsubmit.GlobalConfig, startSignal chan<- struct{}, con
 		log.Fatalf("failed to create listener: %s", err)
 	}
 
-	go ctsubmit.MainMain(ctx, submitListener, logName, consulEndpoint, startSignal)
-	go ctmonitor.MainMain(monitorListener, ctmonitortiledir, ctmonitortileurl, ctmonitormasksize, startSignal)
+	go ctsubmit.MainMain(ctx, submitListener, []string{logName}, coordination.Config{Address: consulEndpoint}, startSignal)
+	go ctmonitor.MainMain(monitorListener, ctmonitor.Config{
+		StoreDirectory: ctmonitortiledir,
+		StoreAddress:   ctmonitortileurl,
+		MaskSize:       ctmonitormasksize,
+		MaxBodyBytes:   ctsubmit.DefaultMaxBodyBytes,
+	}, startSignal)
 	proxy(config.ListenAddress, monitorListener.Addr().String(), submitListener.Addr().String())
 }
 
@@ -144,12 +144,6 @@ func TestCTHammer(t *testing.T) {
 		MaxRetryDuration:    time.Second * 10, // Doesn't matter since IgnoreErrors is false
 		RequestDeadline:     time.Second * 5,
 		DuplicateChance:     10, // Default value from certificate-transparency-go
-		// This is set to true because although we can produce a valid consistency proof between any two STH values,
-		// this will result in failures at times. Consider a tree with a size of 250, but entires 240 to 250 were added
-		// together. Then, a partial tile for entry 245 would not have been stored. We could instead retrieve the tile for 250,
-		// but realistically we would rather just want to wait until 256 entries were stored and the full tile could be retrieved,
-		// as RFC6962 doesn't require us to be able to produce arbitrary proofs on demand.
-		StrictSTHConsistencySize: true,
 	}
 
 	flag.Parse()
@@ -303,12 +297,6 @@ func TestCTFsHammer(t *testing.T) {
 		MaxRetryDuration:    time.Second * 10, // Doesn't matter since IgnoreErrors is false
 		RequestDeadline:     time.Second * 5,
 		DuplicateChance:     10, // Default value from certificate-transparency-go
-		// This is set to true because although we can produce a valid consistency proof between any two STH values,
-		// this will result in failures at times. Consider a tree with a size of 250, but entires 240 to 250 were added
-		// together. Then, a partial tile for entry 245 would not have been stored. We could instead retrieve the tile for 250,
-		// but realistically we would rather just want to wait until 256 entries were stored and the full tile could be retrieved,
-		// as RFC6962 doesn't require us to be able to produce arbitrary proofs on demand.
-		StrictSTHConsistencySize: true,
 	}
 
 	flag.Parse()
@@ -0,0 +1,97 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type Config struct {
+	// Every alert is POSTed as JSON to this URL, if set
+	WebhookUrl string `json:"webhookUrl"`
+	// If set, alerts are also sent to the PagerDuty Events API v2 with this routing key
+	PagerDutyRoutingKey string `json:"pagerDutyRoutingKey"`
+}
+
+const pagerDutyEventsUrl = "https://events.pagerduty.com/v2/enqueue"
+
+// Alert is the body of the webhook request.
+type Alert struct {
+	Log     string    `json:"log"`
+	Kind    string    `json:"kind"`
+	Summary string    `json:"summary"`
+	Time    time.Time `json:"time"`
+}
+
+// Alerter notifies operators when something is wrong with a log. The kind of each alert
+// is also used as the PagerDuty dedup key, together with the log name.
+type Alerter struct {
+	config Config
+	name   string
+}
+
+func New(name string, c Config) *Alerter {
+	return &Alerter{config: c, name: name}
+}
+
+// Send sends the alert in the background, so it never holds up the caller.
+// Failures to deliver are only logged.
+func (a *Alerter) Send(kind, summary string) {
+	if a == nil || (a.config.WebhookUrl == "" && a.config.PagerDutyRoutingKey == "") {
+		return
+	}
+	alert := Alert{Log: a.name, Kind: kind, Summary: summary, Time: time.Now()}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if a.config.WebhookUrl != "" {
+			if err := postJSON(ctx, a.config.WebhookUrl, alert); err != nil {
+				slog.Error("Unable to send alert webhook", "log", a.name, "kind", kind, "error", err)
+			}
+		}
+
+		if a.config.PagerDutyRoutingKey != "" {
+			event := map[string]any{
+				"routing_key":  a.config.PagerDutyRoutingKey,
+				"event_action": "trigger",
+				"dedup_key":    a.name + "/" + kind,
+				"payload": map[string]any{
+					"summary":   a.name + ": " + summary,
+					"source":    a.name,
+					"severity":  "critical",
+					"timestamp": alert.Time.Format(time.RFC3339),
+				},
+			}
+			if err := postJSON(ctx, pagerDutyEventsUrl, event); err != nil {
+				slog.Error("Unable to send PagerDuty alert", "log", a.name, "kind", kind, "error", err)
+			}
+		}
+	}()
+}
+
+func postJSON(ctx context.Context, url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
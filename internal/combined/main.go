@@ -0,0 +1,61 @@
+package combined
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/ctmonitor"
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+)
+
+// MainMain runs the submit pipeline and the monitor for one log in the same process,
+// behind one listener, for small logs that don't need them scaled separately.
+// The monitor reads the bucket and mask size from the log's config in Consul or etcd.
+func MainMain(ctx context.Context, listener net.Listener, kvpath string, coord coordination.Config, monitor ctmonitor.Config, startSignal chan<- struct{}) {
+	if kvpath == "" {
+		log.Fatal("Must provide a Consul KV path")
+	}
+
+	// The log is stopped and its lock released once the server has drained
+	runCtx, stopLog := context.WithCancel(ctx)
+
+	ctloghandle, submit, released, err := ctsubmit.LoadWithFailover(runCtx, kvpath, coord)
+	if err != nil {
+		log.Fatalf("Failed to create log object for %s: %v", kvpath, err)
+	}
+
+	monitor.KVPath = kvpath
+	monitor.Coordination = coord
+	read, err := ctmonitor.StartFromKV(runCtx, monitor)
+	if err != nil {
+		log.Fatalf("Failed to get monitor handler: %v", err)
+	}
+
+	// Every submit endpoint is a POST, and every monitor endpoint is a GET, so the
+	// method is enough to tell them apart, except for the admin endpoints, which all
+	// belong to the submit side. CORS preflights go to the monitor as well.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || strings.HasPrefix(r.URL.Path, "/admin/") {
+			submit.ServeHTTP(w, r)
+			return
+		}
+		read.ServeHTTP(w, r)
+	})
+
+	if startSignal != nil {
+		startSignal <- struct{}{}
+	}
+
+	err = server.Serve(listener, handler, ctloghandle.ServerConfig(), func() {
+		stopLog()
+		<-released
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package coordination
+
+import (
+	"context"
+	"fmt"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+type consulStore struct {
+	client *consul.Client
+	kv     *consul.KV
+}
+
+// newConsulStore starts from the defaults of the Consul client, which are taken from
+// the same CONSUL_* environment variables as the Consul CLI, and 127.0.0.1:8500.
+func newConsulStore(c Config) (*consulStore, error) {
+	config := consul.DefaultConfig()
+	if c.Address != "" {
+		config.Address = c.Address
+	}
+	if c.TokenFile != "" {
+		config.TokenFile = c.TokenFile
+	}
+	if c.Datacenter != "" {
+		config.Datacenter = c.Datacenter
+	}
+	if c.CAFile != "" {
+		config.TLSConfig.CAFile = c.CAFile
+		config.Scheme = "https"
+	}
+	if c.CertFile != "" {
+		config.TLSConfig.CertFile = c.CertFile
+		config.TLSConfig.KeyFile = c.KeyFile
+		config.Scheme = "https"
+	}
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &consulStore{client: client, kv: client.KV()}, nil
+}
+
+func (s *consulStore) Get(ctx context.Context, key string) (Entry, error) {
+	return s.Watch(ctx, key, 0)
+}
+
+// Watch uses a blocking query, which returns after five minutes even if nothing changed.
+func (s *consulStore) Watch(ctx context.Context, key string, index uint64) (Entry, error) {
+	pair, meta, err := s.kv.Get(key, (&consul.QueryOptions{
+		RequireConsistent: true,
+		WaitIndex:         index,
+	}).WithContext(ctx))
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Index: meta.LastIndex}
+	// If the index goes backwards, Consul recommends resetting it
+	if meta.LastIndex < index {
+		e.Index = 0
+	}
+	if pair != nil {
+		e.Value = pair.Value
+		e.ModifyIndex = pair.ModifyIndex
+	}
+	return e, nil
+}
+
+func (s *consulStore) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.kv.Put(&consul.KVPair{Key: key, Value: value}, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (s *consulStore) CompareAndSwap(ctx context.Context, key string, value []byte, modifyIndex uint64) (bool, error) {
+	// A ModifyIndex of zero means the key must not exist yet
+	ok, _, err := s.kv.CAS(&consul.KVPair{
+		Key:         key,
+		Value:       value,
+		ModifyIndex: modifyIndex,
+	}, (&consul.WriteOptions{}).WithContext(ctx))
+	return ok, err
+}
+
+func (s *consulStore) Lock(ctx context.Context, key string) (Lock, error) {
+	lock, err := s.client.LockKey(key)
+	if err != nil {
+		return nil, err
+	}
+	lost, err := lock.Lock(ctx.Done())
+	if err != nil {
+		return nil, err
+	}
+	if lost == nil {
+		return nil, fmt.Errorf("stopped while waiting for lock: %w", ctx.Err())
+	}
+	return &consulLock{lock: lock, lost: lost}, nil
+}
+
+type consulLock struct {
+	lock *consul.Lock
+	lost <-chan struct{}
+}
+
+func (l *consulLock) Lost() <-chan struct{} { return l.lost }
+func (l *consulLock) Unlock() error         { return l.lock.Unlock() }
@@ -0,0 +1,139 @@
+package coordination
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Logs keep their config and state in a KV store, which is also how the instances of a
+// log agree on which of them is sequencing it. Consul is used by default, and etcd or
+// the Kubernetes API can be used instead by deployments that don't run Consul.
+
+const (
+	Consul     = "consul"
+	Etcd       = "etcd"
+	Kubernetes = "kubernetes"
+)
+
+type Config struct {
+	// Consul, the default, Etcd, or Kubernetes
+	Backend string
+	// Address of the Consul agent, or URL of an etcd endpoint or Kubernetes API server.
+	// Defaults to one on localhost, or the API server of the pod.
+	Address string
+	// File with the Consul ACL token, which otherwise comes from CONSUL_HTTP_TOKEN, or the
+	// Kubernetes bearer token, which otherwise is the one of the pod's service account
+	TokenFile string
+	// Consul datacenter, which defaults to the agent's
+	Datacenter string
+	// CA to verify the server with, and client certificate and key for mutual TLS. Consul
+	// also reads them from CONSUL_CACERT, CONSUL_CLIENT_CERT, and CONSUL_CLIENT_KEY.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// Kubernetes namespace, which defaults to the one of the pod
+	Namespace string
+	// Values of config fields, by JSON path, that replace the ones in the store
+	Overrides Overrides
+}
+
+// Store is a consistent KV store with locks.
+type Store interface {
+	// Get reads the value of a key.
+	Get(ctx context.Context, key string) (Entry, error)
+	// Watch blocks until the key is modified after index, which is taken from a previous
+	// Entry, and returns its new value. It can also return early with the same value.
+	Watch(ctx context.Context, key string, index uint64) (Entry, error)
+	Put(ctx context.Context, key string, value []byte) error
+	// CompareAndSwap writes the value if the key was last modified at modifyIndex, or if
+	// it doesn't exist and modifyIndex is zero. It returns false if the key was changed.
+	CompareAndSwap(ctx context.Context, key string, value []byte, modifyIndex uint64) (bool, error)
+	// Lock blocks until the lock at key is acquired, or ctx is done.
+	Lock(ctx context.Context, key string) (Lock, error)
+}
+
+type Entry struct {
+	Value []byte
+	// When the key was last modified, which is zero if it doesn't exist
+	ModifyIndex uint64
+	// Index of the whole store when the key was read, to pass to Watch
+	Index uint64
+}
+
+func (e Entry) Exists() bool {
+	return e.ModifyIndex != 0
+}
+
+type Lock interface {
+	// Lost is closed if the lock is lost, or once it is released.
+	Lost() <-chan struct{}
+	Unlock() error
+}
+
+// RegisterFlags adds the -coordination flags, which set c, to fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Backend, "coordination", Consul, "Where the config is read from and the lock is held, one of consul, etcd, or kubernetes.")
+	fs.StringVar(&c.Address, "coordination-address", "", "Address of the Consul agent, or URL of an etcd endpoint or Kubernetes API server. Defaults to one on localhost, or the API server of the pod.")
+	fs.StringVar(&c.TokenFile, "coordination-token-file", "", "File with the Consul ACL token or Kubernetes bearer token. Defaults to CONSUL_HTTP_TOKEN, or the token of the pod's service account.")
+	fs.StringVar(&c.Datacenter, "coordination-datacenter", "", "Consul datacenter. Defaults to the one of the agent.")
+	fs.StringVar(&c.CAFile, "coordination-ca-file", "", "PEM CA certificate to verify Consul or etcd with, which also enables TLS.")
+	fs.StringVar(&c.CertFile, "coordination-cert-file", "", "PEM client certificate to authenticate to Consul or etcd with.")
+	fs.StringVar(&c.KeyFile, "coordination-key-file", "", "PEM key of -coordination-cert-file.")
+	fs.StringVar(&c.Namespace, "coordination-namespace", "", "Kubernetes namespace the ConfigMaps and Leases are kept in. Defaults to the namespace of the pod.")
+	c.Overrides = Overrides{}
+	fs.Var(c.Overrides, "config", "Override a config field, as key=value where key is its JSON path, such as signer.pkcs11PinFile. Can be repeated, and takes precedence over ITKO_* environment variables.")
+}
+
+// New connects to the store of the configured backend.
+func New(c Config) (Store, error) {
+	switch c.Backend {
+	case "", Consul:
+		return newConsulStore(c)
+	case Etcd:
+		if c.TokenFile != "" || c.Datacenter != "" {
+			return nil, fmt.Errorf("a token and datacenter can only be set for consul")
+		}
+		return newEtcdStore(c)
+	case Kubernetes:
+		if c.Datacenter != "" {
+			return nil, fmt.Errorf("a datacenter can only be set for consul")
+		}
+		return newKubernetesStore(c)
+	default:
+		return nil, fmt.Errorf("unknown coordination backend %q, expected consul, etcd, or kubernetes", c.Backend)
+	}
+}
+
+// newTransport returns an HTTP transport that verifies the server with the CA in caFile,
+// and authenticates with the client certificate in certFile, if they are set.
+func newTransport(caFile, certFile, keyFile string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile == "" && certFile == "" {
+		return transport, nil
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = config
+	return transport, nil
+}
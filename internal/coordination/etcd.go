@@ -0,0 +1,281 @@
+package coordination
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etcd is called through the JSON gateway of its v3 API, served on the same port as
+// gRPC, which needs etcd 3.4 or later. Locks are held with a lease, which is kept alive
+// until the lock is released, and lost if it can't be renewed before it expires.
+
+const (
+	etcdLockTTL     = 15
+	etcdCallTimeout = 10 * time.Second
+)
+
+type etcdStore struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newEtcdStore(c Config) (*etcdStore, error) {
+	address := c.Address
+	if address == "" {
+		address = "http://127.0.0.1:2379"
+	}
+	scheme := "http://"
+	if c.CAFile != "" || c.CertFile != "" {
+		scheme = "https://"
+	}
+	if !strings.Contains(address, "://") {
+		address = scheme + address
+	}
+
+	transport, err := newTransport(c.CAFile, c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Watches and locks block for as long as they need to, so there is no client timeout
+	return &etcdStore{endpoint: strings.TrimSuffix(address, "/") + "/v3", client: &http.Client{Transport: transport}}, nil
+}
+
+// etcdInt is an int64, which the gateway encodes as a JSON string.
+type etcdInt int64
+
+func (i etcdInt) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *etcdInt) UnmarshalJSON(b []byte) error {
+	n, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = etcdInt(n)
+	return err
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision"`
+}
+
+type etcdError struct {
+	Message string `json:"message"`
+}
+
+// call makes a unary request to the gateway. Bytes fields are base64 in both directions,
+// which encoding/json does for []byte.
+func (s *etcdStore) call(ctx context.Context, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e etcdError
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return fmt.Errorf("etcd %s: %s", path, e.Message)
+		}
+		return fmt.Errorf("etcd %s returned %s", path, res.Status)
+	}
+	return json.Unmarshal(data, resp)
+}
+
+func (s *etcdStore) Get(ctx context.Context, key string) (Entry, error) {
+	var resp struct {
+		Header etcdHeader `json:"header"`
+		Kvs    []struct {
+			Value       []byte  `json:"value"`
+			ModRevision etcdInt `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := s.call(ctx, "/kv/range", map[string]any{"key": []byte(key)}, &resp); err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Index: uint64(resp.Header.Revision)}
+	if len(resp.Kvs) > 0 {
+		e.Value = resp.Kvs[0].Value
+		e.ModifyIndex = uint64(resp.Kvs[0].ModRevision)
+	}
+	return e, nil
+}
+
+// Watch streams changes to the key from after index, and reads the key again once the
+// first one arrives.
+func (s *etcdStore) Watch(ctx context.Context, key string, index uint64) (Entry, error) {
+	if index == 0 {
+		return s.Get(ctx, key)
+	}
+	body, err := json.Marshal(map[string]any{"create_request": map[string]any{
+		"key":            []byte(key),
+		"start_revision": etcdInt(index + 1),
+	}})
+	if err != nil {
+		return Entry{}, err
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r, err := http.NewRequestWithContext(watchCtx, http.MethodPost, s.endpoint+"/watch", bytes.NewReader(body))
+	if err != nil {
+		return Entry{}, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(r)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Entry{}, fmt.Errorf("etcd /watch returned %s", res.Status)
+	}
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled bool              `json:"canceled"`
+				Events   []json.RawMessage `json:"events"`
+			} `json:"result"`
+			Error *etcdError `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return Entry{}, err
+		}
+		if msg.Error != nil {
+			return Entry{}, fmt.Errorf("etcd /watch: %s", msg.Error.Message)
+		}
+		// A watch is canceled if index has been compacted, in which case the caller
+		// gets the current value instead
+		if len(msg.Result.Events) > 0 || msg.Result.Canceled {
+			return s.Get(ctx, key)
+		}
+	}
+}
+
+func (s *etcdStore) Put(ctx context.Context, key string, value []byte) error {
+	return s.call(ctx, "/kv/put", map[string]any{"key": []byte(key), "value": value}, &struct{}{})
+}
+
+func (s *etcdStore) CompareAndSwap(ctx context.Context, key string, value []byte, modifyIndex uint64) (bool, error) {
+	// A key that doesn't exist has a mod revision of zero
+	req := map[string]any{
+		"compare": []map[string]any{{
+			"key":          []byte(key),
+			"target":       "MOD",
+			"result":       "EQUAL",
+			"mod_revision": etcdInt(modifyIndex),
+		}},
+		"success": []map[string]any{{
+			"request_put": map[string]any{"key": []byte(key), "value": value},
+		}},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := s.call(ctx, "/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *etcdStore) Lock(ctx context.Context, key string) (Lock, error) {
+	var lease struct {
+		ID etcdInt `json:"ID"`
+	}
+	if err := s.call(ctx, "/lease/grant", map[string]any{"TTL": etcdLockTTL}, &lease); err != nil {
+		return nil, fmt.Errorf("unable to grant lease: %w", err)
+	}
+
+	// The lease has to be kept alive while waiting for the lock, as well as while holding it
+	l := &etcdLock{store: s, lease: lease.ID, lost: make(chan struct{}), done: make(chan struct{})}
+	go l.keepAlive()
+
+	var resp struct {
+		Key []byte `json:"key"`
+	}
+	if err := s.call(ctx, "/lock/lock", map[string]any{"name": []byte(key), "lease": lease.ID}, &resp); err != nil {
+		l.Unlock()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("stopped while waiting for lock: %w", ctx.Err())
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+type etcdLock struct {
+	store *etcdStore
+	lease etcdInt
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	// Closed by Unlock to stop renewing the lease
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (l *etcdLock) Lost() <-chan struct{} { return l.lost }
+
+func (l *etcdLock) keepAlive() {
+	defer l.lostOnce.Do(func() { close(l.lost) })
+	ticker := time.NewTicker(etcdLockTTL * time.Second / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), etcdCallTimeout)
+		var resp struct {
+			Result struct {
+				TTL etcdInt `json:"TTL"`
+			} `json:"result"`
+		}
+		err := l.store.call(ctx, "/lease/keepalive", map[string]any{"ID": l.lease}, &resp)
+		cancel()
+		switch {
+		case err == nil && resp.Result.TTL > 0:
+			renewed = time.Now()
+		case err == nil:
+			slog.Error("etcd lease expired", "lease", int64(l.lease))
+			return
+		case time.Since(renewed) >= etcdLockTTL*time.Second:
+			slog.Error("Unable to renew etcd lease before it expired", "lease", int64(l.lease), "error", err)
+			return
+		default:
+			slog.Warn("Unable to renew etcd lease", "lease", int64(l.lease), "error", err)
+		}
+	}
+}
+
+// Unlock revokes the lease, which deletes the lock key along with it.
+func (l *etcdLock) Unlock() error {
+	l.doneOnce.Do(func() { close(l.done) })
+	ctx, cancel := context.WithTimeout(context.Background(), etcdCallTimeout)
+	defer cancel()
+	return l.store.call(ctx, "/lease/revoke", map[string]any{"ID": l.lease}, &struct{}{})
+}
@@ -0,0 +1,23 @@
+package coordination
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEtcdInt(t *testing.T) {
+	b, err := json.Marshal(etcdInt(42))
+	if err != nil || string(b) != `"42"` {
+		t.Errorf("Marshal = %s, %v", b, err)
+	}
+	for _, in := range []string{`"42"`, `42`} {
+		var i etcdInt
+		if err := json.Unmarshal([]byte(in), &i); err != nil || i != 42 {
+			t.Errorf("Unmarshal(%s) = %d, %v", in, i, err)
+		}
+	}
+	var i etcdInt
+	if err := json.Unmarshal([]byte(`"x"`), &i); err == nil {
+		t.Error("Unmarshal accepted a non-number")
+	}
+}
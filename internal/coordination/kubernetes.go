@@ -0,0 +1,512 @@
+package coordination
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Kubernetes is called through the REST API of the API server. Each key is kept in a
+// ConfigMap named after it, with the slashes replaced by dots, so itko/alpha/config is
+// the value key of the itko.alpha.config ConfigMap. The resource version of a ConfigMap
+// is its modify index. Locks are coordination.k8s.io Leases, which are renewed while
+// held, and lost if they can't be renewed before they expire, like the etcd leases.
+
+const (
+	kubernetesLeaseDuration = 15 * time.Second
+	kubernetesRetryPeriod   = 2 * time.Second
+	kubernetesCallTimeout   = 10 * time.Second
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+var kubernetesName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+type kubernetesStore struct {
+	endpoint  string
+	namespace string
+	// Re-read on every request, as service account tokens are rotated
+	tokenFile string
+	client    *http.Client
+	// Who holds the Leases taken by this process
+	identity string
+}
+
+// newKubernetesStore uses the service account of the pod by default. Address can point
+// at another API server, such as one served by kubectl proxy, which needs no token.
+func newKubernetesStore(c Config) (*kubernetesStore, error) {
+	s := &kubernetesStore{namespace: c.Namespace, tokenFile: c.TokenFile}
+	caFile := c.CAFile
+	if c.Address != "" {
+		s.endpoint = strings.TrimSuffix(c.Address, "/")
+	} else {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a Kubernetes pod, so -coordination-address must be set")
+		}
+		s.endpoint = "https://" + net.JoinHostPort(host, port)
+		if s.tokenFile == "" {
+			s.tokenFile = serviceAccountDir + "/token"
+		}
+		if caFile == "" {
+			caFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+	if s.namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the namespace of the pod, -coordination-namespace must be set: %w", err)
+		}
+		s.namespace = strings.TrimSpace(string(ns))
+	}
+
+	transport, err := newTransport(caFile, c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	// Watches block for as long as they need to, so there is no client timeout
+	s.client = &http.Client{Transport: transport}
+
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	s.identity = hostname + "_" + hex.EncodeToString(suffix)
+	return s, nil
+}
+
+// objectName converts a key such as itko/alpha/config to itko.alpha.config.
+func objectName(key string) (string, error) {
+	name := strings.ReplaceAll(key, "/", ".")
+	if len(name) > 253 || !kubernetesName.MatchString(name) {
+		return "", fmt.Errorf("key %q can't be used as the name of a Kubernetes object", key)
+	}
+	return name, nil
+}
+
+// kubernetesError is the Status returned with a failed request.
+type kubernetesError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *kubernetesError) Error() string {
+	return fmt.Sprintf("kubernetes: %s", e.Message)
+}
+
+func isReason(err error, reason string) bool {
+	e, ok := err.(*kubernetesError)
+	return ok && e.Reason == reason
+}
+
+func (s *kubernetesStore) request(ctx context.Context, method, path, contentType string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.tokenFile != "" {
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		e := &kubernetesError{}
+		if json.Unmarshal(data, e) != nil || e.Message == "" {
+			e.Code, e.Message = res.StatusCode, fmt.Sprintf("%s %s returned %s", method, path, res.Status)
+		}
+		return nil, e
+	}
+	return res, nil
+}
+
+// call makes a request and decodes the response into resp.
+func (s *kubernetesStore) call(ctx context.Context, method, path, contentType string, body, resp any) error {
+	res, err := s.request(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, resp)
+}
+
+type kubernetesMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type configMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubernetesMeta    `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
+}
+
+// newConfigMap holds value as text if it can, so that it can be edited with kubectl.
+func (s *kubernetesStore) newConfigMap(name string, value []byte, resourceVersion uint64) configMap {
+	cm := configMap{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   kubernetesMeta{Name: name, Namespace: s.namespace},
+	}
+	if resourceVersion != 0 {
+		cm.Metadata.ResourceVersion = strconv.FormatUint(resourceVersion, 10)
+	}
+	if utf8.Valid(value) {
+		cm.Data = map[string]string{"value": string(value)}
+	} else {
+		cm.BinaryData = map[string][]byte{"value": value}
+	}
+	return cm
+}
+
+func (cm configMap) value() []byte {
+	if v, ok := cm.Data["value"]; ok {
+		return []byte(v)
+	}
+	return cm.BinaryData["value"]
+}
+
+func parseResourceVersion(rv string) (uint64, error) {
+	n, err := strconv.ParseUint(rv, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected resource version %q: %w", rv, err)
+	}
+	return n, nil
+}
+
+func (s *kubernetesStore) configMapsPath() string {
+	return "/api/v1/namespaces/" + url.PathEscape(s.namespace) + "/configmaps"
+}
+
+// Get lists the ConfigMap rather than reading it, so that the resource version of the
+// namespace is returned even when it doesn't exist.
+func (s *kubernetesStore) Get(ctx context.Context, key string) (Entry, error) {
+	name, err := objectName(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	var list struct {
+		Metadata kubernetesMeta `json:"metadata"`
+		Items    []configMap    `json:"items"`
+	}
+	query := url.Values{"fieldSelector": {"metadata.name=" + name}}
+	if err := s.call(ctx, http.MethodGet, s.configMapsPath()+"?"+query.Encode(), "", nil, &list); err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	if e.Index, err = parseResourceVersion(list.Metadata.ResourceVersion); err != nil {
+		return Entry{}, err
+	}
+	if len(list.Items) > 0 {
+		e.Value = list.Items[0].value()
+		if e.ModifyIndex, err = parseResourceVersion(list.Items[0].Metadata.ResourceVersion); err != nil {
+			return Entry{}, err
+		}
+	}
+	return e, nil
+}
+
+// Watch waits for an event on the ConfigMap after index, for up to five minutes, and then
+// reads it again.
+func (s *kubernetesStore) Watch(ctx context.Context, key string, index uint64) (Entry, error) {
+	if index == 0 {
+		return s.Get(ctx, key)
+	}
+	name, err := objectName(key)
+	if err != nil {
+		return Entry{}, err
+	}
+	query := url.Values{
+		"watch":           {"true"},
+		"fieldSelector":   {"metadata.name=" + name},
+		"resourceVersion": {strconv.FormatUint(index, 10)},
+		"timeoutSeconds":  {"300"},
+	}
+	res, err := s.request(ctx, http.MethodGet, s.configMapsPath()+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer res.Body.Close()
+
+	// Any event means the key changed, or, for an error, that index is too old, in which
+	// case the caller gets the current value instead. So does the end of the watch.
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&event); err != nil && err != io.EOF {
+		return Entry{}, err
+	}
+	return s.Get(ctx, key)
+}
+
+// Put creates or replaces the ConfigMap with a server-side apply.
+func (s *kubernetesStore) Put(ctx context.Context, key string, value []byte) error {
+	name, err := objectName(key)
+	if err != nil {
+		return err
+	}
+	path := s.configMapsPath() + "/" + name + "?fieldManager=itko&force=true"
+	return s.call(ctx, http.MethodPatch, path, "application/apply-patch+yaml", s.newConfigMap(name, value, 0), &struct{}{})
+}
+
+func (s *kubernetesStore) CompareAndSwap(ctx context.Context, key string, value []byte, modifyIndex uint64) (bool, error) {
+	name, err := objectName(key)
+	if err != nil {
+		return false, err
+	}
+	// Creating a ConfigMap fails if it exists, and replacing one fails if its resource
+	// version changed
+	if modifyIndex == 0 {
+		err = s.call(ctx, http.MethodPost, s.configMapsPath(), "application/json", s.newConfigMap(name, value, 0), &struct{}{})
+	} else {
+		err = s.call(ctx, http.MethodPut, s.configMapsPath()+"/"+name, "application/json", s.newConfigMap(name, value, modifyIndex), &struct{}{})
+	}
+	if isReason(err, "AlreadyExists") || isReason(err, "Conflict") || isReason(err, "NotFound") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type lease struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   kubernetesMeta `json:"metadata"`
+	Spec       leaseSpec      `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+// The MicroTime format of Lease timestamps
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (s *kubernetesStore) leasesPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(s.namespace) + "/leases"
+}
+
+// expired reports whether nobody holds the Lease, because it was released or not renewed
+// in time.
+func (l lease) expired(now time.Time) bool {
+	if l.Spec.HolderIdentity == nil || *l.Spec.HolderIdentity == "" || l.Spec.RenewTime == nil {
+		return true
+	}
+	renewed, err := time.Parse(time.RFC3339Nano, *l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	duration := kubernetesLeaseDuration
+	if l.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return now.After(renewed.Add(duration))
+}
+
+// Lock polls the Lease until it is free, and takes it with an update that fails if
+// anyone else took it first.
+func (s *kubernetesStore) Lock(ctx context.Context, key string) (Lock, error) {
+	name, err := objectName(key)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		l, err := s.tryLock(ctx, name)
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("Unable to take Kubernetes lease", "lease", name, "error", err)
+		}
+		if l != nil {
+			return l, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stopped while waiting for lock: %w", ctx.Err())
+		case <-time.After(kubernetesRetryPeriod):
+		}
+	}
+}
+
+func (s *kubernetesStore) tryLock(ctx context.Context, name string) (*kubernetesLock, error) {
+	ctx, cancel := context.WithTimeout(ctx, kubernetesCallTimeout)
+	defer cancel()
+
+	now := time.Now()
+	var current lease
+	err := s.call(ctx, http.MethodGet, s.leasesPath()+"/"+name, "", nil, &current)
+	if err != nil && !isReason(err, "NotFound") {
+		return nil, err
+	}
+	exists := err == nil
+	if exists && !current.expired(now) {
+		return nil, nil
+	}
+
+	transitions := 0
+	if exists && current.Spec.LeaseTransitions != nil {
+		transitions = *current.Spec.LeaseTransitions + 1
+	}
+	duration := int(kubernetesLeaseDuration / time.Second)
+	timestamp := now.UTC().Format(microTime)
+	next := lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   kubernetesMeta{Name: name, Namespace: s.namespace, ResourceVersion: current.Metadata.ResourceVersion},
+		Spec: leaseSpec{
+			HolderIdentity:       &s.identity,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &timestamp,
+			RenewTime:            &timestamp,
+			LeaseTransitions:     &transitions,
+		},
+	}
+	var taken lease
+	if exists {
+		err = s.call(ctx, http.MethodPut, s.leasesPath()+"/"+name, "application/json", next, &taken)
+	} else {
+		err = s.call(ctx, http.MethodPost, s.leasesPath(), "application/json", next, &taken)
+	}
+	if isReason(err, "AlreadyExists") || isReason(err, "Conflict") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := &kubernetesLock{store: s, name: name, lease: taken, lost: make(chan struct{}), done: make(chan struct{})}
+	go l.renew()
+	return l, nil
+}
+
+type kubernetesLock struct {
+	store *kubernetesStore
+	name  string
+
+	mu    sync.Mutex
+	lease lease
+	// Set once the Lease is no longer held, so Unlock doesn't release someone else's
+	gone bool
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	// Closed by Unlock to stop renewing the Lease
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (l *kubernetesLock) Lost() <-chan struct{} { return l.lost }
+
+func (l *kubernetesLock) expire() {
+	l.mu.Lock()
+	l.gone = true
+	l.mu.Unlock()
+	l.lostOnce.Do(func() { close(l.lost) })
+}
+
+func (l *kubernetesLock) renew() {
+	ticker := time.NewTicker(kubernetesLeaseDuration / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), kubernetesCallTimeout)
+		l.mu.Lock()
+		next := l.lease
+		timestamp := time.Now().UTC().Format(microTime)
+		next.Spec.RenewTime = &timestamp
+		var updated lease
+		err := l.store.call(ctx, http.MethodPut, l.store.leasesPath()+"/"+l.name, "application/json", next, &updated)
+		if err == nil {
+			l.lease = updated
+		}
+		l.mu.Unlock()
+		cancel()
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case isReason(err, "Conflict") || isReason(err, "NotFound"):
+			// Someone else changed the Lease, so it can't be ours anymore
+			slog.Error("Kubernetes lease was taken over", "lease", l.name, "error", err)
+			l.expire()
+			return
+		case time.Since(renewed) >= kubernetesLeaseDuration:
+			slog.Error("Unable to renew Kubernetes lease before it expired", "lease", l.name, "error", err)
+			l.expire()
+			return
+		default:
+			slog.Warn("Unable to renew Kubernetes lease", "lease", l.name, "error", err)
+		}
+	}
+}
+
+// Unlock clears the holder of the Lease, so the next instance can take it right away
+// instead of waiting for it to expire.
+func (l *kubernetesLock) Unlock() error {
+	l.doneOnce.Do(func() { close(l.done) })
+	defer l.lostOnce.Do(func() { close(l.lost) })
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.gone {
+		return nil
+	}
+	l.gone = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesCallTimeout)
+	defer cancel()
+	next := l.lease
+	empty := ""
+	one := 1
+	timestamp := time.Now().UTC().Format(microTime)
+	next.Spec.HolderIdentity = &empty
+	next.Spec.LeaseDurationSeconds = &one
+	next.Spec.RenewTime = &timestamp
+	return l.store.call(ctx, http.MethodPut, l.store.leasesPath()+"/"+l.name, "application/json", next, &struct{}{})
+}
@@ -0,0 +1,75 @@
+package coordination
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObjectName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"itko/alpha/config", "itko.alpha.config"},
+		{"itko/2025h1/lock", "itko.2025h1.lock"},
+		{"itko/log-a/epoch", "itko.log-a.epoch"},
+		{"itko/Alpha/config", ""},
+		{"itko/alpha_1/config", ""},
+		{"itko//config", ""},
+		{"/itko/config", ""},
+		{"itko/" + strings.Repeat("a", 250), ""},
+	}
+	for _, tt := range tests {
+		got, err := objectName(tt.key)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("objectName(%q) = %q, %v, want %q", tt.key, got, err, tt.want)
+		}
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	str := func(s string) *string { return &s }
+	seconds := func(n int) *int { return &n }
+	renewed := func(ago time.Duration) *string { return str(now.Add(-ago).Format(microTime)) }
+
+	tests := []struct {
+		name string
+		spec leaseSpec
+		want bool
+	}{
+		{"held", leaseSpec{HolderIdentity: str("a"), RenewTime: renewed(5 * time.Second)}, false},
+		{"not renewed", leaseSpec{HolderIdentity: str("a"), RenewTime: renewed(kubernetesLeaseDuration + time.Second)}, true},
+		{"own duration", leaseSpec{HolderIdentity: str("a"), RenewTime: renewed(30 * time.Second), LeaseDurationSeconds: seconds(60)}, false},
+		{"own duration passed", leaseSpec{HolderIdentity: str("a"), RenewTime: renewed(30 * time.Second), LeaseDurationSeconds: seconds(10)}, true},
+		{"released", leaseSpec{HolderIdentity: str(""), RenewTime: renewed(time.Second)}, true},
+		{"never held", leaseSpec{}, true},
+		{"unparseable renew time", leaseSpec{HolderIdentity: str("a"), RenewTime: str("yesterday")}, true},
+	}
+	for _, tt := range tests {
+		if got := (lease{Spec: tt.spec}).expired(now); got != tt.want {
+			t.Errorf("%s: expired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigMapValue(t *testing.T) {
+	var s kubernetesStore
+	for _, value := range [][]byte{[]byte("usable"), {0xff, 0x00}} {
+		cm := s.newConfigMap("itko.alpha.state", value, 0)
+		// Round trip through JSON, as the API server would
+		b, err := json.Marshal(cm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got configMap
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got.value()) != string(value) {
+			t.Errorf("value = %x, want %x", got.value(), value)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package coordination
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Any field of the stored config can be overridden, so that secrets such as the S3
+// credentials don't have to be kept in the KV store. A field is named by its JSON path,
+// such as s3StaticCredentialPassword or signer.pkcs11PinFile, and can be set from the
+// environment variable of the same name in upper snake case with an ITKO_ prefix, such
+// as ITKO_S3_STATIC_CREDENTIAL_PASSWORD or ITKO_SIGNER_PKCS11_PIN_FILE, or with a flag,
+// which takes precedence. Strings are taken as is, and anything else as JSON.
+
+// Shorter names for the fields most often kept out of the KV store
+var envAliases = map[string]string{
+	"ITKO_S3_ACCESS_KEY": "s3StaticCredentialUserName",
+	"ITKO_S3_SECRET":     "s3StaticCredentialPassword",
+}
+
+// Overrides maps the JSON paths of config fields to their values. It is a flag.Value
+// that is set by repeating a flag of the form key=value.
+type Overrides map[string]string
+
+func (o Overrides) String() string {
+	pairs := make([]string, 0, len(o))
+	for k, v := range o {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (o Overrides) Set(flag string) error {
+	key, value, ok := strings.Cut(flag, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("override must be in the form key=value")
+	}
+	o[key] = value
+	return nil
+}
+
+// DecodeConfig unmarshals a config read from the store into v, which must be a pointer
+// to a struct, and applies the overrides from the environment and c.Overrides over it.
+func (c Config) DecodeConfig(data []byte, v any) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	fields := map[string]reflect.Type{}
+	configFields(reflect.TypeOf(v).Elem(), "", fields)
+
+	overrides := map[string]string{}
+	for path := range fields {
+		if value, ok := os.LookupEnv(envName(path)); ok {
+			overrides[path] = value
+		}
+	}
+	for env, path := range envAliases {
+		if value, ok := os.LookupEnv(env); ok && fields[path] != nil {
+			if _, set := overrides[path]; !set {
+				overrides[path] = value
+			}
+		}
+	}
+	for path, value := range c.Overrides {
+		if fields[path] == nil {
+			return fmt.Errorf("unknown config field %q", path)
+		}
+		overrides[path] = value
+	}
+
+	// Each override is unmarshaled on its own, as a nested object, so that it only
+	// replaces its own field and leaves the rest of its parent struct alone
+	for path, value := range overrides {
+		raw := json.RawMessage(value)
+		if fields[path].Kind() == reflect.String {
+			raw, _ = json.Marshal(value)
+		}
+		parts := strings.Split(path, ".")
+		var overlay any = raw
+		for i := len(parts) - 1; i >= 0; i-- {
+			overlay = map[string]any{parts[i]: overlay}
+		}
+		b, err := json.Marshal(overlay)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", path, err)
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// configFields records the type of every field of a struct by its JSON path, recursing
+// into nested structs.
+func configFields(t reflect.Type, prefix string, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" || name == "" {
+			continue
+		}
+		fields[prefix+name] = f.Type
+		if f.Type.Kind() == reflect.Struct {
+			configFields(f.Type, prefix+name+".", fields)
+		}
+	}
+}
+
+// envName converts a JSON path such as signer.pkcs11PinFile to ITKO_SIGNER_PKCS11_PIN_FILE.
+func envName(path string) string {
+	var b strings.Builder
+	b.WriteString("ITKO")
+	for _, part := range strings.Split(path, ".") {
+		b.WriteByte('_')
+		runes := []rune(part)
+		for i, r := range runes {
+			// A word starts at an upper case letter after a lower case letter or digit,
+			// so logID is LOG_ID and s3Bucket is S3_BUCKET
+			if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[i-1]) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,112 @@
+package coordination
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testConfig struct {
+	Name       string `json:"name"`
+	LogID      string `json:"logID"`
+	S3Bucket   string `json:"s3Bucket"`
+	FlushMs    int    `json:"flushMs"`
+	Secret     string `json:"s3StaticCredentialPassword"`
+	Signer     testSigner
+	Mirrored   bool     `json:"mirroredEntries"`
+	Witnesses  []string `json:"witnesses"`
+	unexported string
+}
+
+type testSigner struct {
+	Type          string `json:"type"`
+	Pkcs11PinFile string `json:"pkcs11PinFile"`
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"name":                       "ITKO_NAME",
+		"logID":                      "ITKO_LOG_ID",
+		"s3Bucket":                   "ITKO_S3_BUCKET",
+		"s3StaticCredentialPassword": "ITKO_S3_STATIC_CREDENTIAL_PASSWORD",
+		"signer.pkcs11PinFile":       "ITKO_SIGNER_PKCS11_PIN_FILE",
+	}
+	for path, want := range tests {
+		if got := envName(path); got != want {
+			t.Errorf("envName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	// The signer has no JSON tag, so it can't be overridden
+	stored := `{"name":"ct.example.com/2025","flushMs":500,"Signer":{"type":"file"}}`
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		overrides Overrides
+		want      testConfig
+		ok        bool
+	}{
+		{
+			name: "stored",
+			want: testConfig{Name: "ct.example.com/2025", FlushMs: 500, Signer: testSigner{Type: "file"}},
+			ok:   true,
+		},
+		{
+			name: "environment",
+			env:  map[string]string{"ITKO_S3_BUCKET": "bucket", "ITKO_FLUSH_MS": "250", "ITKO_MIRRORED_ENTRIES": "true"},
+			want: testConfig{Name: "ct.example.com/2025", S3Bucket: "bucket", FlushMs: 250, Signer: testSigner{Type: "file"}, Mirrored: true},
+			ok:   true,
+		},
+		{
+			name: "full name over the alias",
+			env:  map[string]string{"ITKO_S3_SECRET": "alias", "ITKO_S3_STATIC_CREDENTIAL_PASSWORD": "full"},
+			want: testConfig{Name: "ct.example.com/2025", FlushMs: 500, Secret: "full", Signer: testSigner{Type: "file"}},
+			ok:   true,
+		},
+		{
+			// logID is a string, so 123 is taken as it is rather than as a JSON number
+			name:      "flag over the environment",
+			env:       map[string]string{"ITKO_NAME": "env"},
+			overrides: Overrides{"name": "flag", "logID": "123", "witnesses": `["a","b"]`},
+			want:      testConfig{Name: "flag", LogID: "123", FlushMs: 500, Signer: testSigner{Type: "file"}, Witnesses: []string{"a", "b"}},
+			ok:        true,
+		},
+		{name: "unknown field", overrides: Overrides{"nmae": "x"}},
+		{name: "field without a tag", overrides: Overrides{"Signer.type": "kms"}},
+		{name: "invalid JSON", overrides: Overrides{"flushMs": "fast"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var got testConfig
+			err := Config{Overrides: tt.overrides}.DecodeConfig([]byte(stored), &got)
+			if (err == nil) != tt.ok {
+				t.Fatalf("DecodeConfig = %v", err)
+			}
+			if tt.ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeConfig = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverridesSet(t *testing.T) {
+	o := Overrides{}
+	for _, flag := range []string{"name=a=b", "flushMs=5"} {
+		if err := o.Set(flag); err != nil {
+			t.Errorf("Set(%q) = %v", flag, err)
+		}
+	}
+	if o["name"] != "a=b" || o["flushMs"] != "5" {
+		t.Errorf("overrides = %v", o)
+	}
+	for _, flag := range []string{"name", "=value"} {
+		if err := o.Set(flag); err == nil {
+			t.Errorf("Set(%q) succeeded", flag)
+		}
+	}
+}
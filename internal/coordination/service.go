@@ -0,0 +1,100 @@
+package coordination
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Service is how an instance registers itself in the Consul catalog, so that it can be
+// found through Consul DNS and its health shows up in Consul. Consul checks GET /readyz,
+// which fails on a standby sequencer, or a monitor that can't read its storage.
+type Service struct {
+	// Name of the service. Nothing is registered if this is empty.
+	Name string
+	// Address the service is reached at. Defaults to the address of the Consul node.
+	Address string
+	Tags    []string
+	// How often Consul checks /readyz. Defaults to 10s.
+	CheckInterval time.Duration
+	// Whether the service serves TLS. The check doesn't verify the certificate, as it is
+	// made to the address of the listener rather than a name on the certificate.
+	TLS bool
+}
+
+// RegisterFlags adds the -consul-service flags, which set s, to fs.
+func (s *Service) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.Name, "consul-service", "", "If set, register as a Consul service of this name, with a health check on /readyz.")
+	fs.StringVar(&s.Address, "consul-service-address", "", "Address registered for the Consul service. Defaults to the address of the Consul node.")
+	fs.Func("consul-service-tags", "Comma separated list of tags of the Consul service.", func(tags string) error {
+		s.Tags = strings.Split(tags, ",")
+		return nil
+	})
+	fs.DurationVar(&s.CheckInterval, "consul-service-check-interval", 10*time.Second, "How often Consul checks /readyz.")
+}
+
+// RegisterService registers the instance listening on listenAddress with the local Consul
+// agent, and returns a function that deregisters it.
+func RegisterService(c Config, s Service, listenAddress string) (func() error, error) {
+	if c.Backend != "" && c.Backend != Consul {
+		// The Consul settings are shared with the coordination flags
+		return nil, fmt.Errorf("registering a Consul service needs -coordination consul")
+	}
+	host, portString, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port: %w", err)
+	}
+
+	store, err := newConsulStore(c)
+	if err != nil {
+		return nil, err
+	}
+	agent := store.client.Agent()
+
+	// The check is run by the agent, which is usually on the same machine
+	checkHost := s.Address
+	if checkHost == "" {
+		checkHost = host
+	}
+	if ip := net.ParseIP(checkHost); checkHost == "" || ip != nil && ip.IsUnspecified() {
+		checkHost = "127.0.0.1"
+	}
+	scheme := "http://"
+	if s.TLS {
+		scheme = "https://"
+	}
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	hostname, _ := os.Hostname()
+	id := fmt.Sprintf("%s-%s-%d", s.Name, hostname, port)
+
+	err = agent.ServiceRegister(&consul.AgentServiceRegistration{
+		ID:      id,
+		Name:    s.Name,
+		Address: s.Address,
+		Port:    port,
+		Tags:    s.Tags,
+		Check: &consul.AgentServiceCheck{
+			HTTP:          scheme + net.JoinHostPort(checkHost, portString) + "/readyz",
+			Interval:      interval.String(),
+			Timeout:       min(interval, 5*time.Second).String(),
+			TLSSkipVerify: s.TLS,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to register Consul service: %w", err)
+	}
+	return func() error { return agent.ServiceDeregister(id) }, nil
+}
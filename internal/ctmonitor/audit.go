@@ -0,0 +1,195 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/alert"
+	"itko.dev/internal/sunlight"
+)
+
+const alertAuditFailed = "audit_failed"
+
+// auditor follows the STHs the sequencer publishes, and checks that each one is consistent
+// with the last, and that the data tiles for the entries it adds parse and hash to the
+// tree. The integrity check only looks at signatures, so this catches a sequencer that
+// signs a tree it didn't upload correctly.
+type auditor struct {
+	interval time.Duration
+	alerts   alert.Config
+	mirrored bool
+
+	// The last tree that passed the audit
+	last    tlog.Tree
+	started bool
+	failing bool
+}
+
+func newAuditor(c Config) *auditor {
+	if c.AuditInterval <= 0 {
+		return nil
+	}
+	return &auditor{interval: c.AuditInterval, alerts: c.Alerts, mirrored: c.MirroredEntries}
+}
+
+// run audits every new STH until the context is done. The first STH is taken as it is,
+// since the startup check has already covered it.
+func (a *auditor) run(ctx context.Context, s Storage) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		a.update(ctx, s)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *auditor) update(ctx context.Context, s Storage) {
+	tree, err := a.audit(ctx, s)
+	switch {
+	case err == nil:
+		auditFailed.Set(0)
+		auditedTreeSize.Set(float64(tree.N))
+		if a.failing {
+			a.failing = false
+			slog.InfoContext(ctx, "Audit passes again", "tree_size", tree.N)
+		}
+	case isStorageError(err):
+		slog.WarnContext(ctx, "Unable to audit the latest STH", "error", err)
+	default:
+		auditFailed.Set(1)
+		auditFailuresTotal.Inc()
+		if !a.failing {
+			a.failing = true
+			slog.ErrorContext(ctx, "Latest STH failed the audit", "tree_size", tree.N, "error", err)
+			alert.New("monitor", a.alerts).Send(alertAuditFailed, err.Error())
+		}
+	}
+}
+
+// audit checks the latest STH against the last one that passed. Until it passes, the
+// next audit starts from the same tree, so no entries are skipped.
+func (a *auditor) audit(ctx context.Context, s Storage) (tlog.Tree, error) {
+	raw, _, err := s.Get(ctx, "ct/v1/get-sth")
+	if err != nil {
+		return tlog.Tree{}, storageError(fmt.Errorf("unable to fetch STH: %w", err))
+	}
+	var sth ct.SignedTreeHead
+	if err := json.Unmarshal(raw, &sth); err != nil {
+		return tlog.Tree{}, fmt.Errorf("unable to unmarshal STH: %w", err)
+	}
+	tree := tlog.Tree{N: int64(sth.TreeSize), Hash: tlog.Hash(sth.SHA256RootHash)}
+
+	if !a.started {
+		a.last, a.started = tree, true
+		return tree, nil
+	}
+
+	switch {
+	case tree.N < a.last.N:
+		return tree, fmt.Errorf("tree size went from %d back to %d", a.last.N, tree.N)
+	case tree.N == a.last.N:
+		if tree.Hash != a.last.Hash {
+			return tree, fmt.Errorf("root hash changed at tree size %d", tree.N)
+		}
+		return tree, nil
+	}
+
+	reader := tlog.TileHashReader(tree, tileReader(ctx, s))
+	if a.last.N > 0 {
+		proof, err := tlog.ProveTree(tree.N, a.last.N, reader)
+		if err != nil {
+			return tree, fmt.Errorf("unable to prove tree %d consistent with %d: %w", tree.N, a.last.N, err)
+		}
+		if err := tlog.CheckTree(proof, tree.N, tree.Hash, a.last.N, a.last.Hash); err != nil {
+			return tree, fmt.Errorf("tree %d is not consistent with %d: %w", tree.N, a.last.N, err)
+		}
+	}
+	if err := verifyLeaves(ctx, s, reader, tree, a.last.N, tree.N, a.mirrored); err != nil {
+		return tree, err
+	}
+
+	a.last = tree
+	return tree, nil
+}
+
+// tileReader reads tiles for a tlog.TileHashReader, which checks them against the tree.
+// Tiles that couldn't be fetched are reported as storage errors, so they can be told
+// apart from tiles that don't match.
+func tileReader(ctx context.Context, s Storage) *sunlight.TileReader {
+	return &sunlight.TileReader{
+		Fetch: func(key string) ([]byte, error) {
+			data, _, err := s.Get(ctx, key)
+			if err != nil {
+				return nil, storageError(fmt.Errorf("unable to fetch %s: %w", key, err))
+			}
+			return data, nil
+		},
+		SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {},
+	}
+}
+
+// verifyLeaves checks that the leaves from start up to end parse out of the data tiles,
+// and that each one hashes to the leaf hash in the tree. The hashes are read through a
+// TileHashReader for the tree, so the level zero tiles are checked against its root.
+// Leaves without a leaf_index extension are only read if mirrored is set.
+func verifyLeaves(ctx context.Context, s Storage, reader tlog.HashReader, tree tlog.Tree, start, end int64, mirrored bool) error {
+	for n := start / sunlight.TileWidth; n*sunlight.TileWidth < end; n++ {
+		if _, err := verifyDataTile(ctx, s, reader, tree, n, mirrored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDataTile checks every leaf of data tile n against the tree, and returns them.
+func verifyDataTile(ctx context.Context, s Storage, reader tlog.HashReader, tree tlog.Tree, n int64, mirrored bool) ([]*sunlight.LogEntry, error) {
+	tile := tlog.Tile{H: sunlight.TileHeight, L: -1, N: n, W: int(min(tree.N-n*sunlight.TileWidth, sunlight.TileWidth))}
+
+	// Every leaf in the tile is checked, not only the new ones, since a partial tile
+	// is rewritten in full each time it grows
+	indexes := make([]int64, tile.W)
+	for i := range indexes {
+		indexes[i] = tlog.StoredHashIndex(0, n*sunlight.TileWidth+int64(i))
+	}
+	hashes, err := reader.ReadHashes(indexes)
+	if err != nil {
+		return nil, fmt.Errorf("tiles for data tile %s don't match the tree: %w", sunlight.Path(tile), err)
+	}
+
+	data, _, err := s.Get(ctx, sunlight.Path(tile))
+	if err != nil {
+		return nil, storageError(fmt.Errorf("unable to fetch data tile %s: %w", sunlight.Path(tile), err))
+	}
+
+	entries := make([]*sunlight.LogEntry, 0, tile.W)
+	for entry, err := range parseTileEntries(tile, data, mirrored) {
+		if err != nil {
+			return nil, fmt.Errorf("invalid data tile %s: %w", sunlight.Path(tile), err)
+		}
+		i := len(entries)
+		if i == tile.W {
+			return nil, fmt.Errorf("data tile %s has trailing data", sunlight.Path(tile))
+		}
+		index := n*sunlight.TileWidth + int64(i)
+		if entry.LeafIndex != uint64(index) {
+			return nil, fmt.Errorf("data tile %s has leaf %d at index %d", sunlight.Path(tile), entry.LeafIndex, index)
+		}
+		if tlog.RecordHash(entry.MerkleTreeLeaf()) != hashes[i] {
+			return nil, fmt.Errorf("leaf %d in data tile %s doesn't match the tree", index, sunlight.Path(tile))
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) < tile.W {
+		return nil, fmt.Errorf("data tile %s has %d entries, expected %d", sunlight.Path(tile), len(entries), tile.W)
+	}
+	return entries, nil
+}
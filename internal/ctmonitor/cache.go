@@ -0,0 +1,66 @@
+package ctmonitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Cache-Control values for the read endpoints. The STH changes every flush interval,
+// so it is always revalidated, which is cheap with an ETag. Proofs and entries are for
+// a fixed tree size or range, so they never change once they can be served at all.
+const (
+	cacheRevalidate = "no-cache"
+	cacheRoots      = "public, max-age=3600"
+	cacheImmutable  = "public, max-age=86400, immutable"
+)
+
+func etagFor(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified reports whether the client already has the response with this ETag.
+func notModified(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// setCacheHeaders sets the caching headers for a successful response, and writes a 304
+// instead if the client's copy is still current. It returns true if nothing else should
+// be written.
+func setCacheHeaders(w http.ResponseWriter, r *http.Request, etag, cacheControl string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// entriesCacheControl picks the caching for get-entries. Entries never change once they
+// are in the log, so the response is immutable unless it was cut short by the tree size
+// or the request limit, in which case asking again later could return more.
+func entriesCacheControl(r *http.Request, maxGetEntry int, returned int) string {
+	query := r.URL.Query()
+	start, err1 := strconv.ParseInt(query.Get("start"), 10, 64)
+	end, err2 := strconv.ParseInt(query.Get("end"), 10, 64)
+	if err1 != nil || err2 != nil {
+		return cacheRevalidate
+	}
+	if end-start >= int64(maxGetEntry) {
+		end = start + int64(maxGetEntry) - 1
+	}
+	if int64(returned) == end-start+1 {
+		return cacheImmutable
+	}
+	return cacheRevalidate
+}
@@ -0,0 +1,136 @@
+package ctmonitor
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// get-entries responses are mostly base64, which compresses about 3x. Responses are
+// compressed with zstd or gzip, whichever the client prefers to accept, once they are
+// larger than a threshold. Smaller responses, like the STH, aren't worth it.
+
+// acceptedEncoding picks zstd over gzip if the client accepts both.
+func acceptedEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		accepted[strings.ToLower(name)] = true
+	}
+	switch {
+	case accepted["zstd"]:
+		return "zstd"
+	case accepted["gzip"]:
+		return "gzip"
+	}
+	return ""
+}
+
+// withCompression compresses responses of at least minSize bytes. If minSize is zero,
+// next is returned as is.
+func withCompression(next http.Handler, minSize int) http.Handler {
+	if minSize <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A compressed response gets its own ETag, so strip the suffix again before the
+		// handler compares it with the ETag of the response
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, "-"+encoding+`"`, `"`))
+		}
+
+		// Not deferred, so that a handler aborting the response doesn't get it
+		// finished off as if it were complete
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, code: http.StatusOK}
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// compressWriter holds back the start of the response until it knows whether the
+// response is big enough to compress.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	code    int
+	buf     []byte
+	started bool
+	enc     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.started {
+		return
+	}
+	cw.code = code
+	// Error bodies are small, and 304s have no body at all
+	if code != http.StatusOK {
+		cw.started = true
+		cw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.started {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) < cw.minSize {
+		return len(p), nil
+	}
+
+	cw.started = true
+	h := cw.ResponseWriter.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+cw.encoding+`"`)
+	}
+	cw.ResponseWriter.WriteHeader(cw.code)
+
+	if cw.encoding == "zstd" {
+		enc, err := zstd.NewWriter(cw.ResponseWriter, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			return 0, err
+		}
+		cw.enc = enc
+	} else {
+		cw.enc = gzip.NewWriter(cw.ResponseWriter)
+	}
+	if _, err := cw.enc.Write(cw.buf); err != nil {
+		return 0, err
+	}
+	cw.buf = nil
+	return len(p), nil
+}
+
+// close sends whatever is still held back, uncompressed, or finishes the compressed stream.
+func (cw *compressWriter) close() {
+	if cw.enc != nil {
+		cw.enc.Close()
+		return
+	}
+	if !cw.started {
+		cw.ResponseWriter.WriteHeader(cw.code)
+		cw.ResponseWriter.Write(cw.buf)
+	}
+}
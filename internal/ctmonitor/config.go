@@ -0,0 +1,131 @@
+package ctmonitor
+
+import (
+	"crypto"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"itko.dev/internal/alert"
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/server"
+)
+
+type Config struct {
+	// If set, the mask size, body limit, and, if no storage is given, the bucket are read
+	// from the sequencer's config at <KVPath>/config in Consul or etcd, and follow its changes.
+	KVPath       string
+	Coordination coordination.Config
+
+	// Tile storage, either a local directory, a URL prefix, or an S3 bucket.
+	// They are preferred in that order if more than one is set.
+	StoreDirectory string
+	StoreAddress   string
+	// Timeouts, retries, and auth for StoreAddress
+	UrlStorage UrlStorageConfig
+
+	S3Bucket                   string
+	S3Region                   string
+	S3EndpointUrl              string
+	S3StaticCredentialUserName string
+	S3StaticCredentialPassword string
+	// Only needed for temporary credentials, such as those of a Lambda's role
+	S3SessionToken string
+	// path or virtual, as in the log's config
+	S3AddressingStyle string
+	S3UseAccelerate   bool
+
+	MaskSize     int
+	MaxBodyBytes int64
+	// The layout of the k-anon index paths, which must match the log's config
+	IndexLayoutVersion int
+	IndexSegmentSize   int
+	// Set for a mirror or a migrated Trillian log, whose entries have no leaf_index
+	// extension, which is otherwise an error
+	MirroredEntries bool
+	// Maximum number of entries returned by one get-entries request. Defaults to 1024.
+	MaxGetEntries int
+	// Maximum size of a get-entries response in bytes, before compression. Fewer entries
+	// than asked for are returned to stay under it. Defaults to 8MiB.
+	MaxGetEntriesBytes int
+	Server             server.Config
+
+	// How long a fetched STH is reused before it is fetched again. Zero disables the cache.
+	STHCacheTTL time.Duration
+	// How long computed inclusion and consistency proofs are reused, and how many are kept.
+	// Zero disables the cache.
+	ProofCacheTTL  time.Duration
+	ProofCacheSize int
+	// If set, STHs are verified against this key before they are cached, and the STH and
+	// checkpoint in the bucket are checked every IntegrityCheckInterval. Nothing is served
+	// while they fail.
+	PublicKey              crypto.PublicKey
+	IntegrityCheckInterval time.Duration
+	// The checkpoint origin of the log, which the checkpoint is verified for. Required with
+	// PublicKey, unless it is read from the log's config in the KV store.
+	Origin string
+	// Where to alert when the bucket fails verification
+	Alerts alert.Config
+	// Whether the edge tiles are checked against the STH at startup, and whether a failure
+	// stops the monitor from starting. One of StartupCheckOff, StartupCheckWarn, or
+	// StartupCheckFail. Empty is the same as StartupCheckOff.
+	StartupCheck string
+	// How often to look for a new STH and audit the tiles it adds. Zero disables the audit.
+	AuditInterval time.Duration
+
+	// Serve GET /certificate/<fingerprint>, which looks certificates up in the dedupe index
+	CertificateLookup bool
+
+	// How long GET /readyz waits for the STH and an edge tile. Defaults to 5s.
+	ReadyTimeout time.Duration
+
+	// Origins allowed to call the monitor from a browser, or "*" for any origin
+	CORSOrigins []string
+
+	// Per-IP and global limits on the read path, to protect the bucket
+	RateLimit RateLimitConfig
+
+	// Responses at least this large are compressed. Zero disables compression.
+	CompressMinBytes int
+}
+
+// storage opens the tile storage, preferring a local directory, then a URL prefix, and
+// then the S3 bucket.
+func (c Config) storage() (Storage, error) {
+	if c.StoreDirectory != "" {
+		return &FsStorage{root: c.StoreDirectory}, nil
+	} else if c.StoreAddress != "" {
+		urlStorage, err := NewUrlStorage(c.StoreAddress, c.UrlStorage)
+		if err != nil {
+			return nil, err
+		}
+		var storage Storage = urlStorage
+		if c.UrlStorage.CacheDirectory != "" {
+			storage, err = NewDiskCache(storage, c.UrlStorage.CacheDirectory, c.UrlStorage.CacheMaxBytes)
+			if err != nil {
+				return nil, fmt.Errorf("unable to open disk cache: %w", err)
+			}
+		}
+		return storage, nil
+	}
+	return NewS3Storage(c.S3Region, c.S3Bucket, c.S3EndpointUrl, c.S3StaticCredentialUserName, c.S3StaticCredentialPassword, c.S3SessionToken, c.S3AddressingStyle, c.S3UseAccelerate), nil
+}
+
+// LoadPublicKey reads a PEM encoded public key, as served by the log's metadata.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode public key PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,66 @@
+package ctmonitor
+
+import (
+	"net/http"
+	"slices"
+)
+
+// CORS lets browser based CT viewers call the read path directly. Only GET requests
+// are served, so there is little to configure beyond which origins are allowed.
+
+// allowedMethods are the methods every endpoint of the read path answers to.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// headerSetter is satisfied by both http.Header and fsthttp.Header.
+type headerSetter interface {
+	Set(key, value string)
+}
+
+// setCORSHeaders sets the CORS response headers if origin is allowed, and reports
+// whether it was. For a preflight request, the allowed methods and headers are set too.
+func setCORSHeaders(h headerSetter, allowed []string, origin string, preflight bool, requestHeaders string) bool {
+	if origin == "" {
+		return false
+	}
+	h.Set("Vary", "Origin")
+	switch {
+	case slices.Contains(allowed, "*"):
+		h.Set("Access-Control-Allow-Origin", "*")
+	case slices.Contains(allowed, origin):
+		h.Set("Access-Control-Allow-Origin", origin)
+	default:
+		return false
+	}
+
+	if preflight {
+		h.Set("Access-Control-Allow-Methods", allowedMethods)
+		if requestHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", requestHeaders)
+		}
+		h.Set("Access-Control-Max-Age", "86400")
+	} else {
+		h.Set("Access-Control-Expose-Headers", "ETag, Retry-After, X-Request-Id")
+	}
+	return true
+}
+
+// withCORS answers OPTIONS requests, including preflights, and adds CORS headers to
+// responses for the allowed origins. The mux only routes GET and HEAD, so without this
+// an OPTIONS request would get a 405.
+func withCORS(next http.Handler, allowed []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allowedMethods)
+			if len(allowed) > 0 && r.Header.Get("Access-Control-Request-Method") != "" {
+				setCORSHeaders(w.Header(), allowed, origin, true, r.Header.Get("Access-Control-Request-Headers"))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if len(allowed) > 0 {
+			setCORSHeaders(w.Header(), allowed, origin, false, "")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
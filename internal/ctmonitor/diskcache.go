@@ -0,0 +1,193 @@
+package ctmonitor
+
+import (
+	"container/list"
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCache keeps the immutable objects fetched from a remote store, full tiles and
+// issuers, in a local directory, so a restarted monitor doesn't have to download its
+// whole hot set again. The least recently used objects are evicted once the directory
+// grows past maxBytes. Recency survives restarts through the files' modification times.
+type DiskCache struct {
+	Storage
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // of *diskCacheEntry, most recently used first
+	index map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewDiskCache wraps s with a cache in dir, picking up anything already cached there.
+func NewDiskCache(s Storage, dir string, maxBytes int64) (*DiskCache, error) {
+	c := &DiskCache{
+		Storage:  s,
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		index:    make(map[string]*list.Element),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	type cached struct {
+		diskCacheEntry
+		modified time.Time
+	}
+	var found []cached
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		// Leftovers from a write that was interrupted
+		if !diskCacheable(key) {
+			return os.Remove(path)
+		}
+		found = append(found, cached{diskCacheEntry{key, info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].modified.After(found[j].modified) })
+	for _, f := range found {
+		c.index[f.key] = c.lru.PushBack(&f.diskCacheEntry)
+		c.size += f.size
+	}
+	c.evict()
+	slog.Info("Loaded disk cache", "dir", dir, "objects", len(found), "bytes", c.size)
+	return c, nil
+}
+
+// diskCacheable reports whether the object at key can never change. Partial tiles are
+// also immutable, but are superseded so quickly that caching them is a waste of space.
+func diskCacheable(key string) bool {
+	if strings.Contains(key, "..") {
+		return false
+	}
+	return (strings.HasPrefix(key, "tile/") && !strings.Contains(key, ".p/")) ||
+		strings.HasPrefix(key, "issuer/")
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(key))
+}
+
+func (c *DiskCache) Get(ctx context.Context, key string) (data []byte, notfounderr bool, err error) {
+	if !diskCacheable(key) {
+		return c.Storage.Get(ctx, key)
+	}
+
+	c.mu.Lock()
+	elem, ok := c.index[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	cacheLookup("disk", ok)
+
+	if ok {
+		data, err := os.ReadFile(c.path(key))
+		if err == nil {
+			now := time.Now()
+			os.Chtimes(c.path(key), now, now)
+			return data, false, nil
+		}
+		// Fall through to the store if the file went missing
+		slog.WarnContext(ctx, "Unable to read from disk cache", "key", key, "error", err)
+		c.remove(key)
+	}
+
+	data, notfounderr, err = c.Storage.Get(ctx, key)
+	if err != nil || notfounderr {
+		return data, notfounderr, err
+	}
+	if err := c.put(key, data); err != nil {
+		slog.WarnContext(ctx, "Unable to write to disk cache", "key", key, "error", err)
+	}
+	return data, false, nil
+}
+
+// put writes the object to a temporary file first, so that a crash never leaves a
+// truncated object behind under its real name.
+func (c *DiskCache) put(key string, data []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.index[key]; ok {
+		// Another request fetched it at the same time
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	c.index[key] = c.lru.PushFront(&diskCacheEntry{key, int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+func (c *DiskCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.index[key]; ok {
+		c.size -= elem.Value.(*diskCacheEntry).size
+		c.lru.Remove(elem)
+		delete(c.index, key)
+	}
+}
+
+// evict removes the least recently used objects until the cache fits. c.mu must be held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*diskCacheEntry)
+		delete(c.index, entry.key)
+		c.size -= entry.size
+		if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Unable to evict from disk cache", "key", entry.key, "error", err)
+		}
+	}
+}
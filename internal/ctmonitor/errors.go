@@ -0,0 +1,91 @@
+package ctmonitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorResponse is the body of every error returned by the monitor. Reason is one of a
+// fixed set of strings, so clients can match on it instead of parsing the message.
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+const (
+	reasonMissingParameter   = "missing_parameter"
+	reasonInvalidParameter   = "invalid_parameter"
+	reasonOutOfRange         = "out_of_range"
+	reasonNotFound           = "not_found"
+	reasonStorageUnavailable = "storage_unavailable"
+	reasonInternal           = "internal_error"
+	// The STH or checkpoint in the bucket failed verification against the log's key
+	reasonIntegrity = "integrity_check_failed"
+	// The client or the monitor as a whole is over its rate limit
+	reasonRateLimited = "rate_limited"
+)
+
+type reasonError struct {
+	reason string
+	err    error
+}
+
+func (e reasonError) Error() string { return e.err.Error() }
+func (e reasonError) Unwrap() error { return e.err }
+
+func withReason(reason string, err error) error {
+	return reasonError{reason, err}
+}
+
+func missingParam(name string) error {
+	return withReason(reasonMissingParameter, fmt.Errorf("missing %s parameter", name))
+}
+
+func invalidParam(name string, err error) error {
+	return withReason(reasonInvalidParameter, fmt.Errorf("invalid %s parameter: %w", name, err))
+}
+
+func storageError(err error) error {
+	return withReason(reasonStorageUnavailable, err)
+}
+
+func isStorageError(err error) bool {
+	var re reasonError
+	return errors.As(err, &re) && re.reason == reasonStorageUnavailable
+}
+
+// errorBody builds the JSON body for an error. If the error doesn't carry a reason,
+// one is picked based on the status code.
+func errorBody(code int, err error) []byte {
+	resp := ErrorResponse{Error: err.Error()}
+
+	var re reasonError
+	switch {
+	case errors.As(err, &re):
+		resp.Reason = re.reason
+	case code == http.StatusNotFound:
+		resp.Reason = reasonNotFound
+	case code == http.StatusServiceUnavailable:
+		resp.Reason = reasonStorageUnavailable
+	case code >= 500:
+		resp.Reason = reasonInternal
+	default:
+		resp.Reason = reasonInvalidParameter
+	}
+
+	body, _ := json.Marshal(resp)
+	return body
+}
+
+// writeError writes err as JSON. A 503 means the tile storage couldn't be reached,
+// so clients are asked to come back later.
+func writeError(w http.ResponseWriter, code int, err error) {
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "30")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(errorBody(code, err))
+}
@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net/url"
 	"os"
 	"strconv"
@@ -17,16 +16,98 @@ import (
 	"github.com/fastly/compute-sdk-go/cache/simple"
 	"github.com/fastly/compute-sdk-go/configstore"
 	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+	"itko.dev/internal/sunlight"
 )
 
-// The log needs two configs, the backend service name and the mask size.
-// These can be fetched from edge config but for now we will hard code them.
+// Each host served maps to the name of its backend in the config store, or a comma
+// separated list of backends serving copies of the same bucket, in order of preference.
+// The rest of a log's config is read from "<host>/<name>" keys in the same store, so a
+// log can be added or changed without a redeploy. Missing keys fall back to the defaults
+// below.
 const configStoreName = "hostmap"
-const maskSize = 5
-const requestLimit = 10
+
+// The mask size of the log's k-anon hash index, from "<host>/mask-size". The layout
+// version and segment size are read from "<host>/index-layout-version" and
+// "<host>/index-segment-size", and default to the original layout.
+const defaultFastlyMaskSize = 5
+
+// Fastly limits how many backend requests one request can make, from "<host>/request-limit"
+const defaultFastlyRequestLimit = 10
+
+// Limit get-entries to 75 by default, as each issuer fetch counts against the request
+// limit. This can be overridden with "<host>/max-get-entries".
+const defaultFastlyMaxGetEntries = 75
+
+// fastlyConfigInt reads a positive integer for host from the config store, or returns
+// the default if it is missing or invalid.
+func fastlyConfigInt(config *configstore.Store, host, name string, def int) int {
+	v, err := config.Get(host + "/" + name)
+	if err != nil {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s for %s: %q\n", name, host, v)
+		return def
+	}
+	return n
+}
+
+// If a KV store with this name is linked to the service, leaf indexes found in the
+// hashes index are kept in it, so get-proof-by-hash for a hash that was already looked up
+// doesn't download and search the k-anon file again, which takes up the request budget.
+const kvStoreName = "hashindex"
+
+type fastlyHashIndexCache struct {
+	store   *kvstore.Store
+	backend string
+}
+
+func (c fastlyHashIndexCache) key(hash []byte) string {
+	// Keyed by backend, as each backend is a different log
+	return fmt.Sprintf("%s/%x", c.backend, hash)
+}
+
+func (c fastlyHashIndexCache) get(ctx context.Context, hash []byte) (int64, bool) {
+	entry, err := c.store.Lookup(c.key(hash))
+	if err != nil {
+		if !errors.Is(err, kvstore.ErrKeyNotFound) {
+			log.Printf("Error looking up hash index: %v\n", err)
+		}
+		return 0, false
+	}
+	index, err := strconv.ParseInt(entry.String(), 10, 64)
+	if err != nil {
+		log.Printf("Invalid hash index entry for %s: %v\n", c.key(hash), err)
+		return 0, false
+	}
+	return index, true
+}
+
+func (c fastlyHashIndexCache) put(ctx context.Context, hash []byte, index int64) {
+	if err := c.store.Insert(c.key(hash), strings.NewReader(strconv.FormatInt(index, 10))); err != nil {
+		log.Printf("Error caching hash index: %v\n", err)
+	}
+}
+
+// The read path only serves public data, so any origin may call it
+var corsOrigins = []string{"*"}
 
 func FastlyServe(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
-	if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" || r.Method == "DELETE" {
+	origin := r.Header.Get("Origin")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", allowedMethods)
+		if r.Header.Get("Access-Control-Request-Method") != "" {
+			setCORSHeaders(w.Header(), corsOrigins, origin, true, r.Header.Get("Access-Control-Request-Headers"))
+		}
+		w.WriteHeader(fsthttp.StatusNoContent)
+		return
+	}
+	setCORSHeaders(w.Header(), corsOrigins, origin, false, "")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", allowedMethods)
 		w.WriteHeader(fsthttp.StatusMethodNotAllowed)
 		fmt.Fprintf(w, "This method is not allowed\n")
 		return
@@ -39,28 +120,54 @@ func FastlyServe(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Reque
 		return
 	}
 
-	backend, err := config.Get(r.Host)
+	backendList, err := config.Get(r.Host)
 	if err != nil {
 		w.WriteHeader(fsthttp.StatusNotFound)
 		fmt.Fprintln(w, "Backend not found!!!")
 		return
 	}
+	var backends []string
+	for _, backend := range strings.Split(backendList, ",") {
+		backends = append(backends, strings.TrimSpace(backend))
+	}
 
 	s := &FastlyStorage{
-		backend:  backend,
+		backends: backends,
 		cache:    make(map[string]*CacheEntry),
 		requests: 0,
+		limit:    fastlyConfigInt(config, r.Host, "request-limit", defaultFastlyRequestLimit),
+	}
+	indexLayout := sunlight.IndexLayout{
+		Version:     fastlyConfigInt(config, r.Host, "index-layout-version", 0),
+		Mask:        fastlyConfigInt(config, r.Host, "mask-size", defaultFastlyMaskSize),
+		SegmentSize: fastlyConfigInt(config, r.Host, "index-segment-size", 0),
+	}
+	if err := indexLayout.Validate(); err != nil {
+		fastlyError(w, r, fsthttp.StatusInternalServerError, fmt.Errorf("invalid index layout for %s: %w", r.Host, err))
+		return
+	}
+	maxGetEntries := fastlyConfigInt(config, r.Host, "max-get-entries", defaultFastlyMaxGetEntries)
+	// Each request is handled by a fresh instance, so there is nothing to cache the STH in
+	f := newFetch(s, indexLayout, maxGetEntries, &sthCache{})
+	f.mirrored = fastlyConfigInt(config, r.Host, "mirrored-entries", 0) != 0
+	if kv, err := kvstore.Open(kvStoreName); err == nil {
+		f.hashIndexes = fastlyHashIndexCache{store: kv, backend: backends[0]}
+	} else if !errors.Is(err, kvstore.ErrStoreNotFound) {
+		log.Printf("Error opening KV store: %v\n", err)
 	}
-	f := newFetch(s, maskSize, 75) // Limit get-entries to 75
 
 	if r.URL.Path == "/ct/v1/get-sth-consistency" {
-		FastlyWrapper(f.get_sth_consistency)(ctx, w, r)
+		FastlyWrapper(fastlyCachedProof(backends[0], "consistency", f.get_sth_consistency))(ctx, w, r)
 	} else if r.URL.Path == "/ct/v1/get-proof-by-hash" {
-		FastlyWrapper(f.get_proof_by_hash)(ctx, w, r)
+		FastlyWrapper(fastlyCachedProof(backends[0], "hash", f.get_proof_by_hash))(ctx, w, r)
 	} else if r.URL.Path == "/ct/v1/get-entries" {
-		FastlyWrapper(f.get_entries)(ctx, w, r)
+		FastlyGetEntries(f)(ctx, w, r)
 	} else if r.URL.Path == "/ct/v1/get-entry-and-proof" {
 		FastlyWrapper(f.get_entry_and_proof)(ctx, w, r)
+	} else if r.URL.Path == "/sth-history" {
+		FastlyWrapper(f.get_sth_history)(ctx, w, r)
+	} else if r.URL.Path == "/sth" {
+		FastlyWrapper(f.get_archived_sth)(ctx, w, r)
 	} else {
 		w.WriteHeader(fsthttp.StatusNotFound)
 		fmt.Fprintln(w, "Not found!!!")
@@ -68,36 +175,199 @@ func FastlyServe(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Reque
 	}
 }
 
+// A proof for a given tree size never changes, so computed proofs are kept in the edge
+// cache, and a monitor verifying a proof another monitor already asked for costs no
+// backend requests. The TTL only bounds how long unpopular proofs take up space.
+const fastlyProofTTL = 24 * time.Hour
+
+// fastlyCachedProof caches successful responses, keyed by the backend and the query.
+func fastlyCachedProof(backend, kind string, wrapped func(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error)) func(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
+	return func(ctx context.Context, reqBody io.ReadCloser, query url.Values) ([]byte, int, error) {
+		if os.Getenv("FASTLY_HOSTNAME") == "localhost" {
+			return wrapped(ctx, reqBody, query)
+		}
+
+		// Encode sorts the parameters, so the same query always gets the same key
+		key := fmt.Sprintf("%sproof/%s/%s?%s", os.Getenv("FASTLY_SERVICE_VERSION"), backend, kind, query.Encode())
+		code := fsthttp.StatusOK
+		reader, err := simple.GetOrSet([]byte(key), func() (simple.CacheEntry, error) {
+			var resp []byte
+			var err error
+			resp, code, err = wrapped(ctx, reqBody, query)
+			if err != nil {
+				return simple.CacheEntry{}, err
+			}
+			return simple.CacheEntry{Body: bytes.NewReader(resp), TTL: fastlyProofTTL}, nil
+		})
+		if err != nil {
+			// The cache itself failed, rather than the proof
+			if code == fsthttp.StatusOK {
+				code = fsthttp.StatusInternalServerError
+			}
+			return nil, code, err
+		}
+		defer reader.Close()
+		resp, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fsthttp.StatusInternalServerError, err
+		}
+		return resp, fsthttp.StatusOK, nil
+	}
+}
+
+// Fastly compresses responses with this hint set, for clients that accept it
+const fastlyCompressHint = "x-compress-hint"
+
 func FastlyWrapper(wrapped func(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error)) func(c context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
 	return func(c context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
 		query := r.URL.Query()
 		resp, code, err := wrapped(c, r.Body, query)
 
 		if err != nil {
-			if code == fsthttp.StatusServiceUnavailable {
-				w.Header().Set("Retry-After", fmt.Sprintf("%d", 30+rand.Intn(60)))
-				fsthttp.Error(w, "pool full", code)
-			} else {
-				fsthttp.Error(w, err.Error(), code)
-			}
+			fastlyError(w, r, code, err)
+			return
+		}
 
-			log.Println("Error:", err, "Code:", code, "URL:", r.URL)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+		w.Header().Set(fastlyCompressHint, "on")
+		w.WriteHeader(code)
+		// A HEAD request gets the same headers as a GET, but no body
+		if r.Method == "HEAD" {
+			return
+		}
+		if _, err = w.Write(resp); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	}
+}
 
+// FastlyGetEntries streams the entries into the response as they are encoded, instead of
+// buffering the whole response, to stay well within the memory limit of an instance.
+func FastlyGetEntries(f Fetch) func(c context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
+	return func(c context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
+		entries, issuers, code, err := f.entriesInRange(c, r.URL.Query())
+		if err != nil {
+			fastlyError(w, r, code, err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(fastlyCompressHint, "on")
 		w.WriteHeader(code)
-		if _, err = w.Write(resp); err != nil {
+		if r.Method == "HEAD" {
+			return
+		}
+		if err := writeEntries(w, entries, issuers); err != nil {
+			// The status has already been sent, and the client will fail to parse the
+			// truncated body
 			log.Printf("Error writing response: %v", err)
 		}
 	}
 }
 
+func fastlyError(w fsthttp.ResponseWriter, r *fsthttp.Request, code int, err error) {
+	if code == fsthttp.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "30")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(errorBody(code, err))
+
+	log.Println("Error:", err, "Code:", code, "URL:", r.URL)
+}
+
 type FastlyStorage struct {
-	backend  string
+	// The primary backend first, then the ones to fail over to
+	backends []string
 	cache    map[string]*CacheEntry
+	// The number of requests made to the backends, and the number allowed
 	requests int
+	limit    int
+}
+
+// A backend that returned a 5xx or couldn't be reached is tried last by every request on
+// the POP for this long, so they don't all wait on it before failing over.
+const backendDownTTL = 30 * time.Second
+
+func backendDownKey(backend string) []byte {
+	return []byte("backend-down/" + backend)
+}
+
+// backendDown reports whether a backend is failing its Fastly health check, or was marked
+// as down by a recent request.
+func backendDown(backend string) bool {
+	if b, err := fsthttp.BackendFromName(backend); err == nil {
+		if health, err := b.Health(); err == nil && health == fsthttp.BackendHealthUnhealthy {
+			return true
+		}
+	}
+	if os.Getenv("FASTLY_HOSTNAME") == "localhost" {
+		return false
+	}
+	marker, err := simple.Get(backendDownKey(backend))
+	if err != nil {
+		return false
+	}
+	marker.Close()
+	return true
+}
+
+func markBackendDown(backend string) {
+	if os.Getenv("FASTLY_HOSTNAME") == "localhost" {
+		return
+	}
+	marker, err := simple.GetOrSetEntry(backendDownKey(backend), simple.CacheEntry{
+		Body: strings.NewReader("down"),
+		TTL:  backendDownTTL,
+	})
+	if err != nil {
+		log.Printf("Error marking backend %s as down: %v\n", backend, err)
+		return
+	}
+	marker.Close()
+}
+
+// send fetches the key from the first backend that is up, failing over to the next one
+// on a 5xx or a network error. Backends that are down are still tried after the others,
+// in case they have all failed. Each attempt counts against the request budget.
+func (f *FastlyStorage) send(ctx context.Context, key string) (*fsthttp.Response, error) {
+	var up, down []string
+	for _, backend := range f.backends {
+		if backendDown(backend) {
+			down = append(down, backend)
+		} else {
+			up = append(up, backend)
+		}
+	}
+
+	var lastErr error
+	for _, backend := range append(up, down...) {
+		if f.requests >= f.limit {
+			return nil, errRequestBudget
+		}
+		f.requests++
+
+		req, err := fsthttp.NewRequest("GET", fmt.Sprintf("https://%s/%s", backend, key), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.CacheOptions = fsthttp.CacheOptions{
+			Pass: true,
+		}
+		resp, err := req.Send(ctx, backend)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("backend %s returned %s", backend, fsthttp.StatusText(resp.StatusCode))
+		}
+		log.Printf("Error fetching %s: %v\n", key, err)
+		markBackendDown(backend)
+		lastErr = err
+	}
+	return nil, lastErr
 }
 
 type CacheEntry struct {
@@ -105,10 +375,6 @@ type CacheEntry struct {
 	body   []byte
 }
 
-func (f *FastlyStorage) AvailableReqs() int {
-	return requestLimit - f.requests
-}
-
 func (f *FastlyStorage) Get(ctx context.Context, key string) (data []byte, notfounderr bool, err error) {
 	if data, ok := f.cache[key]; ok {
 		if data.status == 404 {
@@ -119,21 +385,15 @@ func (f *FastlyStorage) Get(ctx context.Context, key string) (data []byte, notfo
 		return data.body, false, nil
 	}
 
-	url := fmt.Sprintf("https://%s/%s", f.backend, key)
+	// Every backend serves the same objects, so they share a cache key
+	url := fmt.Sprintf("https://%s/%s", f.backends[0], key)
 
 	notFound := false
 
+	// Only called when the object isn't in the edge cache, so only fetches that
+	// really go to the origin count against the budget
 	cacheFunc := func() (simple.CacheEntry, error) {
-		f.requests++
-
-		req, err := fsthttp.NewRequest("GET", url, nil)
-		req.CacheOptions = fsthttp.CacheOptions{
-			Pass: true,
-		}
-		if err != nil {
-			return simple.CacheEntry{}, err
-		}
-		resp, err := req.Send(ctx, f.backend)
+		resp, err := f.send(ctx, key)
 		if err != nil {
 			return simple.CacheEntry{}, err
 		}
@@ -1,11 +1,14 @@
 package ctmonitor
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"time"
 
 	ct "github.com/google/certificate-transparency-go"
 	"golang.org/x/mod/sumdb/tlog"
@@ -14,16 +17,47 @@ import (
 
 type Fetch struct {
 	s           Storage
-	maskSize    int
+	indexLayout sunlight.IndexLayout
+	// Set for a mirror or a migrated Trillian log, whose entries have no leaf_index
+	mirrored    bool
 	maxGetEntry int
+	// Byte budget for a get-entries response. Zero means DefaultMaxGetEntriesBytes.
+	maxGetEntryBytes int
+	sth              *sthCache
+	// Only set if the monitor was given the log's public key
+	integrity *integrityChecker
+	// Only set if proofs are cached
+	proofs *proofCache
+	// How long /readyz waits on the storage
+	readyTimeout time.Duration
+	// Only set if hash to index lookups are cached outside the storage
+	hashIndexes hashIndexCache
 }
 
-func newFetch(storage Storage, maskSize, maxGetEntry int) Fetch {
+// hashIndexCache keeps leaf indexes found in the hashes index. A leaf hash never moves to
+// another index, so entries never have to be invalidated. Saves fetching and searching a
+// whole k-anon file when the same hash is looked up again.
+type hashIndexCache interface {
+	get(ctx context.Context, hash []byte) (int64, bool)
+	put(ctx context.Context, hash []byte, index int64)
+}
+
+func newFetch(storage Storage, indexLayout sunlight.IndexLayout, maxGetEntry int, sth *sthCache) Fetch {
 	return Fetch{
-		s:           storage,
-		maskSize:    maskSize,
+		s:           instrumentedStorage{storage},
+		indexLayout: indexLayout,
 		maxGetEntry: maxGetEntry,
+		sth:         sth,
+	}
+}
+
+// parseTileEntries parses a data tile of the log, which only has entries without a
+// leaf_index extension if mirrored is set.
+func parseTileEntries(tile tlog.Tile, data []byte, mirrored bool) iter.Seq2[*sunlight.LogEntry, error] {
+	if mirrored {
+		return sunlight.ParseMirroredTileEntries(tile, data)
 	}
+	return sunlight.ParseTileEntries(tile, data)
 }
 
 func (f *Fetch) get(ctx context.Context, key string) ([]byte, error) {
@@ -32,16 +66,30 @@ func (f *Fetch) get(ctx context.Context, key string) ([]byte, error) {
 }
 
 func (f *Fetch) getSth(ctx context.Context) (ct.SignedTreeHead, error) {
-	sthBytes, err := f.get(ctx, "ct/v1/get-sth")
-	if err != nil {
-		return ct.SignedTreeHead{}, err
+	_, sth, err := f.sth.get(ctx, f.s)
+	return sth, err
+}
+
+// Issuers are stored under their fingerprint, so they never change and can be cached
+// forever. There are only a handful of intermediates, so the cache stays small.
+var issuers sync.Map
+
+func (f *Fetch) getIssuer(ctx context.Context, fp [32]byte) ([]byte, error) {
+	cached, ok := issuers.Load(fp)
+	cacheLookup("issuer", ok)
+	if ok {
+		return cached.([]byte), nil
 	}
-	var sth ct.SignedTreeHead
-	err = json.Unmarshal(sthBytes, &sth)
+	data, err := f.get(ctx, fmt.Sprintf("issuer/%x", fp))
 	if err != nil {
-		return ct.SignedTreeHead{}, err
+		return nil, err
 	}
-	return sth, nil
+	// Don't cache something that isn't what was asked for
+	if sha256.Sum256(data) != fp {
+		return nil, fmt.Errorf("issuer %x does not match its fingerprint", fp)
+	}
+	issuers.Store(fp, data)
+	return data, nil
 }
 
 func (f *Fetch) getTile(ctx context.Context, tile tlog.Tile) ([]byte, error) {
@@ -68,32 +116,43 @@ const (
 	RHULeafIndexSize = 5
 )
 
-// TODO: convert these to use binary search
 func (f *Fetch) getIndexForHash(ctx context.Context, hash []byte) (int64, error) {
-	// check if hash is 32 bytes
+	// The index is keyed by the first 16 bytes of the leaf hash
 	if len(hash) != RHUHashSize {
-		return 0, errors.New("hash must be 32 bytes")
+		return 0, fmt.Errorf("hash must be %d bytes", RHUHashSize)
+	}
+
+	if f.hashIndexes != nil {
+		index, ok := f.hashIndexes.get(ctx, hash)
+		cacheLookup("hash_index", ok)
+		if ok {
+			return index, nil
+		}
 	}
 
-	path := sunlight.KAnonHashPath(hash, f.maskSize)
+	path := f.indexLayout.Path(hash)
 	file, err := f.get(ctx, "int/hashes/"+path)
 	if err != nil {
 		return 0, err
 	}
 
-	recordCount := len(file) / RHURecordSize
-
-	for i := 0; i < recordCount; i++ {
-		if bytes.Equal(hash[:], file[i*RHURecordSize:(i*RHURecordSize)+RHUHashSize]) {
-			// Create a buffer for the full 64-bit timestamp
-			fullIndxeBytes := make([]byte, 8)
-			// Copy the 5 bytes to the buffer
-			copy(fullIndxeBytes[0:5], file[(i*RHURecordSize)+RHUHashSize:(i+1)*RHURecordSize])
-			// Convert to uint64
-			leafIndex := binary.LittleEndian.Uint64(fullIndxeBytes)
+	records, err := sunlight.IndexRecords(file, RHURecordSize)
+	if err != nil {
+		return 0, err
+	}
+	i, found := sunlight.SearchIndex(records, RHURecordSize, hash)
+	if found {
+		// Create a buffer for the full 64-bit timestamp
+		fullIndxeBytes := make([]byte, 8)
+		// Copy the 5 bytes to the buffer
+		copy(fullIndxeBytes[0:5], records[(i*RHURecordSize)+RHUHashSize:(i+1)*RHURecordSize])
+		// Convert to uint64
+		leafIndex := binary.LittleEndian.Uint64(fullIndxeBytes)
 
-			return int64(leafIndex), nil
+		if f.hashIndexes != nil {
+			f.hashIndexes.put(ctx, hash, int64(leafIndex))
 		}
+		return int64(leafIndex), nil
 	}
 
 	return 0, errors.New("record not found")
@@ -0,0 +1,55 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"itko.dev/internal/sunlight"
+)
+
+func TestGetIndexForHash(t *testing.T) {
+	layout := sunlight.IndexLayout{Mask: 5}
+	record := func(hash [RHUHashSize]byte, index uint64) []byte {
+		b := binary.LittleEndian.AppendUint64(hash[:], index)
+		return b[:RHURecordSize]
+	}
+	first := [RHUHashSize]byte{0xab, 0xcd, 0xe0, 0x01}
+	last := [RHUHashSize]byte{0xab, 0xcd, 0xe0, 0xff}
+	file := sunlight.IndexHeader(RHURecordSize)
+	file = append(file, record(first, 3)...)
+	file = append(file, record([RHUHashSize]byte{0xab, 0xcd, 0xe0, 0x80}, 1<<33)...)
+	file = append(file, record(last, 9)...)
+	f := &Fetch{
+		s:           memStorage{"int/hashes/" + layout.Path(first[:]): file},
+		indexLayout: layout,
+	}
+
+	tests := []struct {
+		name string
+		hash []byte
+		// -1 if the lookup fails
+		want int64
+	}{
+		{"first", first[:], 3},
+		{"over 32 bits", []byte{0xab, 0xcd, 0xe0, 0x80, 15: 0}, 1 << 33},
+		{"last", last[:], 9},
+		{"absent", []byte{0xab, 0xcd, 0xe0, 0x02, 15: 0}, -1},
+		{"full leaf hash", make([]byte, 32), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.getIndexForHash(context.Background(), tt.hash)
+			switch {
+			case tt.want < 0 && err == nil:
+				t.Errorf("getIndexForHash = %d, want an error", got)
+			case tt.want >= 0 && (err != nil || got != tt.want):
+				t.Errorf("getIndexForHash = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := f.getIndexForHash(context.Background(), make([]byte, 32)); err == nil || err.Error() != "hash must be 16 bytes" {
+		t.Errorf("getIndexForHash of a full leaf hash = %v, want the size it expects", err)
+	}
+}
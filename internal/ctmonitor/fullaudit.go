@@ -0,0 +1,411 @@
+package ctmonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"golang.org/x/sync/errgroup"
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/sunlight"
+)
+
+// The background auditor only looks at the tiles each new STH adds. FullAudit instead reads
+// every object of the log, to check a bucket before and after a migration or an incident.
+
+// AuditReport is the result of FullAudit. The log is intact if it has no problems.
+type AuditReport struct {
+	TreeSize int64  `json:"treeSize"`
+	RootHash []byte `json:"rootHash"`
+	// Whether the STH and checkpoint signatures were checked, which needs the public key
+	SignaturesVerified bool `json:"signaturesVerified"`
+
+	DataTiles int64 `json:"dataTiles"`
+	Leaves    int64 `json:"leaves"`
+	Issuers   int   `json:"issuers"`
+	// Zero if the indexes weren't checked
+	HashIndexFiles   int `json:"hashIndexFiles"`
+	DedupeIndexFiles int `json:"dedupeIndexFiles"`
+	// Index records for leaves past the tree size. These are expected while the log is
+	// running, since the indexes are written around the STH.
+	PendingRecords int `json:"pendingRecords"`
+
+	OK bool `json:"ok"`
+	// Only the first maxAuditProblems are kept, but all of them are counted
+	ProblemCount int            `json:"problemCount"`
+	Problems     []AuditProblem `json:"problems"`
+}
+
+// AuditProblem is something wrong with one object in the storage.
+type AuditProblem struct {
+	Object  string `json:"object"`
+	Problem string `json:"problem"`
+}
+
+const maxAuditProblems = 1000
+
+// FullAudit checks the whole log in the storage: that the STH and checkpoint agree and are
+// signed by PublicKey if it is set, that every data tile parses and each leaf hashes to the
+// tree tiles, which hash up to the STH's root hash, and that every issuer the entries refer
+// to is there. If indexes is set, the records of the hash and dedupe indexes are checked to
+// point at the leaves they were made from, and every leaf to be in both.
+//
+// Something wrong with the log is reported as a problem, and the audit carries on. An
+// error is only returned if the audit couldn't be done, such as if the storage is down.
+func FullAudit(ctx context.Context, c Config, concurrency int, indexes bool) (*AuditReport, error) {
+	if c.KVPath != "" {
+		store, err := coordination.New(c.Coordination)
+		if err != nil {
+			return nil, err
+		}
+		cc, _, err := fetchKVConfig(ctx, store, c.Coordination, c.KVPath+"/config", 0)
+		if err != nil {
+			return nil, err
+		}
+		c = cc.apply(c)
+	}
+
+	layout := sunlight.IndexLayout{Version: c.IndexLayoutVersion, Mask: c.MaskSize, SegmentSize: c.IndexSegmentSize}
+	if indexes {
+		if err := layout.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid index layout: %w", err)
+		}
+	}
+	s, err := c.storage()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &fullAudit{s: s, layout: layout, mirrored: c.MirroredEntries, concurrency: max(concurrency, 1), issuers: make(map[[32]byte]bool)}
+	if err := a.run(ctx, c, indexes); err != nil {
+		return nil, err
+	}
+	a.report.OK = a.report.ProblemCount == 0
+	if a.report.Problems == nil {
+		a.report.Problems = []AuditProblem{}
+	}
+	return &a.report, nil
+}
+
+type fullAudit struct {
+	s           Storage
+	layout      sunlight.IndexLayout
+	mirrored    bool
+	concurrency int
+
+	tree   tlog.Tree
+	reader tlog.HashReader
+
+	mu      sync.Mutex
+	report  AuditReport
+	issuers map[[32]byte]bool
+	// Whether each data tile was verified. The leaves of the others are left out of the
+	// index check, since a problem has already been reported for them.
+	verified []bool
+
+	// What each leaf is indexed by, kept if the indexes are checked
+	recordHashes [][16]byte
+	certFps      [][16]byte
+	timestamps   []int64
+}
+
+func (a *fullAudit) problem(object string, format string, args ...any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.report.ProblemCount++
+	if len(a.report.Problems) < maxAuditProblems {
+		a.report.Problems = append(a.report.Problems, AuditProblem{Object: object, Problem: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (a *fullAudit) run(ctx context.Context, c Config, indexes bool) error {
+	ok, err := a.checkHeads(ctx, c)
+	if err != nil || !ok {
+		return err
+	}
+	if err := a.checkDataTiles(ctx, indexes); err != nil {
+		return err
+	}
+	if err := a.checkIssuers(ctx); err != nil {
+		return err
+	}
+	if !indexes {
+		return nil
+	}
+	a.report.HashIndexFiles, err = a.checkIndex(ctx, "int/hashes/", RHURecordSize, a.recordHashes, nil)
+	if err != nil {
+		return err
+	}
+	a.report.DedupeIndexFiles, err = a.checkIndex(ctx, "int/dedupe/", DDURecordSize, a.certFps, a.timestamps)
+	return err
+}
+
+// checkHeads checks the STH and checkpoint, and sets the tree the rest of the audit is
+// done against. It returns false if there is no STH to audit against.
+func (a *fullAudit) checkHeads(ctx context.Context, c Config) (bool, error) {
+	integrity, err := newIntegrityChecker(c)
+	if err != nil {
+		return false, err
+	}
+	a.report.SignaturesVerified = integrity != nil
+
+	raw, _, err := a.s.Get(ctx, "ct/v1/get-sth")
+	if err != nil {
+		return false, fmt.Errorf("unable to fetch STH: %w", err)
+	}
+	var sth ct.SignedTreeHead
+	if err := json.Unmarshal(raw, &sth); err != nil {
+		a.problem("ct/v1/get-sth", "unable to unmarshal STH: %v", err)
+		return false, nil
+	}
+	if integrity != nil {
+		if err := integrity.verifier.VerifySTHSignature(sth); err != nil {
+			a.problem("ct/v1/get-sth", "%v: STH: %v", errInvalidSignature, err)
+		}
+	}
+	a.tree = tlog.Tree{N: int64(sth.TreeSize), Hash: tlog.Hash(sth.SHA256RootHash)}
+	a.reader = tlog.TileHashReader(a.tree, a.tileReader(ctx))
+	a.report.TreeSize = a.tree.N
+	a.report.RootHash = a.tree.Hash[:]
+
+	// The checkpoint is published after the STH, so it may be for an older tree, which
+	// must then be a prefix of the STH's
+	checkpoint, _, err := a.s.Get(ctx, "checkpoint")
+	if err != nil {
+		return false, fmt.Errorf("unable to fetch checkpoint: %w", err)
+	}
+	if integrity != nil {
+		if _, err := integrity.verifyCheckpoint(checkpoint); err != nil {
+			a.problem("checkpoint", "%v", err)
+		}
+	}
+	body, _, _ := strings.Cut(string(checkpoint), "\n\n")
+	cp, err := sunlight.ParseCheckpoint(body + "\n")
+	switch {
+	case err != nil:
+		a.problem("checkpoint", "unable to parse checkpoint: %v", err)
+	case cp.N > a.tree.N:
+		a.problem("checkpoint", "checkpoint size %d is larger than the STH size %d", cp.N, a.tree.N)
+	case cp.N == a.tree.N:
+		if cp.Hash != a.tree.Hash {
+			a.problem("checkpoint", "checkpoint and STH have different root hashes at size %d", cp.N)
+		}
+	case cp.N == 0:
+		// tlog leaves the hash of an empty tree as zero, rather than RFC 6962's
+		if cp.Hash != tlog.Hash(sha256.Sum256(nil)) {
+			a.problem("checkpoint", "checkpoint of an empty tree has the wrong root hash")
+		}
+	default:
+		hash, err := tlog.TreeHash(cp.N, a.reader)
+		if isStorageError(err) {
+			return false, err
+		} else if err != nil {
+			a.problem("checkpoint", "unable to hash the tree at the checkpoint size %d: %v", cp.N, err)
+		} else if hash != cp.Hash {
+			a.problem("checkpoint", "checkpoint at size %d isn't a prefix of the STH", cp.N)
+		}
+	}
+	return true, nil
+}
+
+// tileReader is like the package's tileReader, but keeps the tiles above level zero, which
+// the TileHashReader would otherwise fetch again for every data tile under them.
+func (a *fullAudit) tileReader(ctx context.Context) *sunlight.TileReader {
+	var cache sync.Map
+	return &sunlight.TileReader{
+		Fetch: func(key string) ([]byte, error) {
+			if data, ok := cache.Load(key); ok {
+				return data.([]byte), nil
+			}
+			data, _, err := a.s.Get(ctx, key)
+			if err != nil {
+				return nil, storageError(fmt.Errorf("unable to fetch %s: %w", key, err))
+			}
+			if !strings.HasPrefix(key, "tile/0/") {
+				cache.Store(key, data)
+			}
+			return data, nil
+		},
+		SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {},
+	}
+}
+
+// checkDataTiles verifies every data tile against the tree, and collects the issuers and,
+// if indexes is set, what each leaf should be indexed by.
+func (a *fullAudit) checkDataTiles(ctx context.Context, indexes bool) error {
+	tiles := (a.tree.N + sunlight.TileWidth - 1) / sunlight.TileWidth
+	a.verified = make([]bool, tiles)
+	if indexes {
+		a.recordHashes = make([][16]byte, a.tree.N)
+		a.certFps = make([][16]byte, a.tree.N)
+		a.timestamps = make([]int64, a.tree.N)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(a.concurrency)
+	for n := range tiles {
+		g.Go(func() error {
+			entries, err := verifyDataTile(gctx, a.s, a.reader, a.tree, n, a.mirrored)
+			if isStorageError(err) {
+				return err
+			} else if err != nil {
+				tile := tlog.Tile{H: sunlight.TileHeight, L: -1, N: n, W: int(min(a.tree.N-n*sunlight.TileWidth, sunlight.TileWidth))}
+				a.problem(sunlight.Path(tile), "%v", err)
+				return nil
+			}
+
+			for _, e := range entries {
+				if indexes {
+					recordHash := tlog.RecordHash(e.MerkleTreeLeaf())
+					a.recordHashes[e.LeafIndex] = [16]byte(recordHash[:16])
+					a.certFps[e.LeafIndex] = [16]byte(e.CertificateFp[:16])
+					a.timestamps[e.LeafIndex] = e.Timestamp
+				}
+			}
+
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.verified[n] = true
+			a.report.DataTiles++
+			a.report.Leaves += int64(len(entries))
+			for _, e := range entries {
+				for _, fp := range e.ChainFp {
+					a.issuers[fp] = true
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// checkIssuers checks that every issuer referred to by an entry is stored under its
+// fingerprint.
+func (a *fullAudit) checkIssuers(ctx context.Context) error {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(a.concurrency)
+	for fp := range a.issuers {
+		g.Go(func() error {
+			key := fmt.Sprintf("issuer/%x", fp)
+			data, notfound, err := a.s.Get(gctx, key)
+			if notfound {
+				a.problem(key, "issuer is missing")
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("unable to fetch %s: %w", key, err)
+			}
+			if sha256.Sum256(data) != fp {
+				a.problem(key, "issuer doesn't match its fingerprint")
+			}
+			return nil
+		})
+	}
+	a.report.Issuers = len(a.issuers)
+	return g.Wait()
+}
+
+// checkIndex reads every file of the index under dir that a leaf should be in. Each record
+// must be in the right file, in order, and match the leaf it points at, and each verified
+// leaf must have exactly one record. The records of the hash index have no timestamp, so
+// timestamps is nil for it. It returns the number of files read.
+func (a *fullAudit) checkIndex(ctx context.Context, dir string, recordSize int, hashes [][16]byte, timestamps []int64) (int, error) {
+	paths := make(map[string]bool)
+	for i := range hashes {
+		if a.verified[i/sunlight.TileWidth] {
+			paths[a.layout.Path(hashes[i][:])] = true
+		}
+	}
+	indexed := make([]bool, len(hashes))
+	// Files that couldn't be read are reported once, rather than for each of their leaves
+	unreadable := make(map[string]bool)
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(a.concurrency)
+	for path := range paths {
+		g.Go(func() error {
+			key := dir + path
+			file, notfound, err := a.s.Get(gctx, key)
+			if err != nil && !notfound {
+				return fmt.Errorf("unable to fetch %s: %w", key, err)
+			}
+			records, err := sunlight.IndexRecords(file, recordSize)
+			if notfound || err != nil {
+				if notfound {
+					a.problem(key, "index file is missing")
+				} else {
+					a.problem(key, "%v", err)
+				}
+				a.mu.Lock()
+				defer a.mu.Unlock()
+				unreadable[path] = true
+				return nil
+			}
+
+			var matched []int64
+			pending := 0
+			for i := 0; i*recordSize < len(records); i++ {
+				record := records[i*recordSize : (i+1)*recordSize]
+				hash := record[:16]
+				leafIndexBytes := make([]byte, 8)
+				copy(leafIndexBytes, record[16:16+5])
+				leaf := int64(binary.LittleEndian.Uint64(leafIndexBytes))
+
+				if i > 0 && bytes.Compare(records[(i-1)*recordSize:(i-1)*recordSize+16], hash) > 0 {
+					a.problem(key, "record %d is out of order", i)
+				}
+				if a.layout.Path(hash) != path {
+					a.problem(key, "record for leaf %d belongs in %s", leaf, dir+a.layout.Path(hash))
+					continue
+				}
+				if leaf >= a.tree.N {
+					pending++
+					continue
+				}
+				if !a.verified[leaf/sunlight.TileWidth] {
+					continue
+				}
+				if !bytes.Equal(hashes[leaf][:], hash) {
+					a.problem(key, "record for leaf %d has the hash of another leaf", leaf)
+					continue
+				}
+				if timestamps != nil && int64(binary.LittleEndian.Uint64(record[16+5:])) != timestamps[leaf] {
+					a.problem(key, "record for leaf %d has the wrong timestamp", leaf)
+					continue
+				}
+				matched = append(matched, leaf)
+			}
+
+			var duplicates []int64
+			a.mu.Lock()
+			a.report.PendingRecords += pending
+			for _, leaf := range matched {
+				if indexed[leaf] {
+					duplicates = append(duplicates, leaf)
+				}
+				indexed[leaf] = true
+			}
+			a.mu.Unlock()
+			for _, leaf := range duplicates {
+				a.problem(key, "leaf %d has more than one record", leaf)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+
+	for i := range hashes {
+		if path := a.layout.Path(hashes[i][:]); a.verified[i/sunlight.TileWidth] && !indexed[i] && !unreadable[path] {
+			a.problem(dir+path, "leaf %d isn't indexed", i)
+		}
+	}
+	return len(paths), nil
+}
@@ -0,0 +1,120 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// The sequencer archives the first STH it issues for each tree size, and lists the
+// sizes in an index split into pages of sunlight.STHIndexPageSize. Logs created
+// before the archive existed only have the STHs issued since.
+
+// STHHistoryResponse is returned by GET /sth-history. If Next is set, there may be
+// more tree sizes, which can be listed by passing it as start.
+type STHHistoryResponse struct {
+	TreeSizes []uint64 `json:"treeSizes"`
+	Next      *uint64  `json:"next,omitempty"`
+}
+
+// getArchivedSth fetches the archived STH for a tree size. found is false if the log
+// never issued an STH for that size.
+func (f *Fetch) getArchivedSth(ctx context.Context, treeSize uint64) (raw []byte, sth ct.SignedTreeHead, found bool, err error) {
+	raw, notfound, err := f.s.Get(ctx, sunlight.STHPath(treeSize))
+	if notfound {
+		return nil, sth, false, nil
+	}
+	if err != nil {
+		return nil, sth, false, err
+	}
+	if err := json.Unmarshal(raw, &sth); err != nil {
+		return nil, sth, false, fmt.Errorf("unable to unmarshal archived STH: %w", err)
+	}
+	return raw, sth, true, nil
+}
+
+// signedRoot returns the root hash the log signed for treeSize, so that proofs can be
+// checked before they are served. signed is false for sizes that were never archived.
+func (f *Fetch) signedRoot(ctx context.Context, current ct.SignedTreeHead, treeSize int64) (root tlog.Hash, signed bool, err error) {
+	if uint64(treeSize) == current.TreeSize {
+		return tlog.Hash(current.SHA256RootHash), true, nil
+	}
+	_, sth, found, err := f.getArchivedSth(ctx, uint64(treeSize))
+	if err != nil || !found {
+		return root, false, err
+	}
+	return tlog.Hash(sth.SHA256RootHash), true, nil
+}
+
+func (f Fetch) get_sth_history(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
+	var start uint64
+	if startStr := query.Get("start"); startStr != "" {
+		start, err = strconv.ParseUint(startStr, 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, invalidParam("start", err)
+		}
+	}
+
+	sth, err := f.getSth(ctx)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, storageError(err)
+	}
+
+	page := start / sunlight.STHIndexPageSize
+	index, notfound, err := f.s.Get(ctx, sunlight.STHIndexPath(page))
+	if err != nil && !notfound {
+		return nil, http.StatusServiceUnavailable, storageError(err)
+	}
+
+	// A page is missing if no pool ended inside it, so that isn't an error
+	var sizes []uint64
+	if !notfound {
+		if err := json.Unmarshal(index, &sizes); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("unable to unmarshal STH index: %w", err)
+		}
+	}
+
+	response := STHHistoryResponse{TreeSizes: make([]uint64, 0, len(sizes))}
+	for _, size := range sizes {
+		if size >= start {
+			response.TreeSizes = append(response.TreeSizes, size)
+		}
+	}
+	if next := (page + 1) * sunlight.STHIndexPageSize; next <= sth.TreeSize {
+		response.Next = &next
+	}
+
+	jsonBytes, err := json.Marshal(response)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return jsonBytes, http.StatusOK, nil
+}
+
+func (f Fetch) get_archived_sth(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
+	treeSizeStr := query.Get("tree_size")
+	if treeSizeStr == "" {
+		return nil, http.StatusBadRequest, missingParam("tree_size")
+	}
+	treeSize, err := strconv.ParseUint(treeSizeStr, 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest, invalidParam("tree_size", err)
+	}
+
+	raw, _, found, err := f.getArchivedSth(ctx, treeSize)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, storageError(err)
+	}
+	if !found {
+		return nil, http.StatusNotFound, fmt.Errorf("no STH was archived for tree size %d", treeSize)
+	}
+	return raw, http.StatusOK, nil
+}
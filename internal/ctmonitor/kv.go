@@ -0,0 +1,148 @@
+package ctmonitor
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"itko.dev/internal/coordination"
+)
+
+// kvConfig mirrors the fields of ctsubmit.GlobalConfig that the monitor uses. Reading
+// them from the same key as the sequencer means the two can't drift apart, which with
+// the mask size meant every hash lookup failed.
+type kvConfig struct {
+	Name             string `json:"name"`
+	CheckpointOrigin string `json:"checkpointOrigin"`
+	MaskSize         int    `json:"maskSize"`
+	RootDirectory    string `json:"rootDirectory"`
+
+	IndexLayoutVersion int `json:"indexLayoutVersion"`
+	IndexSegmentSize   int `json:"indexSegmentSize"`
+
+	MirroredEntries bool `json:"mirroredEntries"`
+
+	S3Bucket                   string `json:"s3Bucket"`
+	S3Region                   string `json:"s3Region"`
+	S3EndpointUrl              string `json:"s3EndpointUrl"`
+	S3StaticCredentialUserName string `json:"s3StaticCredentialUserName"`
+	S3StaticCredentialPassword string `json:"s3StaticCredentialPassword"`
+	S3AddressingStyle          string `json:"s3AddressingStyle"`
+	S3UseAccelerate            bool   `json:"s3UseAccelerate"`
+
+	MonitorMaxBodyBytes int64 `json:"monitorMaxBodyBytes"`
+}
+
+// apply overrides the flags with the config from the KV store. The index layout and body
+// limit always come from there, but the bucket is only used if no storage was given, since
+// the monitor usually reads the tiles through a public URL instead.
+func (cc kvConfig) apply(c Config) Config {
+	if cc.MaskSize > 0 {
+		c.MaskSize = cc.MaskSize
+		c.IndexLayoutVersion = cc.IndexLayoutVersion
+		c.IndexSegmentSize = cc.IndexSegmentSize
+	}
+	if cc.MirroredEntries {
+		c.MirroredEntries = true
+	}
+	// The sequencer signs checkpoints for the name unless an origin is configured
+	if c.Origin == "" {
+		c.Origin = cmp.Or(cc.CheckpointOrigin, cc.Name)
+	}
+	if cc.MonitorMaxBodyBytes > 0 {
+		c.MaxBodyBytes = cc.MonitorMaxBodyBytes
+	}
+	if c.StoreDirectory == "" && c.StoreAddress == "" && c.S3Bucket == "" {
+		c.StoreDirectory = cc.RootDirectory
+		c.S3Bucket = cc.S3Bucket
+		c.S3Region = cc.S3Region
+		c.S3EndpointUrl = cc.S3EndpointUrl
+		c.S3StaticCredentialUserName = cc.S3StaticCredentialUserName
+		c.S3StaticCredentialPassword = cc.S3StaticCredentialPassword
+		c.S3AddressingStyle = cc.S3AddressingStyle
+		c.S3UseAccelerate = cc.S3UseAccelerate
+	}
+	return c
+}
+
+func fetchKVConfig(ctx context.Context, store coordination.Store, coord coordination.Config, configpath string, waitIndex uint64) (kvConfig, uint64, error) {
+	var cc kvConfig
+	e, err := store.Watch(ctx, configpath, waitIndex)
+	if err != nil {
+		return cc, 0, err
+	}
+	if !e.Exists() {
+		return cc, e.Index, fmt.Errorf("no configuration found at %s", configpath)
+	}
+	if err := coord.DecodeConfig(e.Value, &cc); err != nil {
+		return cc, e.Index, fmt.Errorf("unable to unmarshal configuration: %w", err)
+	}
+	return cc, e.Index, nil
+}
+
+// StartFromKV is like Start, but takes the config shared with the sequencer from
+// <kvPath>/config in Consul or etcd, and rebuilds the handler whenever it changes.
+func StartFromKV(ctx context.Context, c Config) (http.Handler, error) {
+	store, err := coordination.New(c.Coordination)
+	if err != nil {
+		return nil, err
+	}
+	configpath := c.KVPath + "/config"
+
+	cc, waitIndex, err := fetchKVConfig(ctx, store, c.Coordination, configpath, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each handler gets its own context, so the background work of the old one
+	// is stopped once it is replaced.
+	handlerCtx, cancel := context.WithCancel(ctx)
+	handler, err := Start(handlerCtx, cc.apply(c))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var current atomic.Pointer[http.Handler]
+	current.Store(&handler)
+
+	go func() {
+		for {
+			next, index, err := fetchKVConfig(ctx, store, c.Coordination, configpath, waitIndex)
+			if err != nil {
+				if ctx.Err() != nil {
+					cancel()
+					return
+				}
+				slog.ErrorContext(ctx, "Unable to watch configuration", "kv_path", c.KVPath, "error", err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			waitIndex = index
+
+			if next == cc {
+				continue
+			}
+
+			nextCtx, nextCancel := context.WithCancel(ctx)
+			handler, err := Start(nextCtx, next.apply(c))
+			if err != nil {
+				nextCancel()
+				slog.ErrorContext(ctx, "Ignoring configuration change", "kv_path", c.KVPath, "error", err)
+				continue
+			}
+			current.Store(&handler)
+			cancel()
+			cc, cancel = next, nextCancel
+			slog.InfoContext(ctx, "Reloaded configuration", "kv_path", c.KVPath)
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*current.Load()).ServeHTTP(w, r)
+	}), nil
+}
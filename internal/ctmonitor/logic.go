@@ -1,44 +1,91 @@
 package ctmonitor
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
 
 	ct "github.com/google/certificate-transparency-go"
 	"github.com/google/certificate-transparency-go/tls"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/mod/sumdb/tlog"
 	"itko.dev/internal/sunlight"
 )
 
+const DefaultMaxGetEntries = 1024
+
+// DefaultMaxGetEntriesBytes caps the size of a get-entries response, as 1024 precerts with
+// long chains can add up to far more than clients expect to download at once.
+const DefaultMaxGetEntriesBytes = 8 << 20
+
 // TODO: Evaluate if the context is actually needed
-func Start(ctx context.Context, tileStoreDir string, tileStoreUrl string, maskSize int) (http.Handler, error) {
-	var f Fetch
-	maxGetEntry := 1024
+func Start(ctx context.Context, c Config) (http.Handler, error) {
+	maxGetEntry := c.MaxGetEntries
+	if maxGetEntry <= 0 {
+		maxGetEntry = DefaultMaxGetEntries
+	}
 
-	if tileStoreDir != "" {
-		storage := &FsStorage{root: tileStoreDir}
-		f = newFetch(storage, maskSize, maxGetEntry)
-	} else {
-		storage := &UrlStorage{urlPrefix: tileStoreUrl}
-		f = newFetch(storage, maskSize, maxGetEntry)
+	indexLayout := sunlight.IndexLayout{Version: c.IndexLayoutVersion, Mask: c.MaskSize, SegmentSize: c.IndexSegmentSize}
+	if err := indexLayout.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid index layout: %w", err)
+	}
+
+	sth, err := newSTHCache(c)
+	if err != nil {
+		return nil, err
 	}
 
-	// Wrap the HTTP handler function with OTel instrumentation
-	wGetSth := otelhttp.NewHandler(http.HandlerFunc(wrapper(f.get_sth)), "get-sth")
-	wGetSthConsistency := otelhttp.NewHandler(http.HandlerFunc(wrapper(f.get_sth_consistency)), "get-sth-consistency")
-	wGetProofByHash := otelhttp.NewHandler(http.HandlerFunc(wrapper(f.get_proof_by_hash)), "get-proof-by-hash")
-	wGetEntries := otelhttp.NewHandler(http.HandlerFunc(wrapper(f.get_entries)), "get-entries")
-	wGetRoots := otelhttp.NewHandler(http.HandlerFunc(wrapper(f.get_roots)), "get-roots")
-	wGetEntryAndProof := otelhttp.NewHandler(http.HandlerFunc(wrapper(f.get_entry_and_proof)), "get-entry-and-proof")
+	storage, err := c.storage()
+	if err != nil {
+		return nil, err
+	}
+	f := newFetch(storage, indexLayout, maxGetEntry, sth)
+	f.mirrored = c.MirroredEntries
+
+	integrity, err := newIntegrityChecker(c)
+	if err != nil {
+		return nil, err
+	}
+	if integrity != nil {
+		f.integrity = integrity
+		integrity.update(ctx, f.s)
+		go integrity.run(ctx, f.s)
+	}
+
+	f.proofs = newProofCache(c.ProofCacheTTL, c.ProofCacheSize)
+	f.maxGetEntryBytes = c.MaxGetEntriesBytes
+	f.readyTimeout = c.ReadyTimeout
+	if f.readyTimeout <= 0 {
+		f.readyTimeout = DefaultReadyTimeout
+	}
+
+	if err := startupCheck(ctx, c.StartupCheck, f, integrity); err != nil {
+		return nil, err
+	}
+	if auditor := newAuditor(c); auditor != nil {
+		go auditor.run(ctx, f.s)
+	}
+
+	// Wrap the HTTP handler function with OTel and Prometheus instrumentation
+	wGetSth := instrument(withSurrogateKey(http.HandlerFunc(wrapper(f.get_sth, cacheRevalidate)), sunlight.SurrogateKeySTH), "get-sth")
+	wGetSthConsistency := instrument(http.HandlerFunc(wrapper(f.get_sth_consistency, cacheImmutable)), "get-sth-consistency")
+	wGetProofByHash := instrument(http.HandlerFunc(wrapper(f.get_proof_by_hash, cacheImmutable)), "get-proof-by-hash")
+	wGetEntries := instrument(http.HandlerFunc(f.getEntries), "get-entries")
+	wGetRoots := instrument(http.HandlerFunc(wrapper(f.get_roots, cacheRoots)), "get-roots")
+	wGetEntryAndProof := instrument(http.HandlerFunc(wrapper(f.get_entry_and_proof, cacheImmutable)), "get-entry-and-proof")
+	wGetSthHistory := instrument(http.HandlerFunc(wrapper(f.get_sth_history, cacheRevalidate)), "get-sth-history")
+	wGetArchivedSth := instrument(http.HandlerFunc(wrapper(f.get_archived_sth, cacheImmutable)), "get-archived-sth")
+	wTile := instrument(http.HandlerFunc(f.tile), "tile")
+	wCheckpoint := instrument(http.HandlerFunc(f.checkpoint), "checkpoint")
+	wIssuer := instrument(http.HandlerFunc(f.issuer), "issuer")
+	wStatus := instrument(http.HandlerFunc(f.status), "status")
 
 	// Create a new HTTP server mux and start listening
 	mux := http.NewServeMux()
@@ -48,49 +95,70 @@ func Start(ctx context.Context, tileStoreDir string, tileStoreUrl string, maskSi
 	mux.Handle("GET /ct/v1/get-entries", wGetEntries)
 	mux.Handle("GET /ct/v1/get-roots", wGetRoots)
 	mux.Handle("GET /ct/v1/get-entry-and-proof", wGetEntryAndProof)
+	mux.Handle("GET /sth-history", wGetSthHistory)
+	mux.Handle("GET /sth", wGetArchivedSth)
+	mux.Handle("GET /tile/", wTile)
+	mux.Handle("GET /checkpoint", wCheckpoint)
+	mux.Handle("GET /issuer/{fingerprint}", wIssuer)
+	mux.Handle("GET /status", wStatus)
+	mux.HandleFunc("GET /readyz", f.readyz)
+	if c.CertificateLookup {
+		mux.Handle("GET /certificate/{fingerprint}", instrument(http.HandlerFunc(f.certificate), "certificate"))
+	}
+
+	limiter := newRateLimiter(c.RateLimit, maxGetEntry)
+	return withCORS(limiter.limit(integrity.gate(withCompression(http.MaxBytesHandler(mux, c.MaxBodyBytes), c.CompressMinBytes))), c.CORSOrigins), nil
+}
 
-	return http.MaxBytesHandler(mux, 128*1024), nil
+// withSurrogateKey tags responses with a surrogate key, so a CDN in front of the monitor
+// can have them purged when a new STH is published.
+func withSurrogateKey(h http.Handler, key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Surrogate-Key", key)
+		h.ServeHTTP(w, r)
+	})
 }
 
-func wrapper(wrapped func(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error)) func(w http.ResponseWriter, r *http.Request) {
+func wrapper(wrapped func(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error), cacheControl string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query()
 		resp, code, err := wrapped(r.Context(), r.Body, query)
 		if err != nil {
-			if code == http.StatusServiceUnavailable {
-				w.Header().Set("Retry-After", fmt.Sprintf("%d", 30+rand.Intn(60)))
-				http.Error(w, "pool full", code)
-			} else {
-				http.Error(w, err.Error(), code)
-			}
+			writeError(w, code, err)
+			return
+		}
+		if setCacheHeaders(w, r, etagFor(resp), cacheControl) {
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(code)
 		if _, err = w.Write(resp); err != nil {
-			log.Printf("Error writing response: %v", err)
+			slog.WarnContext(r.Context(), "Error writing response", "error", err)
 		}
 	}
 }
 
-func hashreader(ctx context.Context, f Fetch, fallbackTreeSize int64) tlog.HashReaderFunc {
-	// Tree size is 1 greater than the index of the last entry
-	finalTile := tlog.TileForIndex(sunlight.TileHeight, tlog.StoredHashIndex(0, fallbackTreeSize-1))
+// hashreader reads stored hashes for proofs out of the tiles covering publishedTreeSize,
+// which must be the size of a published STH. Tiles only ever grow to the right, and every
+// tile the sequencer has published is kept, so the tiles for that size also contain every
+// hash of any smaller tree, even if that tree's own partial tiles were never stored.
+func hashreader(ctx context.Context, f Fetch, publishedTreeSize int64) tlog.HashReaderFunc {
 	// TODO: add some sort of cache here, this function is bound to be called a few times for the same tiles
 	return func(indexes []int64) ([]tlog.Hash, error) {
 		hashes := make([]tlog.Hash, 0, len(indexes))
 		for _, index := range indexes {
 			tile := tlog.TileForIndex(sunlight.TileHeight, index)
-			// Special case the final tile to get the correct width
-			if tile.N == finalTile.N {
-				tile.W = finalTile.W
+			width := publishedWidth(tile, publishedTreeSize)
+			if width < tile.W {
+				return nil, fmt.Errorf("hash %d is not in the tree of size %d", index, publishedTreeSize)
 			}
+			tile.W = width
 			// This function will always first try and get the full width tile,
 			// and then fall back to the width actually specified in the tile.
 			data, err := f.getTile(ctx, tile)
 			if err != nil {
-				return nil, fmt.Errorf("failed to fetch tile %s: %w (fallback %s)", sunlight.Path(tile), err, sunlight.Path(finalTile))
+				return nil, fmt.Errorf("failed to fetch tile %s: %w", sunlight.Path(tile), err)
 			}
 			hash, err := tlog.HashFromTile(tile, data, index)
 			if err != nil {
@@ -102,6 +170,20 @@ func hashreader(ctx context.Context, f Fetch, fallbackTreeSize int64) tlog.HashR
 	}
 }
 
+// publishedWidth is the width of the tile in a tree of the given size, capped at the full width.
+func publishedWidth(tile tlog.Tile, treeSize int64) int {
+	// Tiles at level L hold the hashes at level L*H of the tree
+	hashesAtLevel := treeSize >> (uint(tile.L) * uint(tile.H))
+	width := hashesAtLevel - tile.N*sunlight.TileWidth
+	if width > sunlight.TileWidth {
+		return sunlight.TileWidth
+	}
+	if width < 0 {
+		return 0
+	}
+	return int(width)
+}
+
 type tileWithBytes struct {
 	tile  tlog.Tile
 	bytes []byte
@@ -109,61 +191,67 @@ type tileWithBytes struct {
 
 // TODO: Remove the wrapper from this endpoint and have it instead stream the response
 func (f Fetch) get_sth(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
-	resp, err = f.get(ctx, "ct/v1/get-sth")
+	resp, _, err = f.sth.get(ctx, f.s)
 	if err != nil {
-		return nil, 503, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
 	}
-	return resp, 200, nil
+	return resp, http.StatusOK, nil
 }
 
 func (f Fetch) get_sth_consistency(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
 	// Get and decode the first tree size parameter
 	firstStr := query.Get("first")
 	if firstStr == "" {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, missingParam("first")
 	}
 	first, err := strconv.ParseInt(firstStr, 10, 64)
 	if err != nil {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, invalidParam("first", err)
 	}
 	// Get and decode the second tree size parameter
 	secondStr := query.Get("second")
 	if secondStr == "" {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, missingParam("second")
 	}
 	second, err := strconv.ParseInt(secondStr, 10, 64)
 	if err != nil {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, invalidParam("second", err)
 	}
 
 	if first < 0 || second < 0 {
-		return nil, 400, fmt.Errorf("parameters must be positive")
+		return nil, http.StatusBadRequest, withReason(reasonInvalidParameter, fmt.Errorf("parameters must be positive"))
 	}
 
 	if first > second {
-		return nil, 400, fmt.Errorf("first must be less than or equal to second")
+		return nil, http.StatusBadRequest, withReason(reasonInvalidParameter, fmt.Errorf("first must be less than or equal to second"))
 	}
 
+	return f.proofs.get(fmt.Sprintf("consistency/%d/%d", first, second), func() ([]byte, int, error) {
+		return f.sthConsistency(ctx, first, second)
+	})
+}
+
+func (f Fetch) sthConsistency(ctx context.Context, first, second int64) (resp []byte, code int, err error) {
 	sth, err := f.getSth(ctx)
 	if err != nil {
-		// TODO: Fix all the response status codes
-		return nil, 521, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
 	}
 
 	if first > int64(sth.TreeSize) || second > int64(sth.TreeSize) {
-		return nil, 400, fmt.Errorf("tree size out of range")
+		return nil, http.StatusBadRequest, withReason(reasonOutOfRange, fmt.Errorf("tree size out of range"))
 	}
 
 	// Get the consistency proof
 	var proof tlog.TreeProof
 
 	// If the first tree size is 0, then the prove tree function returns an error.
-	// However, as per the spec, in this case, an empty proof should be returned
-	// TODO: this fails if the size of the first tree is greater than the actual number of records in the tree
+	// However, as per the spec, in this case, an empty proof should be returned.
+	// Neither size has to be one we issued an STH for, the hashes are read out of the
+	// tiles for the latest STH instead.
 	if first >= 1 {
-		proof, err = tlog.ProveTree(second, first, hashreader(ctx, f, second))
+		proof, err = tlog.ProveTree(second, first, hashreader(ctx, f, int64(sth.TreeSize)))
 		if err != nil {
-			return nil, 523, err
+			return nil, http.StatusServiceUnavailable, storageError(err)
 		}
 	}
 
@@ -179,60 +267,89 @@ func (f Fetch) get_sth_consistency(ctx context.Context, reqBody io.ReadCloser, q
 
 	jsonBytes, err := json.Marshal(response)
 	if err != nil {
-		return nil, 524, err
+		return nil, http.StatusInternalServerError, err
 	}
 
-	return jsonBytes, 200, nil
+	return jsonBytes, http.StatusOK, nil
 }
 
 func (f Fetch) get_proof_by_hash(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
 	// Get and decode the hash parameter
 	hashBase64 := query.Get("hash")
 	if hashBase64 == "" {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, missingParam("hash")
 	}
 	hash, err := base64.StdEncoding.DecodeString(hashBase64)
 	if err != nil {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, invalidParam("hash", err)
 	}
 	if len(hash) != 32 {
-		return nil, 400, fmt.Errorf("hash must be 32 bytes")
+		return nil, http.StatusBadRequest, invalidParam("hash", fmt.Errorf("must be 32 bytes"))
 	}
 
 	// Get and parse the tree_size parameter
 	treeSizeStr := query.Get("tree_size")
 	if treeSizeStr == "" {
-		return nil, 400, err
-
+		return nil, http.StatusBadRequest, missingParam("tree_size")
 	}
 	treeSize, err := strconv.ParseInt(treeSizeStr, 10, 64)
 	if err != nil {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, invalidParam("tree_size", err)
 	}
 
+	return f.proofs.get(fmt.Sprintf("hash/%x/%d", hash, treeSize), func() ([]byte, int, error) {
+		return f.proofByHash(ctx, hash, treeSize)
+	})
+}
+
+func (f Fetch) proofByHash(ctx context.Context, hash []byte, treeSize int64) (resp []byte, code int, err error) {
 	sth, err := f.getSth(ctx)
 	if err != nil {
-		return nil, 500, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
 	}
 	if treeSize > int64(sth.TreeSize) {
-		return nil, 400, fmt.Errorf("tree size is larger than the current sth")
+		return nil, http.StatusBadRequest, withReason(reasonOutOfRange, fmt.Errorf("tree size is larger than the current sth"))
 	}
 
 	// Use the hash to fetch the index
 	index, err := f.getIndexForHash(ctx, hash[:16])
 	if err != nil {
-		return nil, 404, err
+		return nil, http.StatusNotFound, err
 	}
 
+	// The entry may have been added after the requested tree
 	if index < 0 || index >= treeSize {
-		return nil, 400, fmt.Errorf("index out of range")
+		return nil, http.StatusNotFound, fmt.Errorf("hash is not in the tree of size %d", treeSize)
+	}
+
+	// The index files only keep the first 16 bytes of each hash, so make sure
+	// the leaf at that index is really the one that was asked for.
+	reader := hashreader(ctx, f, int64(sth.TreeSize))
+	leaf, err := reader([]int64{tlog.StoredHashIndex(0, index)})
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, storageError(err)
+	}
+	if !bytes.Equal(leaf[0][:], hash) {
+		return nil, http.StatusNotFound, fmt.Errorf("hash not found")
 	}
 
 	// Get the proof
-	proof, err := tlog.ProveRecord(treeSize, index, hashreader(ctx, f, treeSize))
+	proof, err := tlog.ProveRecord(treeSize, index, reader)
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to prove record", "index", index, "tree_size", treeSize, "error", err)
+		return nil, http.StatusServiceUnavailable, storageError(err)
+	}
+
+	// Check the proof against the STH, in case the tiles don't match what was signed
+	root, signed, err := f.signedRoot(ctx, sth, treeSize)
 	if err != nil {
-		log.Println(err)
-		return nil, 511, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
+	}
+	if signed {
+		if err := tlog.CheckRecord(proof, treeSize, root, index, leaf[0]); err != nil {
+			slog.ErrorContext(ctx, "Record proof does not match the signed tree", "index", index, "tree_size", treeSize, "error", err)
+			return nil, http.StatusInternalServerError, err
+		}
 	}
 
 	// why you make me do this golang
@@ -248,53 +365,59 @@ func (f Fetch) get_proof_by_hash(ctx context.Context, reqBody io.ReadCloser, que
 
 	jsonBytes, err := json.Marshal(response)
 	if err != nil {
-		return nil, 512, err
+		return nil, http.StatusInternalServerError, err
 	}
 
-	return jsonBytes, 200, nil
+	return jsonBytes, http.StatusOK, nil
 }
 
-func (f Fetch) get_entries(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
+// entriesInRange parses the entries requested by get-entries out of the data tiles,
+// and fetches the issuers needed for their chains. This is done before anything is
+// written, so that an error can still be returned with the right status code.
+func (f Fetch) entriesInRange(ctx context.Context, query url.Values) (entries []*sunlight.LogEntry, issuers map[[32]byte][]byte, code int, err error) {
 	// Get and decode the start index parameter
 	startStr := query.Get("start")
 	if startStr == "" {
-		return nil, 400, err
+		return nil, nil, http.StatusBadRequest, missingParam("start")
 	}
 	start, err := strconv.ParseInt(startStr, 10, 64)
 	if err != nil {
-		return nil, 400, err
+		return nil, nil, http.StatusBadRequest, invalidParam("start", err)
 	}
 	// Get and decode the end index parameter
 	endStr := query.Get("end")
 	if endStr == "" {
-		return nil, 400, err
+		return nil, nil, http.StatusBadRequest, missingParam("end")
 	}
 	end, err := strconv.ParseInt(endStr, 10, 64)
 	if err != nil {
-		return nil, 400, err
+		return nil, nil, http.StatusBadRequest, invalidParam("end", err)
 	}
 
 	if start > end {
-		return nil, 400, fmt.Errorf("start must be less than or equal to end")
+		return nil, nil, http.StatusBadRequest, withReason(reasonInvalidParameter, fmt.Errorf("start must be less than or equal to end"))
 	}
 
 	if start < 0 || end < 0 {
-		return nil, 400, fmt.Errorf("start and end must be positive")
+		return nil, nil, http.StatusBadRequest, withReason(reasonInvalidParameter, fmt.Errorf("start and end must be positive"))
 	}
 
-	// Limit the number of entries fetched at once
+	// Limit the number of entries fetched at once, end being inclusive
 	limit := int64(f.maxGetEntry)
-	if end-start > limit {
-		end = start + limit
+	if end-start >= limit {
+		end = start + limit - 1
 	}
 
 	sth, err := f.getSth(ctx)
 	if err != nil {
-		return nil, 521, err
+		return nil, nil, http.StatusServiceUnavailable, storageError(err)
 	}
 	if end >= int64(sth.TreeSize) {
 		end = int64(sth.TreeSize) - 1
 	}
+	if start > end {
+		return nil, nil, http.StatusBadRequest, withReason(reasonOutOfRange, fmt.Errorf("start is past the end of the tree"))
+	}
 
 	// Get the first and last tiles, -1 signifies a data tile
 	firstTile := tlog.TileForIndex(sunlight.TileHeight, tlog.StoredHashIndex(0, start))
@@ -310,89 +433,128 @@ func (f Fetch) get_entries(ctx context.Context, reqBody io.ReadCloser, query url
 		lastTile.W = sthFinalTile.W
 	}
 
+	tiles := make([]tlog.Tile, 0)
 	// In this case, the last tile is the same as the first tile so we only need to fetch one tile
 	if firstTile.N == lastTile.N {
-		data, err := f.getTile(ctx, lastTile)
-		if err != nil {
-			return nil, 513, err
-		}
-		dataTiles = append(dataTiles, tileWithBytes{lastTile, data})
+		tiles = append(tiles, lastTile)
 	} else {
-		{
-			// If the index of the last tile is greater than the index of the first tile,
-			// it means the first tile is complete
-			firstTile.W = 256
-			data, err := f.getTile(ctx, firstTile)
-			if err != nil {
-				return nil, 514, err
-			}
-			dataTiles = append(dataTiles, tileWithBytes{firstTile, data})
+		// If the index of the last tile is greater than the index of the first tile,
+		// it means the first tile is complete
+		firstTile.W = 256
+		tiles = append(tiles, firstTile)
+
+		// We also need to fetch all the tiles in middle. Here, we sort of just
+		// need to define the tile ourselves and fetch it
+		for i := firstTile.N + 1; i < lastTile.N; i++ {
+			tiles = append(tiles, tlog.Tile{
+				H: sunlight.TileHeight,
+				L: -1,
+				N: i,
+				W: 256,
+			})
 		}
 
-		{
-			// We also need to fetch all the tiles in middle. Here, we sort of just
-			// need to define the tile ourselves and fetch it
-			for i := firstTile.N + 1; i < lastTile.N; i++ {
-				tile := tlog.Tile{
-					H: sunlight.TileHeight,
-					L: -1,
-					N: i,
-					W: 256,
-				}
-
-				data, err := f.getTile(ctx, tile)
-				if err != nil {
-					return nil, 515, err
-				}
-				dataTiles = append(dataTiles, tileWithBytes{tile, data})
-			}
+		// Finally, fetch the last tile
+		tiles = append(tiles, lastTile)
+	}
 
+	for i, tile := range tiles {
+		data, err := f.getTile(ctx, tile)
+		// Once the storage runs out of requests, return the entries from the tiles that
+		// were fetched, as they are still a valid prefix of the range
+		if errors.Is(err, errRequestBudget) && i > 0 {
+			break
 		}
-
-		{
-			// Finally, fetch the last tile
-			data, err := f.getTile(ctx, lastTile)
-			if err != nil {
-				return nil, 516, err
-			}
-			dataTiles = append(dataTiles, tileWithBytes{lastTile, data})
+		if err != nil {
+			return nil, nil, http.StatusServiceUnavailable, storageError(err)
 		}
+		dataTiles = append(dataTiles, tileWithBytes{tile, data})
 	}
 
 	// Now we need to parse the data tiles into entries
-	var entries []*sunlight.LogEntry
 	for _, tile := range dataTiles {
-		rest := tile.bytes
-		for len(rest) > 0 {
-			entry, nextRest, err := sunlight.ReadTileLeaf(rest)
+		for entry, err := range parseTileEntries(tile.tile, tile.bytes, f.mirrored) {
 			if err != nil {
-				return nil, 517, err
+				return nil, nil, http.StatusInternalServerError, fmt.Errorf("invalid data tile %s: %w", sunlight.Path(tile.tile), err)
 			}
 			if entry.LeafIndex >= uint64(start) && entry.LeafIndex <= uint64(end) {
 				entries = append(entries, entry)
 			}
-			rest = nextRest
 		}
 	}
 
-	ctLeafEntries := make([]ct.LeafEntry, 0, len(entries))
-
+	// With a limited number of requests, only return the entries whose issuers could be fetched
+	issuers = make(map[[32]byte][]byte)
 outerloop:
-	for _, entry := range entries {
-		merkleTreeLeaf := entry.MerkleTreeLeaf()
-
-		// TODO: add a cache here
-		chain := make([]ct.ASN1Cert, 0, len(entry.ChainFp))
+	for i, entry := range entries {
 		for _, fp := range entry.ChainFp {
-			if f.s.AvailableReqs() == 0 {
-				break outerloop
+			if _, ok := issuers[fp]; ok {
+				continue
 			}
 
-			data, err := f.get(ctx, fmt.Sprintf("issuer/%x", fp))
+			data, err := f.getIssuer(ctx, fp)
+			if errors.Is(err, errRequestBudget) && i > 0 {
+				entries = entries[:i]
+				break outerloop
+			}
 			if err != nil {
-				return nil, 518, err
+				return nil, nil, http.StatusServiceUnavailable, storageError(err)
 			}
-			chain = append(chain, ct.ASN1Cert{Data: data})
+			issuers[fp] = data
+		}
+	}
+
+	// Clients are expected to handle fewer entries than they asked for, so stop once the
+	// response would go over the byte budget. The first entry is always returned, so a
+	// client can still make progress past an entry larger than the budget.
+	budget := f.maxGetEntryBytes
+	if budget <= 0 {
+		budget = DefaultMaxGetEntriesBytes
+	}
+	size := len(`{"entries":[]}`)
+	for i, entry := range entries {
+		if i > 0 {
+			size++ // the comma
+		}
+		size += entrySize(entry, issuers)
+		if i > 0 && size > budget {
+			entries = entries[:i]
+			break
+		}
+	}
+
+	return entries, issuers, http.StatusOK, nil
+}
+
+// entrySize is the number of bytes writeEntries writes for the entry, without encoding it.
+func entrySize(entry *sunlight.LogEntry, issuers map[[32]byte][]byte) int {
+	// Each element of the chain is prefixed with a 24 bit length, as is the chain itself
+	extraData := 3
+	for _, fp := range entry.ChainFp {
+		extraData += 3 + len(issuers[fp])
+	}
+	if entry.IsPrecert {
+		extraData += 3 + len(entry.PreCertificate)
+	}
+	leafInput := len(entry.MerkleTreeLeaf())
+
+	// The JSON encoder ends each value with a newline
+	return len(`{"leaf_input":"","extra_data":""}`+"\n") +
+		base64.StdEncoding.EncodedLen(leafInput) + base64.StdEncoding.EncodedLen(extraData)
+}
+
+// writeEntries writes a GetEntriesResponse one entry at a time, so the response
+// isn't built up in memory first.
+func writeEntries(w io.Writer, entries []*sunlight.LogEntry, issuers map[[32]byte][]byte) error {
+	if _, err := io.WriteString(w, `{"entries":[`); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for i, entry := range entries {
+		chain := make([]ct.ASN1Cert, 0, len(entry.ChainFp))
+		for _, fp := range entry.ChainFp {
+			chain = append(chain, ct.ASN1Cert{Data: issuers[fp]})
 		}
 
 		var extra interface{}
@@ -407,67 +569,93 @@ outerloop:
 
 		extraData, err := tls.Marshal(extra)
 		if err != nil {
-			return nil, 519, err
+			return err
 		}
 
-		leafEntry := ct.LeafEntry{
-			LeafInput: merkleTreeLeaf,
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		err = enc.Encode(ct.LeafEntry{
+			LeafInput: entry.MerkleTreeLeaf(),
 			ExtraData: extraData,
+		})
+		if err != nil {
+			return err
 		}
-		ctLeafEntries = append(ctLeafEntries, leafEntry)
 	}
 
-	response := ct.GetEntriesResponse{
-		Entries: ctLeafEntries,
-	}
+	_, err := io.WriteString(w, "]}")
+	return err
+}
 
-	jsonBytes, err := json.Marshal(response)
+// getEntries serves get-entries, streaming the response instead of going through wrapper.
+func (f Fetch) getEntries(w http.ResponseWriter, r *http.Request) {
+	entries, issuers, code, err := f.entriesInRange(r.Context(), r.URL.Query())
 	if err != nil {
-		return nil, 520, err
+		writeError(w, code, err)
+		return
 	}
 
-	return jsonBytes, 200, nil
+	// The body isn't buffered, so the ETag is derived from the range instead. The
+	// entries in a range never change, so this identifies the response just as well.
+	if len(entries) > 0 {
+		etag := fmt.Sprintf(`"%d-%d"`, entries[0].LeafIndex, len(entries))
+		if setCacheHeaders(w, r, etag, entriesCacheControl(r, f.maxGetEntry, len(entries))) {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := writeEntries(w, entries, issuers); err != nil {
+		// The status has already been sent, so the only way to tell the client the
+		// response is incomplete is to drop the connection
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
+		panic(http.ErrAbortHandler)
+	}
 }
 
 // TODO: Remove the wrapper from this endpoint and have it instead stream the response
 func (f Fetch) get_roots(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
 	resp, err = f.get(ctx, "ct/v1/get-roots")
 	if err != nil {
-		return nil, 503, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
 	}
-	return resp, 200, nil
+	return resp, http.StatusOK, nil
 }
 
 func (f Fetch) get_entry_and_proof(ctx context.Context, reqBody io.ReadCloser, query url.Values) (resp []byte, code int, err error) {
 	// Get and decode the leaf index parameter
 	leafIndexStr := query.Get("leaf_index")
 	if leafIndexStr == "" {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, missingParam("leaf_index")
 	}
 	leafIndex, err := strconv.ParseInt(leafIndexStr, 10, 64)
 	if err != nil {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, invalidParam("leaf_index", err)
 	}
 	// Get and decode the tree size parameter
 	treeSizeStr := query.Get("tree_size")
 	if treeSizeStr == "" {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, missingParam("tree_size")
 	}
 	treeSize, err := strconv.ParseInt(treeSizeStr, 10, 64)
 	if err != nil {
-		return nil, 400, err
+		return nil, http.StatusBadRequest, invalidParam("tree_size", err)
 	}
 
 	if leafIndex < 0 || leafIndex >= treeSize {
-		return nil, 400, fmt.Errorf("index out of range")
+		return nil, http.StatusBadRequest, withReason(reasonOutOfRange, fmt.Errorf("index out of range"))
 	}
 
 	sth, err := f.getSth(ctx)
 	if err != nil {
-		return nil, 500, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
 	}
 	if treeSize > int64(sth.TreeSize) {
-		return nil, 400, fmt.Errorf("tree size is larger than the current sth")
+		return nil, http.StatusBadRequest, withReason(reasonOutOfRange, fmt.Errorf("tree size is larger than the current sth"))
 	}
 
 	// Get the entry
@@ -477,36 +665,32 @@ func (f Fetch) get_entry_and_proof(ctx context.Context, reqBody io.ReadCloser, q
 	// TODO: add a cache
 	data, err := f.getTile(ctx, tile)
 	if err != nil {
-		return nil, 500, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
 	}
 
 	var leafEntry *sunlight.LogEntry
 
-	rest := data
-	for len(rest) > 0 {
-		entry, nextRest, err := sunlight.ReadTileLeaf(rest)
+	for entry, err := range parseTileEntries(tile, data, f.mirrored) {
 		if err != nil {
-			return nil, 500, err
+			return nil, http.StatusInternalServerError, fmt.Errorf("invalid data tile %s: %w", sunlight.Path(tile), err)
 		}
 		if entry.LeafIndex == uint64(leafIndex) {
 			leafEntry = entry
 			break
 		}
-		rest = nextRest
 	}
 
 	if leafEntry == nil {
-		return nil, 404, fmt.Errorf("entry not found")
+		return nil, http.StatusNotFound, fmt.Errorf("entry not found")
 	}
 
 	merkleTreeLeaf := leafEntry.MerkleTreeLeaf()
 
-	// TODO: add a cache here
 	chain := make([]ct.ASN1Cert, 0, len(leafEntry.ChainFp))
 	for _, fp := range leafEntry.ChainFp {
-		data, err := f.get(ctx, fmt.Sprintf("issuer/%x", fp))
+		data, err := f.getIssuer(ctx, fp)
 		if err != nil {
-			return nil, 500, err
+			return nil, http.StatusServiceUnavailable, storageError(err)
 		}
 		chain = append(chain, ct.ASN1Cert{Data: data})
 	}
@@ -523,13 +707,13 @@ func (f Fetch) get_entry_and_proof(ctx context.Context, reqBody io.ReadCloser, q
 
 	extraData, err := tls.Marshal(extra)
 	if err != nil {
-		return nil, 500, err
+		return nil, http.StatusInternalServerError, err
 	}
 
 	// Get the proof
-	proof, err := tlog.ProveRecord(treeSize, leafIndex, hashreader(ctx, f, treeSize))
+	proof, err := tlog.ProveRecord(treeSize, leafIndex, hashreader(ctx, f, int64(sth.TreeSize)))
 	if err != nil {
-		return nil, 500, err
+		return nil, http.StatusServiceUnavailable, storageError(err)
 	}
 
 	// why you make me do this golang
@@ -546,8 +730,8 @@ func (f Fetch) get_entry_and_proof(ctx context.Context, reqBody io.ReadCloser, q
 
 	jsonBytes, err := json.Marshal(response)
 	if err != nil {
-		return nil, 500, err
+		return nil, http.StatusInternalServerError, err
 	}
 
-	return jsonBytes, 200, nil
+	return jsonBytes, http.StatusOK, nil
 }
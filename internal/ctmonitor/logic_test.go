@@ -0,0 +1,84 @@
+package ctmonitor
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// entriesLog returns a Fetch for a log of n entries in one partial data tile. The STH
+// isn't signed, as it isn't verified without a public key.
+func entriesLog(n int, maxGetEntry int) Fetch {
+	issuer := []byte("issuer")
+	var tile []byte
+	for i := range n {
+		tile = sunlight.AppendTileLeaf(tile, &sunlight.LogEntry{
+			Certificate: []byte(fmt.Sprintf("certificate %d", i)),
+			ChainFp:     [][32]byte{sha256.Sum256(issuer)},
+			LeafIndex:   uint64(i),
+		})
+	}
+	s := memStorage{
+		"ct/v1/get-sth": []byte(fmt.Sprintf(`{"tree_size":%d,"sha256_root_hash":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`, n)),
+		sunlight.Path(tlog.Tile{H: sunlight.TileHeight, L: -1, N: 0, W: n}): tile,
+		fmt.Sprintf("issuer/%x", sha256.Sum256(issuer)):                     issuer,
+	}
+	return newFetch(s, sunlight.IndexLayout{Mask: 5}, maxGetEntry, &sthCache{})
+}
+
+func TestEntriesInRange(t *testing.T) {
+	const maxGetEntry = 10
+	f := entriesLog(20, maxGetEntry)
+
+	tests := []struct {
+		start, end int
+		// The first and last entries returned
+		first, last int
+		cache       string
+	}{
+		{0, 100, 0, maxGetEntry - 1, cacheImmutable},
+		{0, maxGetEntry - 1, 0, maxGetEntry - 1, cacheImmutable},
+		{5, 9, 5, 9, cacheImmutable},
+		{15, 100, 15, 19, cacheRevalidate},
+	}
+	for _, tt := range tests {
+		query := url.Values{"start": {fmt.Sprint(tt.start)}, "end": {fmt.Sprint(tt.end)}}
+		entries, _, code, err := f.entriesInRange(context.Background(), query)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("entries %d to %d: %d, %v", tt.start, tt.end, code, err)
+		}
+		if len(entries) != tt.last-tt.first+1 || entries[0].LeafIndex != uint64(tt.first) || entries[len(entries)-1].LeafIndex != uint64(tt.last) {
+			t.Errorf("entries %d to %d returned %d entries, want %d to %d", tt.start, tt.end, len(entries), tt.first, tt.last)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/ct/v1/get-entries?"+query.Encode(), nil)
+		if cache := entriesCacheControl(r, maxGetEntry, len(entries)); cache != tt.cache {
+			t.Errorf("entries %d to %d are cached with %q, want %q", tt.start, tt.end, cache, tt.cache)
+		}
+	}
+}
+
+func TestEntriesInRangePastTheTree(t *testing.T) {
+	tests := []struct {
+		size, start, end int
+	}{
+		{20, 20, 25},
+		{20, 300, 400},
+		{0, 0, 0},
+	}
+	for _, tt := range tests {
+		query := url.Values{"start": {fmt.Sprint(tt.start)}, "end": {fmt.Sprint(tt.end)}}
+		_, _, code, err := entriesLog(tt.size, 10).entriesInRange(context.Background(), query)
+		var re reasonError
+		if code != http.StatusBadRequest || !errors.As(err, &re) || re.reason != reasonOutOfRange {
+			t.Errorf("entries %d to %d of a tree of size %d = %d, %v, want a 400 out of range", tt.start, tt.end, tt.size, code, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// The sequencer keeps a dedupe index from certificate fingerprints to leaf indexes, so that
+// a resubmitted certificate gets the same SCT. Serving it lets a CA check whether a
+// certificate made it into the log without knowing its leaf hash or reading get-entries.
+// This isn't part of RFC 6962, so it is only served if enabled.
+
+// The layout of the records in int/dedupe/, which must match ctsubmit.DedupeUpload.
+const (
+	DDURecordSize = 29
+	DDUHashSize   = 16
+	// Sunlight defines index size to be 40 bits or 5 bytes
+	DDULeafIndexSize = 5
+)
+
+// LookupResponse is returned by GET /certificate/<fingerprint>.
+type LookupResponse struct {
+	LeafIndex uint64 `json:"leafIndex"`
+	// The timestamp of the SCT issued for the certificate
+	Timestamp int64 `json:"timestamp"`
+	// The Merkle leaf hash, for get-proof-by-hash
+	LeafHash []byte `json:"leafHash,omitempty"`
+	// Whether the entry is covered by the latest STH. Until it is, it can't be proven.
+	Included bool `json:"included"`
+}
+
+var errLookupNotFound = errors.New("certificate not found")
+
+// getDedupeEntry returns the leaf index and timestamp recorded for the first 16 bytes of a
+// certificate fingerprint.
+func (f *Fetch) getDedupeEntry(ctx context.Context, hash []byte) (uint64, int64, error) {
+	file, notfound, err := f.s.Get(ctx, "int/dedupe/"+f.indexLayout.Path(hash))
+	if notfound {
+		return 0, 0, errLookupNotFound
+	} else if err != nil {
+		return 0, 0, storageError(err)
+	}
+
+	records, err := sunlight.IndexRecords(file, DDURecordSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	i, found := sunlight.SearchIndex(records, DDURecordSize, hash)
+	if !found {
+		return 0, 0, errLookupNotFound
+	}
+	record := records[i*DDURecordSize : (i+1)*DDURecordSize]
+
+	indexBytes := make([]byte, 8)
+	copy(indexBytes, record[DDUHashSize:DDUHashSize+DDULeafIndexSize])
+	leafIndex := binary.LittleEndian.Uint64(indexBytes)
+	timestamp := int64(binary.LittleEndian.Uint64(record[DDUHashSize+DDULeafIndexSize:]))
+	return leafIndex, timestamp, nil
+}
+
+func (f Fetch) lookup(ctx context.Context, fp [32]byte) (LookupResponse, int, error) {
+	var resp LookupResponse
+	var err error
+	resp.LeafIndex, resp.Timestamp, err = f.getDedupeEntry(ctx, fp[:DDUHashSize])
+	switch {
+	case errors.Is(err, errLookupNotFound):
+		return resp, http.StatusNotFound, err
+	case isStorageError(err):
+		return resp, http.StatusServiceUnavailable, err
+	case err != nil:
+		return resp, http.StatusInternalServerError, err
+	}
+
+	sth, err := f.getSth(ctx)
+	if err != nil {
+		return resp, http.StatusServiceUnavailable, storageError(err)
+	}
+	// Entries are added to the dedupe index right after the STH covering them is
+	// published, so this only happens while the cached STH is older than that
+	if resp.LeafIndex >= sth.TreeSize {
+		return resp, http.StatusOK, nil
+	}
+
+	// The index only keeps the first 16 bytes of the fingerprint, so make sure the
+	// entry is really for the certificate that was asked for
+	tile := tlog.TileForIndex(sunlight.TileHeight, tlog.StoredHashIndex(0, int64(resp.LeafIndex)))
+	tile.L = -1
+	tile.W = publishedWidth(tlog.Tile{H: tile.H, L: 0, N: tile.N}, int64(sth.TreeSize))
+	data, err := f.getTile(ctx, tile)
+	if err != nil {
+		return resp, http.StatusServiceUnavailable, storageError(err)
+	}
+	for entry, err := range parseTileEntries(tile, data, f.mirrored) {
+		if err != nil {
+			return resp, http.StatusInternalServerError, fmt.Errorf("invalid data tile %s: %w", sunlight.Path(tile), err)
+		}
+		if entry.LeafIndex == resp.LeafIndex {
+			if entry.CertificateFp != fp {
+				return resp, http.StatusNotFound, errLookupNotFound
+			}
+			hash := tlog.RecordHash(entry.MerkleTreeLeaf())
+			resp.LeafHash = hash[:]
+			resp.Included = true
+			return resp, http.StatusOK, nil
+		}
+	}
+	return resp, http.StatusInternalServerError, fmt.Errorf("leaf %d is missing from its data tile", resp.LeafIndex)
+}
+
+// certificate serves GET /certificate/<fingerprint>, where the fingerprint is the hex
+// encoded SHA-256 of the certificate or precertificate.
+func (f Fetch) certificate(w http.ResponseWriter, r *http.Request) {
+	fpBytes, err := hex.DecodeString(r.PathValue("fingerprint"))
+	if err != nil || len(fpBytes) != 32 {
+		writeError(w, http.StatusBadRequest, invalidParam("fingerprint", fmt.Errorf("must be 32 hex encoded bytes")))
+		return
+	}
+
+	resp, code, err := f.lookup(r.Context(), [32]byte(fpBytes))
+	if err != nil {
+		writeError(w, code, err)
+		return
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Once the entry is in the tree, the response never changes
+	cacheControl := cacheRevalidate
+	if resp.Included {
+		cacheControl = cacheImmutable
+	}
+	if setCacheHeaders(w, r, etagFor(body), cacheControl) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
+	}
+}
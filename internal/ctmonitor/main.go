@@ -5,16 +5,26 @@ import (
 	"log"
 	"net"
 	"net/http"
+
+	"itko.dev/internal/server"
 )
 
 // This is seperated so we can run this in the integration test.
 // Tests don't need to export Otel to Honeycomb.
-func MainMain(listener net.Listener, storeDirectory string, storeAddress string, maskSize int, startSignal chan<- struct{}) {
-	if storeDirectory == "" && storeAddress == "" {
-		log.Fatal("Must provide a tile storage backend address")
-	}
+func MainMain(listener net.Listener, c Config, startSignal chan<- struct{}) {
+	// Stops the background checks once the server has drained
+	ctx, cancel := context.WithCancel(context.Background())
 
-	mux, err := Start(context.Background(), storeDirectory, storeAddress, maskSize)
+	var mux http.Handler
+	var err error
+	if c.KVPath != "" {
+		mux, err = StartFromKV(ctx, c)
+	} else {
+		if c.StoreDirectory == "" && c.StoreAddress == "" && c.S3Bucket == "" {
+			log.Fatal("Must provide a tile storage backend address")
+		}
+		mux, err = Start(ctx, c)
+	}
 	if err != nil {
 		log.Fatalf("Failed to get log handler: %v", err)
 	}
@@ -23,6 +33,9 @@ func MainMain(listener net.Listener, storeDirectory string, storeAddress string,
 		startSignal <- struct{}{}
 	}
 
-	// Start the log
-	log.Fatal(http.Serve(listener, mux))
+	// Start the log. On a SIGTERM, in-flight requests such as large get-entries
+	// downloads are given the drain timeout to finish.
+	if err := server.Serve(listener, mux, c.Server, cancel); err != nil {
+		log.Fatal(err)
+	}
 }
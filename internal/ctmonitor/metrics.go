@@ -0,0 +1,117 @@
+package ctmonitor
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Metrics are registered with the default Prometheus registry, and served by the binary
+// on a separate listener, like the submit side. They are kept apart from its metrics by
+// the itko_monitor_ prefix, so the read path can be planned for on its own.
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_monitor_requests_total",
+		Help: "Requests to the monitor, by endpoint and response code.",
+	}, []string{"endpoint", "code"})
+
+	requestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_monitor_request_duration_seconds",
+		Help:    "Latency of monitor requests, by endpoint.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"endpoint"})
+
+	responseBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_monitor_response_bytes",
+		Help:    "Size of monitor responses before compression, by endpoint. The sum is the number of bytes served.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"endpoint"})
+
+	storageSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_monitor_storage_fetch_duration_seconds",
+		Help:    "Latency of fetches from tile storage, by kind of object and result.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"kind", "result"})
+
+	cacheLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_monitor_cache_lookups_total",
+		Help: "Lookups in the monitor's caches, by cache and whether they hit.",
+	}, []string{"cache", "result"})
+
+	auditFailed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "itko_monitor_audit_failed",
+		Help: "1 while the latest STH fails the audit of newly published tiles, 0 otherwise.",
+	})
+
+	auditFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "itko_monitor_audit_failures_total",
+		Help: "Audits of newly published tiles that failed.",
+	})
+
+	auditedTreeSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "itko_monitor_audited_tree_size",
+		Help: "Size of the last tree that passed the audit.",
+	})
+)
+
+// instrument wraps an endpoint's handler with tracing and metrics.
+func instrument(h http.Handler, endpoint string) http.Handler {
+	labels := prometheus.Labels{"endpoint": endpoint}
+	h = promhttp.InstrumentHandlerResponseSize(responseBytes.MustCurryWith(labels), h)
+	h = promhttp.InstrumentHandlerDuration(requestSeconds.MustCurryWith(labels), h)
+	h = promhttp.InstrumentHandlerCounter(requestsTotal.MustCurryWith(labels), h)
+	return otelhttp.NewHandler(h, endpoint)
+}
+
+func cacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookupsTotal.WithLabelValues(cache, result).Inc()
+}
+
+// storageKind groups keys into the kinds of objects in the bucket, to keep the
+// number of label values small.
+func storageKind(key string) string {
+	switch {
+	case strings.HasPrefix(key, "tile/data/"):
+		return "data_tile"
+	case strings.HasPrefix(key, "tile/"):
+		return "tree_tile"
+	case strings.HasPrefix(key, "issuer/"):
+		return "issuer"
+	case strings.HasPrefix(key, "int/hashes/"):
+		return "hash_index"
+	case strings.HasPrefix(key, "int/dedupe/"):
+		return "dedupe_index"
+	case key == "ct/v1/get-sth" || key == "checkpoint" || strings.HasPrefix(key, "sth/"):
+		return "sth"
+	}
+	return "other"
+}
+
+// instrumentedStorage records the latency of every fetch from the wrapped storage.
+type instrumentedStorage struct {
+	Storage
+}
+
+func (s instrumentedStorage) Get(ctx context.Context, key string) (data []byte, notfounderr bool, err error) {
+	start := time.Now()
+	data, notfounderr, err = s.Storage.Get(ctx, key)
+	result := "ok"
+	if notfounderr {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+	}
+	storageSeconds.WithLabelValues(storageKind(key), result).Observe(time.Since(start).Seconds())
+	return data, notfounderr, err
+}
@@ -0,0 +1,92 @@
+package ctmonitor
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Monitors tend to ask for the same proofs at the same time, such as for a certificate that
+// was just issued, and every proof reads a handful of tiles. A proof for a given tree size
+// never changes, so computed proofs are kept for a short while, and concurrent requests
+// for the same proof wait on a single computation.
+
+// DefaultProofCacheSize is the number of proofs kept if no size is configured.
+const DefaultProofCacheSize = 4096
+
+type proofCacheEntry struct {
+	resp    []byte
+	expires time.Time
+}
+
+type proofCache struct {
+	ttl     time.Duration
+	maxSize int
+	group   singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]proofCacheEntry
+}
+
+func newProofCache(ttl time.Duration, maxSize int) *proofCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultProofCacheSize
+	}
+	return &proofCache{ttl: ttl, maxSize: maxSize, entries: make(map[string]proofCacheEntry)}
+}
+
+// get returns the cached response for key, or computes it with fn. Only successful
+// responses are cached. A nil cache always calls fn.
+func (c *proofCache) get(key string, fn func() ([]byte, int, error)) ([]byte, int, error) {
+	if c == nil {
+		return fn()
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	hit := ok && time.Now().Before(entry.expires)
+	c.mu.Unlock()
+	cacheLookup("proof", hit)
+	if hit {
+		return entry.resp, http.StatusOK, nil
+	}
+
+	type result struct {
+		resp []byte
+		code int
+	}
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		resp, code, err := fn()
+		if err == nil {
+			c.put(key, resp)
+		}
+		return result{resp, code}, err
+	})
+	r := v.(result)
+	return r.resp, r.code, err
+}
+
+func (c *proofCache) put(key string, resp []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.maxSize {
+		// Drop whatever has expired, and if that isn't enough, start over. Entries only
+		// live for a few seconds, so there is little point in anything smarter.
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxSize {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = proofCacheEntry{resp: resp, expires: now.Add(c.ttl)}
+}
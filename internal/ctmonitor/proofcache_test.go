@@ -0,0 +1,92 @@
+package ctmonitor
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProofCache(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		size int
+		// The proofs requested in order, waiting sleep before each
+		keys  []string
+		sleep time.Duration
+		// How many times the proof is computed
+		want int
+	}{
+		{"hit", time.Minute, 0, []string{"a", "a", "a"}, 0, 1},
+		{"different proofs", time.Minute, 0, []string{"a", "b", "a", "b"}, 0, 2},
+		{"expired", 10 * time.Millisecond, 0, []string{"a", "a"}, 20 * time.Millisecond, 2},
+		{"disabled", 0, 0, []string{"a", "a"}, 0, 2},
+		{"full", time.Minute, 2, []string{"a", "b", "c", "a"}, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newProofCache(tt.ttl, tt.size)
+			computed := 0
+			for _, key := range tt.keys {
+				time.Sleep(tt.sleep)
+				resp, code, err := c.get(key, func() ([]byte, int, error) {
+					computed++
+					return []byte(key), http.StatusOK, nil
+				})
+				if err != nil || code != http.StatusOK || string(resp) != key {
+					t.Fatalf("get(%q) = %q, %d, %v", key, resp, code, err)
+				}
+			}
+			if computed != tt.want {
+				t.Errorf("proof computed %d times, want %d", computed, tt.want)
+			}
+		})
+	}
+}
+
+func TestProofCacheErrors(t *testing.T) {
+	c := newProofCache(time.Minute, 0)
+	failing := func() ([]byte, int, error) {
+		return nil, http.StatusBadRequest, errors.New("tree size too large")
+	}
+	for range 2 {
+		if _, code, err := c.get("a", failing); err == nil || code != http.StatusBadRequest {
+			t.Fatalf("get = %d, %v, want the error", code, err)
+		}
+	}
+	// The failure isn't cached
+	resp, _, err := c.get("a", func() ([]byte, int, error) { return []byte("proof"), http.StatusOK, nil })
+	if err != nil || string(resp) != "proof" {
+		t.Errorf("get after a failure = %q, %v", resp, err)
+	}
+}
+
+func TestProofCacheConcurrent(t *testing.T) {
+	c := newProofCache(time.Minute, 0)
+	var mu sync.Mutex
+	computed := 0
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.get("a", func() ([]byte, int, error) {
+				mu.Lock()
+				computed++
+				mu.Unlock()
+				<-release
+				return []byte("proof"), http.StatusOK, nil
+			})
+		}()
+	}
+	// Give every request a chance to join the one computation
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if computed != 1 {
+		t.Errorf("proof computed %d times by concurrent requests, want 1", computed)
+	}
+}
@@ -0,0 +1,187 @@
+package ctmonitor
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"itko.dev/internal/sunlight"
+)
+
+type RateLimitConfig struct {
+	// Requests per second allowed from each client IP, and the burst above that.
+	// Zero disables the per-IP limit.
+	PerIP      float64
+	PerIPBurst int
+	// Requests per second allowed across all clients. Zero disables the global limit.
+	Global      float64
+	GlobalBurst int
+	// If set, the client IP is taken from this header instead of the connection, for
+	// monitors behind a load balancer. For X-Forwarded-For, the first address is used.
+	IPHeader string
+}
+
+// Per-IP limiters are forgotten once the client has been idle this long
+const rateLimitIdle = 10 * time.Minute
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter protects the bucket from clients that read more than their share. Each
+// request costs one token, except get-entries, which costs one per data tile it reads,
+// since a large range is many times more expensive to serve than anything else.
+type rateLimiter struct {
+	config      RateLimitConfig
+	maxGetEntry int
+	global      *rate.Limiter
+
+	mu        sync.Mutex
+	clients   map[string]*ipLimiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(c RateLimitConfig, maxGetEntry int) *rateLimiter {
+	if c.PerIP <= 0 && c.Global <= 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		config:      c,
+		maxGetEntry: maxGetEntry,
+		clients:     make(map[string]*ipLimiter),
+		lastSweep:   time.Now(),
+	}
+	if c.Global > 0 {
+		l.global = rate.NewLimiter(rate.Limit(c.Global), max(c.GlobalBurst, 1))
+	}
+	return l
+}
+
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.config.IPHeader != "" {
+		if value := r.Header.Get(l.config.IPHeader); value != "" {
+			first, _, _ := strings.Cut(value, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forClient returns the limiter for a client IP, and drops idle clients every so often
+// so the map doesn't grow forever.
+func (l *rateLimiter) forClient(ip string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		for key, client := range l.clients {
+			if now.Sub(client.lastSeen) > rateLimitIdle {
+				delete(l.clients, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &ipLimiter{limiter: rate.NewLimiter(rate.Limit(l.config.PerIP), max(l.config.PerIPBurst, 1))}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	return client.limiter
+}
+
+// cost is the number of tokens a request takes.
+func (l *rateLimiter) cost(r *http.Request) int {
+	if r.URL.Path != "/ct/v1/get-entries" {
+		return 1
+	}
+	query := r.URL.Query()
+	start, err1 := strconv.ParseInt(query.Get("start"), 10, 64)
+	end, err2 := strconv.ParseInt(query.Get("end"), 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 1
+	}
+	if end-start >= int64(l.maxGetEntry) {
+		end = start + int64(l.maxGetEntry) - 1
+	}
+	return int(end/sunlight.TileWidth-start/sunlight.TileWidth) + 1
+}
+
+// reserve takes n tokens from the limiter, and returns how long until they would be
+// available if it can't. Nothing is taken if the request is refused.
+func reserve(limiter *rate.Limiter, n int, now time.Time) (*rate.Reservation, time.Duration) {
+	// A request that costs more than the burst can never be allowed, so it is
+	// charged the whole burst instead
+	n = min(n, limiter.Burst())
+	res := limiter.ReserveN(now, n)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return nil, delay
+	}
+	return res, 0
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limiter *rate.Limiter, now time.Time) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limiter.Burst()))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(max(int(limiter.TokensAt(now)), 0)))
+}
+
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Load balancers shouldn't take a monitor out of service for being busy
+		if r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		cost := l.cost(r)
+
+		var client *rate.Reservation
+		if l.config.PerIP > 0 {
+			limiter := l.forClient(l.clientIP(r), now)
+			var delay time.Duration
+			client, delay = reserve(limiter, cost, now)
+			setRateLimitHeaders(w, limiter, now)
+			if client == nil {
+				tooManyRequests(w, delay)
+				return
+			}
+		}
+
+		if l.global != nil {
+			if _, delay := reserve(l.global, cost, now); delay > 0 {
+				// The client's tokens weren't used, so give them back
+				if client != nil {
+					client.CancelAt(now)
+				}
+				tooManyRequests(w, delay)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, delay time.Duration) {
+	seconds := strconv.Itoa(int(math.Ceil(delay.Seconds())))
+	w.Header().Set("Retry-After", seconds)
+	w.Header().Set("RateLimit-Reset", seconds)
+	writeError(w, http.StatusTooManyRequests, withReason(reasonRateLimited, fmt.Errorf("rate limit exceeded")))
+}
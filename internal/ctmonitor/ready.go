@@ -0,0 +1,68 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// DefaultReadyTimeout is how long the readiness check waits on the storage if no timeout
+// is configured.
+const DefaultReadyTimeout = 5 * time.Second
+
+// checkReady fetches the STH and one of the tiles on the right edge of its tree from the
+// storage, bypassing the caches, so that a monitor pointed at a broken origin reports
+// itself as not ready. A different tile is picked each time, so that over a few checks
+// every level is covered without fetching them all on every check.
+func (f Fetch) checkReady(ctx context.Context) error {
+	raw, _, err := f.s.Get(ctx, "ct/v1/get-sth")
+	if err != nil {
+		return fmt.Errorf("unable to fetch STH: %w", err)
+	}
+	var sth ct.SignedTreeHead
+	if err := json.Unmarshal(raw, &sth); err != nil {
+		return fmt.Errorf("unable to unmarshal STH: %w", err)
+	}
+	if sth.TreeSize == 0 {
+		return nil
+	}
+
+	// Level -1 is the data tile, which has the same width as the level zero tile
+	levels := 1
+	for n := int64(sth.TreeSize); n >= sunlight.TileWidth; n >>= sunlight.TileHeight {
+		levels++
+	}
+	level := rand.IntN(levels+1) - 1
+
+	l := max(level, 0)
+	hashes := int64(sth.TreeSize) >> (l * sunlight.TileHeight)
+	tile := tlog.TileForIndex(sunlight.TileHeight, tlog.StoredHashIndex(l*sunlight.TileHeight, hashes-1))
+	tile.L = level
+	if _, _, err := f.s.Get(ctx, sunlight.Path(tile)); err != nil {
+		return fmt.Errorf("unable to fetch tile %s: %w", sunlight.Path(tile), err)
+	}
+	return nil
+}
+
+// readyz serves GET /readyz for load balancers.
+func (f Fetch) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), f.readyTimeout)
+	defer cancel()
+
+	if err := f.checkReady(ctx); err != nil {
+		slog.WarnContext(r.Context(), "Readiness check failed", "error", err)
+		writeError(w, http.StatusServiceUnavailable, storageError(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
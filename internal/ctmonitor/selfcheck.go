@@ -0,0 +1,96 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// What to do when the storage fails the startup check.
+const (
+	StartupCheckOff  = "off"
+	StartupCheckWarn = "warn"
+	StartupCheckFail = "fail"
+)
+
+// startupCheck checks that the storage is consistent before anything is served, so that a
+// bucket with a missing or corrupt tile is found at startup rather than by users getting
+// errors from get-entries. Depending on the mode, a failure is logged or returned.
+func startupCheck(ctx context.Context, mode string, f Fetch, integrity *integrityChecker) error {
+	if mode == "" || mode == StartupCheckOff {
+		return nil
+	}
+	if mode != StartupCheckWarn && mode != StartupCheckFail {
+		return fmt.Errorf("invalid startup check mode %q", mode)
+	}
+
+	treeSize, err := selfCheck(ctx, f, integrity)
+	if err != nil {
+		if mode == StartupCheckFail {
+			return fmt.Errorf("storage failed the startup check: %w", err)
+		}
+		slog.ErrorContext(ctx, "Storage failed the startup check, serving anyway", "error", err)
+		return nil
+	}
+	slog.InfoContext(ctx, "Storage passed the startup check", "tree_size", treeSize)
+	return nil
+}
+
+// selfCheck verifies the STH and checkpoint, and that the right edge tiles of the tree
+// hash up to the STH's root hash. The last data tile is parsed, and each of its leaves is
+// checked against the tree. It returns the size of the checked tree.
+func selfCheck(ctx context.Context, f Fetch, integrity *integrityChecker) (int64, error) {
+	// Signatures can only be checked if the monitor was given the log's key
+	if integrity != nil {
+		if err := integrity.check(ctx, f.s); err != nil {
+			return 0, err
+		}
+	}
+
+	raw, _, err := f.s.Get(ctx, "ct/v1/get-sth")
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch STH: %w", err)
+	}
+	var sth ct.SignedTreeHead
+	if err := json.Unmarshal(raw, &sth); err != nil {
+		return 0, fmt.Errorf("unable to unmarshal STH: %w", err)
+	}
+	tree := tlog.Tree{N: int64(sth.TreeSize), Hash: tlog.Hash(sth.SHA256RootHash)}
+
+	// The checkpoint is published after the STH, so it may be for an older tree
+	checkpoint, _, err := f.s.Get(ctx, "checkpoint")
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch checkpoint: %w", err)
+	}
+	body, _, _ := strings.Cut(string(checkpoint), "\n\n")
+	cp, err := sunlight.ParseCheckpoint(body + "\n")
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse checkpoint: %w", err)
+	}
+	if cp.N > tree.N {
+		return 0, fmt.Errorf("checkpoint size %d is larger than the STH size %d", cp.N, tree.N)
+	}
+	if cp.N == tree.N && cp.Hash != tree.Hash {
+		return 0, fmt.Errorf("checkpoint and STH have different root hashes at size %d", tree.N)
+	}
+
+	if tree.N == 0 {
+		return 0, nil
+	}
+
+	// Reading the hashes of the last data tile makes the TileHashReader fetch every tile
+	// on the right edge of the tree, and check them against the root hash.
+	reader := tlog.TileHashReader(tree, tileReader(ctx, f.s))
+	lastTile := (tree.N - 1) / sunlight.TileWidth
+	if err := verifyLeaves(ctx, f.s, reader, tree, lastTile*sunlight.TileWidth, tree.N, f.mirrored); err != nil {
+		return 0, err
+	}
+
+	return tree.N, nil
+}
@@ -0,0 +1,83 @@
+package ctmonitor
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"itko.dev/internal/sunlight"
+)
+
+// The tiles, checkpoint, and issuers are served as they are stored in the bucket, so that
+// tile-aware monitors can read the log through the monitor without access to the bucket.
+
+// writeStatic writes a file from the bucket with the headers for its key.
+func writeStatic(w http.ResponseWriter, r *http.Request, key string, data []byte) {
+	contentType, cacheControl := sunlight.ObjectHeaders(key)
+	if surrogateKey := sunlight.SurrogateKey(key); surrogateKey != "" {
+		w.Header().Set("Surrogate-Key", surrogateKey)
+	}
+	if setCacheHeaders(w, r, etagFor(data), cacheControl) {
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(data); err != nil {
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
+	}
+}
+
+func (f Fetch) tile(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if _, err := sunlight.ParsePath(path); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	data, notfound, err := f.s.Get(r.Context(), path)
+	if notfound {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tile not found"))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusServiceUnavailable, storageError(err))
+		return
+	}
+
+	writeStatic(w, r, path, data)
+}
+
+func (f Fetch) checkpoint(w http.ResponseWriter, r *http.Request) {
+	data, err := f.get(r.Context(), "checkpoint")
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, storageError(err))
+		return
+	}
+	if f.integrity != nil {
+		if _, err := f.integrity.verifyCheckpoint(data); err != nil {
+			writeError(w, http.StatusServiceUnavailable, withReason(reasonIntegrity, err))
+			return
+		}
+	}
+	writeStatic(w, r, "checkpoint", data)
+}
+
+func (f Fetch) issuer(w http.ResponseWriter, r *http.Request) {
+	fpBytes, err := hex.DecodeString(r.PathValue("fingerprint"))
+	if err != nil || len(fpBytes) != 32 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("invalid issuer fingerprint"))
+		return
+	}
+
+	// Issuers are only fetched once, and are checked against their fingerprint
+	data, err := f.getIssuer(r.Context(), [32]byte(fpBytes))
+	if err != nil {
+		if _, notfound, _ := f.s.Get(r.Context(), "issuer/"+r.PathValue("fingerprint")); notfound {
+			writeError(w, http.StatusNotFound, fmt.Errorf("issuer not found"))
+			return
+		}
+		writeError(w, http.StatusServiceUnavailable, storageError(err))
+		return
+	}
+	writeStatic(w, r, fmt.Sprintf("issuer/%x", fpBytes), data)
+}
@@ -0,0 +1,160 @@
+package ctmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+)
+
+// StatusResponse is returned by GET /status. Everything in it is derived from what the
+// sequencer has written to the bucket, so it is only as fresh as the latest STH.
+type StatusResponse struct {
+	Name string `json:"name,omitempty"`
+
+	TreeSize     uint64 `json:"treeSize"`
+	STHTimestamp uint64 `json:"sthTimestamp"`
+	STHAgeMs     int64  `json:"sthAgeMs"`
+
+	CheckpointOrigin string `json:"checkpointOrigin,omitempty"`
+	CheckpointSize   uint64 `json:"checkpointSize"`
+
+	// SCTs are only returned once the entry is covered by a published STH, so an entry
+	// is merged within roughly one flush interval of being submitted.
+	MergeDelayEstimateMs int `json:"mergeDelayEstimateMs,omitempty"`
+
+	AcceptedRoots int `json:"acceptedRoots"`
+
+	NotAfterStart string `json:"notAfterStart,omitempty"`
+	NotAfterLimit string `json:"notAfterLimit,omitempty"`
+
+	// Set while the STH or checkpoint in the bucket fails verification
+	IntegrityError string `json:"integrityError,omitempty"`
+}
+
+// logInfo mirrors ctsubmit.LogInfo, which the sequencer writes to int/log.json on startup.
+type logInfo struct {
+	Name          string `json:"name"`
+	NotAfterStart string `json:"notAfterStart"`
+	NotAfterLimit string `json:"notAfterLimit"`
+	FlushMs       int    `json:"flushMs"`
+}
+
+func (f Fetch) getStatus(ctx context.Context) (StatusResponse, error) {
+	var status StatusResponse
+	status.IntegrityError = f.integrity.failed()
+
+	sth, err := f.getSth(ctx)
+	if err != nil {
+		return status, fmt.Errorf("unable to fetch STH: %w", err)
+	}
+	status.TreeSize = sth.TreeSize
+	status.STHTimestamp = sth.Timestamp
+	status.STHAgeMs = time.Since(time.UnixMilli(int64(sth.Timestamp))).Milliseconds()
+
+	// The checkpoint is published after the STH, so it may briefly lag behind
+	checkpoint, err := f.get(ctx, "checkpoint")
+	if err != nil {
+		return status, fmt.Errorf("unable to fetch checkpoint: %w", err)
+	}
+	lines := strings.SplitN(string(checkpoint), "\n", 3)
+	if len(lines) < 3 {
+		return status, fmt.Errorf("malformed checkpoint")
+	}
+	status.CheckpointOrigin = lines[0]
+	status.CheckpointSize, err = strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return status, fmt.Errorf("malformed checkpoint size: %w", err)
+	}
+
+	rootsBytes, err := f.get(ctx, "ct/v1/get-roots")
+	if err != nil {
+		return status, fmt.Errorf("unable to fetch roots: %w", err)
+	}
+	var roots ct.GetRootsResponse
+	if err := json.Unmarshal(rootsBytes, &roots); err != nil {
+		return status, fmt.Errorf("unable to unmarshal roots: %w", err)
+	}
+	status.AcceptedRoots = len(roots.Certificates)
+
+	// Logs whose sequencer hasn't been restarted since this was added won't have it yet
+	infoBytes, notfound, err := f.s.Get(ctx, "int/log.json")
+	switch {
+	case notfound:
+	case err != nil:
+		return status, fmt.Errorf("unable to fetch log info: %w", err)
+	default:
+		var info logInfo
+		if err := json.Unmarshal(infoBytes, &info); err != nil {
+			return status, fmt.Errorf("unable to unmarshal log info: %w", err)
+		}
+		status.Name = info.Name
+		status.NotAfterStart = info.NotAfterStart
+		status.NotAfterLimit = info.NotAfterLimit
+		status.MergeDelayEstimateMs = info.FlushMs
+	}
+
+	return status, nil
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{with .Name}}{{.}}{{else}}Log{{end}} status</title></head>
+<body>
+<h1>{{with .Name}}{{.}}{{else}}Log{{end}} status</h1>
+<table>
+<tr><th align="left">Tree size</th><td>{{.TreeSize}}</td></tr>
+<tr><th align="left">Latest STH</th><td>{{.STHTime}} ({{.STHAge}} ago)</td></tr>
+<tr><th align="left">Checkpoint</th><td>{{.CheckpointOrigin}} at {{.CheckpointSize}}</td></tr>
+{{with .MergeDelayEstimateMs}}<tr><th align="left">Merge delay</th><td>about {{.}}ms</td></tr>{{end}}
+<tr><th align="left">Accepted roots</th><td>{{.AcceptedRoots}}</td></tr>
+{{with .IntegrityError}}<tr><th align="left">Integrity</th><td>failed: {{.}}</td></tr>{{end}}
+{{if .NotAfterStart}}<tr><th align="left">Temporal window</th><td>{{.NotAfterStart}} to {{.NotAfterLimit}}</td></tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+// status serves the status page as JSON, or as HTML to browsers.
+func (f Fetch) status(w http.ResponseWriter, r *http.Request) {
+	status, err := f.getStatus(r.Context())
+	if err != nil {
+		slog.WarnContext(r.Context(), "Unable to build status", "error", err)
+		writeError(w, http.StatusServiceUnavailable, storageError(err))
+		return
+	}
+
+	w.Header().Set("Cache-Control", cacheRevalidate)
+	var buf bytes.Buffer
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = statusTemplate.Execute(&buf, struct {
+			StatusResponse
+			STHTime string
+			STHAge  time.Duration
+		}{
+			StatusResponse: status,
+			STHTime:        time.UnixMilli(int64(status.STHTimestamp)).UTC().Format(time.RFC3339),
+			STHAge:         (time.Duration(status.STHAgeMs) * time.Millisecond).Round(time.Second),
+		})
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(&buf).Encode(status)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
+	}
+}
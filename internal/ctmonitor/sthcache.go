@@ -0,0 +1,68 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+)
+
+// Nearly every read endpoint needs the latest STH, and a new one is only published every
+// flush interval, so it is kept for a few seconds instead of being fetched from storage
+// on every request.
+type sthCache struct {
+	ttl      time.Duration
+	verifier *ct.SignatureVerifier
+
+	mu      sync.Mutex
+	fetched time.Time
+	raw     []byte
+	sth     ct.SignedTreeHead
+}
+
+func newSTHCache(c Config) (*sthCache, error) {
+	cache := &sthCache{ttl: c.STHCacheTTL}
+	if c.PublicKey != nil {
+		verifier, err := ct.NewSignatureVerifier(c.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create STH verifier: %w", err)
+		}
+		cache.verifier = verifier
+	}
+	return cache, nil
+}
+
+// get returns the raw and parsed STH, fetching it if the cached copy has expired.
+// Concurrent requests wait on the same fetch rather than all going to storage.
+func (c *sthCache) get(ctx context.Context, s Storage) ([]byte, ct.SignedTreeHead, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hit := c.raw != nil && time.Since(c.fetched) < c.ttl
+	cacheLookup("sth", hit)
+	if hit {
+		return c.raw, c.sth, nil
+	}
+
+	raw, _, err := s.Get(ctx, "ct/v1/get-sth")
+	if err != nil {
+		return nil, ct.SignedTreeHead{}, err
+	}
+	var sth ct.SignedTreeHead
+	if err := json.Unmarshal(raw, &sth); err != nil {
+		return nil, ct.SignedTreeHead{}, err
+	}
+	if c.verifier != nil {
+		if err := c.verifier.VerifySTHSignature(sth); err != nil {
+			return nil, ct.SignedTreeHead{}, fmt.Errorf("invalid STH signature: %w", err)
+		}
+	}
+
+	if c.ttl > 0 {
+		c.raw, c.sth, c.fetched = raw, sth, time.Now()
+	}
+	return raw, sth, nil
+}
@@ -2,48 +2,127 @@ package ctmonitor
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 type Storage interface {
 	Get(ctx context.Context, key string) (data []byte, notfounderr bool, err error)
-	AvailableReqs() int
 }
 
+// errRequestBudget is returned by a storage that can only make a limited number of
+// requests to its origin, once a fetch would go over the limit. Fetches answered from a
+// cache don't count against it.
+var errRequestBudget = errors.New("origin request budget exhausted")
+
 // ------------------------------------------------------------
 
+// UrlStorageConfig controls how tiles are fetched from an HTTP origin.
+type UrlStorageConfig struct {
+	// Time allowed for each attempt. Defaults to 10 seconds.
+	Timeout time.Duration
+	// Number of times a request is retried after a 5xx or network error
+	Retries int
+	// Sent with every request, such as an Authorization header for an internal origin
+	Headers map[string]string
+	// PEM file of root CAs to trust instead of the system roots
+	CAFile string
+	// If set, full tiles and issuers are kept in this directory across restarts,
+	// up to CacheMaxBytes
+	CacheDirectory string
+	CacheMaxBytes  int64
+}
+
 type UrlStorage struct {
 	urlPrefix string
+	client    *http.Client
+	config    UrlStorageConfig
+}
+
+func NewUrlStorage(urlPrefix string, c UrlStorageConfig) (*UrlStorage, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	return &UrlStorage{
+		urlPrefix: urlPrefix,
+		// Requests to the tile store are traced as children of the request being served
+		client: &http.Client{Transport: otelhttp.NewTransport(transport)},
+		config: c,
+	}, nil
 }
 
 func (f *UrlStorage) Get(ctx context.Context, key string) (data []byte, notfounderr bool, err error) {
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		data, notfounderr, retry, err = f.get(ctx, key)
+		if err == nil || !retry || attempt >= f.config.Retries {
+			return data, notfounderr, err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, false, err
+		}
+	}
+}
+
+func (f *UrlStorage) get(ctx context.Context, key string) (data []byte, notfounderr bool, retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, f.config.Timeout)
+	defer cancel()
+
 	req, err := http.NewRequestWithContext(ctx, "GET", f.urlPrefix+key, nil)
 	if err != nil {
-		return nil, false, err
+		return nil, false, false, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	for k, v := range f.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := f.client.Do(req)
 	if err != nil {
-		return nil, false, err
+		return nil, false, true, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 404 {
-			return nil, true, errors.New(resp.Status)
+			return nil, true, false, errors.New(resp.Status)
 		} else {
-			return nil, false, errors.New(resp.Status)
+			return nil, false, resp.StatusCode >= 500, errors.New(resp.Status)
 		}
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, false, err
+		return nil, false, true, err
 	}
-	return body, false, nil
-}
-
-func (f *UrlStorage) AvailableReqs() int {
-	return 1
+	return body, false, false, nil
 }
 
 // ------------------------------------------------------------
@@ -66,6 +145,50 @@ func (f *FsStorage) Get(ctx context.Context, key string) (data []byte, notfounde
 	return data, false, nil
 }
 
-func (f *FsStorage) AvailableReqs() int {
-	return 1
+// ------------------------------------------------------------
+
+// S3Storage reads tiles straight from the bucket with credentials, so the bucket
+// doesn't have to be public. It takes the same settings as the S3 storage in ctsubmit.
+type S3Storage struct {
+	client *s3.Client
+	bucket string
+}
+
+func NewS3Storage(region, bucket, endpoint, username, password, sessionToken, addressingStyle string, accelerate bool) *S3Storage {
+	s3Config := aws.Config{
+		Credentials: credentials.NewStaticCredentialsProvider(username, password, sessionToken),
+		Region:      region,
+	}
+	// Without an endpoint, the SDK picks the regional AWS endpoint
+	if endpoint != "" {
+		s3Config.BaseEndpoint = aws.String(endpoint)
+	}
+	otelaws.AppendMiddlewares(&s3Config.APIOptions)
+
+	client := s3.NewFromConfig(s3Config, func(o *s3.Options) {
+		o.UsePathStyle = addressingStyle != "virtual"
+		o.UseAccelerate = accelerate
+	})
+
+	return &S3Storage{
+		client: client,
+		bucket: bucket,
+	}
+}
+
+func (b *S3Storage) Get(ctx context.Context, key string) (data []byte, notfounderr bool, err error) {
+	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *s3types.NoSuchKey
+		return nil, errors.As(err, &notFound), err
+	}
+	defer output.Body.Close()
+	data, err = io.ReadAll(output.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
 }
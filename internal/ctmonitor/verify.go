@@ -0,0 +1,188 @@
+package ctmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/alert"
+	"itko.dev/internal/sunlight"
+)
+
+const alertInvalidSignature = "invalid_signature"
+
+// errInvalidSignature is returned when the bucket holds an STH or checkpoint that wasn't
+// signed by the log's key, as opposed to when the bucket couldn't be read.
+var errInvalidSignature = errors.New("invalid signature")
+
+// integrityChecker verifies the STH and checkpoint in the bucket against the log's public
+// key, at startup and then periodically. If either doesn't verify, or they are for
+// different trees, the bucket has been tampered with or corrupted, and nothing is served
+// until it passes again.
+type integrityChecker struct {
+	verifier *ct.SignatureVerifier
+	// The checkpoint must be signed for origin, which comes from the config rather than
+	// the checkpoint, so that one the key signed for another log doesn't verify
+	origin     string
+	noteVerify note.Verifier
+	alerts     alert.Config
+	interval   time.Duration
+
+	// The reason the last check failed, or nil if it passed
+	failure atomic.Pointer[string]
+}
+
+func newIntegrityChecker(c Config) (*integrityChecker, error) {
+	if c.PublicKey == nil {
+		return nil, nil
+	}
+	if c.Origin == "" {
+		return nil, fmt.Errorf("the checkpoint origin must be set to verify the checkpoint against the public key")
+	}
+	verifier, err := ct.NewSignatureVerifier(c.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create STH verifier: %w", err)
+	}
+	noteVerify, err := sunlight.NewRFC6962Verifier(c.Origin, c.PublicKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create checkpoint verifier for origin %q: %w", c.Origin, err)
+	}
+	return &integrityChecker{
+		verifier:   verifier,
+		origin:     c.Origin,
+		noteVerify: noteVerify,
+		alerts:     c.Alerts,
+		interval:   c.IntegrityCheckInterval,
+	}, nil
+}
+
+// verifyCheckpoint checks the checkpoint's signature and origin, and returns its tree.
+func (c *integrityChecker) verifyCheckpoint(checkpoint []byte) (tlog.Tree, error) {
+	n, err := note.Open(checkpoint, note.VerifierList(c.noteVerify))
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("%w: checkpoint: %v", errInvalidSignature, err)
+	}
+	cp, err := sunlight.ParseCheckpoint(n.Text)
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("%w: unable to parse checkpoint: %v", errInvalidSignature, err)
+	}
+	if cp.Origin != c.origin {
+		return tlog.Tree{}, fmt.Errorf("%w: checkpoint has origin %q, expected %q", errInvalidSignature, cp.Origin, c.origin)
+	}
+	return cp.Tree, nil
+}
+
+// headsAttempts is how many times the STH and checkpoint are read before they are taken
+// to be for different trees. The sequencer writes the checkpoint just after the STH, so a
+// read between the two writes sees them apart.
+const headsAttempts = 3
+
+// check fetches the STH and checkpoint straight from storage, skipping the STH cache, and
+// checks that they are signed by the log for the same tree.
+func (c *integrityChecker) check(ctx context.Context, s Storage) error {
+	for attempt := 1; ; attempt++ {
+		raw, _, err := s.Get(ctx, "ct/v1/get-sth")
+		if err != nil {
+			return fmt.Errorf("unable to fetch STH: %w", err)
+		}
+		var sth ct.SignedTreeHead
+		if err := json.Unmarshal(raw, &sth); err != nil {
+			return fmt.Errorf("%w: unable to unmarshal STH: %v", errInvalidSignature, err)
+		}
+		if err := c.verifier.VerifySTHSignature(sth); err != nil {
+			return fmt.Errorf("%w: STH: %v", errInvalidSignature, err)
+		}
+
+		checkpoint, _, err := s.Get(ctx, "checkpoint")
+		if err != nil {
+			return fmt.Errorf("unable to fetch checkpoint: %w", err)
+		}
+		tree, err := c.verifyCheckpoint(checkpoint)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case tree.N == int64(sth.TreeSize) && tree.Hash == tlog.Hash(sth.SHA256RootHash):
+			return nil
+		case tree.N == int64(sth.TreeSize):
+			return fmt.Errorf("%w: checkpoint and STH have different root hashes at size %d", errInvalidSignature, tree.N)
+		case attempt == headsAttempts:
+			return fmt.Errorf("%w: checkpoint is for size %d, but the STH is for size %d", errInvalidSignature, tree.N, sth.TreeSize)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 250 * time.Millisecond):
+		}
+	}
+}
+
+// run checks the bucket every interval until the context is done. A bucket that can't
+// be read doesn't change whether the last check passed.
+func (c *integrityChecker) run(ctx context.Context, s Storage) {
+	if c.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.update(ctx, s)
+	}
+}
+
+func (c *integrityChecker) update(ctx context.Context, s Storage) {
+	err := c.check(ctx, s)
+	switch {
+	case err == nil:
+		if c.failure.Swap(nil) != nil {
+			slog.InfoContext(ctx, "STH and checkpoint verify again, serving requests")
+		}
+	case errors.Is(err, errInvalidSignature):
+		reason := err.Error()
+		if c.failure.Swap(&reason) == nil {
+			slog.ErrorContext(ctx, "Bucket failed verification, refusing to serve requests", "error", err)
+			alert.New(c.origin, c.alerts).Send(alertInvalidSignature, reason)
+		}
+	default:
+		slog.WarnContext(ctx, "Unable to verify the bucket", "error", err)
+	}
+}
+
+// failed returns why the last check failed, or an empty string if it passed.
+func (c *integrityChecker) failed() string {
+	if c == nil {
+		return ""
+	}
+	if reason := c.failure.Load(); reason != nil {
+		return *reason
+	}
+	return ""
+}
+
+// gate refuses every request except the status page while the bucket fails verification.
+func (c *integrityChecker) gate(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := c.failed(); reason != "" && r.URL.Path != "/status" {
+			writeError(w, http.StatusServiceUnavailable, withReason(reasonIntegrity, errors.New(reason)))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
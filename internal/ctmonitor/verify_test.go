@@ -0,0 +1,116 @@
+package ctmonitor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"itko.dev/internal/sunlight"
+)
+
+// memStorage is a Storage in memory.
+type memStorage map[string][]byte
+
+func (m memStorage) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	data, ok := m[key]
+	return data, !ok, nil
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sunlight.NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := sunlight.NewSigner(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const origin = "example.com/log"
+	root, other1 := [32]byte{1}, [32]byte{2}
+	sth := func(s *sunlight.Signer, size uint64, hash [32]byte) []byte {
+		data, err := sunlight.SignTreeHead(s, size, 1700000000000, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	checkpoint := func(origin string, s *sunlight.Signer, size int64, hash [32]byte) []byte {
+		data, err := sunlight.SignTreeHeadCheckpoint(origin, s, size, 1700000000000, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name       string
+		sth        []byte
+		checkpoint []byte
+		// Empty if the check passes
+		want string
+	}{
+		{"same tree", sth(signer, 10, root), checkpoint(origin, signer, 10, root), ""},
+		{"other origin", sth(signer, 10, root), checkpoint("other.example/log", signer, 10, root), "checkpoint"},
+		{"other key", sth(signer, 10, root), checkpoint(origin, otherSigner, 10, root), "checkpoint"},
+		{"STH from other key", sth(otherSigner, 10, root), checkpoint(origin, signer, 10, root), "STH"},
+		{"split view", sth(signer, 10, root), checkpoint(origin, signer, 10, other1), "different root hashes"},
+		{"older checkpoint", sth(signer, 10, root), checkpoint(origin, signer, 9, root), "size 9"},
+		{"newer checkpoint", sth(signer, 10, root), checkpoint(origin, signer, 11, root), "size 11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newIntegrityChecker(Config{PublicKey: key.Public(), Origin: origin})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := memStorage{"ct/v1/get-sth": tt.sth, "checkpoint": tt.checkpoint}
+			err = c.check(context.Background(), s)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("check = %v, want it to pass", err)
+			case tt.want == "":
+			case !errors.Is(err, errInvalidSignature):
+				t.Errorf("check = %v, want an invalid signature error", err)
+			case !strings.Contains(err.Error(), tt.want):
+				t.Errorf("check = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntegrityCheckerNeedsOrigin(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newIntegrityChecker(Config{PublicKey: key.Public()}); err == nil {
+		t.Error("newIntegrityChecker succeeded without an origin")
+	}
+	if c, err := newIntegrityChecker(Config{}); c != nil || err != nil {
+		t.Errorf("newIntegrityChecker without a key = %v, %v, want nil, nil", c, err)
+	}
+	cc := kvConfig{Name: "example.com/log"}
+	if got := cc.apply(Config{}).Origin; got != "example.com/log" {
+		t.Errorf("origin from the KV config = %q, want the log's name", got)
+	}
+	cc.CheckpointOrigin = "example.com/origin"
+	if got := cc.apply(Config{}).Origin; got != "example.com/origin" {
+		t.Errorf("origin from the KV config = %q, want its checkpointOrigin", got)
+	}
+	if got := cc.apply(Config{Origin: "flag.example/log"}).Origin; got != "flag.example/log" {
+		t.Errorf("origin = %q, want the one configured", got)
+	}
+}
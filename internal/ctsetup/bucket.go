@@ -0,0 +1,132 @@
+package ctsetup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"itko.dev/internal/ctsubmit"
+)
+
+// The objects the monitor and clients of the static API read through the public URL of
+// the bucket. Anything else put in the bucket stays private.
+var publicObjects = []string{
+	"checkpoint",
+	"ct/v1/get-sth",
+	"ct/v1/get-roots",
+	"tile/*",
+	"issuer/*",
+	"sth/*",
+	"int/hashes/*",
+	"int/dedupe/*",
+	"int/log.json",
+	logListKey,
+}
+
+// provisionBucket creates the log's bucket if it doesn't exist yet, and sets it up to be
+// served directly: public reads of the log's objects only, CORS so that browsers can
+// read them, and a lifecycle rule that cleans up abandoned multipart uploads.
+func provisionBucket(ctx context.Context, gc ctsubmit.GlobalConfig) error {
+	client := ctsubmit.NewS3Client(gc.S3Region, gc.S3EndpointUrl, gc.S3StaticCredentialUserName, gc.S3StaticCredentialPassword, gc.S3Options())
+	bucket := aws.String(gc.S3Bucket)
+
+	input := &s3.CreateBucketInput{Bucket: bucket}
+	// us-east-1 is the default, and is rejected as a location constraint
+	if gc.S3Region != "" && gc.S3Region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			LocationConstraint: s3types.BucketLocationConstraint(gc.S3Region),
+		}
+	}
+	_, err := client.CreateBucket(ctx, input)
+	var owned *s3types.BucketAlreadyOwnedByYou
+	switch {
+	case errors.As(err, &owned):
+		slog.Info("Bucket already exists", "bucket", gc.S3Bucket)
+	case err != nil:
+		return fmt.Errorf("unable to create bucket: %w", err)
+	default:
+		slog.Info("Created bucket", "bucket", gc.S3Bucket)
+	}
+
+	// New buckets on AWS block public bucket policies
+	_, err = client.DeletePublicAccessBlock(ctx, &s3.DeletePublicAccessBlockInput{Bucket: bucket})
+	if err := ignoreUnsupported(err, "public access block"); err != nil {
+		return fmt.Errorf("unable to allow a public bucket policy: %w", err)
+	}
+
+	resources := make([]string, 0, len(publicObjects))
+	for _, o := range publicObjects {
+		resources = append(resources, "arn:aws:s3:::"+gc.S3Bucket+"/"+o)
+	}
+	policy, err := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Sid":       "PublicReadLogObjects",
+			"Effect":    "Allow",
+			"Principal": "*",
+			"Action":    []string{"s3:GetObject"},
+			"Resource":  resources,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.PutBucketPolicy(ctx, &s3.PutBucketPolicyInput{Bucket: bucket, Policy: aws.String(string(policy))})
+	if err != nil {
+		return fmt.Errorf("unable to set bucket policy: %w", err)
+	}
+
+	_, err = client.PutBucketCors(ctx, &s3.PutBucketCorsInput{
+		Bucket: bucket,
+		CORSConfiguration: &s3types.CORSConfiguration{
+			CORSRules: []s3types.CORSRule{{
+				AllowedMethods: []string{http.MethodGet, http.MethodHead},
+				AllowedOrigins: []string{"*"},
+				MaxAgeSeconds:  aws.Int32(86400),
+			}},
+		},
+	})
+	if err := ignoreUnsupported(err, "CORS"); err != nil {
+		return fmt.Errorf("unable to set bucket CORS: %w", err)
+	}
+
+	// Nothing the log writes ever expires, so this only cleans up after failed uploads
+	_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: bucket,
+		LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{
+			Rules: []s3types.LifecycleRule{{
+				ID:     aws.String("abort-incomplete-uploads"),
+				Status: s3types.ExpirationStatusEnabled,
+				Filter: &s3types.LifecycleRuleFilterMemberPrefix{Value: ""},
+				AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{
+					DaysAfterInitiation: aws.Int32(1),
+				},
+			}},
+		},
+	})
+	if err := ignoreUnsupported(err, "lifecycle"); err != nil {
+		return fmt.Errorf("unable to set bucket lifecycle: %w", err)
+	}
+
+	slog.Info("Provisioned bucket", "bucket", gc.S3Bucket)
+	return nil
+}
+
+// ignoreUnsupported drops the error of a bucket setting that the provider doesn't
+// implement, as most S3-compatible providers only have some of them.
+func ignoreUnsupported(err error, setting string) error {
+	var responseError *awshttp.ResponseError
+	if errors.As(err, &responseError) && responseError.HTTPStatusCode() == http.StatusNotImplemented {
+		slog.Warn("Bucket setting isn't supported by the provider, skipping it", "setting", setting)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package ctsetup
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+
+	"itko.dev/internal/ctsubmit"
+)
+
+// Where the log list entry is kept in the bucket, next to the log info
+const logListKey = "int/log-list.json"
+
+// The log list entry is an operator with only this log, in the format of the v3 log lists
+// of Chrome and Apple, so that it can be pasted into an inclusion request as is.
+type logListOperator struct {
+	Name  string         `json:"name"`
+	Email []string       `json:"email"`
+	Logs  []logListEntry `json:"logs"`
+}
+
+type logListEntry struct {
+	Description      string           `json:"description"`
+	LogID            string           `json:"log_id"`
+	Key              []byte           `json:"key"`
+	Url              string           `json:"url"`
+	Mmd              int              `json:"mmd"`
+	TemporalInterval temporalInterval `json:"temporal_interval"`
+}
+
+type temporalInterval struct {
+	StartInclusive string `json:"start_inclusive"`
+	EndExclusive   string `json:"end_exclusive"`
+}
+
+// logList returns the log list entry of the log with the public key pub, or nil if the
+// config has no logList.url.
+func logList(gc ctsubmit.GlobalConfig, pub crypto.PublicKey) ([]byte, error) {
+	if gc.LogList.Url == "" {
+		return nil, nil
+	}
+	key, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal public key: %w", err)
+	}
+
+	entry := logListEntry{
+		Description: gc.LogList.Description,
+		LogID:       gc.LogID,
+		Key:         key,
+		Url:         gc.LogList.Url,
+		Mmd:         gc.LogList.Mmd,
+		TemporalInterval: temporalInterval{
+			StartInclusive: gc.NotAfterStart,
+			EndExclusive:   gc.NotAfterLimit,
+		},
+	}
+	if entry.Description == "" {
+		entry.Description = gc.Name
+	}
+	if entry.Mmd == 0 {
+		entry.Mmd = 86400
+	}
+	email := gc.LogList.OperatorEmail
+	if email == nil {
+		email = []string{}
+	}
+	return json.MarshalIndent(logListOperator{Name: gc.LogList.OperatorName, Email: email, Logs: []logListEntry{entry}}, "", "  ")
+}
@@ -3,122 +3,211 @@ package ctsetup
 import (
 	"context"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
+	"fmt"
 	"log"
-	"os"
+	"log/slog"
 	"time"
 
-	"github.com/google/certificate-transparency-go/x509util"
-	consul "github.com/hashicorp/consul/api"
-
+	"itko.dev/internal/coordination"
 	"itko.dev/internal/ctsubmit"
 	"itko.dev/internal/sunlight"
 )
 
-func MainMain(ctx context.Context, consulAddress, consulKey, rootCerts, signingKey string, gc ctsubmit.GlobalConfig) {
-	err := uploadRoots(ctx, rootCerts, gc)
-	if err != nil {
-		log.Fatalf("Failed to upload root certificates to S3: %v", err)
+// Options change what Setup does to a log that already exists.
+type Options struct {
+	// Overwrite the STH of an existing log with an empty tree, and its config with one
+	// of a different key. This throws away every entry already in the log.
+	Force bool
+	// Check the key, config, and roots, and that the KV store and bucket can be read,
+	// then log what would be written instead of writing it.
+	DryRun bool
+	// Create the S3 bucket if needed, and set its policy, CORS, and lifecycle so that it
+	// can be served directly.
+	ProvisionBucket bool
+}
+
+func MainMain(ctx context.Context, coord coordination.Config, consulKey, rootCerts, signingKey string, gc ctsubmit.GlobalConfig, opts Options) {
+	if err := Setup(ctx, coord, consulKey, rootCerts, signingKey, gc, opts); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	err = uploadConfig(consulAddress, consulKey, gc)
+// Setup is the same as MainMain, but returns an error instead of exiting
+// so that it can be used by the shard manager.
+//
+// Running it again against an existing log only updates the roots and the config, so
+// that it can be used to change them on a live log. An existing STH is left alone, and
+// a config with a different log ID is refused, unless opts.Force is set.
+func Setup(ctx context.Context, coord coordination.Config, consulKey, rootCerts, signingKey string, gc ctsubmit.GlobalConfig, opts Options) error {
+	// Nothing is uploaded unless the whole config is valid
+	err := gc.Validate()
 	if err != nil {
-		log.Fatalf("Failed to upload config to Consul: %v", err)
+		return err
 	}
-
-	err = uploadEmptySth(ctx, signingKey, gc)
+	rootBytes, rootCount, err := readRoots(ctx, rootCerts)
 	if err != nil {
-		log.Fatalf("Failed to upload empty STH to S3: %v", err)
+		return fmt.Errorf("failed to read root certificates: %w", err)
 	}
-}
 
-func uploadConfig(consulAddress, consulKey string, globalConfig ctsubmit.GlobalConfig) error {
-	// Upload config to Consul
-	globalConfigBytes, err := json.Marshal(globalConfig)
+	if opts.ProvisionBucket {
+		switch {
+		case gc.RootDirectory != "" || gc.S3Bucket == "":
+			return fmt.Errorf("only an S3 bucket can be provisioned")
+		case opts.DryRun:
+			slog.Info("Would provision bucket", "bucket", gc.S3Bucket)
+		default:
+			if err := provisionBucket(ctx, gc); err != nil {
+				return err
+			}
+		}
+	}
+
+	store, err := coordination.New(coord)
 	if err != nil {
 		return err
 	}
+	storage := newStorage(gc)
 
-	config := consul.DefaultConfig()
-	config.Address = consulAddress
-	client, err := consul.NewClient(config)
+	existing, err := existingConfig(ctx, store, consulKey)
 	if err != nil {
 		return err
 	}
-	kv := client.KV()
-	_, err = kv.Put(&consul.KVPair{
-		Key:   consulKey + "/config",
-		Value: globalConfigBytes,
-	}, nil)
-
-	return err
-}
-
-func uploadRoots(ctx context.Context, rootCerts string, gc ctsubmit.GlobalConfig) error {
-	r := x509util.NewPEMCertPool()
-	err := r.AppendCertsFromPEMFile(rootCerts)
+	if existing != nil && existing.LogID != gc.LogID && !opts.Force {
+		return fmt.Errorf("%s already holds the config of log %s, not %s, use -force to replace it", consulKey, existing.LogID, gc.LogID)
+	}
+	started, err := hasTreeHead(ctx, storage)
 	if err != nil {
 		return err
 	}
+	writeSth := !started || opts.Force
+
+	// The key is only needed to sign the empty tree and for the log list entry, but it is
+	// loaded before anything is written so that a wrong key doesn't leave a log half set up
+	var key *sunlight.Signer
+	var logListBytes []byte
+	if writeSth || opts.DryRun || gc.LogList.Url != "" {
+		keyConfig := gc
+		if signingKey != "" {
+			keyConfig.KeyPath = signingKey
+		}
+		key, err = ctsubmit.NewSigner(keyConfig)
+		if err != nil {
+			return fmt.Errorf("failed to load key: %w", err)
+		}
+		logID, err := ctsubmit.LogIDForKey(key.Public())
+		if err != nil {
+			return err
+		}
+		if logID != gc.LogID {
+			return fmt.Errorf("logID in the config is %s, but the log ID of the key is %s", gc.LogID, logID)
+		}
+		logListBytes, err = logList(gc, key.Public())
+		if err != nil {
+			return err
+		}
+	}
 
-	roots := r.RawCertificates()
-	var res struct {
-		Certificates [][]byte `json:"certificates"`
+	if opts.DryRun {
+		slog.Info("Dry run, nothing will be written", "kv_path", consulKey, "log_id", gc.LogID)
+		slog.Info("Would upload roots", "key", "ct/v1/get-roots", "count", rootCount)
+		slog.Info("Would write config", "key", consulKey+"/config", "replaces_existing", existing != nil)
+		if logListBytes != nil {
+			slog.Info("Would upload log list entry", "key", logListKey)
+		}
+		if writeSth {
+			slog.Info("Would upload the STH of the empty tree", "key", "ct/v1/get-sth", "replaces_existing", started)
+		} else {
+			slog.Info("Would leave the existing STH alone")
+		}
+		return nil
 	}
 
-	res.Certificates = make([][]byte, 0, len(roots))
-	for _, r := range roots {
-		res.Certificates = append(res.Certificates, r.Raw)
+	err = storage.Set(ctx, "ct/v1/get-roots", rootBytes)
+	if err != nil {
+		return fmt.Errorf("failed to upload root certificates to S3: %w", err)
 	}
 
-	rootBytes, err := json.Marshal(res)
+	err = uploadConfig(ctx, store, consulKey, gc)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to upload config: %w", err)
 	}
 
-	var storage ctsubmit.Storage
-	if gc.RootDirectory != "" {
-		s := ctsubmit.NewFsStorage(gc.RootDirectory)
-		storage = &s
-	} else {
-		s := ctsubmit.NewS3Storage(gc.S3Region, gc.S3Bucket, gc.S3EndpointUrl, gc.S3StaticCredentialUserName, gc.S3StaticCredentialPassword)
-		storage = &s
+	// Written from the same config as the log, so that the two can't drift apart
+	if logListBytes != nil {
+		err = storage.Set(ctx, logListKey, logListBytes)
+		if err != nil {
+			return fmt.Errorf("failed to upload log list entry: %w", err)
+		}
+		slog.Info("Uploaded log list entry", "key", logListKey)
 	}
-	return storage.Set(ctx, "ct/v1/get-roots", rootBytes)
 
+	if !writeSth {
+		slog.Info("Log already has an STH, only updated its roots and config", "kv_path", consulKey)
+		return nil
+	}
+	err = uploadEmptySth(ctx, key, storage)
+	if err != nil {
+		return fmt.Errorf("failed to upload empty STH to S3: %w", err)
+	}
+
+	return nil
 }
 
-func uploadEmptySth(ctx context.Context, signingKey string, gc ctsubmit.GlobalConfig) error {
-	keyPEM, err := os.ReadFile(signingKey)
+// existingConfig returns the config already stored at consulKey, if any.
+func existingConfig(ctx context.Context, store coordination.Store, consulKey string) (*ctsubmit.GlobalConfig, error) {
+	e, err := store.Get(ctx, consulKey+"/config")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("unable to read existing config: %w", err)
+	}
+	if !e.Exists() {
+		return nil, nil
+	}
+	var gc ctsubmit.GlobalConfig
+	if err := json.Unmarshal(e.Value, &gc); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal existing config: %w", err)
+	}
+	return &gc, nil
+}
+
+// hasTreeHead reports whether the log has published an STH or checkpoint, which an
+// empty tree must not replace.
+func hasTreeHead(ctx context.Context, storage ctsubmit.Storage) (bool, error) {
+	for _, key := range []string{"ct/v1/get-sth", "checkpoint"} {
+		exists, err := storage.Exists(ctx, key)
+		if err != nil {
+			return false, fmt.Errorf("unable to check for an existing %s: %w", key, err)
+		}
+		if exists {
+			return true, nil
+		}
 	}
-	keyBlock, _ := pem.Decode(keyPEM)
+	return false, nil
+}
 
-	// keyDecrypted, err := x509.DecryptPEMBlock(keyBlock, []byte("dirk"))
-	// if err != nil {
-	// 	return err
-	// }
+func newStorage(gc ctsubmit.GlobalConfig) ctsubmit.Storage {
+	if gc.RootDirectory != "" {
+		s := ctsubmit.NewFsStorage(gc.RootDirectory)
+		return &s
+	}
+	s := ctsubmit.NewS3Storage(gc.S3Region, gc.S3Bucket, gc.S3EndpointUrl, gc.S3StaticCredentialUserName, gc.S3StaticCredentialPassword, gc.S3Options())
+	return &s
+}
 
-	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+func uploadConfig(ctx context.Context, store coordination.Store, consulKey string, globalConfig ctsubmit.GlobalConfig) error {
+	// Upload config to Consul or etcd
+	globalConfigBytes, err := json.Marshal(globalConfig)
 	if err != nil {
 		return err
 	}
+	return store.Put(ctx, consulKey+"/config", globalConfigBytes)
+}
 
+func uploadEmptySth(ctx context.Context, key *sunlight.Signer, storage ctsubmit.Storage) error {
 	jsonBytes, err := sunlight.SignTreeHead(key, 0, uint64(time.Now().UnixMilli()), sha256.Sum256([]byte("")))
 	if err != nil {
 		return err
 	}
 
-	var storage ctsubmit.Storage
-	if gc.RootDirectory != "" {
-		s := ctsubmit.NewFsStorage(gc.RootDirectory)
-		storage = &s
-	} else {
-		s := ctsubmit.NewS3Storage(gc.S3Region, gc.S3Bucket, gc.S3EndpointUrl, gc.S3StaticCredentialUserName, gc.S3StaticCredentialPassword)
-		storage = &s
-	}
 	return storage.Set(ctx, "ct/v1/get-sth", jsonBytes)
 }
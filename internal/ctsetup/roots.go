@@ -0,0 +1,164 @@
+package ctsetup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+)
+
+// Bundles fetched over https are limited to this size, which is far more than every
+// root in every root program
+const maxRootBundleBytes = 64 << 20
+
+// rootsFile is one file of PEM roots, named for the summary.
+type rootsFile struct {
+	name string
+	data []byte
+}
+
+// readRoots returns the get-roots response for the roots in rootCerts, and how many roots
+// it has. rootCerts is a comma separated list of PEM files, directories of .pem and .crt
+// files, and https URLs of PEM bundles, such as one published by a root program. A root
+// found in more than one place is only included once.
+func readRoots(ctx context.Context, rootCerts string) ([]byte, int, error) {
+	var res struct {
+		Certificates [][]byte `json:"certificates"`
+	}
+	seen := make(map[[32]byte]bool)
+	duplicates := 0
+
+	for _, source := range strings.Split(rootCerts, ",") {
+		files, err := readRootsSource(ctx, strings.TrimSpace(source))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, f := range files {
+			certs, err := parseRoots(f.data)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s: %w", f.name, err)
+			}
+			for _, cert := range certs {
+				fingerprint := sha256.Sum256(cert.Raw)
+				if seen[fingerprint] {
+					duplicates++
+					continue
+				}
+				seen[fingerprint] = true
+				res.Certificates = append(res.Certificates, cert.Raw)
+				slog.Info("Accepted root", "subject", cert.Subject.String(), "sha256", hex.EncodeToString(fingerprint[:]), "source", f.name)
+			}
+		}
+	}
+	if len(res.Certificates) == 0 {
+		return nil, 0, fmt.Errorf("no roots found in %s", rootCerts)
+	}
+	slog.Info("Read roots", "count", len(res.Certificates), "duplicates", duplicates)
+
+	rootBytes, err := json.Marshal(res)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rootBytes, len(res.Certificates), nil
+}
+
+// readRootsSource reads the PEM files of one entry of rootCerts.
+func readRootsSource(ctx context.Context, source string) ([]rootsFile, error) {
+	if strings.HasPrefix(source, "http://") {
+		return nil, fmt.Errorf("roots must be fetched over https: %s", source)
+	}
+	if strings.HasPrefix(source, "https://") {
+		data, err := fetchRoots(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		return []rootsFile{{name: source, data: data}}, nil
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		return []rootsFile{{name: source, data: data}}, nil
+	}
+
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, err
+	}
+	var files []rootsFile
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		name := filepath.Join(source, e.Name())
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, rootsFile{name: name, data: data})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .pem or .crt files in %s", source)
+	}
+	return files, nil
+}
+
+func fetchRoots(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch roots: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch roots from %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxRootBundleBytes))
+}
+
+// parseRoots returns the certificates in the PEM data, which must have at least one.
+func parseRoots(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if x509.IsFatal(err) {
+			return nil, fmt.Errorf("unable to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return certs, nil
+}
@@ -0,0 +1,272 @@
+package ctshard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/ctsetup"
+	"itko.dev/internal/ctsubmit"
+	"itko.dev/internal/server"
+)
+
+// Template describes how to create a yearly temporal shard. It is stored as JSON in
+// Consul, and every string field other than Config and RootCerts has {year} replaced
+// with the year of the shard, so "itko/ct{year}" becomes "itko/ct2026".
+type Template struct {
+	// Config is the base configuration shared by every shard. Name, KeyPath, LogID,
+	// NotAfterStart, and NotAfterLimit are filled in per shard.
+	Config ctsubmit.GlobalConfig `json:"config"`
+
+	KVPath  string `json:"kvPath"`
+	Name    string `json:"name"`
+	KeyPath string `json:"keyPath"`
+	// Only one of these needs to be set, matching the storage used by Config.
+	RootDirectory string `json:"rootDirectory"`
+	S3Bucket      string `json:"s3Bucket"`
+
+	// Accepted roots uploaded to every new shard, in the same form as -root-certs of
+	// itko-setup.
+	RootCerts string `json:"rootCerts"`
+	// If set, a new P-256 key is generated at KeyPath when it doesn't exist.
+	// Otherwise, the key is expected to be provisioned externally before the
+	// shard is due, and creation is retried until it shows up.
+	GenerateKeys bool `json:"generateKeys"`
+	// How many days before a shard can first receive submissions it is created.
+	LeadDays int `json:"leadDays"`
+}
+
+func (t *Template) format(s string, year int) string {
+	return strings.ReplaceAll(s, "{year}", strconv.Itoa(year))
+}
+
+type Manager struct {
+	store       coordination.Store
+	coord       coordination.Config
+	templateKey string
+	router      *ctsubmit.ShardRouter
+
+	// Shards which have already been loaded, keyed by year
+	loaded map[int]bool
+	// Cancelling this stops every shard and releases its lock
+	runCtx context.Context
+	// Tracks shards that haven't released their lock yet
+	released sync.WaitGroup
+}
+
+func NewManager(runCtx context.Context, coord coordination.Config, templateKey string, router *ctsubmit.ShardRouter) (*Manager, error) {
+	store, err := coordination.New(coord)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		store:       store,
+		coord:       coord,
+		templateKey: templateKey,
+		router:      router,
+		loaded:      make(map[int]bool),
+		runCtx:      runCtx,
+	}, nil
+}
+
+func (m *Manager) template(ctx context.Context) (Template, error) {
+	var t Template
+	raw, err := m.store.Get(ctx, m.templateKey)
+	if err != nil {
+		return t, err
+	}
+	if !raw.Exists() {
+		return t, fmt.Errorf("no shard template found at %s", m.templateKey)
+	}
+	if err := json.Unmarshal(raw.Value, &t); err != nil {
+		return t, fmt.Errorf("unable to unmarshal shard template: %w", err)
+	}
+	if !strings.Contains(t.KVPath, "{year}") {
+		return t, errors.New("shard template kvPath must contain {year}")
+	}
+	return t, nil
+}
+
+// The longest validity period accepted by the CA/Browser Forum baseline requirements.
+const maxValidityDays = 398
+
+// Reconcile makes sure every shard that could receive submissions exists and is
+// being served, creating shards once they are within the lead time.
+func (m *Manager) Reconcile(ctx context.Context, now time.Time) error {
+	t, err := m.template(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Certificates being issued now can expire up to maxValidityDays from now, so every
+	// year up to then needs a shard, plus any year that will be needed within the lead time.
+	first := now.UTC().Year()
+	last := now.UTC().AddDate(0, 0, maxValidityDays+t.LeadDays).Year()
+
+	var errs []error
+	for year := first; year <= last; year++ {
+		if m.loaded[year] {
+			continue
+		}
+		if err := m.ensure(ctx, t, year); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", year, err))
+			continue
+		}
+		if err := m.load(ctx, t, year); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", year, err))
+			continue
+		}
+		m.loaded[year] = true
+	}
+	return errors.Join(errs...)
+}
+
+// ensure runs the ctsetup equivalent for a shard if it doesn't have a config yet.
+func (m *Manager) ensure(ctx context.Context, t Template, year int) error {
+	kvpath := t.format(t.KVPath, year)
+
+	// Serialize creation so that a standby running the same manager can't set up
+	// the same shard twice and overwrite the STH of a shard that is already in use.
+	lock, err := m.store.Lock(ctx, m.templateKey+"/lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	existing, err := m.store.Get(ctx, kvpath+"/config")
+	if err != nil {
+		return err
+	}
+	if existing.Exists() {
+		return nil
+	}
+
+	gc := t.Config
+	gc.Name = t.format(t.Name, year)
+	gc.KeyPath = t.format(t.KeyPath, year)
+	gc.NotAfterStart = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	gc.NotAfterLimit = time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+	if t.RootDirectory != "" {
+		gc.RootDirectory = t.format(t.RootDirectory, year)
+	}
+	if t.S3Bucket != "" {
+		gc.S3Bucket = t.format(t.S3Bucket, year)
+	}
+
+	// Keys in a KMS are shared by every shard, so there is nothing to generate
+	isFile := gc.Signer.Type == "" || gc.Signer.Type == ctsubmit.SignerFile
+	if _, err := os.Stat(gc.KeyPath); isFile && errors.Is(err, os.ErrNotExist) {
+		if !t.GenerateKeys {
+			return fmt.Errorf("key %s does not exist yet", gc.KeyPath)
+		}
+		slog.Info("Generating key for shard", "year", year, "key_path", gc.KeyPath)
+		if _, err := ctsubmit.GenerateSigningKey(gc.KeyPath, gc.KeyPassphraseFile); err != nil {
+			return fmt.Errorf("unable to generate key: %w", err)
+		}
+	}
+
+	signer, err := ctsubmit.NewSigner(gc)
+	if err != nil {
+		return err
+	}
+	gc.LogID, err = ctsubmit.LogIDForKey(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	if gc.RootDirectory != "" {
+		if err := os.MkdirAll(gc.RootDirectory, 0755); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Creating shard", "name", gc.Name, "kv_path", kvpath, "log_id", gc.LogID)
+	return ctsetup.Setup(ctx, m.coord, kvpath, t.RootCerts, gc.KeyPath, gc, ctsetup.Options{})
+}
+
+func (m *Manager) load(ctx context.Context, t Template, year int) error {
+	kvpath := t.format(t.KVPath, year)
+
+	// Shards outlive the reconcile that loaded them
+	ctloghandle, logmux, done, err := ctsubmit.LoadWithFailover(m.runCtx, kvpath, m.coord)
+	if err != nil {
+		return err
+	}
+	m.released.Add(1)
+	go func() {
+		<-done
+		m.released.Done()
+	}()
+
+	slog.Info("Serving shard", "kv_path", kvpath)
+	return m.router.Add("/"+path.Base(kvpath), ctloghandle, logmux)
+}
+
+// Run reconciles the shards once an hour until the context is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Reconcile(ctx, time.Now()); err != nil {
+				slog.Error("Unable to reconcile shards", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// MainMain serves every shard created from the template in Consul at templateKey,
+// creating new shards ahead of each year boundary.
+func MainMain(ctx context.Context, listener net.Listener, templateKey string, coord coordination.Config, startSignal chan<- struct{}) {
+	router := ctsubmit.NewShardRouter()
+	runCtx, stopShards := context.WithCancel(ctx)
+
+	m, err := NewManager(runCtx, coord, templateKey, router)
+	if err != nil {
+		log.Fatalf("Failed to create shard manager: %v", err)
+	}
+
+	// The current year's shard has to be up before serving, but later shards
+	// are allowed to fail here and be retried, for example while waiting on
+	// an externally provisioned key.
+	if err := m.Reconcile(ctx, time.Now()); err != nil {
+		slog.Error("Unable to reconcile shards", "error", err)
+	}
+	if !m.loaded[time.Now().UTC().Year()] {
+		log.Fatal("Failed to load the shard for the current year")
+	}
+	go m.Run(runCtx)
+
+	if startSignal != nil {
+		startSignal <- struct{}{}
+	}
+
+	// Every shard is created from the same template, so they share its server limits
+	t, err := m.template(ctx)
+	if err != nil {
+		log.Fatalf("Failed to fetch shard template: %v", err)
+	}
+
+	err = server.Serve(listener, router, t.Config.Server, func() {
+		stopShards()
+		m.released.Wait()
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+package ctsubmit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"itko.dev/internal/alert"
+)
+
+type AlertConfig struct {
+	// Where alerts are sent
+	alert.Config
+	// Alert when the latest STH is older than this. Zero disables the check.
+	StaleSthMs int `json:"staleSthMs"`
+}
+
+// Alert kinds
+const (
+	alertPipelineFailed = "pipeline_failed"
+	alertLockLost       = "lock_lost"
+	alertStaleSTH       = "stale_sth"
+)
+
+// Before alerts, the only signal that the log had stopped making progress was a log
+// line, after which the process kept serving 503s.
+func newAlerter(gc GlobalConfig) *alert.Alerter {
+	return alert.New(gc.Name, gc.Alerts.Config)
+}
+
+// watchSTH alerts once each time the latest STH becomes older than staleSthMs.
+// Stage one flushes a pool every flush interval even when it is empty, or every
+// minSthIntervalMs if that is set, so on a healthy log the STH is never much older
+// than that.
+func (l *Log) watchSTH(ctx context.Context) {
+	threshold := time.Duration(l.config.Alerts.StaleSthMs) * time.Millisecond
+	if threshold <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(threshold / 4)
+	defer ticker.Stop()
+	stale := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if l.lifecycle.State() != StateUsable {
+			return
+		}
+		age := time.Since(time.UnixMilli(l.stageTwoData.metrics.lastSTH.Load()))
+		if age > threshold && !stale {
+			l.alerts.Send(alertStaleSTH, fmt.Sprintf("latest STH is %s old", age.Round(time.Second)))
+		}
+		stale = age > threshold
+	}
+}
@@ -0,0 +1,149 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The log's key can be kept in Azure Key Vault, which is called over its REST API.
+// Credentials come from a service principal's secret, in AZURE_TENANT_ID,
+// AZURE_CLIENT_ID, and AZURE_CLIENT_SECRET, or otherwise from the managed identity of
+// the instance the log runs on. AZURE_CLIENT_ID picks a user-assigned managed identity.
+
+const (
+	azureKeyVaultApiVersion = "7.4"
+	azureKeyVaultResource   = "https://vault.azure.net"
+	azureImdsUrl            = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+type azureKeyVaultSigner struct {
+	keyId  string
+	public crypto.PublicKey
+	client *http.Client
+	tokens *tokenSource
+}
+
+func newAzureKeyVaultSigner(ctx context.Context, keyId string) (*azureKeyVaultSigner, error) {
+	u, err := url.Parse(keyId)
+	if err != nil || u.Scheme != "https" || len(strings.Split(strings.Trim(u.Path, "/"), "/")) != 3 {
+		return nil, fmt.Errorf("azureKeyId must be a key identifier with a version, such as https://<vault>.vault.azure.net/keys/<name>/<version>")
+	}
+	client := &http.Client{Timeout: remoteSignerTimeout}
+	s := &azureKeyVaultSigner{keyId: strings.TrimSuffix(keyId, "/"), client: client}
+
+	tenant, clientId, secret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	s.tokens = &tokenSource{fetch: func(ctx context.Context) (oauthToken, error) {
+		var req *http.Request
+		var err error
+		if secret != "" {
+			form := url.Values{
+				"grant_type":    {"client_credentials"},
+				"client_id":     {clientId},
+				"client_secret": {secret},
+				"scope":         {azureKeyVaultResource + "/.default"},
+			}
+			req, err = http.NewRequestWithContext(ctx, http.MethodPost, "https://login.microsoftonline.com/"+url.PathEscape(tenant)+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+			if err != nil {
+				return oauthToken{}, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureKeyVaultResource}}
+			if clientId != "" {
+				query.Set("client_id", clientId)
+			}
+			req, err = http.NewRequestWithContext(ctx, http.MethodGet, azureImdsUrl+"?"+query.Encode(), nil)
+			if err != nil {
+				return oauthToken{}, err
+			}
+			req.Header.Set("Metadata", "true")
+		}
+		var token oauthToken
+		return token, doJSON(client, req, &token)
+	}}
+
+	var resp struct {
+		Key struct {
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"key"`
+	}
+	if err := s.call(ctx, http.MethodGet, "", nil, &resp); err != nil {
+		return nil, fmt.Errorf("unable to get public key from Key Vault: %w", err)
+	}
+	if (resp.Key.Kty != "EC" && resp.Key.Kty != "EC-HSM") || resp.Key.Crv != "P-256" {
+		return nil, fmt.Errorf("Key Vault key is a %s %s key, expected a P-256 EC key", resp.Key.Crv, resp.Key.Kty)
+	}
+	x, errX := base64.RawURLEncoding.DecodeString(resp.Key.X)
+	y, errY := base64.RawURLEncoding.DecodeString(resp.Key.Y)
+	if errX != nil || errY != nil {
+		return nil, fmt.Errorf("unable to decode public key from Key Vault")
+	}
+	public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !public.Curve.IsOnCurve(public.X, public.Y) {
+		return nil, fmt.Errorf("public key from Key Vault is not on the curve")
+	}
+	s.public = public
+	return s, nil
+}
+
+func (s *azureKeyVaultSigner) call(ctx context.Context, method, suffix string, body, out any) error {
+	token, err := s.tokens.get(ctx)
+	if err != nil {
+		return err
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.keyId+suffix+"?api-version="+azureKeyVaultApiVersion, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(s.client, req, out)
+}
+
+func (s *azureKeyVaultSigner) Public() crypto.PublicKey { return s.public }
+
+func (s *azureKeyVaultSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("Key Vault key only signs SHA-256 digests")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteSignerTimeout)
+	defer cancel()
+
+	req := map[string]string{"alg": "ES256", "value": base64.RawURLEncoding.EncodeToString(digest)}
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := s.call(ctx, http.MethodPost, "/sign", req, &resp); err != nil {
+		return nil, fmt.Errorf("Key Vault signing failed: %w", err)
+	}
+
+	// Key Vault returns r and s concatenated, as in JWS, rather than ASN.1
+	raw, err := base64.RawURLEncoding.DecodeString(resp.Value)
+	if err != nil {
+		return nil, fmt.Errorf("Key Vault returned a malformed signature")
+	}
+	return rawSignature(raw)
+}
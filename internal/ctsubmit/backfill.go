@@ -0,0 +1,68 @@
+package ctsubmit
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+	"itko.dev/internal/sunlight"
+)
+
+// BackfillIndexes writes every file of the hash and dedupe indexes in layout from scratch,
+// with the records rebuilt from the data tiles of the published tree. layout can differ
+// from the log's, to change its mask size or layout version, after which the log's config
+// must be changed to match. Existing files are overwritten rather than merged, so records
+// for leaves past the tree size are dropped, and files of another layout are left as
+// they are. The sequencer mustn't be running, as it would keep adding to the old files.
+func BackfillIndexes(ctx context.Context, gc GlobalConfig, layout sunlight.IndexLayout, concurrency int) (hashFiles, dedupeFiles int, err error) {
+	if err := layout.Validate(); err != nil {
+		return 0, 0, fmt.Errorf("invalid index layout: %w", err)
+	}
+	concurrency = cmp.Or(concurrency, 16)
+	bucket := newBucket(gc)
+
+	tree, err := loadTree(ctx, bucket)
+	if err != nil {
+		return 0, 0, err
+	}
+	slog.Info("Rebuilding index records from the data tiles", "tree_size", tree.N)
+	hashes, dedupe, err := rebuildIndexes(ctx, bucket, tree, gc.MirroredEntries, concurrency)
+	if err != nil {
+		return 0, 0, err
+	}
+	return writeIndexes(ctx, bucket, hashes, dedupe, layout, concurrency)
+}
+
+// writeIndexes writes every file of the hash and dedupe indexes in layout with the records,
+// and returns how many files each has.
+func writeIndexes(ctx context.Context, bucket Bucket, hashes, dedupe *indexRecords, layout sunlight.IndexLayout, concurrency int) (hashFiles, dedupeFiles int, err error) {
+	counts := make([]int, 2)
+	for i, index := range []*indexRecords{hashes, dedupe} {
+		files := index.files(layout)
+		counts[i] = len(files)
+
+		var done atomic.Int64
+		stop := reportProgress("Wrote "+index.dir+" files", &done, int64(len(files)))
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(concurrency)
+		for _, f := range files {
+			g.Go(func() error {
+				key := index.dir + f.path
+				if err := bucket.set(gctx, key, append(sunlight.IndexHeader(index.recordSize), f.records...)); err != nil {
+					return fmt.Errorf("unable to write %s: %w", key, err)
+				}
+				done.Add(1)
+				return nil
+			})
+		}
+		err := g.Wait()
+		stop()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return counts[0], counts[1], nil
+}
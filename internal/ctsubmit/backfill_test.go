@@ -0,0 +1,46 @@
+package ctsubmit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"itko.dev/internal/sunlight"
+)
+
+func TestBackfillIndexes(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout sunlight.IndexLayout
+		ok     bool
+	}{
+		{"version 0", sunlight.IndexLayout{Mask: 5}, true},
+		{"version 1", sunlight.IndexLayout{Version: 1, Mask: 12, SegmentSize: 4}, true},
+		{"invalid layout", sunlight.IndexLayout{Mask: 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLog(t, 300)
+			l.writeSTH(t)
+			hashFiles, dedupeFiles, err := BackfillIndexes(context.Background(), GlobalConfig{RootDirectory: l.dir}, tt.layout, 4)
+			if (err == nil) != tt.ok {
+				t.Fatalf("BackfillIndexes = %v", err)
+			}
+			if tt.ok {
+				if hashFiles == 0 || dedupeFiles == 0 {
+					t.Errorf("BackfillIndexes wrote %d and %d files", hashFiles, dedupeFiles)
+				}
+				l.checkIndexes(t, tt.layout)
+			}
+		})
+	}
+}
+
+func TestBackfillIndexesCorruptTile(t *testing.T) {
+	l := newTestLog(t, 300)
+	l.writeSTH(t)
+	corrupt(t, filepath.Join(l.dir, "tile/data/001.p/44"))
+	if _, _, err := BackfillIndexes(context.Background(), GlobalConfig{RootDirectory: l.dir}, sunlight.IndexLayout{Mask: 5}, 4); err == nil {
+		t.Error("BackfillIndexes rebuilt the indexes from a data tile that doesn't match the tree")
+	}
+}
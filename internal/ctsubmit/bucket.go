@@ -2,12 +2,15 @@ package ctsubmit
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/google/certificate-transparency-go/x509"
@@ -18,30 +21,120 @@ import (
 
 type Bucket struct {
 	S Storage
+	// Deadlines of each call to S, so that one hung request fails instead of stalling
+	// the pipeline. Default to defaultStorageReadTimeout and defaultStorageWriteTimeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
 }
 
+const (
+	defaultStorageReadTimeout  = 10 * time.Second
+	defaultStorageWriteTimeout = 30 * time.Second
+)
+
+// Get reads key from storage, within the read timeout.
+func (b *Bucket) Get(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(b.ReadTimeout, defaultStorageReadTimeout))
+	defer cancel()
+	return b.S.Get(ctx, key)
+}
+
+func (b *Bucket) exists(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(b.ReadTimeout, defaultStorageReadTimeout))
+	defer cancel()
+	return b.S.Exists(ctx, key)
+}
+
+func (b *Bucket) set(ctx context.Context, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(b.WriteTimeout, defaultStorageWriteTimeout))
+	defer cancel()
+	return b.S.Set(ctx, key, data)
+}
+
+// TODO: move this logic into the storage interface
+func isNotFound(err error) bool {
+	var notFound *s3types.NoSuchKey
+	return errors.As(err, &notFound) || errors.Is(err, os.ErrNotExist) || errors.Is(err, errRecordNotFound)
+}
+
+// errRecordNotFound is returned by GetDedupeEntry for a hash that isn't in its index file.
+var errRecordNotFound = errors.New("record not found")
+
 // --------------------------------------------------------------------------------------------
 
 func (b *Bucket) SetTile(ctx context.Context, tile tlog.Tile, data []byte) error {
-	return b.S.Set(ctx, sunlight.Path(tile), data)
+	return b.set(ctx, sunlight.Path(tile), data)
 }
 
 func (b *Bucket) SetSth(ctx context.Context, data []byte) error {
-	return b.S.Set(ctx, "ct/v1/get-sth", data)
+	return b.set(ctx, "ct/v1/get-sth", data)
+}
+
+// ArchiveSth stores the STH for a new tree size under sth/, and adds the size to the
+// page of the STH index covering it, so auditors can fetch an STH for any tree size the
+// log has reached. Only the first STH for each size is archived.
+func (b *Bucket) ArchiveSth(ctx context.Context, treeSize uint64, data []byte) error {
+	if err := b.set(ctx, sunlight.STHPath(treeSize), data); err != nil {
+		return err
+	}
+
+	indexPath := sunlight.STHIndexPath(treeSize / sunlight.STHIndexPageSize)
+	var sizes []uint64
+	index, err := b.Get(ctx, indexPath)
+	if err != nil && !isNotFound(err) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(index, &sizes); err != nil {
+			return fmt.Errorf("unable to unmarshal STH index: %w", err)
+		}
+	}
+
+	// The index is sorted, and the same size may be archived twice if a
+	// previous attempt failed after writing the STH.
+	if len(sizes) > 0 && sizes[len(sizes)-1] >= treeSize {
+		return nil
+	}
+	sizes = append(sizes, treeSize)
+	index, err = json.Marshal(sizes)
+	if err != nil {
+		return err
+	}
+	return b.set(ctx, indexPath, index)
 }
 
 func (b *Bucket) SetCheckpoint(ctx context.Context, data []byte) error {
-	return b.S.Set(ctx, "checkpoint", data)
+	return b.set(ctx, "checkpoint", data)
+}
+
+// LogInfo is the public part of the log's config, which the monitor reports on its
+// status page. It is rewritten every time the sequencer starts.
+type LogInfo struct {
+	Name          string `json:"name"`
+	NotAfterStart string `json:"notAfterStart"`
+	NotAfterLimit string `json:"notAfterLimit"`
+	FlushMs       int    `json:"flushMs"`
+}
+
+func (b *Bucket) SetLogInfo(ctx context.Context, info LogInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return b.set(ctx, "int/log.json", data)
 }
 
 func (b *Bucket) SetIssuer(ctx context.Context, cert *x509.Certificate) error {
-	fingerprint := sha256.Sum256(cert.Raw)
-	exists, err := b.S.Exists(ctx, fmt.Sprintf("issuer/%x", fingerprint))
+	return b.setIssuer(ctx, cert.Raw)
+}
+
+func (b *Bucket) setIssuer(ctx context.Context, der []byte) error {
+	fingerprint := sha256.Sum256(der)
+	exists, err := b.exists(ctx, fmt.Sprintf("issuer/%x", fingerprint))
 	if err != nil {
 		return err
 	}
 	if !exists {
-		return b.S.Set(ctx, fmt.Sprintf("issuer/%x", fingerprint), cert.Raw)
+		return b.set(ctx, fmt.Sprintf("issuer/%x", fingerprint), der)
 	}
 	return nil
 }
@@ -92,13 +185,15 @@ func BytesToRecord(b []byte) (RecordHashUpload, error) {
 }
 
 // TODO: This NEEDS unit testing
-// TODO: convert these to use binary search
-func (b *Bucket) PutRecordHashes(ctx context.Context, hashes []RecordHashUpload, mask int) error {
+func (b *Bucket) PutRecordHashes(ctx context.Context, hashes []RecordHashUpload, layout sunlight.IndexLayout) (err error) {
+	ctx, span := tracer.Start(ctx, "bucket.PutRecordHashes")
+	defer func() { endSpan(span, err) }()
+
 	f := make(map[string][]byte)
 
 	// Populate the hash paths
 	for i := range hashes {
-		hashes[i].hashPath = sunlight.KAnonHashPath(hashes[i].hash[:], mask)
+		hashes[i].hashPath = layout.Path(hashes[i].hash[:])
 	}
 
 	// First, get all the files corresponding to all of the hashes.
@@ -107,37 +202,31 @@ func (b *Bucket) PutRecordHashes(ctx context.Context, hashes []RecordHashUpload,
 			continue
 		}
 
-		var err error
-		f[e.hashPath], err = b.S.Get(ctx, "int/hashes/"+e.hashPath)
+		file, err := b.Get(ctx, "int/hashes/"+e.hashPath)
 		if err != nil {
-			// TODO: move this logic into the storage interface
-			var notFound *s3types.NoSuchKey
-			if errors.As(err, &notFound) || errors.Is(err, os.ErrNotExist) {
+			if isNotFound(err) {
 				// If the file is not found, create a new one.
 				f[e.hashPath] = make([]byte, 0)
-			} else {
-				return err
+				continue
 			}
+			return err
+		}
+		f[e.hashPath], err = sunlight.IndexRecords(file, RHURecordSize)
+		if err != nil {
+			return fmt.Errorf("unable to read int/hashes/%s: %w", e.hashPath, err)
 		}
 	}
 
 	// Now, update the files with the new hashes.
 	for _, e := range hashes {
 		records := f[e.hashPath]
-		recordCount := len(records) / RHURecordSize
-
-		// Find the insertion point
-		insertIndex := recordCount
-		for i := 0; i < recordCount; i++ {
-			// insert 4 into the list 1 3 5 7 9.
-			// iterate until we find the first value that 4 is less than. Then, insert into that index.
-
-			// This is true if the first value is less than the second
-			if bytes.Compare(e.hash[:], records[i*RHURecordSize:(i*RHURecordSize)+RHUHashSize]) < 0 {
-				// the insertion point should be where the compared value currently is
-				insertIndex = i
-				break
-			}
+
+		// The records are sorted, so insert after the last one that isn't larger.
+		// Lookups return the first match, so an existing duplicate keeps winning.
+		insertIndex, found := sunlight.SearchIndex(records, RHURecordSize, e.hash[:])
+		for found && insertIndex < len(records)/RHURecordSize &&
+			bytes.Equal(records[insertIndex*RHURecordSize:insertIndex*RHURecordSize+RHUHashSize], e.hash[:]) {
+			insertIndex++
 		}
 
 		// Create the new byte slice with the inserted record
@@ -153,7 +242,7 @@ func (b *Bucket) PutRecordHashes(ctx context.Context, hashes []RecordHashUpload,
 	// Now, write the updated files back to the bucket.
 	g, gctx := errgroup.WithContext(ctx)
 	for k, v := range f {
-		g.Go(func() error { return b.S.Set(gctx, "int/hashes/"+k, v) })
+		g.Go(func() error { return b.set(gctx, "int/hashes/"+k, append(sunlight.IndexHeader(RHURecordSize), v...)) })
 	}
 
 	if err := g.Wait(); err != nil {
@@ -163,22 +252,21 @@ func (b *Bucket) PutRecordHashes(ctx context.Context, hashes []RecordHashUpload,
 	return nil
 }
 
-func (b *Bucket) GetRecordHash(ctx context.Context, hash [16]byte, mask int) (RecordHashUpload, error) {
-	f, err := b.S.Get(ctx, "int/hashes/"+sunlight.KAnonHashPath(hash[:], mask))
+func (b *Bucket) GetRecordHash(ctx context.Context, hash [16]byte, layout sunlight.IndexLayout) (_ RecordHashUpload, err error) {
+	ctx, span := tracer.Start(ctx, "bucket.GetRecordHash")
+	defer func() { endSpan(span, err) }()
+
+	f, err := b.Get(ctx, "int/hashes/"+layout.Path(hash[:]))
 	if err != nil {
 		return RecordHashUpload{}, err
 	}
 
-	recordCount := len(f) / RHURecordSize
-
-	for i := 0; i < recordCount; i++ {
-		record, err := BytesToRecord(f[i*RHURecordSize : (i+1)*RHURecordSize])
-		if err != nil {
-			return RecordHashUpload{}, err
-		}
-		if bytes.Equal(hash[:], record.hash[:]) {
-			return record, nil
-		}
+	records, err := sunlight.IndexRecords(f, RHURecordSize)
+	if err != nil {
+		return RecordHashUpload{}, err
+	}
+	if i, found := sunlight.SearchIndex(records, RHURecordSize, hash[:]); found {
+		return BytesToRecord(records[i*RHURecordSize : (i+1)*RHURecordSize])
 	}
 	return RecordHashUpload{}, errors.New("record not found")
 }
@@ -234,12 +322,15 @@ func BytesToDedupe(b []byte) (DedupeUpload, error) {
 }
 
 // TODO: This NEEDS unit testing
-func (b *Bucket) PutDedupeEntries(ctx context.Context, hashes []DedupeUpload, mask int) error {
+func (b *Bucket) PutDedupeEntries(ctx context.Context, hashes []DedupeUpload, layout sunlight.IndexLayout) (err error) {
+	ctx, span := tracer.Start(ctx, "bucket.PutDedupeEntries")
+	defer func() { endSpan(span, err) }()
+
 	f := make(map[string][]byte)
 
 	// Populate the hash paths
 	for i := range hashes {
-		hashes[i].hashPath = sunlight.KAnonHashPath(hashes[i].hash[:], mask)
+		hashes[i].hashPath = layout.Path(hashes[i].hash[:])
 	}
 
 	// First, get all the files corresponding to all of the hashes.
@@ -248,37 +339,31 @@ func (b *Bucket) PutDedupeEntries(ctx context.Context, hashes []DedupeUpload, ma
 			continue
 		}
 
-		var err error
-		f[e.hashPath], err = b.S.Get(ctx, "int/dedupe/"+e.hashPath)
+		file, err := b.Get(ctx, "int/dedupe/"+e.hashPath)
 		if err != nil {
-			// TODO: move this logic into the storage interface
-			var notFound *s3types.NoSuchKey
-			if errors.As(err, &notFound) || errors.Is(err, os.ErrNotExist) {
+			if isNotFound(err) {
 				// If the file is not found, create a new one.
 				f[e.hashPath] = make([]byte, 0)
-			} else {
-				return err
+				continue
 			}
+			return err
+		}
+		f[e.hashPath], err = sunlight.IndexRecords(file, DDURecordSize)
+		if err != nil {
+			return fmt.Errorf("unable to read int/dedupe/%s: %w", e.hashPath, err)
 		}
 	}
 
 	// Now, update the files with the new hashes.
 	for _, e := range hashes {
 		records := f[e.hashPath]
-		recordCount := len(records) / DDURecordSize
-
-		// Find the insertion point
-		insertIndex := recordCount
-		for i := 0; i < recordCount; i++ {
-			// insert 4 into the list 1 3 5 7 9.
-			// iterate until we find the first value that 4 is less than. Then, insert into that index.
-
-			// This is true if the first value is less than the second
-			if bytes.Compare(e.hash[:], records[i*DDURecordSize:(i*DDURecordSize)+DDUHashSize]) < 0 {
-				// the insertion point should be where the compared value currently is
-				insertIndex = i
-				break
-			}
+
+		// The records are sorted, so insert after the last one that isn't larger.
+		// Lookups return the first match, so an existing duplicate keeps winning.
+		insertIndex, found := sunlight.SearchIndex(records, DDURecordSize, e.hash[:])
+		for found && insertIndex < len(records)/DDURecordSize &&
+			bytes.Equal(records[insertIndex*DDURecordSize:insertIndex*DDURecordSize+DDUHashSize], e.hash[:]) {
+			insertIndex++
 		}
 
 		// Create the new byte slice with the inserted record
@@ -294,7 +379,7 @@ func (b *Bucket) PutDedupeEntries(ctx context.Context, hashes []DedupeUpload, ma
 	// Now, write the updated files back to the bucket.
 	g, gctx := errgroup.WithContext(ctx)
 	for k, v := range f {
-		g.Go(func() error { return b.S.Set(gctx, "int/dedupe/"+k, v) })
+		g.Go(func() error { return b.set(gctx, "int/dedupe/"+k, append(sunlight.IndexHeader(DDURecordSize), v...)) })
 	}
 
 	if err := g.Wait(); err != nil {
@@ -304,22 +389,21 @@ func (b *Bucket) PutDedupeEntries(ctx context.Context, hashes []DedupeUpload, ma
 	return nil
 }
 
-func (b *Bucket) GetDedupeEntry(ctx context.Context, hash [16]byte, mask int) (DedupeUpload, error) {
-	f, err := b.S.Get(ctx, "int/dedupe/"+sunlight.KAnonHashPath(hash[:], mask))
+func (b *Bucket) GetDedupeEntry(ctx context.Context, hash [16]byte, layout sunlight.IndexLayout) (_ DedupeUpload, err error) {
+	ctx, span := tracer.Start(ctx, "bucket.GetDedupeEntry")
+	defer func() { endSpan(span, err) }()
+
+	f, err := b.Get(ctx, "int/dedupe/"+layout.Path(hash[:]))
 	if err != nil {
 		return DedupeUpload{}, err
 	}
 
-	recordCount := len(f) / DDURecordSize
-
-	for i := 0; i < recordCount; i++ {
-		record, err := BytesToDedupe(f[i*DDURecordSize : (i+1)*DDURecordSize])
-		if err != nil {
-			return DedupeUpload{}, err
-		}
-		if bytes.Equal(hash[:], record.hash[:]) {
-			return record, nil
-		}
+	records, err := sunlight.IndexRecords(f, DDURecordSize)
+	if err != nil {
+		return DedupeUpload{}, err
+	}
+	if i, found := sunlight.SearchIndex(records, DDURecordSize, hash[:]); found {
+		return BytesToDedupe(records[i*DDURecordSize : (i+1)*DDURecordSize])
 	}
-	return DedupeUpload{}, errors.New("record not found")
+	return DedupeUpload{}, errRecordNotFound
 }
@@ -0,0 +1,109 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// memStorage is a Storage in memory, which records the time left before the deadline of
+// the last call.
+type memStorage struct {
+	objects map[string][]byte
+	left    time.Duration
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string][]byte)}
+}
+
+func (m *memStorage) record(ctx context.Context) {
+	m.left = -1
+	if deadline, ok := ctx.Deadline(); ok {
+		m.left = time.Until(deadline)
+	}
+}
+
+func (m *memStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	m.record(ctx)
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (m *memStorage) Set(ctx context.Context, key string, data []byte) error {
+	m.record(ctx)
+	m.objects[key] = bytes.Clone(data)
+	return nil
+}
+
+func (m *memStorage) Exists(ctx context.Context, key string) (bool, error) {
+	m.record(ctx)
+	_, ok := m.objects[key]
+	return ok, nil
+}
+
+func TestBucketDeadlines(t *testing.T) {
+	tests := []struct {
+		name        string
+		bucket      Bucket
+		read, write time.Duration
+	}{
+		{"defaults", Bucket{}, defaultStorageReadTimeout, defaultStorageWriteTimeout},
+		{"configured", Bucket{ReadTimeout: time.Second, WriteTimeout: 2 * time.Second}, time.Second, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemStorage()
+			b := tt.bucket
+			b.S = s
+			ctx := context.Background()
+
+			// Each call has to reach the storage with its own deadline
+			check := func(op string, want time.Duration) {
+				t.Helper()
+				if s.left <= 0 || s.left > want || s.left < want-time.Second/2 {
+					t.Errorf("%s reached the storage with %v left, want about %v", op, s.left, want)
+				}
+			}
+
+			if err := b.set(ctx, "key", []byte("value")); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			check("set", tt.write)
+
+			data, err := b.Get(ctx, "key")
+			if err != nil || string(data) != "value" {
+				t.Fatalf("Get = %q, %v, want \"value\"", data, err)
+			}
+			check("Get", tt.read)
+
+			ok, err := b.exists(ctx, "key")
+			if err != nil || !ok {
+				t.Fatalf("exists = %v, %v, want true", ok, err)
+			}
+			check("exists", tt.read)
+
+			if _, err := b.Get(ctx, "missing"); !isNotFound(err) {
+				t.Errorf("Get of a missing key = %v, want a not found error", err)
+			}
+		})
+	}
+}
+
+func TestBucketDeadlineKeepsEarlierDeadline(t *testing.T) {
+	s := newMemStorage()
+	b := Bucket{S: s}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := b.exists(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if s.left <= 0 || s.left > time.Second {
+		t.Errorf("exists reached the storage with %v left, want at most the caller's 1s", s.left)
+	}
+}
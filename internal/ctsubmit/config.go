@@ -1,23 +1,22 @@
 package ctsubmit
 
 import (
+	"bytes"
 	"context"
-	"crypto/ecdsa"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
-	"log"
-	"os"
-	"os/signal"
+	"iter"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
 	ct "github.com/google/certificate-transparency-go"
-	"github.com/google/certificate-transparency-go/x509"
-	"github.com/google/certificate-transparency-go/x509util"
-	consul "github.com/hashicorp/consul/api"
+	"golang.org/x/mod/sumdb/note"
 	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/alert"
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/server"
 	"itko.dev/internal/sunlight"
 )
 
@@ -28,6 +27,26 @@ type GlobalConfig struct {
 	ListenAddress string `json:"listenAddress"`
 	MaskSize      int    `json:"maskSize"`
 
+	// The origin line of the checkpoint, which c2sp.org/static-ct-api says should be the
+	// submission prefix without the scheme. Defaults to the name.
+	CheckpointOrigin string `json:"checkpointOrigin"`
+
+	// The layout of the k-anon index paths, see sunlight.IndexLayout. Defaults to version
+	// 0, the layout of logs created before it was configurable.
+	IndexLayoutVersion int `json:"indexLayoutVersion"`
+	IndexSegmentSize   int `json:"indexSegmentSize"`
+
+	// Set for a log whose tree starts with entries copied from a RFC 6962 log by itko
+	// migrate trillian. Their extensions have no leaf_index, which is otherwise an error
+	// when the data tiles are read.
+	MirroredEntries bool `json:"mirroredEntries"`
+
+	// File holding the passphrase of an encrypted key at KeyPath. ITKO_KEY_PASSPHRASE
+	// takes precedence, and without either the passphrase is asked for on a terminal.
+	KeyPassphraseFile string `json:"keyPassphraseFile"`
+	// Where the log's key is kept, if not in the file at KeyPath
+	Signer SignerConfig `json:"signer"`
+
 	// If this is set, the log will write to the filesystem instead of S3
 	// This value is prefered over the S3 values
 	RootDirectory string `json:"rootDirectory"`
@@ -37,22 +56,149 @@ type GlobalConfig struct {
 	S3EndpointUrl              string `json:"s3EndpointUrl"`
 	S3StaticCredentialUserName string `json:"s3StaticCredentialUserName"`
 	S3StaticCredentialPassword string `json:"s3StaticCredentialPassword"`
+	// path or virtual. Defaults to path, which works with most S3-compatible providers
+	S3AddressingStyle string `json:"s3AddressingStyle"`
+	// If set, objects are uploaded with a checksum of this algorithm, one of CRC32,
+	// CRC32C, SHA1, or SHA256, which the provider checks before storing them
+	S3ChecksumAlgorithm string `json:"s3ChecksumAlgorithm"`
+	// Check the checksums returned with objects that were uploaded with one
+	S3ValidateChecksums bool `json:"s3ValidateChecksums"`
+	// Use S3 Transfer Acceleration, which needs the virtual addressing style
+	S3UseAccelerate bool `json:"s3UseAccelerate"`
+
+	// Deadlines of each read and write to the bucket or root directory. Default to 10s
+	// and 30s.
+	StorageReadTimeoutMs  int `json:"storageReadTimeoutMs"`
+	StorageWriteTimeoutMs int `json:"storageWriteTimeoutMs"`
 
 	NotAfterStart string `json:"notAfterStart"`
 	NotAfterLimit string `json:"notAfterLimit"`
 	FlushMs       int    `json:"flushMs"`
+	// When no entries are pending, an STH is only published this often instead of every
+	// flush interval. Pools with entries are still flushed every flushMs, so this doesn't
+	// delay any SCTs. Defaults to zero, publishing an STH every flush interval.
+	MinSthIntervalMs int `json:"minSthIntervalMs"`
+
+	// Bearer token for the operator endpoints under /admin/.
+	// If this is empty, the endpoints are not served at all.
+	AdminToken string `json:"adminToken"`
+	// Bearer token used by stage zero front-ends to talk to the sequencer.
+	// If this is empty, the sequencer does not accept entries from front-ends.
+	SequencerToken string `json:"sequencerToken"`
+
+	// If set, front-ends publish entries to this NATS JetStream stream instead of
+	// calling the sequencer directly, and the sequencer consumes from it.
+	NatsUrl    string `json:"natsUrl"`
+	NatsStream string `json:"natsStream"`
+
+	// Timeouts and connection limits for the HTTP server
+	Server server.Config `json:"server"`
+
+	// Request body size limits in bytes. Some cross-signed chains don't fit in the
+	// default of 128KB. The monitor only serves GET requests, so its limit can be lower.
+	SubmitMaxBodyBytes  int64 `json:"submitMaxBodyBytes"`
+	MonitorMaxBodyBytes int64 `json:"monitorMaxBodyBytes"`
+
+	// Target for the time from an entry's timestamp until it is covered by a published STH,
+	// used to report SLO attainment. Defaults to the 5 second limit on sequencing an entry.
+	MergeDelaySloMs int `json:"mergeDelaySloMs"`
+
+	// Where to send alerts when the pipeline fails, the lock is lost, or the STH goes stale
+	Alerts AlertConfig `json:"alerts"`
+
+	// Keys that cosign every checkpoint along with the log's key
+	Cosigners []CosignerConfig `json:"cosigners"`
+
+	// Witnesses each checkpoint is sent to. Their cosignatures are added to the checkpoint.
+	Witnesses []WitnessConfig `json:"witnesses"`
+
+	// If set, the STH, checkpoint, and partial tiles are purged from Fastly after each publish
+	Purge PurgeConfig `json:"purge"`
+
+	// The log's entry in the Chrome and Apple log lists, which itko-setup generates
+	LogList LogListConfig `json:"logList"`
+}
+
+type LogListConfig struct {
+	// Submission prefix of the log, such as https://ct2025.example.com/. No entry is
+	// generated if this is empty.
+	Url string `json:"url"`
+	// Defaults to the name
+	Description string `json:"description"`
+	// Maximum merge delay in seconds. Defaults to 86400.
+	Mmd           int      `json:"mmd"`
+	OperatorName  string   `json:"operatorName"`
+	OperatorEmail []string `json:"operatorEmail"`
+}
+
+const DefaultMaxBodyBytes = 128 * 1024
+
+func (gc GlobalConfig) submitMaxBodyBytes() int64 {
+	if gc.SubmitMaxBodyBytes <= 0 {
+		return DefaultMaxBodyBytes
+	}
+	return gc.SubmitMaxBodyBytes
+}
+
+func (gc GlobalConfig) checkpointOrigin() (string, error) {
+	origin := gc.CheckpointOrigin
+	if origin == "" {
+		origin = gc.Name
+	}
+	if !sunlight.IsValidOrigin(origin) {
+		return "", fmt.Errorf("invalid checkpoint origin %q: must be non-empty, without spaces or '+'", origin)
+	}
+	return origin, nil
+}
+
+func (gc GlobalConfig) indexLayout() (sunlight.IndexLayout, error) {
+	layout := sunlight.IndexLayout{Version: gc.IndexLayoutVersion, Mask: gc.MaskSize, SegmentSize: gc.IndexSegmentSize}
+	if err := layout.Validate(); err != nil {
+		return sunlight.IndexLayout{}, fmt.Errorf("invalid index layout: %w", err)
+	}
+	return layout, nil
+}
+
+func (gc GlobalConfig) mergeDelaySLO() time.Duration {
+	if gc.MergeDelaySloMs <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(gc.MergeDelaySloMs) * time.Millisecond
 }
 
 type Log struct {
-	config GlobalConfig
-	eStop  *consul.Lock
+	// The config the log was loaded with. The parts of it that can change while the log
+	// is running are in settings.
+	config   GlobalConfig
+	settings *atomic.Pointer[settings]
+	eStop    coordination.Lock
+	store    coordination.Store
+	coord    coordination.Config
+	kvpath   string
+	// A front-end only runs stage zero, and hands entries to a remote sequencer
+	frontend bool
+	// Closed when the lock is lost
+	lost <-chan struct{}
+	// Incremented every time the lock is acquired, used for fencing
+	epoch uint64
+
+	lifecycle *lifecycle
+	alerts    *alert.Alerter
 
 	stageZeroData
 	stageOneData
 	stageTwoData
 }
 
+// ServerConfig is the HTTP server config the log was configured with.
+func (l *Log) ServerConfig() server.Config {
+	return l.config.Server
+}
+
 type UnsequencedEntryWithReturnPath struct {
+	// The context of the request that submitted the entry. If it is done before the
+	// entry is sequenced, nobody is waiting for the SCT and the entry is dropped.
+	ctx        context.Context
 	entry      sunlight.UnsequencedEntry
 	returnPath chan<- sunlight.LogEntry
 }
@@ -68,16 +214,18 @@ type tileWithBytes struct {
 }
 
 type stageZeroData struct {
-	stageOneTx chan<- UnsequencedEntryWithReturnPath
+	sequencer sequencer
 
-	roots         *x509util.PEMCertPool
+	settings      *atomic.Pointer[settings]
 	notAfterStart time.Time
 	notAfterLimit time.Time
 	logID         [32]byte
 	bucket        Bucket
-	maskSize      int
+	indexLayout   sunlight.IndexLayout
+	lifecycle     *lifecycle
+	metrics       *logMetrics
 
-	signingKey *ecdsa.PrivateKey
+	signingKey *sunlight.Signer
 }
 
 type stageOneData struct {
@@ -85,7 +233,11 @@ type stageOneData struct {
 	stageTwoTx chan<- []LogEntryWithReturnPath
 
 	startingSequence uint64
-	flushMs          int
+	settings         *atomic.Pointer[settings]
+	lifecycle        *lifecycle
+	metrics          *logMetrics
+	// Entries dropped because their request was abandoned before they were sequenced
+	abandoned uint64
 }
 
 type stageTwoData struct {
@@ -93,138 +245,131 @@ type stageTwoData struct {
 
 	bucket           Bucket
 	edgeTiles        map[int]tileWithBytes
-	maskSize         int
+	indexLayout      sunlight.IndexLayout
 	checkpointOrigin string
 	treeSize         uint64
-
-	signingKey *ecdsa.PrivateKey
+	lifecycle        *lifecycle
+	metrics          *logMetrics
+	// fence returns an error if another instance has acquired the lock since this one
+	fence func(context.Context) error
+	// Only set if the CDN is purged after each publish
+	purger *purger
+	// Only set if checkpoints are sent to witnesses
+	witnesses *witnesser
+
+	signingKey *sunlight.Signer
+	cosigners  []note.Signer
 }
 
-func LoadLog(ctx context.Context, kvpath, consulAddress string) (*Log, error) {
-	var lock *consul.Lock
+// newStore connects to the coordination store. Tests replace it with one in memory.
+var newStore = coordination.New
+
+// LoadLog takes the lock of the log at kvpath, blocking until it is free, and loads the
+// log. If loading fails after the lock was taken, the lock is released, so that the next
+// attempt, here or on another instance, can take it.
+func LoadLog(ctx context.Context, kvpath string, coord coordination.Config) (_ *Log, loadErr error) {
+	var lock coordination.Lock
+	var lost <-chan struct{}
+	var epoch uint64
+	var store coordination.Store
 	var gc GlobalConfig
 
 	{
 		lockpath := kvpath + "/lock"
-		configpath := kvpath + "/config"
-
-		// Start by creating a new Consul client
-		config := consul.DefaultConfig()
-		config.Address = consulAddress
-		client, err := consul.NewClient(config)
-		if err != nil {
-			return nil, err
-		}
 
-		// Create a new lock struct for the key
-		lock, err = client.LockKey(lockpath)
+		// Start by connecting to Consul or etcd
+		var err error
+		store, err = newStore(coord)
 		if err != nil {
 			return nil, err
 		}
 
-		// Lock the key and get a channel to listen for lock loss
-		eStopChan, err := lock.Lock(nil)
+		// Lock the key and get a channel to listen for lock loss.
+		// This blocks until the lock is acquired or the context is cancelled.
+		lock, err = store.Lock(ctx, lockpath)
 		if err != nil {
 			return nil, err
 		}
+		// Nothing is running yet if the log fails to load, so the lock is released for
+		// the next attempt to take. The named result is checked, as err is shadowed here.
+		defer func() {
+			if loadErr != nil {
+				lock.Unlock()
+			}
+		}()
 
-		// If the lock is lost, log a fatal message and fail fast
-		// This will happen in two cases, either we perform cleanup and unlock the lock
+		// The lock is lost in two cases, either we perform cleanup and unlock the lock
 		// or the lock is lost due to reasons out of our control.
 		// Either way, without the lock, we are not allowed to do any more tasks.
-		go func(eStopChan <-chan struct{}) {
-			<-eStopChan
-			log.Fatal("Consul lock lost, exiting now!")
-		}(eStopChan)
-
-		// If the program recieves a Ctrl-C, release the lock
-		// This will cause the lock loss handler to fire
-		// Not really the best place to handle this, but
-		// we need to release the lock somewhere and other cleanup is
-		// not implemented yet
-		interruptChan := make(chan os.Signal, 1)
-		signal.Notify(interruptChan, os.Interrupt)
-		go func(interruptChan chan os.Signal, lock *consul.Lock) {
-			<-interruptChan
-			log.Println("Interrupted, releasing lock")
-			lock.Unlock()
-		}(interruptChan, lock)
-
-		// Once the lock is acquired, fetch the configuration from Consul
-		kv := client.KV()
-		rawConfig, _, err := kv.Get(configpath, &consul.QueryOptions{
-			RequireConsistent: true,
-		})
+		// Whoever loaded the log is responsible for stopping it when this channel closes,
+		// and for releasing the lock when shutting down.
+		lost = lock.Lost()
+
+		// Once the lock is acquired, fetch the configuration
+		gc, err = fetchConfig(ctx, store, coord, kvpath)
 		if err != nil {
 			return nil, err
 		}
-		if rawConfig == nil {
-			return nil, fmt.Errorf("no configuration found at %s", configpath)
-		}
 
-		// Unmarshal the configuration into a struct
-		if err := json.Unmarshal(rawConfig.Value, &gc); err != nil {
-			return nil, err
+		// Bump the epoch so that any previous holder of the lock is fenced off
+		epoch, err = incrementEpoch(ctx, store, kvpath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to increment epoch: %v", err)
 		}
+		slog.Info("Acquired lock", "kv_path", kvpath, "epoch", epoch)
 	}
 
-	// Now, we can continue by actually setting up the log
-
-	// First, check that the private key we have is actually valid, because
-	// we can't do anything without it.
-	var key *ecdsa.PrivateKey
-
+	// Check what state the log is in. If it has been frozen, it is still loaded
+	// so that the edge tiles are verified, but the stages will not be started.
+	l := &Log{
+		config: gc,
+		eStop:  lock,
+		store:  store,
+		coord:  coord,
+		kvpath: kvpath,
+		lost:   lost,
+		epoch:  epoch,
+		alerts: newAlerter(gc),
+	}
 	{
-		keyPEM, err := os.ReadFile(gc.KeyPath)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read key: %v", err)
-		}
-		keyBlock, _ := pem.Decode(keyPEM)
-
-		key, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+		state, _, err := l.fetchLifecycleState(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse key: %v", err)
+			return nil, fmt.Errorf("unable to fetch lifecycle state: %v", err)
 		}
+		l.lifecycle = newLifecycle(state)
+		slog.Info("Loaded lifecycle state", "kv_path", kvpath, "state", state)
+	}
 
-		pkix, err := x509.MarshalPKIXPublicKey(key.Public())
-		if err != nil {
-			return nil, fmt.Errorf("unable to marshal public key: %v", err)
-		}
-		logSha := sha256.Sum256(pkix)
-		logID := base64.StdEncoding.EncodeToString(logSha[:])
+	// Now, we can continue by actually setting up the log
 
-		// sanity check to make sure wrong private key is not accidentally used
-		if logID != gc.LogID {
-			return nil, fmt.Errorf("log ID does not match: %s != %s", logID, gc.LogID)
-		}
+	// First, check that the private key we have is actually valid, because
+	// we can't do anything without it.
+	key, err := LoadSigner(gc)
+	if err != nil {
+		return nil, err
+	}
+	cosigners, err := loadCosigners(gc)
+	if err != nil {
+		return nil, err
+	}
+	checkpointOrigin, err := gc.checkpointOrigin()
+	if err != nil {
+		return nil, err
 	}
 
-	// Create the channels for the stages
-	// TODO: This will cause problems if the channel is full and an unbuffered channel here
-	// isn't really the right thing to have either.
-	// It seems that go doesn't have a simple way to send to a buffered channel but
-	// return an error if the channel is full instead of blocking.
+	// Create the channels for the stages.
+	// If the stage one channel stays full, the sequencer returns a 429 instead of blocking.
 
 	stageOneCommChan := make(chan UnsequencedEntryWithReturnPath, 200)
 	stageTwoCommChan := make(chan []LogEntryWithReturnPath, 2)
 
-	var bucket Bucket
-
-	if gc.RootDirectory != "" {
-		log.Println("Using filesystem storage")
-		fsStorage := NewFsStorage(gc.RootDirectory)
-		bucket = Bucket{S: &fsStorage}
-	} else {
-		log.Println("Using S3 storage")
-		s3Storage := NewS3Storage(gc.S3Region, gc.S3Bucket, gc.S3EndpointUrl, gc.S3StaticCredentialUserName, gc.S3StaticCredentialPassword)
-		bucket = Bucket{S: &s3Storage}
-	}
+	bucket := newBucket(gc)
 
 	// Get the latest STH
 	var sth ct.SignedTreeHead
 	{
-		log.Println("Fetching latest STH")
-		sthBytes, err := bucket.S.Get(ctx, "ct/v1/get-sth")
+		slog.Info("Fetching latest STH", "kv_path", kvpath)
+		sthBytes, err := bucket.Get(ctx, "ct/v1/get-sth")
 		if err != nil {
 			return nil, fmt.Errorf("unable to fetch STH: %v", err)
 		}
@@ -234,65 +379,30 @@ func LoadLog(ctx context.Context, kvpath, consulAddress string) (*Log, error) {
 		}
 	}
 
-	// Stage zero setup
-	var stageZero stageZeroData
-	{
-		notAfterStart, err := time.Parse(time.RFC3339, gc.NotAfterStart)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse NotAfterStart: %v", err)
-		}
-		notAfterLimit, err := time.Parse(time.RFC3339, gc.NotAfterLimit)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse NotAfterLimit: %v", err)
-		}
-
-		var res struct {
-			Certificates [][]byte `json:"certificates"`
-		}
-		roots, err := bucket.S.Get(ctx, "ct/v1/get-roots")
-		if err != nil {
-			return nil, fmt.Errorf("unable to fetch roots: %v", err)
-		}
-		err = json.Unmarshal(roots, &res)
-		if err != nil {
-			return nil, fmt.Errorf("unable to unmarshal roots: %v", err)
-		}
-
-		// iterate over the certificates and add them to the pool
-		r := x509util.NewPEMCertPool()
-		for _, certBytes := range res.Certificates {
-			cert, err := x509.ParseCertificate(certBytes)
-			if err != nil {
-				return nil, fmt.Errorf("unable to parse certificate: %v", err)
-			}
-			r.AddCert(cert)
-		}
-
-		logID, err := base64.StdEncoding.DecodeString(gc.LogID)
-		if err != nil {
-			return nil, fmt.Errorf("unable to decode log ID: %v", err)
-		}
-		if len(logID) != 32 {
-			return nil, fmt.Errorf("logID must be exactly 32 bytes long")
-		}
-
-		// Convert []byte to [32]byte
-		var logIDArray [32]byte
-		copy(logIDArray[:], logID)
-
-		stageZero = stageZeroData{
-			stageOneTx: stageOneCommChan,
-
-			roots:         r,
-			notAfterStart: notAfterStart,
-			notAfterLimit: notAfterLimit,
-			logID:         logIDArray,
-			bucket:        bucket,
-			maskSize:      gc.MaskSize,
+	// Publish the parts of the config the monitor's status page reports
+	err = bucket.SetLogInfo(ctx, LogInfo{
+		Name:          gc.Name,
+		NotAfterStart: gc.NotAfterStart,
+		NotAfterLimit: gc.NotAfterLimit,
+		FlushMs:       gc.FlushMs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to publish log info: %v", err)
+	}
 
-			signingKey: key,
-		}
+	// Stage zero setup
+	stageZero, err := loadStageZero(ctx, gc, bucket, key, l.lifecycle)
+	if err != nil {
+		return nil, err
 	}
+	stageZero.sequencer = &localSequencer{
+		stageOneTx: stageOneCommChan,
+		lifecycle:  l.lifecycle,
+	}
+	l.settings = stageZero.settings
+	metrics := newLogMetrics(gc.Name, gc.mergeDelaySLO())
+	metrics.lastSTH.Store(int64(sth.Timestamp))
+	stageZero.metrics = metrics
 
 	var stageOne stageOneData
 	{
@@ -302,66 +412,22 @@ func LoadLog(ctx context.Context, kvpath, consulAddress string) (*Log, error) {
 
 			// Starting index is zero indexed, so we don't need to add one
 			startingSequence: sth.TreeSize,
-			flushMs:          gc.FlushMs,
+			settings:         stageZero.settings,
+			lifecycle:        l.lifecycle,
+			metrics:          metrics,
 		}
 	}
 
 	var stageTwo stageTwoData
 	{
-		edgeTiles := make(map[int]tileWithBytes)
-
-		if sth.TreeSize == 0 {
-			// If there are no tiles, then initialize an empty data tile
-			edgeTiles[-1] = tileWithBytes{
-				Tile: tlog.Tile{
-					H: sunlight.TileHeight,
-					L: -1,
-					N: 0,
-					W: 0,
-				},
-				Bytes: []byte{},
-			}
-		} else {
-			// Fetch the edge tiles
-			// This technique was taken from Sunlight. The idea is that the TileHashReader has the ability
-			// to fetch, verify, and save the tiles once verified using a custom function. We set this up,
-			// and then use it to fetch the level zero tile of the current tree size. This causes it to
-			// fetch all the parent tiles up until the root hash in order to verify the level zero tile.
-			_, err := tlog.TileHashReader(tlog.Tree{
-				N:    int64(sth.TreeSize),
-				Hash: tlog.Hash(sth.SHA256RootHash),
-			}, &sunlight.TileReader{
-				Fetch: func(key string) ([]byte, error) {
-					log.Println("Fetching tile", key)
-					return bucket.S.Get(ctx, key)
-				}, SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {
-					for i, tile := range tiles {
-						if t, ok := edgeTiles[tile.L]; !ok || t.N < tile.N || (t.N == tile.N && t.W < tile.W) {
-							edgeTiles[tile.L] = tileWithBytes{
-								Tile:  tile,
-								Bytes: data[i],
-							}
-						}
-					}
-				},
-			}).ReadHashes([]int64{tlog.StoredHashIndex(0, int64(sth.TreeSize)-1)})
-			if err != nil {
-				return nil, fmt.Errorf("unable to fetch and verify edge tiles: %v", err)
-			}
-
-			// Verify the data tile
-			dataTile := edgeTiles[0]
-			// the data tile is the same as the level zero tile, with L -1
-			dataTile.Tile.L = -1
-
-			dataTileBytes, err := bucket.S.Get(ctx, sunlight.Path(dataTile.Tile))
-			if err != nil {
-				return nil, fmt.Errorf("unable to fetch data tile: %v", err)
-			}
-			dataTile.Bytes = dataTileBytes
-			edgeTiles[-1] = dataTile
+		edgeTiles, err := loadEdgeTiles(ctx, bucket, tlog.Tree{N: int64(sth.TreeSize), Hash: tlog.Hash(sth.SHA256RootHash)}, gc.MirroredEntries)
+		if err != nil {
+			return nil, err
+		}
 
-			// TODO: verify the data tile against the L0 tile
+		witnesses, err := newWitnesser(gc, bucket, l.checkEpoch)
+		if err != nil {
+			return nil, err
 		}
 
 		stageTwo = stageTwoData{
@@ -369,22 +435,221 @@ func LoadLog(ctx context.Context, kvpath, consulAddress string) (*Log, error) {
 
 			bucket:           bucket,
 			edgeTiles:        edgeTiles,
-			maskSize:         gc.MaskSize,
-			checkpointOrigin: gc.Name,
+			indexLayout:      stageZero.indexLayout,
+			checkpointOrigin: checkpointOrigin,
 			treeSize:         sth.TreeSize,
+			lifecycle:        l.lifecycle,
+			metrics:          metrics,
+			fence:            l.checkEpoch,
+			purger:           newPurger(gc.Purge),
+			witnesses:        witnesses,
 
 			signingKey: key,
+			cosigners:  cosigners,
 		}
 	}
 
-	log.Println("Log loaded successfully")
+	slog.Info("Log loaded successfully", "kv_path", kvpath)
 
-	return &Log{
-		config: gc,
-		eStop:  lock,
+	l.stageZeroData = stageZero
+	l.stageOneData = stageOne
+	l.stageTwoData = stageTwo
+
+	return l, nil
+}
+
+// FetchConfig reads the config of the log at kvpath, without taking its lock.
+func FetchConfig(ctx context.Context, kvpath string, coord coordination.Config) (GlobalConfig, error) {
+	store, err := newStore(coord)
+	if err != nil {
+		return GlobalConfig{}, err
+	}
+	return fetchConfig(ctx, store, coord, kvpath)
+}
+
+// fetchConfig reads the config of the log, with any overrides from coord applied over it.
+func fetchConfig(ctx context.Context, store coordination.Store, coord coordination.Config, kvpath string) (GlobalConfig, error) {
+	var gc GlobalConfig
+	configpath := kvpath + "/config"
+
+	rawConfig, err := store.Get(ctx, configpath)
+	if err != nil {
+		return gc, err
+	}
+	if !rawConfig.Exists() {
+		return gc, fmt.Errorf("no configuration found at %s", configpath)
+	}
+
+	// Unmarshal the configuration into a struct
+	if err := coord.DecodeConfig(rawConfig.Value, &gc); err != nil {
+		return gc, err
+	}
+	if err := gc.Validate(); err != nil {
+		return gc, fmt.Errorf("%s: %w", configpath, err)
+	}
+	return gc, nil
+}
+
+func newBucket(gc GlobalConfig) Bucket {
+	readTimeout := time.Duration(gc.StorageReadTimeoutMs) * time.Millisecond
+	writeTimeout := time.Duration(gc.StorageWriteTimeoutMs) * time.Millisecond
+	if gc.RootDirectory != "" {
+		slog.Info("Using filesystem storage", "root", gc.RootDirectory)
+		fsStorage := NewFsStorage(gc.RootDirectory)
+		return Bucket{S: &fsStorage, ReadTimeout: readTimeout, WriteTimeout: writeTimeout}
+	}
+	slog.Info("Using S3 storage", "bucket", gc.S3Bucket)
+	s3Storage := NewS3Storage(gc.S3Region, gc.S3Bucket, gc.S3EndpointUrl, gc.S3StaticCredentialUserName, gc.S3StaticCredentialPassword, gc.S3Options())
+	return Bucket{S: &s3Storage, ReadTimeout: readTimeout, WriteTimeout: writeTimeout}
+}
+
+// loadStageZero sets up everything stage zero needs except for the sequencer,
+// which is either the in-process stage one or a remote sequencer.
+func loadStageZero(ctx context.Context, gc GlobalConfig, bucket Bucket, key *sunlight.Signer, lc *lifecycle) (stageZeroData, error) {
+	notAfterStart, err := time.Parse(time.RFC3339, gc.NotAfterStart)
+	if err != nil {
+		return stageZeroData{}, fmt.Errorf("unable to parse NotAfterStart: %v", err)
+	}
+	notAfterLimit, err := time.Parse(time.RFC3339, gc.NotAfterLimit)
+	if err != nil {
+		return stageZeroData{}, fmt.Errorf("unable to parse NotAfterLimit: %v", err)
+	}
+
+	roots, rootsBytes, err := fetchRoots(ctx, bucket)
+	if err != nil {
+		return stageZeroData{}, err
+	}
+	live := &atomic.Pointer[settings]{}
+	live.Store(newSettings(gc, roots, rootsBytes))
 
-		stageZeroData: stageZero,
-		stageOneData:  stageOne,
-		stageTwoData:  stageTwo,
+	logID, err := base64.StdEncoding.DecodeString(gc.LogID)
+	if err != nil {
+		return stageZeroData{}, fmt.Errorf("unable to decode log ID: %v", err)
+	}
+	if len(logID) != 32 {
+		return stageZeroData{}, fmt.Errorf("logID must be exactly 32 bytes long")
+	}
+
+	// Convert []byte to [32]byte
+	var logIDArray [32]byte
+	copy(logIDArray[:], logID)
+
+	indexLayout, err := gc.indexLayout()
+	if err != nil {
+		return stageZeroData{}, err
+	}
+
+	return stageZeroData{
+		settings:      live,
+		notAfterStart: notAfterStart,
+		notAfterLimit: notAfterLimit,
+		logID:         logIDArray,
+		bucket:        bucket,
+		indexLayout:   indexLayout,
+		lifecycle:     lc,
+
+		signingKey: key,
 	}, nil
 }
+
+// loadEdgeTiles fetches the right-most tile of each level of the tree and the data tile
+// under it, which new entries are appended to, and verifies them against the tree. The data
+// tile can only have entries without a leaf_index if mirrored is set.
+func loadEdgeTiles(ctx context.Context, bucket Bucket, tree tlog.Tree, mirrored bool) (map[int]tileWithBytes, error) {
+	edgeTiles := make(map[int]tileWithBytes)
+
+	if tree.N == 0 {
+		// If there are no tiles, then initialize an empty data tile
+		edgeTiles[-1] = tileWithBytes{
+			Tile: tlog.Tile{
+				H: sunlight.TileHeight,
+				L: -1,
+				N: 0,
+				W: 0,
+			},
+			Bytes: []byte{},
+		}
+	} else {
+		// Fetch the edge tiles
+		// This technique was taken from Sunlight. The idea is that the TileHashReader has the ability
+		// to fetch, verify, and save the tiles once verified using a custom function. We set this up,
+		// and then use it to fetch the level zero tile of the current tree size. This causes it to
+		// fetch all the parent tiles up until the root hash in order to verify the level zero tile.
+		_, err := tlog.TileHashReader(tree, &sunlight.TileReader{
+			Fetch: func(key string) ([]byte, error) {
+				slog.Info("Fetching tile", "level", key)
+				return bucket.Get(ctx, key)
+			}, SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {
+				for i, tile := range tiles {
+					if t, ok := edgeTiles[tile.L]; !ok || t.N < tile.N || (t.N == tile.N && t.W < tile.W) {
+						edgeTiles[tile.L] = tileWithBytes{
+							Tile:  tile,
+							Bytes: data[i],
+						}
+					}
+				}
+			},
+		}).ReadHashes([]int64{tlog.StoredHashIndex(0, tree.N-1)})
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch and verify edge tiles: %v", err)
+		}
+
+		// Verify the data tile
+		dataTile := edgeTiles[0]
+		// the data tile is the same as the level zero tile, with L -1
+		dataTile.Tile.L = -1
+
+		dataTileBytes, err := bucket.Get(ctx, sunlight.Path(dataTile.Tile))
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch data tile: %v", err)
+		}
+		if err := verifyDataTile(dataTile.Tile, dataTileBytes, edgeTiles[0].Bytes, mirrored); err != nil {
+			return nil, err
+		}
+		dataTile.Bytes = dataTileBytes
+		edgeTiles[-1] = dataTile
+	}
+
+	return edgeTiles, nil
+}
+
+// parseTileEntries parses a data tile of a log, which only has entries without a
+// leaf_index extension if mirrored is set, for the entries of a mirror or a migrated
+// Trillian log.
+func parseTileEntries(tile tlog.Tile, data []byte, mirrored bool) iter.Seq2[*sunlight.LogEntry, error] {
+	if mirrored {
+		return sunlight.ParseMirroredTileEntries(tile, data)
+	}
+	return sunlight.ParseTileEntries(tile, data)
+}
+
+// verifyDataTile checks a data tile against the verified level zero tile with the same
+// coordinates. New entries are appended to the right-most data tile, so a corrupted one
+// would otherwise be carried into every tile published after it.
+func verifyDataTile(tile tlog.Tile, data []byte, hashes []byte, mirrored bool) error {
+	if len(hashes) != tile.W*tlog.HashSize {
+		return fmt.Errorf("level zero tile for %s has %d bytes, expected %d", sunlight.Path(tile), len(hashes), tile.W*tlog.HashSize)
+	}
+	i := 0
+	for entry, err := range parseTileEntries(tile, data, mirrored) {
+		if err != nil {
+			return fmt.Errorf("invalid data tile %s: %w", sunlight.Path(tile), err)
+		}
+		if i == tile.W {
+			return fmt.Errorf("data tile %s has more than %d entries", sunlight.Path(tile), tile.W)
+		}
+		index := tile.N*sunlight.TileWidth + int64(i)
+		if entry.LeafIndex != uint64(index) {
+			return fmt.Errorf("data tile %s has leaf %d at index %d", sunlight.Path(tile), entry.LeafIndex, index)
+		}
+		hash := tlog.RecordHash(entry.MerkleTreeLeaf())
+		if !bytes.Equal(hash[:], hashes[i*tlog.HashSize:(i+1)*tlog.HashSize]) {
+			return fmt.Errorf("leaf %d in data tile %s doesn't match the tree", index, sunlight.Path(tile))
+		}
+		i++
+	}
+	if i < tile.W {
+		return fmt.Errorf("data tile %s has %d entries, expected %d", sunlight.Path(tile), i, tile.W)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package ctsubmit
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+// Validate checks the config for the problems that would otherwise only show up part way
+// through loading the log, or once it is running, and reports all of them at once. It
+// doesn't read the key or the bucket, so it can be run anywhere the config is.
+func (gc GlobalConfig) Validate() error {
+	var v validator
+
+	if gc.Name == "" {
+		v.add("name", "must be set, such as ct.example.com/2025")
+	}
+	if _, err := gc.checkpointOrigin(); err != nil && gc.Name != "" {
+		field := "checkpointOrigin"
+		if gc.CheckpointOrigin == "" {
+			field = "name"
+		}
+		v.add(field, "%v, such as ct.example.com/2025", err)
+	}
+	if logID, err := base64.StdEncoding.DecodeString(gc.LogID); gc.LogID == "" || err != nil || len(logID) != 32 {
+		v.add("logID", "must be the base64 SHA-256 hash of the log's public key, as printed by itko keygen -in <key>")
+	}
+	if _, err := gc.indexLayout(); err != nil {
+		v.add("maskSize", "%v", err)
+	}
+
+	switch gc.Signer.Type {
+	case "", SignerFile:
+		if gc.KeyPath == "" {
+			v.add("keyPath", "must be set to the PEM file of the log's key, unless signer.type is set")
+		}
+	case SignerGcpKms:
+		if !strings.HasPrefix(gc.Signer.GcpKeyVersion, "projects/") || !strings.Contains(gc.Signer.GcpKeyVersion, "/cryptoKeyVersions/") {
+			v.add("signer.gcpKeyVersion", "must be a key version, such as projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>/cryptoKeyVersions/1")
+		}
+	case SignerAzureKeyVault:
+		if u, err := url.Parse(gc.Signer.AzureKeyId); err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Path, "/keys/") {
+			v.add("signer.azureKeyId", "must be a key ID with its version, such as https://<vault>.vault.azure.net/keys/<name>/<version>")
+		}
+	case SignerPkcs11:
+		if gc.Signer.Pkcs11Module == "" {
+			v.add("signer.pkcs11Module", "must be set, such as /usr/lib/softhsm/libsofthsm2.so")
+		}
+		if gc.Signer.Pkcs11KeyLabel == "" {
+			v.add("signer.pkcs11KeyLabel", "must be set to the label of the key pair")
+		}
+		v.nonNegative("signer.pkcs11Sessions", gc.Signer.Pkcs11Sessions)
+	default:
+		v.add("signer.type", "%q is not one of file, %s, %s, or %s", gc.Signer.Type, SignerGcpKms, SignerAzureKeyVault, SignerPkcs11)
+	}
+
+	notAfterStart, startErr := time.Parse(time.RFC3339, gc.NotAfterStart)
+	if startErr != nil {
+		v.add("notAfterStart", "%q is not an RFC 3339 timestamp, such as 2025-01-01T00:00:00Z", gc.NotAfterStart)
+	}
+	notAfterLimit, limitErr := time.Parse(time.RFC3339, gc.NotAfterLimit)
+	if limitErr != nil {
+		v.add("notAfterLimit", "%q is not an RFC 3339 timestamp, such as 2026-01-01T00:00:00Z", gc.NotAfterLimit)
+	}
+	if startErr == nil && limitErr == nil && !notAfterStart.Before(notAfterLimit) {
+		v.add("notAfterLimit", "must be after notAfterStart")
+	}
+
+	switch {
+	case gc.RootDirectory == "" && gc.S3Bucket == "":
+		v.add("s3Bucket", "either s3Bucket or rootDirectory must be set")
+	case gc.RootDirectory != "":
+		if strings.HasSuffix(gc.RootDirectory, "/") && gc.RootDirectory != "/" {
+			v.add("rootDirectory", "must not end with a slash, such as /var/lib/itko/tiles")
+		}
+	default:
+		if gc.S3Region == "" {
+			v.add("s3Region", "must be set with s3Bucket, such as us-east-1")
+		}
+		if gc.S3EndpointUrl != "" {
+			if u, err := url.Parse(gc.S3EndpointUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				v.add("s3EndpointUrl", "%q is not a URL, such as https://s3.us-east-1.amazonaws.com", gc.S3EndpointUrl)
+			} else if strings.HasSuffix(gc.S3EndpointUrl, "/") {
+				v.add("s3EndpointUrl", "must not end with a slash")
+			}
+		}
+		if (gc.S3StaticCredentialUserName == "") != (gc.S3StaticCredentialPassword == "") {
+			v.add("s3StaticCredentialPassword", "s3StaticCredentialUserName and s3StaticCredentialPassword must be set together")
+		}
+		switch gc.S3AddressingStyle {
+		case "", "path", "virtual":
+		default:
+			v.add("s3AddressingStyle", "%q is not path or virtual", gc.S3AddressingStyle)
+		}
+		switch gc.S3ChecksumAlgorithm {
+		case "", "CRC32", "CRC32C", "SHA1", "SHA256":
+		default:
+			v.add("s3ChecksumAlgorithm", "%q is not one of CRC32, CRC32C, SHA1, or SHA256", gc.S3ChecksumAlgorithm)
+		}
+		if gc.S3UseAccelerate && (gc.S3AddressingStyle != "virtual" || gc.S3EndpointUrl != "") {
+			v.add("s3UseAccelerate", "needs s3AddressingStyle set to virtual, and no s3EndpointUrl")
+		}
+	}
+
+	if gc.FlushMs <= 0 {
+		v.add("flushMs", "must be positive, such as 500")
+	}
+	v.nonNegative("minSthIntervalMs", gc.MinSthIntervalMs)
+	v.nonNegative("storageReadTimeoutMs", gc.StorageReadTimeoutMs)
+	v.nonNegative("storageWriteTimeoutMs", gc.StorageWriteTimeoutMs)
+	v.nonNegative("mergeDelaySloMs", gc.MergeDelaySloMs)
+	v.nonNegative("submitMaxBodyBytes", int(gc.SubmitMaxBodyBytes))
+	v.nonNegative("monitorMaxBodyBytes", int(gc.MonitorMaxBodyBytes))
+	v.nonNegative("server.readHeaderTimeoutMs", gc.Server.ReadHeaderTimeoutMs)
+	v.nonNegative("server.readTimeoutMs", gc.Server.ReadTimeoutMs)
+	v.nonNegative("server.writeTimeoutMs", gc.Server.WriteTimeoutMs)
+	v.nonNegative("server.idleTimeoutMs", gc.Server.IdleTimeoutMs)
+	v.nonNegative("server.maxConnections", gc.Server.MaxConnections)
+	v.nonNegative("server.drainTimeoutMs", gc.Server.DrainTimeoutMs)
+	v.nonNegative("alerts.staleSthMs", gc.Alerts.StaleSthMs)
+
+	if gc.NatsUrl != "" && gc.NatsStream == "" {
+		v.add("natsStream", "must be set with natsUrl, such as itko-alpha")
+	}
+	if gc.Alerts.WebhookUrl != "" {
+		v.url("alerts.webhookUrl", gc.Alerts.WebhookUrl)
+	}
+	for i, c := range gc.Cosigners {
+		if c.Name == "" || c.KeyPath == "" {
+			v.add(fmt.Sprintf("cosigners[%d]", i), "name and keyPath must both be set")
+		}
+	}
+	for i, w := range gc.Witnesses {
+		field := fmt.Sprintf("witnesses[%d]", i)
+		v.url(field+".url", w.Url)
+		if w.VerifierKey != "" {
+			if _, err := note.NewVerifier(w.VerifierKey); err != nil {
+				v.add(field+".verifierKey", "%v, it should look like <name>+<key hash>+<base64 key>", err)
+			}
+		}
+	}
+	if (gc.Purge.FastlyServiceId == "") != (gc.Purge.FastlyApiToken == "") {
+		v.add("purge", "fastlyServiceId and fastlyApiToken must be set together")
+	}
+	if gc.LogList.Url != "" {
+		if u, err := url.Parse(gc.LogList.Url); err != nil || u.Scheme != "https" || u.Host == "" || !strings.HasSuffix(u.Path, "/") {
+			v.add("logList.url", "%q is not an https URL ending in a slash, such as https://ct2025.example.com/", gc.LogList.Url)
+		}
+		if gc.LogList.OperatorName == "" {
+			v.add("logList.operatorName", "must be set with logList.url")
+		}
+	}
+	v.nonNegative("logList.mmd", gc.LogList.Mmd)
+
+	return v.err()
+}
+
+// validator collects the problems found by Validate.
+type validator struct {
+	problems []string
+}
+
+func (v *validator) add(field, format string, args ...any) {
+	v.problems = append(v.problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) nonNegative(field string, value int) {
+	if value < 0 {
+		v.add(field, "must not be negative")
+	}
+}
+
+func (v *validator) url(field, value string) {
+	if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(field, "%q is not an http or https URL", value)
+	}
+}
+
+func (v *validator) err() error {
+	switch len(v.problems) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("invalid config: %s", v.problems[0])
+	}
+	return fmt.Errorf("invalid config, %d problems:\n  %s", len(v.problems), strings.Join(v.problems, "\n  "))
+}
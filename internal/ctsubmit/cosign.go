@@ -0,0 +1,50 @@
+package ctsubmit
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"golang.org/x/mod/sumdb/note"
+	"itko.dev/internal/sunlight"
+)
+
+type CosignerConfig struct {
+	// The key name of the cosigner, as witnesses and monitors know it
+	Name string `json:"name"`
+	// PEM encoded PKCS #8 Ed25519 private key
+	KeyPath string `json:"keyPath"`
+}
+
+// loadCosigners loads the keys that cosign every checkpoint alongside the log's own
+// signature, in the c2sp.org/tlog-cosignature format.
+func loadCosigners(gc GlobalConfig) ([]note.Signer, error) {
+	signers := make([]note.Signer, 0, len(gc.Cosigners))
+	for _, c := range gc.Cosigners {
+		keyPEM, err := os.ReadFile(c.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cosigner key for %s: %v", c.Name, err)
+		}
+		keyBlock, _ := pem.Decode(keyPEM)
+		if keyBlock == nil {
+			return nil, fmt.Errorf("unable to decode cosigner key for %s: no PEM block found", c.Name)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse cosigner key for %s: %v", c.Name, err)
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("cosigner key for %s is not an Ed25519 key", c.Name)
+		}
+
+		signer, err := sunlight.NewCosigner(c.Name, edKey)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
@@ -0,0 +1,149 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/mod/sumdb/tlog"
+	"golang.org/x/sync/errgroup"
+	"itko.dev/internal/sunlight"
+)
+
+// StaticCTExportConfig is where ExportStaticCT writes the snapshot.
+type StaticCTExportConfig struct {
+	// Directory is the directory the snapshot is written to, which is laid out as a
+	// c2sp.org/static-ct-api monitoring prefix.
+	Directory string
+	// Link hard links the tiles and issuers into Directory instead of copying them. The
+	// log must be on filesystem storage, on the same filesystem as Directory.
+	Link bool
+	// Concurrency is the number of objects read or written at once. Defaults to 16.
+	Concurrency int
+}
+
+// StaticCTExportResult is what ExportStaticCT wrote.
+type StaticCTExportResult struct {
+	TreeSize int64
+	// Tiles is the number of tree tiles, each level zero one of which has a data tile
+	Tiles   int
+	Issuers int
+}
+
+// ExportStaticCT writes a snapshot of the log of gc, at the tree of its checkpoint, as a
+// c2sp.org/static-ct-api monitoring prefix, so that tooling built for static logs can read
+// it without knowing about itko. The snapshot has the checkpoint, every tree and data tile
+// of the tree, and the issuers of its entries, along with a PEM bundle of the issuers.
+// The rest of the bucket, such as the indexes and the RFC 6962 STH, is left out. The log
+// stores its tiles at the static-ct-api paths already, so they are copied or linked as
+// they are, after they are checked against the checkpoint. The checkpoint is written last,
+// so a snapshot that has one is complete. Entries mirrored from a RFC 6962 log have no
+// leaf_index extension, which static-ct-api requires, so a log with any can't be exported.
+// The log isn't changed, so the sequencer can keep running.
+func ExportStaticCT(ctx context.Context, gc GlobalConfig, ec StaticCTExportConfig) (StaticCTExportResult, error) {
+	if ec.Link && gc.RootDirectory == "" {
+		return StaticCTExportResult{}, fmt.Errorf("only a log on filesystem storage can be linked")
+	}
+	if gc.RootDirectory != "" && filepath.Clean(gc.RootDirectory) == filepath.Clean(ec.Directory) {
+		return StaticCTExportResult{}, fmt.Errorf("the snapshot can't be written to the log's own directory")
+	}
+	concurrency := cmp.Or(ec.Concurrency, 16)
+	bucket := newBucket(gc)
+	out := NewFsStorage(ec.Directory)
+
+	// The checkpoint is published after the STH, and the tiles before both, so every
+	// tile of its tree is there
+	checkpoint, err := bucket.Get(ctx, "checkpoint")
+	if err != nil {
+		return StaticCTExportResult{}, fmt.Errorf("unable to fetch checkpoint: %w", err)
+	}
+	body, _, _ := strings.Cut(string(checkpoint), "\n\n")
+	c, err := sunlight.ParseCheckpoint(body + "\n")
+	if err != nil {
+		return StaticCTExportResult{}, fmt.Errorf("unable to parse checkpoint: %w", err)
+	}
+	tree := tlog.Tree{N: c.N, Hash: c.Hash}
+	slog.Info("Exporting log", "origin", c.Origin, "tree_size", tree.N, "directory", ec.Directory)
+
+	// export writes the object key, with data read from the log
+	export := func(ctx context.Context, key string, data []byte) error {
+		if !ec.Link {
+			return out.Set(ctx, key, data)
+		}
+		path := filepath.Join(ec.Directory, key)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// The snapshot may be updating an older one
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(filepath.Join(gc.RootDirectory, key), path)
+	}
+
+	result := StaticCTExportResult{TreeSize: tree.N}
+	var issuers [][32]byte
+	if tree.N > 0 {
+		result.Tiles = len(tlog.NewTiles(sunlight.TileHeight, 0, tree.N))
+		issuers, err = copyTree(ctx, tree, concurrency, func(ctx context.Context, path string) ([]byte, error) {
+			data, err := bucket.Get(ctx, path)
+			if err != nil {
+				return nil, fmt.Errorf("unable to fetch %s: %w", path, err)
+			}
+			return data, nil
+		}, func(ctx context.Context, tile tlog.Tile, data []byte) error {
+			return export(ctx, sunlight.Path(tile), data)
+		})
+		if err != nil {
+			return StaticCTExportResult{}, err
+		}
+	}
+	result.Issuers = len(issuers)
+
+	// The bundle is the one older versions of Sunlight kept, in fingerprint order so that
+	// exports of the same tree are the same
+	slices.SortFunc(issuers, func(a, b [32]byte) int { return bytes.Compare(a[:], b[:]) })
+	ders := make([][]byte, len(issuers))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i, fp := range issuers {
+		g.Go(func() error {
+			key := fmt.Sprintf("issuer/%x", fp)
+			der, err := bucket.Get(gctx, key)
+			if err != nil {
+				return fmt.Errorf("unable to fetch %s: %w", key, err)
+			}
+			if sha256.Sum256(der) != fp {
+				return fmt.Errorf("issuer %x doesn't match its fingerprint", fp)
+			}
+			ders[i] = der
+			if err := export(gctx, key, der); err != nil {
+				return fmt.Errorf("unable to write %s: %w", key, err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return StaticCTExportResult{}, err
+	}
+	var bundle []byte
+	for _, der := range ders {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := out.Set(ctx, sunlightIssuersBundle, bundle); err != nil {
+		return StaticCTExportResult{}, fmt.Errorf("unable to write %s: %w", sunlightIssuersBundle, err)
+	}
+
+	if err := out.Set(ctx, "checkpoint", checkpoint); err != nil {
+		return StaticCTExportResult{}, fmt.Errorf("unable to write checkpoint: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+func TestExportStaticCT(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		link bool
+		// A file of the log that is corrupted
+		corrupt string
+		ok      bool
+	}{
+		{"copy", 300, false, "", true},
+		{"link", 300, true, "", true},
+		{"one partial tile", 5, false, "", true},
+		{"empty", 0, false, "", true},
+		{"data tile doesn't match the tree", 300, false, "tile/data/001.p/44", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLog(t, tt.size)
+			if tt.corrupt != "" {
+				corrupt(t, filepath.Join(l.dir, tt.corrupt))
+			}
+			out := filepath.Join(t.TempDir(), "export")
+			result, err := ExportStaticCT(context.Background(), GlobalConfig{RootDirectory: l.dir}, StaticCTExportConfig{Directory: out, Link: tt.link})
+			if (err == nil) != tt.ok {
+				t.Fatalf("ExportStaticCT = %+v, %v", result, err)
+			}
+			if !tt.ok {
+				if _, err := os.Stat(filepath.Join(out, "checkpoint")); err == nil {
+					t.Error("a failed export has a checkpoint")
+				}
+				return
+			}
+
+			tiles := len(tlog.NewTiles(sunlight.TileHeight, 0, tt.size))
+			issuers := min(int(tt.size), 2)
+			if result.TreeSize != tt.size || result.Tiles != tiles || result.Issuers != issuers {
+				t.Errorf("ExportStaticCT = %+v, want %d entries, %d tiles and %d issuers", result, tt.size, tiles, issuers)
+			}
+			if tt.size == 0 {
+				l.issuers = nil
+			}
+			l.checkCopy(t, out)
+
+			bundle, err := os.ReadFile(filepath.Join(out, sunlightIssuersBundle))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []byte
+			for _, der := range l.issuers {
+				want = append(want, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+			}
+			if !bytes.Equal(bundle, want) {
+				t.Errorf("%s = %q, want the issuers in fingerprint order", sunlightIssuersBundle, bundle)
+			}
+		})
+	}
+}
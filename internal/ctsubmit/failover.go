@@ -0,0 +1,203 @@
+package ctsubmit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"itko.dev/internal/coordination"
+)
+
+// Every time an instance acquires the lock, it increments the epoch stored at <prefix>/epoch.
+// Before each STH and checkpoint is published, stage two checks that the stored epoch
+// is still its own. This fences off an old primary that has lost the lock but hasn't
+// noticed yet, so it can never publish a tree head after a standby has taken over.
+
+func incrementEpoch(ctx context.Context, store coordination.Store, kvpath string) (uint64, error) {
+	key := kvpath + "/epoch"
+	for {
+		e, err := store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		var epoch uint64
+		if e.Exists() {
+			epoch, err = strconv.ParseUint(string(e.Value), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("unable to parse epoch: %w", err)
+			}
+		}
+		epoch++
+
+		ok, err := store.CompareAndSwap(ctx, key, []byte(strconv.FormatUint(epoch, 10)), e.ModifyIndex)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return epoch, nil
+		}
+	}
+}
+
+// LockLog takes the lock of the log at kvpath for a tool that changes its bucket, so
+// that the sequencer can't run at the same time. The epoch is bumped as well, so that a
+// sequencer that has lost the lock without noticing can't publish either. It blocks
+// until the lock is free, and returns the log's config. The lock must be released with
+// Unlock once the tool is done.
+func LockLog(ctx context.Context, kvpath string, coord coordination.Config) (GlobalConfig, coordination.Lock, error) {
+	store, err := newStore(coord)
+	if err != nil {
+		return GlobalConfig{}, nil, err
+	}
+	lock, err := store.Lock(ctx, kvpath+"/lock")
+	if err != nil {
+		return GlobalConfig{}, nil, err
+	}
+	gc, err := fetchConfig(ctx, store, coord, kvpath)
+	if err != nil {
+		lock.Unlock()
+		return GlobalConfig{}, nil, err
+	}
+	epoch, err := incrementEpoch(ctx, store, kvpath)
+	if err != nil {
+		lock.Unlock()
+		return GlobalConfig{}, nil, fmt.Errorf("unable to increment epoch: %v", err)
+	}
+	slog.Info("Acquired lock", "kv_path", kvpath, "epoch", epoch)
+	return gc, lock, nil
+}
+
+func (l *Log) checkEpoch(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "coordination.checkEpoch")
+	defer func() { endSpan(span, err) }()
+
+	e, err := l.store.Get(ctx, l.kvpath+"/epoch")
+	if err != nil {
+		return fmt.Errorf("unable to fetch epoch: %w", err)
+	}
+	if !e.Exists() {
+		return fmt.Errorf("epoch is missing")
+	}
+	epoch, err := strconv.ParseUint(string(e.Value), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse epoch: %w", err)
+	}
+	if epoch != l.epoch {
+		return fmt.Errorf("epoch is now %d, this instance has epoch %d", epoch, l.epoch)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------
+
+// failoverHandler serves the currently loaded instance of a log, or a 503 while
+// the lock is being reacquired.
+type failoverHandler struct {
+	current atomic.Pointer[http.Handler]
+	log     atomic.Pointer[Log]
+}
+
+// lifecycleState returns the state of the instance currently serving the log, or false
+// while the lock is being reacquired.
+func (f *failoverHandler) lifecycleState() (LifecycleState, bool) {
+	l := f.log.Load()
+	if l == nil {
+		return "", false
+	}
+	return l.lifecycle.State(), true
+}
+
+func (f *failoverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := f.current.Load()
+	if h == nil {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", 5+rand.Intn(10)))
+		http.Error(w, "sequencer is failing over", http.StatusServiceUnavailable)
+		return
+	}
+	(*h).ServeHTTP(w, r)
+}
+
+// LoadWithFailover loads and starts a log, blocking until the lock is acquired.
+// Instead of exiting when the lock is lost, the instance is stopped and the
+// process goes back to waiting on the lock, then reloads the log from storage
+// and resumes sequencing. The returned handler always serves whichever
+// instance currently holds the lock.
+//
+// Cancelling the context stops the log and releases the lock, so a standby can
+// take over straight away. The returned channel is closed once that is done.
+func LoadWithFailover(ctx context.Context, kvpath string, coord coordination.Config) (*Log, http.Handler, <-chan struct{}, error) {
+	l, h, cancel, err := loadAndStart(ctx, kvpath, coord)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fh := &failoverHandler{}
+	fh.current.Store(&h)
+	fh.log.Store(l)
+	released := make(chan struct{})
+
+	go func() {
+		defer close(released)
+		for {
+			select {
+			case <-l.lost:
+			case <-ctx.Done():
+				cancel()
+				if err := l.eStop.Unlock(); err != nil {
+					slog.Error("Unable to release lock", "kv_path", kvpath, "error", err)
+				} else {
+					slog.Info("Released lock", "kv_path", kvpath)
+				}
+				return
+			}
+
+			// Stop serving and shut down the stages of the old instance.
+			// Anything waiting on the old pipeline will time out with a 503.
+			fh.current.Store(nil)
+			fh.log.Store(nil)
+			cancel()
+			slog.Warn("Lock lost, waiting to reacquire it", "kv_path", kvpath)
+			l.alerts.Send(alertLockLost, "Lock lost, waiting to reacquire it")
+
+			for {
+				l, h, cancel, err = loadAndStart(ctx, kvpath, coord)
+				if err == nil {
+					break
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("Failed to reload log", "kv_path", kvpath, "error", err)
+				time.Sleep(5 * time.Second)
+			}
+
+			fh.current.Store(&h)
+			fh.log.Store(l)
+			slog.Info("Reloaded log", "kv_path", kvpath, "epoch", l.epoch)
+		}
+	}()
+
+	return l, fh, released, nil
+}
+
+func loadAndStart(ctx context.Context, kvpath string, coord coordination.Config) (*Log, http.Handler, context.CancelFunc, error) {
+	l, err := LoadLog(ctx, kvpath, coord)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	h, err := l.Start(runCtx)
+	if err != nil {
+		cancel()
+		l.eStop.Unlock()
+		return nil, nil, nil, err
+	}
+	return l, h, cancel, nil
+}
@@ -0,0 +1,243 @@
+package ctsubmit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"itko.dev/internal/coordination"
+)
+
+// memStore is a coordination.Store in memory.
+type memStore struct {
+	mu    sync.Mutex
+	index uint64
+	kv    map[string]coordination.Entry
+	locks map[string]*memLock
+}
+
+func newMemStore() *memStore {
+	return &memStore{kv: make(map[string]coordination.Entry), locks: make(map[string]*memLock)}
+}
+
+func (s *memStore) Get(ctx context.Context, key string) (coordination.Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.kv[key]
+	e.Index = s.index
+	return e, nil
+}
+
+func (s *memStore) Watch(ctx context.Context, key string, index uint64) (coordination.Entry, error) {
+	return s.Get(ctx, key)
+}
+
+func (s *memStore) Put(ctx context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index++
+	s.kv[key] = coordination.Entry{Value: value, ModifyIndex: s.index}
+	return nil
+}
+
+func (s *memStore) CompareAndSwap(ctx context.Context, key string, value []byte, modifyIndex uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kv[key].ModifyIndex != modifyIndex {
+		return false, nil
+	}
+	s.index++
+	s.kv[key] = coordination.Entry{Value: value, ModifyIndex: s.index}
+	return true, nil
+}
+
+func (s *memStore) Lock(ctx context.Context, key string) (coordination.Lock, error) {
+	for {
+		s.mu.Lock()
+		held := s.locks[key]
+		if held == nil {
+			l := &memLock{store: s, key: key, lost: make(chan struct{})}
+			s.locks[key] = l
+			s.mu.Unlock()
+			return l, nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-held.lost:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+type memLock struct {
+	store *memStore
+	key   string
+	lost  chan struct{}
+	once  sync.Once
+}
+
+func (l *memLock) Lost() <-chan struct{} { return l.lost }
+
+func (l *memLock) Unlock() error {
+	l.once.Do(func() {
+		l.store.mu.Lock()
+		delete(l.store.locks, l.key)
+		l.store.mu.Unlock()
+		close(l.lost)
+	})
+	return nil
+}
+
+func useMemStore(t *testing.T) *memStore {
+	s := newMemStore()
+	old := newStore
+	newStore = func(coordination.Config) (coordination.Store, error) { return s, nil }
+	t.Cleanup(func() { newStore = old })
+	return s
+}
+
+// TestLoadLogReleasesLockOnError checks that a log that fails to load doesn't keep its
+// lock, as the failover loop retries LoadLog, which would wait on its own lock forever.
+func TestLoadLogReleasesLockOnError(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"missing config", "", "no configuration found"},
+		{"invalid config", "{", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := useMemStore(t)
+			if tt.config != "" {
+				s.Put(context.Background(), "itko/test/config", []byte(tt.config))
+			}
+
+			for attempt := range 3 {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				_, err := LoadLog(ctx, "itko/test", coordination.Config{})
+				cancel()
+				if err == nil {
+					t.Fatalf("attempt %d: LoadLog succeeded", attempt)
+				}
+				if errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("attempt %d: LoadLog waited on the lock of the failed attempt", attempt)
+				}
+				if !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("attempt %d: LoadLog = %v, want an error containing %q", attempt, err, tt.want)
+				}
+			}
+
+			// The lock is free for another instance, or a tool, to take
+			_, lock, err := LockLog(context.Background(), "itko/test", coordination.Config{})
+			if err == nil {
+				lock.Unlock()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			lock, err = s.Lock(ctx, "itko/test/lock")
+			if err != nil {
+				t.Fatalf("the lock was not released: %v", err)
+			}
+			lock.Unlock()
+		})
+	}
+}
+
+// TestIncrementEpochConcurrent checks that instances racing for the epoch each get their
+// own, as a compare-and-swap that loses is retried.
+func TestIncrementEpochConcurrent(t *testing.T) {
+	s := newMemStore()
+	const instances = 20
+	var wg sync.WaitGroup
+	epochs := make([]uint64, instances)
+	for i := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if epochs[i], err = incrementEpoch(context.Background(), s, "itko/test"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for _, epoch := range epochs {
+		if seen[epoch] || epoch < 1 || epoch > instances {
+			t.Errorf("epochs = %v, want each of 1 to %d once", epochs, instances)
+			break
+		}
+		seen[epoch] = true
+	}
+}
+
+func TestCheckEpoch(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+		ok     bool
+	}{
+		{"own epoch", "7", true},
+		{"taken over", "8", false},
+		{"missing", "", false},
+		{"unparseable", "seven", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemStore()
+			if tt.stored != "" {
+				s.Put(context.Background(), "itko/test/epoch", []byte(tt.stored))
+			}
+			l := &Log{store: s, kvpath: "itko/test", epoch: 7}
+			if err := l.checkEpoch(context.Background()); (err == nil) != tt.ok {
+				t.Errorf("checkEpoch = %v, want it to pass %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// TestLockLogFencesSequencer checks that a tool taking the lock fences off a sequencer
+// that lost it without noticing.
+func TestLockLogFencesSequencer(t *testing.T) {
+	s := useMemStore(t)
+	ctx := context.Background()
+	s.Put(ctx, "itko/test/config", []byte(`{
+		"name": "ct.example.com/test",
+		"logID": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		"keyPath": "key.pem",
+		"maskSize": 5,
+		"rootDirectory": "`+t.TempDir()+`",
+		"notAfterStart": "2025-01-01T00:00:00Z",
+		"notAfterLimit": "2026-01-01T00:00:00Z",
+		"flushMs": 500
+	}`))
+	epoch, err := incrementEpoch(ctx, s, "itko/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Log{store: s, kvpath: "itko/test", epoch: epoch}
+	if err := l.checkEpoch(ctx); err != nil {
+		t.Fatalf("checkEpoch of the sequencer holding the lock = %v", err)
+	}
+
+	_, lock, err := LockLog(ctx, "itko/test", coordination.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	if err := l.checkEpoch(ctx); err == nil {
+		t.Error("the sequencer can still publish after a tool took the lock")
+	}
+	e, _ := s.Get(ctx, "itko/test/epoch")
+	if got, _ := strconv.ParseUint(string(e.Value), 10, 64); got != epoch+1 {
+		t.Errorf("epoch = %s, want %d", e.Value, epoch+1)
+	}
+}
@@ -0,0 +1,160 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+	"itko.dev/internal/sunlight"
+)
+
+// FsckConfig is how Fsck runs.
+type FsckConfig struct {
+	// DryRun logs the index files that would be rewritten, without writing them.
+	DryRun bool
+	// Concurrency is the number of objects read or written at once. Defaults to 16.
+	Concurrency int
+}
+
+// FsckResult is what Fsck found.
+type FsckResult struct {
+	TreeSize    int64
+	HashFiles   int
+	DedupeFiles int
+	// The keys of the index files that were rewritten, or would have been with DryRun
+	Repaired []string
+}
+
+// Fsck checks every file of the hash and dedupe indexes that a leaf of the published tree
+// should be in against the records rebuilt from the data tiles, and rewrites those that
+// are missing, unreadable, or don't have exactly the records of their leaves, in order.
+// Records for leaves past the tree size are kept as they are, since they are written
+// before the STH that covers them. The sequencer mustn't be running unless DryRun is set,
+// or records it adds while a file is rewritten may be lost.
+func Fsck(ctx context.Context, gc GlobalConfig, fc FsckConfig) (FsckResult, error) {
+	layout, err := gc.indexLayout()
+	if err != nil {
+		return FsckResult{}, err
+	}
+	fc.Concurrency = cmp.Or(fc.Concurrency, 16)
+	bucket := newBucket(gc)
+
+	tree, err := loadTree(ctx, bucket)
+	if err != nil {
+		return FsckResult{}, err
+	}
+	slog.Info("Rebuilding index records from the data tiles", "tree_size", tree.N)
+	hashes, dedupe, err := rebuildIndexes(ctx, bucket, tree, gc.MirroredEntries, fc.Concurrency)
+	if err != nil {
+		return FsckResult{}, err
+	}
+
+	result := FsckResult{TreeSize: tree.N}
+	var mu sync.Mutex
+	for _, index := range []*indexRecords{hashes, dedupe} {
+		files := index.files(layout)
+		if index == hashes {
+			result.HashFiles = len(files)
+		} else {
+			result.DedupeFiles = len(files)
+		}
+
+		var done atomic.Int64
+		stop := reportProgress("Checked "+index.dir+" files", &done, int64(len(files)))
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(fc.Concurrency)
+		for _, f := range files {
+			g.Go(func() error {
+				defer done.Add(1)
+				key := index.dir + f.path
+				repaired, reason, err := fsckIndexFile(gctx, bucket, layout, index, f, tree.N)
+				if err != nil {
+					return err
+				}
+				if repaired == nil {
+					return nil
+				}
+
+				mu.Lock()
+				result.Repaired = append(result.Repaired, key)
+				mu.Unlock()
+				if fc.DryRun {
+					slog.Warn("Index file needs repair", "key", key, "reason", reason)
+					return nil
+				}
+				if err := bucket.set(gctx, key, append(sunlight.IndexHeader(index.recordSize), repaired...)); err != nil {
+					return fmt.Errorf("unable to write %s: %w", key, err)
+				}
+				slog.Info("Repaired index file", "key", key, "reason", reason)
+				return nil
+			})
+		}
+		err := g.Wait()
+		stop()
+		if err != nil {
+			return result, err
+		}
+	}
+	slices.Sort(result.Repaired)
+	return result, nil
+}
+
+// fsckIndexFile compares a file of an index with the records rebuilt for it. If they
+// differ, it returns the records the file should have, and why.
+func fsckIndexFile(ctx context.Context, bucket Bucket, layout sunlight.IndexLayout, index *indexRecords, f indexFile, treeSize int64) ([]byte, string, error) {
+	key := index.dir + f.path
+	file, err := bucket.Get(ctx, key)
+	if isNotFound(err) {
+		return f.records, "missing", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("unable to fetch %s: %w", key, err)
+	}
+	records, err := sunlight.IndexRecords(file, index.recordSize)
+	if err != nil {
+		return f.records, err.Error(), nil
+	}
+
+	// Keep the records for leaves past the tree size, if they are in the right file
+	want := slices.Clone(f.records)
+	for i := 0; i*index.recordSize < len(records); i++ {
+		record := records[i*index.recordSize : (i+1)*index.recordSize]
+		if recordLeafIndex(record) >= treeSize && layout.Path(record[:RHUHashSize]) == f.path {
+			want = append(want, record...)
+		}
+	}
+	r := &indexRecords{recordSize: index.recordSize, records: want}
+	sort.Sort(r)
+	if bytes.Equal(records, want) {
+		return nil, "", nil
+	}
+
+	// Work out why, for the log
+	have := make(map[string]bool)
+	for i := 0; i*index.recordSize < len(records); i++ {
+		have[string(records[i*index.recordSize:(i+1)*index.recordSize])] = true
+	}
+	missing := 0
+	for i := range r.Len() {
+		if !have[string(r.record(i))] {
+			missing++
+		}
+		delete(have, string(r.record(i)))
+	}
+	switch {
+	case missing > 0 && len(have) > 0:
+		return want, fmt.Sprintf("missing %d of %d records, and has %d that don't match a leaf", missing, r.Len(), len(have)), nil
+	case missing > 0:
+		return want, fmt.Sprintf("missing %d of %d records", missing, r.Len()), nil
+	case len(have) > 0:
+		return want, fmt.Sprintf("has %d records that don't match a leaf", len(have)), nil
+	default:
+		return want, "records out of order or duplicated", nil
+	}
+}
@@ -0,0 +1,135 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// writeSTH publishes an STH for the tree of l, as loadTree reads it. The signature isn't
+// checked by the tools that rebuild the indexes.
+func (l *testLog) writeSTH(t *testing.T) {
+	t.Helper()
+	sth, err := json.Marshal(ct.SignedTreeHead{TreeSize: uint64(l.tree.N), SHA256RootHash: ct.SHA256Hash(l.tree.Hash)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(l.dir, "ct/v1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(l.dir, "ct/v1/get-sth"), sth, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkIndexes checks that every leaf of l can be found in both indexes in layout.
+func (l *testLog) checkIndexes(t *testing.T, layout sunlight.IndexLayout) {
+	t.Helper()
+	bucket := newBucket(GlobalConfig{RootDirectory: l.dir})
+	ctx := context.Background()
+	for i, entry := range l.entries {
+		hash := tlog.RecordHash(entry.MerkleTreeLeaf())
+		record, err := bucket.GetRecordHash(ctx, [16]byte(hash[:16]), layout)
+		if err != nil || record.leafIndex != uint64(i) {
+			t.Fatalf("hash index of leaf %d = %d, %v", i, record.leafIndex, err)
+		}
+		dedupe, err := bucket.GetDedupeEntry(ctx, [16]byte(entry.CertificateFp[:16]), layout)
+		if err != nil || dedupe.leafIndex != uint64(i) || dedupe.timestamp != entry.Timestamp {
+			t.Fatalf("dedupe index of leaf %d = %+v, %v", i, dedupe, err)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	layout := sunlight.IndexLayout{Mask: 5}
+	l := newTestLog(t, 300)
+	l.writeSTH(t)
+	gc := GlobalConfig{RootDirectory: l.dir, MaskSize: layout.Mask}
+	ctx := context.Background()
+	if _, _, err := BackfillIndexes(ctx, gc, layout, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cases change the hash index file of leaf 7, adding records with its hash
+	hash := tlog.RecordHash(l.entries[7].MerkleTreeLeaf())
+	key := "int/hashes/" + layout.Path(hash[:RHUHashSize])
+	path := filepath.Join(l.dir, key)
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := file[sunlight.IndexHeaderSize:]
+	record := func(leafIndex uint64) []byte {
+		r := RecordHashUpload{hash: [16]byte(hash[:16]), leafIndex: leafIndex}
+		return r.ToBytes()
+	}
+
+	tests := []struct {
+		name    string
+		records []byte
+		// Whether the file is rewritten
+		repaired bool
+	}{
+		{"intact", records, false},
+		{"missing record", records[RHURecordSize:], true},
+		{"record that doesn't match a leaf", slices.Concat(record(100), records), true},
+		{"duplicated record", slices.Concat(records, records[:RHURecordSize]), true},
+		// Written before the STH that covers it
+		{"record past the tree size", slices.Concat(records, record(500)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path, slices.Concat(sunlight.IndexHeader(RHURecordSize), tt.records), 0644); err != nil {
+				t.Fatal(err)
+			}
+			result, err := Fsck(ctx, gc, FsckConfig{Concurrency: 4})
+			if err != nil || result.TreeSize != 300 || (len(result.Repaired) > 0) != tt.repaired {
+				t.Fatalf("Fsck = %+v, %v", result, err)
+			}
+			if tt.repaired && !slices.Equal(result.Repaired, []string{key}) {
+				t.Errorf("Fsck repaired %q, want %q", result.Repaired, key)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.repaired && !bytes.Equal(got, file) || !tt.repaired && !bytes.Equal(got[sunlight.IndexHeaderSize:], tt.records) {
+				t.Errorf("Fsck left %x", got)
+			}
+		})
+	}
+}
+
+func TestFsckMissingFile(t *testing.T) {
+	layout := sunlight.IndexLayout{Mask: 5}
+	l := newTestLog(t, 300)
+	l.writeSTH(t)
+	gc := GlobalConfig{RootDirectory: l.dir, MaskSize: layout.Mask}
+	ctx := context.Background()
+	if _, _, err := BackfillIndexes(ctx, gc, layout, 4); err != nil {
+		t.Fatal(err)
+	}
+	key := "int/dedupe/" + layout.Path(l.entries[7].CertificateFp[:RHUHashSize])
+	if err := os.Remove(filepath.Join(l.dir, key)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		result, err := Fsck(ctx, gc, FsckConfig{DryRun: dryRun, Concurrency: 4})
+		if err != nil || !slices.Equal(result.Repaired, []string{key}) {
+			t.Fatalf("Fsck with DryRun %v = %q, %v, want %q", dryRun, result.Repaired, err, key)
+		}
+		if _, err := os.Stat(filepath.Join(l.dir, key)); (err == nil) == dryRun {
+			t.Errorf("Fsck with DryRun %v: %s exists %v", dryRun, key, err == nil)
+		}
+	}
+	l.checkIndexes(t, layout)
+}
@@ -0,0 +1,206 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The log's key can be kept in Google Cloud KMS, which is called over its REST API.
+// Credentials come from the service account key file in GOOGLE_APPLICATION_CREDENTIALS,
+// or otherwise from the metadata server of the instance the log runs on.
+
+const (
+	gcpKmsUrl       = "https://cloudkms.googleapis.com/v1/"
+	gcpMetadataUrl  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpKmsScope     = "https://www.googleapis.com/auth/cloudkms"
+	gcpKmsAlgorithm = "EC_SIGN_P256_SHA256"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type gcpKmsSigner struct {
+	keyVersion string
+	public     crypto.PublicKey
+	client     *http.Client
+	tokens     *tokenSource
+}
+
+func newGcpKmsSigner(ctx context.Context, keyVersion string) (*gcpKmsSigner, error) {
+	if !strings.HasPrefix(keyVersion, "projects/") || !strings.Contains(keyVersion, "/cryptoKeyVersions/") {
+		return nil, fmt.Errorf("gcpKeyVersion must be the resource name of a key version")
+	}
+	client := &http.Client{Timeout: remoteSignerTimeout}
+	s := &gcpKmsSigner{keyVersion: keyVersion, client: client}
+
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		fetch, err := gcpServiceAccountToken(client, path)
+		if err != nil {
+			return nil, err
+		}
+		s.tokens = &tokenSource{fetch: fetch}
+	} else {
+		s.tokens = &tokenSource{fetch: func(ctx context.Context) (oauthToken, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataUrl, nil)
+			if err != nil {
+				return oauthToken{}, err
+			}
+			req.Header.Set("Metadata-Flavor", "Google")
+			var token oauthToken
+			return token, doJSON(client, req, &token)
+		}}
+	}
+
+	var resp struct {
+		Pem       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := s.call(ctx, http.MethodGet, "/publicKey", nil, &resp); err != nil {
+		return nil, fmt.Errorf("unable to get public key from Cloud KMS: %w", err)
+	}
+	if resp.Algorithm != gcpKmsAlgorithm {
+		return nil, fmt.Errorf("Cloud KMS key is %s, expected %s", resp.Algorithm, gcpKmsAlgorithm)
+	}
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode public key from Cloud KMS")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key from Cloud KMS: %w", err)
+	}
+	s.public = public
+	return s, nil
+}
+
+func (s *gcpKmsSigner) call(ctx context.Context, method, suffix string, body, out any) error {
+	token, err := s.tokens.get(ctx)
+	if err != nil {
+		return err
+	}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, gcpKmsUrl+s.keyVersion+suffix, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(s.client, req, out)
+}
+
+func (s *gcpKmsSigner) Public() crypto.PublicKey { return s.public }
+
+func (s *gcpKmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("Cloud KMS key only signs SHA-256 digests")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteSignerTimeout)
+	defer cancel()
+
+	// The checksums protect the digest and signature from being corrupted in transit
+	req := map[string]any{
+		"digest":       map[string]string{"sha256": base64.StdEncoding.EncodeToString(digest)},
+		"digestCrc32c": strconv.FormatUint(uint64(crc32.Checksum(digest, crc32c)), 10),
+	}
+	var resp struct {
+		Signature            []byte `json:"signature"`
+		SignatureCrc32c      string `json:"signatureCrc32c"`
+		VerifiedDigestCrc32c bool   `json:"verifiedDigestCrc32c"`
+	}
+	if err := s.call(ctx, http.MethodPost, ":asymmetricSign", req, &resp); err != nil {
+		return nil, fmt.Errorf("Cloud KMS signing failed: %w", err)
+	}
+	if !resp.VerifiedDigestCrc32c || resp.SignatureCrc32c != strconv.FormatUint(uint64(crc32.Checksum(resp.Signature, crc32c)), 10) {
+		return nil, fmt.Errorf("Cloud KMS signing failed: checksum mismatch")
+	}
+	return resp.Signature, nil
+}
+
+// gcpServiceAccountToken exchanges a JWT signed with a service account key for an
+// access token, as described at https://developers.google.com/identity/protocols/oauth2/service-account.
+func gcpServiceAccountToken(client *http.Client, path string) (func(context.Context) (oauthToken, error), error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read GOOGLE_APPLICATION_CREDENTIALS: %w", err)
+	}
+	var creds struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenUri    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("unable to parse GOOGLE_APPLICATION_CREDENTIALS: %w", err)
+	}
+	if creds.Type != "service_account" {
+		return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS must be a service account key, not %q", creds.Type)
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode service account key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service account key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service account key must be an RSA key")
+	}
+
+	return func(ctx context.Context) (oauthToken, error) {
+		now := time.Now().Unix()
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+		claims, err := json.Marshal(map[string]any{
+			"iss":   creds.ClientEmail,
+			"scope": gcpKmsScope,
+			"aud":   creds.TokenUri,
+			"iat":   now,
+			"exp":   now + 3600,
+		})
+		if err != nil {
+			return oauthToken{}, err
+		}
+		unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+		h := sha256.Sum256([]byte(unsigned))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+		if err != nil {
+			return oauthToken{}, err
+		}
+
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, creds.TokenUri, strings.NewReader(form.Encode()))
+		if err != nil {
+			return oauthToken{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		var token oauthToken
+		return token, doJSON(client, req, &token)
+	}, nil
+}
@@ -0,0 +1,200 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"golang.org/x/sync/errgroup"
+	"itko.dev/internal/sunlight"
+)
+
+// The hash and dedupe indexes are only ever added to by stage two, so a file that is lost
+// or corrupted stays that way. The data tiles are authoritative, so the records of both
+// indexes can be rebuilt from them, as long as they still hash up to the STH.
+
+// How often the tools that scan the whole log report their progress
+const scanProgressInterval = 10 * time.Second
+
+// indexRecords are the records of one index for every leaf of a tree, sorted as they are
+// kept in the files: by hash, then by leaf index, as a duplicate is inserted after the
+// records already there. This also groups them by file.
+type indexRecords struct {
+	dir        string
+	recordSize int
+	records    []byte
+}
+
+func (r *indexRecords) Len() int { return len(r.records) / r.recordSize }
+func (r *indexRecords) Less(i, j int) bool {
+	return compareRecords(r.record(i), r.record(j)) < 0
+}
+func (r *indexRecords) Swap(i, j int) {
+	var tmp [DDURecordSize]byte
+	a, b := r.record(i), r.record(j)
+	copy(tmp[:], a)
+	copy(a, b)
+	copy(b, tmp[:len(a)])
+}
+
+func (r *indexRecords) record(i int) []byte {
+	return r.records[i*r.recordSize : (i+1)*r.recordSize]
+}
+
+// compareRecords orders two records of the same index by hash, then by leaf index.
+func compareRecords(a, b []byte) int {
+	if c := bytes.Compare(a[:RHUHashSize], b[:RHUHashSize]); c != 0 {
+		return c
+	}
+	return cmp.Compare(recordLeafIndex(a), recordLeafIndex(b))
+}
+
+// recordLeafIndex reads the leaf index of a record of either index, which both keep
+// after the hash.
+func recordLeafIndex(record []byte) int64 {
+	var leafIndex [8]byte
+	copy(leafIndex[:], record[RHUHashSize:RHUHashSize+RHULeafIndexSize])
+	return int64(binary.LittleEndian.Uint64(leafIndex[:]))
+}
+
+// indexFile is the records of one file of an index.
+type indexFile struct {
+	path    string
+	records []byte
+}
+
+// files splits the records into the files of the layout they go in.
+func (r *indexRecords) files(layout sunlight.IndexLayout) []indexFile {
+	var files []indexFile
+	for i := 0; i < r.Len(); {
+		path := layout.Path(r.record(i)[:RHUHashSize])
+		j := i + 1
+		for j < r.Len() && layout.Path(r.record(j)[:RHUHashSize]) == path {
+			j++
+		}
+		files = append(files, indexFile{path: path, records: r.records[i*r.recordSize : j*r.recordSize]})
+		i = j
+	}
+	return files
+}
+
+// loadTree reads the tree of the published STH.
+func loadTree(ctx context.Context, bucket Bucket) (tlog.Tree, error) {
+	data, err := bucket.Get(ctx, "ct/v1/get-sth")
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("unable to fetch STH: %w", err)
+	}
+	var sth ct.SignedTreeHead
+	if err := json.Unmarshal(data, &sth); err != nil {
+		return tlog.Tree{}, fmt.Errorf("unable to unmarshal STH: %w", err)
+	}
+	return tlog.Tree{N: int64(sth.TreeSize), Hash: tlog.Hash(sth.SHA256RootHash)}, nil
+}
+
+// rebuildIndexes reads every data tile of the tree, checks it against the level zero tile
+// over it, which is checked against the tree's root hash, and returns the records of the
+// hash and dedupe indexes for its leaves. A data tile that doesn't match the tree is an
+// error, as the indexes can't be rebuilt without it. Entries without a leaf_index are
+// only read if mirrored is set.
+func rebuildIndexes(ctx context.Context, bucket Bucket, tree tlog.Tree, mirrored bool, concurrency int) (hashes, dedupe *indexRecords, err error) {
+	hashes = &indexRecords{dir: "int/hashes/", recordSize: RHURecordSize, records: make([]byte, tree.N*RHURecordSize)}
+	dedupe = &indexRecords{dir: "int/dedupe/", recordSize: DDURecordSize, records: make([]byte, tree.N*DDURecordSize)}
+
+	// The tiles above level zero are kept, as the TileHashReader would otherwise fetch
+	// them again for every data tile under them
+	var cache sync.Map
+	hashReader := tlog.TileHashReader(tree, &sunlight.TileReader{
+		Fetch: func(key string) ([]byte, error) {
+			if data, ok := cache.Load(key); ok {
+				return data.([]byte), nil
+			}
+			data, err := bucket.Get(ctx, key)
+			if err != nil {
+				return nil, fmt.Errorf("unable to fetch %s: %w", key, err)
+			}
+			if !strings.HasPrefix(key, "tile/0/") {
+				cache.Store(key, data)
+			}
+			return data, nil
+		},
+		SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {},
+	})
+
+	tiles := (tree.N + sunlight.TileWidth - 1) / sunlight.TileWidth
+	var done atomic.Int64
+	stop := reportProgress("Read data tiles", &done, tiles)
+	defer stop()
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for n := range tiles {
+		g.Go(func() error {
+			tile := tlog.Tile{H: sunlight.TileHeight, L: 0, N: n, W: int(min(tree.N-n*sunlight.TileWidth, sunlight.TileWidth))}
+			levelZero, err := tlog.ReadTileData(tile, hashReader)
+			if err != nil {
+				return fmt.Errorf("unable to read %s: %w", sunlight.Path(tile), err)
+			}
+			tile.L = -1
+			data, err := bucket.Get(gctx, sunlight.Path(tile))
+			if err != nil {
+				return fmt.Errorf("unable to fetch data tile %s: %w", sunlight.Path(tile), err)
+			}
+			if err := verifyDataTile(tile, data, levelZero, mirrored); err != nil {
+				return err
+			}
+
+			for entry, err := range parseTileEntries(tile, data, mirrored) {
+				if err != nil {
+					return err
+				}
+				recordHash := tlog.RecordHash(entry.MerkleTreeLeaf())
+				hash := RecordHashUpload{hash: [16]byte(recordHash[:16]), leafIndex: entry.LeafIndex}
+				copy(hashes.record(int(entry.LeafIndex)), hash.ToBytes())
+				dedupeVal := DedupeUpload{hash: [16]byte(entry.CertificateFp[:16]), leafIndex: entry.LeafIndex, timestamp: entry.Timestamp}
+				copy(dedupe.record(int(entry.LeafIndex)), dedupeVal.ToBytes())
+			}
+			done.Add(1)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+
+	sort.Sort(hashes)
+	sort.Sort(dedupe)
+	return hashes, dedupe, nil
+}
+
+// reportProgress logs how far done has got towards total every scanProgressInterval,
+// until it is stopped.
+func reportProgress(msg string, done *atomic.Int64, total int64) (stop func()) {
+	ticker := time.NewTicker(scanProgressInterval)
+	stopped := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-ticker.C:
+				slog.Info(msg, "done", done.Load(), "total", total)
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stopped)
+		slog.Info(msg, "done", done.Load(), "total", total)
+	}
+}
@@ -0,0 +1,111 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"itko.dev/internal/sunlight"
+)
+
+// IndexInspection is returned by GET /admin/dedupe/<key> and GET /admin/hashes/<key>. It
+// shows everything in the k-anon file the key lives in that matches it, to debug a
+// certificate that got a second SCT, or a get-proof-by-hash that can't find its leaf.
+type IndexInspection struct {
+	// The first 16 bytes of the fingerprint or leaf hash, which is all the index keeps
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	// Whether the file exists, and how many records it holds
+	Exists  bool `json:"exists"`
+	Records int  `json:"records"`
+	// Every record with the key, in file order. Lookups return the first one.
+	Matches []IndexRecord `json:"matches"`
+}
+
+type IndexRecord struct {
+	Position  int    `json:"position"`
+	LeafIndex uint64 `json:"leafIndex"`
+	// Only set for dedupe records
+	Timestamp *int64 `json:"timestamp,omitempty"`
+}
+
+// parseIndexKey accepts a fingerprint or leaf hash in hex or base64, as either is what an
+// operator is likely to have at hand, and truncates it to the size of the index key.
+func parseIndexKey(s string) ([16]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) < 16 {
+		return [16]byte{}, fmt.Errorf("key must be at least 16 bytes of hex or base64")
+	}
+	return [16]byte(key[:16]), nil
+}
+
+func (l *Log) inspectIndex(w http.ResponseWriter, r *http.Request, dir string, recordSize int) {
+	if !l.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	key, err := parseIndexKey(r.PathValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := IndexInspection{
+		Key:     hex.EncodeToString(key[:]),
+		Path:    dir + l.stageTwoData.indexLayout.Path(key[:]),
+		Matches: []IndexRecord{},
+	}
+	file, err := l.stageTwoData.bucket.Get(r.Context(), resp.Path)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		resp.Exists = true
+		records, err := sunlight.IndexRecords(file, recordSize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to read %s: %v", resp.Path, err), http.StatusInternalServerError)
+			return
+		}
+		resp.Records = len(records) / recordSize
+
+		i, found := sunlight.SearchIndex(records, recordSize, key[:])
+		for ; found && i < resp.Records; i++ {
+			record := records[i*recordSize : (i+1)*recordSize]
+			if !bytes.Equal(record[:16], key[:]) {
+				break
+			}
+			match := IndexRecord{Position: i}
+			if recordSize == DDURecordSize {
+				dedupe, _ := BytesToDedupe(record)
+				match.LeafIndex = dedupe.leafIndex
+				match.Timestamp = &dedupe.timestamp
+			} else {
+				hash, _ := BytesToRecord(record)
+				match.LeafIndex = hash.leafIndex
+			}
+			resp.Matches = append(resp.Matches, match)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
+	}
+}
+
+func (l *Log) inspectDedupe(w http.ResponseWriter, r *http.Request) {
+	l.inspectIndex(w, r, "int/dedupe/", DDURecordSize)
+}
+
+func (l *Log) inspectHashes(w http.ResponseWriter, r *http.Request) {
+	l.inspectIndex(w, r, "int/hashes/", RHURecordSize)
+}
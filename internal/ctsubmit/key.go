@@ -0,0 +1,354 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// The signing key can be kept encrypted on disk, as an "ENCRYPTED PRIVATE KEY" PEM block
+// holding a PKCS#8 key encrypted with PBES2, such as one written by
+// `openssl pkcs8 -topk8 -v2 aes-256-cbc`. The passphrase is taken from the
+// ITKO_KEY_PASSPHRASE environment variable, then the file at keyPassphraseFile, and is
+// otherwise asked for if stdin is a terminal.
+
+const keyPassphraseEnv = "ITKO_KEY_PASSPHRASE"
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// Iterations used when encrypting a key, as recommended by OWASP for PBKDF2-HMAC-SHA256
+const pbkdf2Iterations = 600000
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt        []byte
+	Cost        int
+	BlockSize   int
+	Parallelism int
+	KeyLength   int `asn1:"optional"`
+}
+
+// KeyPassphrase returns the passphrase for the signing key from the environment or
+// passphraseFile, or nil if neither is set.
+func KeyPassphrase(passphraseFile string) ([]byte, error) {
+	if p := os.Getenv(keyPassphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	if passphraseFile != "" {
+		p, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key passphrase: %w", err)
+		}
+		return bytes.TrimRight(p, "\r\n"), nil
+	}
+	return nil, nil
+}
+
+// ReadSigningKey reads the log's private key from a PEM file, which may be an
+// "EC PRIVATE KEY", a PKCS#8 "PRIVATE KEY", or an "ENCRYPTED PRIVATE KEY". PKCS#8 keys
+// can also be RSA or Ed25519 keys.
+func ReadSigningKey(path, passphraseFile string) (crypto.Signer, error) {
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key: %w", err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("unable to decode key: no PEM block found")
+	}
+
+	var parsed any
+	switch keyBlock.Type {
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		var passphrase []byte
+		passphrase, err = KeyPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		if passphrase == nil {
+			passphrase, err = promptPassphrase(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var der []byte
+		der, err = decryptPKCS8(keyBlock.Bytes, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt key: %w", err)
+		}
+		parsed, err = x509.ParsePKCS8PrivateKey(der)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", keyBlock.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse key: %w", err)
+	}
+
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key is a %T, which can't sign", parsed)
+	}
+	return key, nil
+}
+
+func promptPassphrase(path string) ([]byte, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("key is encrypted, but neither %s nor keyPassphraseFile is set", keyPassphraseEnv)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", path)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
+
+// GenerateSigningKey generates a P-256 key for a log and writes it to keyPath, encrypted
+// if a passphrase is set. An existing file is never overwritten.
+func GenerateSigningKey(keyPath, passphraseFile string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := KeyPassphrase(passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	var keyPEM []byte
+	if passphrase != nil {
+		keyPEM, err = EncryptSigningKey(key, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+	return key, writeKeyFile(keyPath, keyPEM)
+}
+
+// GenerateCosignerKey generates an Ed25519 cosigner key and writes it to keyPath, as the
+// unencrypted PKCS#8 key read by the cosigners section.
+func GenerateCosignerKey(keyPath string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeKeyFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func writeKeyFile(keyPath string, keyPEM []byte) error {
+	// O_EXCL so that an existing key is never overwritten
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(keyPEM); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// EncryptSigningKey encodes an EC private key as an "ENCRYPTED PRIVATE KEY" PEM block,
+// using PBKDF2-HMAC-SHA256 and AES-256-CBC.
+func EncryptSigningKey(key *ecdsa.PrivateKey, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, pbkdf2Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: pbkdf2Iterations,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data:      data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encrypted}), nil
+}
+
+// decryptPKCS8 decrypts a PKCS#8 EncryptedPrivateKeyInfo encrypted with PBES2, with
+// PBKDF2 or scrypt as the key derivation function and AES-CBC as the cipher.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil || len(rest) > 0 {
+		return nil, errors.New("malformed encrypted key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("malformed PBES2 parameters")
+	}
+
+	var keyLen int
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen = 16
+	case alg.Equal(oidAES192CBC):
+		keyLen = 24
+	case alg.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s", alg)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("malformed cipher parameters")
+	}
+
+	kdf := params.KeyDerivationFunc
+	var key []byte
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, errors.New("malformed PBKDF2 parameters")
+		}
+		var prf func() hash.Hash
+		switch {
+		case len(p.PRF.Algorithm) == 0 || p.PRF.Algorithm.Equal(oidHMACSHA1):
+			prf = sha1.New
+		case p.PRF.Algorithm.Equal(oidHMACSHA256):
+			prf = sha256.New
+		case p.PRF.Algorithm.Equal(oidHMACSHA384):
+			prf = sha512.New384
+		case p.PRF.Algorithm.Equal(oidHMACSHA512):
+			prf = sha512.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", p.PRF.Algorithm)
+		}
+		if p.Iterations < 1 || (p.KeyLength != 0 && p.KeyLength != keyLen) {
+			return nil, errors.New("invalid PBKDF2 parameters")
+		}
+		key = pbkdf2.Key(passphrase, p.Salt, p.Iterations, keyLen, prf)
+	case kdf.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, errors.New("malformed scrypt parameters")
+		}
+		if p.KeyLength != 0 && p.KeyLength != keyLen {
+			return nil, errors.New("invalid scrypt parameters")
+		}
+		var err error
+		key, err = scrypt.Key(passphrase, p.Salt, p.Cost, p.BlockSize, p.Parallelism, keyLen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scrypt parameters: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function %s", kdf.Algorithm)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed encrypted key")
+	}
+	data := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.Data)
+
+	// A wrong passphrase almost always leaves invalid padding
+	padding := int(data[len(data)-1])
+	if padding < 1 || padding > aes.BlockSize || !bytes.Equal(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errors.New("incorrect passphrase")
+	}
+	return data[:len(data)-padding], nil
+}
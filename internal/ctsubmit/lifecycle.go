@@ -0,0 +1,255 @@
+package ctsubmit
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LifecycleState is the state of the log as stored in Consul at <prefix>/state.
+// A log only ever moves forward through these states, usable -> read-only -> retired.
+type LifecycleState string
+
+const (
+	// The log accepts submissions and issues STHs as normal.
+	// This is also the state of a log with no state key in Consul.
+	StateUsable LifecycleState = "usable"
+	// The log no longer accepts submissions. Entries that have already been
+	// sequenced are incorporated into one final STH, and then stage one and two stop.
+	StateReadOnly LifecycleState = "read-only"
+	// Same as read-only, except that no new STH will ever be issued again.
+	// Anything still in the pipeline when the log is retired is dropped.
+	StateRetired LifecycleState = "retired"
+)
+
+var ErrLogNotUsable = errors.New("log is not accepting submissions")
+
+func ParseLifecycleState(s string) (LifecycleState, error) {
+	switch LifecycleState(strings.TrimSpace(s)) {
+	case "", StateUsable:
+		return StateUsable, nil
+	case StateReadOnly:
+		return StateReadOnly, nil
+	case StateRetired:
+		return StateRetired, nil
+	default:
+		return "", fmt.Errorf("unknown lifecycle state %q", s)
+	}
+}
+
+// rank is used to make sure transitions only ever go forwards.
+func (s LifecycleState) rank() int {
+	switch s {
+	case StateUsable:
+		return 0
+	case StateReadOnly:
+		return 1
+	case StateRetired:
+		return 2
+	default:
+		return -1
+	}
+}
+
+type lifecycle struct {
+	mu    sync.Mutex
+	state LifecycleState
+
+	// frozen is closed once the log leaves the usable state. Stage one
+	// listens on this to know when to drain and stop.
+	frozen chan struct{}
+	// stopped is closed once stage two has published its final STH (or
+	// skipped it, if retired) and exited.
+	stopped chan struct{}
+}
+
+func newLifecycle(state LifecycleState) *lifecycle {
+	lc := &lifecycle{
+		state:   state,
+		frozen:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// If the log is loaded when it is already frozen, the stages are never started
+	if state != StateUsable {
+		close(lc.frozen)
+		close(lc.stopped)
+	}
+	return lc
+}
+
+func (lc *lifecycle) State() LifecycleState {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.state
+}
+
+// isFrozen reports whether the log has left the usable state.
+func (lc *lifecycle) isFrozen() bool {
+	select {
+	case <-lc.frozen:
+		return true
+	default:
+		return false
+	}
+}
+
+// notUsable is the error for an entry that is submitted to a frozen log.
+func (lc *lifecycle) notUsable() error {
+	return fmt.Errorf("%w: log is %s", ErrLogNotUsable, lc.State())
+}
+
+// transition moves the log into a new state, returning true if anything changed.
+func (lc *lifecycle) transition(to LifecycleState) (bool, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if to.rank() < 0 {
+		return false, fmt.Errorf("unknown lifecycle state %q", to)
+	}
+	if to == lc.state {
+		return false, nil
+	}
+	if to.rank() < lc.state.rank() {
+		return false, fmt.Errorf("refusing to move log from %s back to %s", lc.state, to)
+	}
+
+	if lc.state == StateUsable {
+		close(lc.frozen)
+	}
+	lc.state = to
+	return true, nil
+}
+
+// --------------------------------------------------------------------------------------------
+
+func (l *Log) fetchLifecycleState(ctx context.Context) (LifecycleState, uint64, error) {
+	e, err := l.store.Get(ctx, l.kvpath+"/state")
+	if err != nil {
+		return "", 0, err
+	}
+	if !e.Exists() {
+		return StateUsable, e.Index, nil
+	}
+	state, err := ParseLifecycleState(string(e.Value))
+	return state, e.Index, err
+}
+
+// watchLifecycle follows the state key, so that an operator can freeze the log by
+// writing to Consul or etcd without restarting the process.
+func (l *Log) watchLifecycle(ctx context.Context) {
+	var waitIndex uint64
+	for {
+		e, err := l.store.Watch(ctx, l.kvpath+"/state", waitIndex)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.ErrorContext(ctx, "Unable to watch lifecycle state", "kv_path", l.kvpath, "error", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		waitIndex = e.Index
+
+		if !e.Exists() {
+			continue
+		}
+		state, err := ParseLifecycleState(string(e.Value))
+		if err != nil {
+			slog.WarnContext(ctx, "Ignoring lifecycle state change", "kv_path", l.kvpath, "error", err)
+			continue
+		}
+
+		changed, err := l.lifecycle.transition(state)
+		if err != nil {
+			slog.WarnContext(ctx, "Ignoring lifecycle state change", "kv_path", l.kvpath, "error", err)
+			continue
+		}
+		if changed {
+			slog.InfoContext(ctx, "Log changed lifecycle state", "kv_path", l.kvpath, "state", state)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------
+
+// Freeze drains the pipeline, waits for the final STH and checkpoint to be
+// published, and then records the read-only state in Consul. It returns the final STH.
+func (l *Log) Freeze(ctx context.Context) ([]byte, error) {
+	changed, err := l.lifecycle.transition(StateReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		slog.InfoContext(ctx, "Freezing log, waiting for the final STH", "kv_path", l.kvpath)
+	}
+
+	select {
+	case <-l.lifecycle.stopped:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting for the pipeline to drain: %w", ctx.Err())
+	}
+
+	// Only flip the state in Consul once the final STH is out, so that a
+	// failure part way through doesn't leave Consul claiming the log is frozen
+	// when the last entries were never published.
+	current, _, err := l.fetchLifecycleState(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch lifecycle state: %w", err)
+	}
+	// Don't clobber a retired state that was written in the meantime
+	if current.rank() < StateReadOnly.rank() {
+		if err := l.store.Put(ctx, l.kvpath+"/state", []byte(StateReadOnly)); err != nil {
+			return nil, fmt.Errorf("unable to record lifecycle state: %w", err)
+		}
+	}
+
+	return l.stageTwoData.bucket.Get(ctx, "ct/v1/get-sth")
+}
+
+// readyz serves GET /readyz for load balancers and Consul health checks. A log is ready
+// while it accepts submissions. A standby doesn't serve the log until it has the lock,
+// and a log that is failing over serves a 503 for everything, this included.
+func (l *Log) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if state := l.lifecycle.State(); state != StateUsable {
+		http.Error(w, fmt.Sprintf("log is %s", state), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// authorized checks the request for the admin token.
+func (l *Log) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(l.settings.Load().adminToken)) == 1
+}
+
+func (l *Log) freeze(w http.ResponseWriter, r *http.Request) {
+	if !l.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	sth, err := l.Freeze(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to freeze log", "kv_path", l.kvpath, "error", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Log frozen by operator", "kv_path", l.kvpath)
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(sth); err != nil {
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
+	}
+}
@@ -0,0 +1,154 @@
+package ctsubmit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLifecycleState(t *testing.T) {
+	tests := []struct {
+		in   string
+		want LifecycleState
+		ok   bool
+	}{
+		{"", StateUsable, true},
+		{"usable", StateUsable, true},
+		{"read-only\n", StateReadOnly, true},
+		{" retired ", StateRetired, true},
+		{"readonly", "", false},
+		{"Usable", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseLifecycleState(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("ParseLifecycleState(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestLifecycleTransition(t *testing.T) {
+	tests := []struct {
+		from, to LifecycleState
+		changed  bool
+		ok       bool
+	}{
+		{StateUsable, StateUsable, false, true},
+		{StateUsable, StateReadOnly, true, true},
+		{StateUsable, StateRetired, true, true},
+		{StateReadOnly, StateReadOnly, false, true},
+		{StateReadOnly, StateRetired, true, true},
+		{StateReadOnly, StateUsable, false, false},
+		{StateRetired, StateRetired, false, true},
+		{StateRetired, StateReadOnly, false, false},
+		{StateRetired, StateUsable, false, false},
+		{StateUsable, "frozen", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" to "+string(tt.to), func(t *testing.T) {
+			lc := newLifecycle(tt.from)
+			if lc.isFrozen() != (tt.from != StateUsable) {
+				t.Errorf("a new %s log is frozen %v", tt.from, lc.isFrozen())
+			}
+
+			changed, err := lc.transition(tt.to)
+			if changed != tt.changed || (err == nil) != tt.ok {
+				t.Fatalf("transition = %v, %v, want %v", changed, err, tt.changed)
+			}
+			want := tt.from
+			if tt.ok {
+				want = tt.to
+			}
+			if lc.State() != want {
+				t.Errorf("state = %s, want %s", lc.State(), want)
+			}
+			if lc.isFrozen() != (want != StateUsable) {
+				t.Errorf("%s log is frozen %v", want, lc.isFrozen())
+			}
+			if want != StateUsable && !errors.Is(lc.notUsable(), ErrLogNotUsable) {
+				t.Errorf("notUsable = %v", lc.notUsable())
+			}
+
+			// A log that is frozen when it is loaded never starts the stages, so nothing
+			// would ever close stopped
+			select {
+			case <-lc.stopped:
+				if tt.from == StateUsable {
+					t.Error("stopped is closed before the pipeline stopped")
+				}
+			default:
+				if tt.from != StateUsable {
+					t.Error("stopped isn't closed for a log loaded frozen")
+				}
+			}
+		})
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	tests := []struct {
+		name string
+		// The state already in the store when the log is frozen
+		stored  string
+		stopped bool
+		want    string
+		ok      bool
+	}{
+		{"usable", "", true, "read-only", true},
+		{"retired in the meantime", "retired", true, "retired", true},
+		{"pipeline never stops", "", false, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			if tt.stored != "" {
+				store.Put(context.Background(), "itko/test/state", []byte(tt.stored))
+			}
+			bucket := newMemStorage()
+			bucket.objects["ct/v1/get-sth"] = []byte(`{"tree_size":10}`)
+			l := &Log{
+				store:        store,
+				kvpath:       "itko/test",
+				lifecycle:    newLifecycle(StateUsable),
+				stageTwoData: stageTwoData{bucket: Bucket{S: bucket}},
+			}
+			if tt.stopped {
+				close(l.lifecycle.stopped)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			sth, err := l.Freeze(ctx)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Freeze = %v", err)
+			}
+			if l.lifecycle.State() != StateReadOnly {
+				t.Errorf("state = %s, want read-only even if the freeze hasn't finished", l.lifecycle.State())
+			}
+			if e, _ := store.Get(context.Background(), "itko/test/state"); string(e.Value) != tt.want {
+				t.Errorf("stored state = %q, want %q", e.Value, tt.want)
+			}
+			if tt.ok && string(sth) != `{"tree_size":10}` {
+				t.Errorf("Freeze returned %q, want the final STH", sth)
+			}
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	for _, state := range []LifecycleState{StateUsable, StateReadOnly, StateRetired} {
+		l := &Log{lifecycle: newLifecycle(state)}
+		w := httptest.NewRecorder()
+		l.readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		want := http.StatusServiceUnavailable
+		if state == StateUsable {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("readyz of a %s log = %d, want %d", state, w.Code, want)
+		}
+	}
+}
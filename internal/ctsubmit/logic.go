@@ -7,16 +7,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"maps"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 
 	ct "github.com/google/certificate-transparency-go"
 	"github.com/google/certificate-transparency-go/trillian/ctfe"
 	"github.com/google/certificate-transparency-go/x509"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"golang.org/x/mod/sumdb/tlog"
 	"golang.org/x/sync/errgroup"
 	"itko.dev/internal/sunlight"
@@ -24,30 +27,75 @@ import (
 
 // TODO: Evaluate if the context is actually needed
 func (l *Log) Start(ctx context.Context) (http.Handler, error) {
-	// Start the stages
-	go func() {
-		err := l.stageOneData.stageOne(ctx)
-		fmt.Printf("Error in stageOne: %v\n", err)
-		fmt.Println("Stopping log now!")
-		l.eStop.Unlock()
-	}()
-	go func() {
-		err := l.stageTwoData.stageTwo(ctx)
-		fmt.Printf("Error in stageTwo: %v\n", err)
-		fmt.Println("Stopping log now!")
-		l.eStop.Unlock()
-	}()
+	// Start the stages, unless the log has already been frozen or this is a front-end
+	if !l.frontend && l.lifecycle.State() == StateUsable {
+		go func() {
+			err := l.stageOneData.stageOne(ctx)
+			if err == nil {
+				slog.Info("Stage one stopped, log is frozen", "kv_path", l.kvpath)
+				return
+			}
+			slog.Error("Stage one failed, stopping log", "kv_path", l.kvpath, "error", err)
+			if ctx.Err() == nil {
+				l.alerts.Send(alertPipelineFailed, fmt.Sprintf("stage one failed: %v", err))
+			}
+			l.eStop.Unlock()
+		}()
+		go func() {
+			err := l.stageTwoData.stageTwo(ctx)
+			if err == nil {
+				slog.Info("Stage two stopped, log is frozen", "kv_path", l.kvpath)
+				close(l.lifecycle.stopped)
+				return
+			}
+			slog.Error("Stage two failed, stopping log", "kv_path", l.kvpath, "error", err)
+			if ctx.Err() == nil {
+				l.alerts.Send(alertPipelineFailed, fmt.Sprintf("stage two failed: %v", err))
+			}
+			l.eStop.Unlock()
+		}()
+	}
+
+	// Follow the lifecycle state in Consul so the log can be frozen while running
+	go l.watchLifecycle(ctx)
+	go l.watchConfig(ctx)
+	go l.watchRoots(ctx)
+
+	if !l.frontend {
+		go l.observe(ctx)
+		go l.watchSTH(ctx)
+		go l.stageTwoData.witnesses.run(ctx)
+	}
+
+	if !l.frontend && l.config.NatsUrl != "" {
+		go func() {
+			if err := l.stageZeroData.consumeQueue(ctx, l.config); err != nil {
+				slog.Error("Error consuming from queue", "kv_path", l.kvpath, "error", err)
+			}
+		}()
+	}
 
 	// Wrap the HTTP handler function with OTel instrumentation
 	addChain := otelhttp.NewHandler(http.HandlerFunc(l.stageZeroData.addChain), "add-chain")
 	addPreChain := otelhttp.NewHandler(http.HandlerFunc(l.stageZeroData.addPreChain), "add-pre-chain")
+	validate := otelhttp.NewHandler(http.HandlerFunc(l.stageZeroData.validate), "validate")
 
 	// Create a new HTTP server mux and start listening
 	mux := http.NewServeMux()
 	mux.Handle("POST /ct/v1/add-chain", addChain)
 	mux.Handle("POST /ct/v1/add-pre-chain", addPreChain)
+	mux.Handle("POST /ct/v1/validate", validate)
+	mux.HandleFunc("GET /readyz", l.readyz)
+	if !l.frontend && l.config.AdminToken != "" {
+		mux.HandleFunc("POST /admin/freeze", l.freeze)
+		mux.HandleFunc("GET /admin/dedupe/{key}", l.inspectDedupe)
+		mux.HandleFunc("GET /admin/hashes/{key}", l.inspectHashes)
+	}
+	if !l.frontend && l.config.SequencerToken != "" {
+		mux.Handle("POST /itko.internal.v1.Sequencer/", l.stageZeroData.sequenceHandler(l.config.SequencerToken))
+	}
 
-	return http.MaxBytesHandler(mux, 128*1024), nil
+	return http.MaxBytesHandler(mux, l.config.submitMaxBodyBytes()), nil
 }
 
 func (d *stageZeroData) addChain(w http.ResponseWriter, r *http.Request) {
@@ -59,29 +107,126 @@ func (d *stageZeroData) addPreChain(w http.ResponseWriter, r *http.Request) {
 }
 
 func (d *stageZeroData) stageZeroWrapper(w http.ResponseWriter, r *http.Request, precertEndpoint bool) {
+	endpoint := "add-chain"
+	if precertEndpoint {
+		endpoint = "add-pre-chain"
+	}
+	start := time.Now()
+
 	resp, code, err := d.stageZero(r.Context(), r.Body, precertEndpoint)
+	d.metrics.submissions.WithLabelValues(endpoint, strconv.Itoa(code)).Inc()
+	d.metrics.submissionSeconds.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.Println(err)
-		if code == http.StatusServiceUnavailable {
-			w.Header().Set("Retry-After", fmt.Sprintf("%d", 30+rand.Intn(60)))
+		slog.InfoContext(r.Context(), "Rejected submission", "code", code, "error", err)
+		switch code {
+		case http.StatusTooManyRequests:
+			// Throttled because of the submission rate, so retrying soon is fine
+			retry := 1 + rand.Intn(5)
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			w.Header().Set("RateLimit-Remaining", "0")
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(retry))
 			http.Error(w, "pool full", code)
-		} else {
+		case http.StatusServiceUnavailable:
+			// The pipeline isn't making progress, so back off for longer
+			w.Header().Set("Retry-After", strconv.Itoa(30+rand.Intn(60)))
+			http.Error(w, "sequencer unavailable", code)
+		default:
 			http.Error(w, err.Error(), code)
 		}
 		return
 	}
 
+	body, err := json.Marshal(resp)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to marshal json response", "error", err)
+		http.Error(w, "unable to marshal json response", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Itko-Leaf-Index", strconv.FormatUint(resp.LeafIndex, 10))
 	w.WriteHeader(code)
-	if _, err = w.Write(resp); err != nil {
-		log.Printf("Error writing response: %v", err)
+	if _, err = w.Write(body); err != nil {
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
 	}
 }
 
-func (d *stageZeroData) stageZero(ctx context.Context, reqBody io.ReadCloser, precertEndpoint bool) (resp []byte, code int, err error) {
+// The leaf index is already in the SCT extensions, but it is also returned under a vendor
+// key and in a header, as it makes debugging from the CA side much easier. RFC 6962 clients
+// ignore fields they don't know about.
+type addChainResponse struct {
+	ct.AddChainResponse
+	LeafIndex uint64 `json:"itko_leaf_index"`
+}
+
+func (d *stageZeroData) stageZero(ctx context.Context, reqBody io.ReadCloser, precertEndpoint bool) (resp *addChainResponse, code int, err error) {
+	if state := d.lifecycle.State(); state != StateUsable {
+		return nil, http.StatusForbidden, fmt.Errorf("%w: log is %s", ErrLogNotUsable, state)
+	}
+
+	entry, code, err := d.validateChain(reqBody)
+	if err != nil {
+		return nil, code, err
+	}
+
+	if entry.IsPrecert != precertEndpoint {
+		if precertEndpoint {
+			return nil, http.StatusBadRequest, fmt.Errorf("expected precertificate, got certificate")
+		} else {
+			return nil, http.StatusBadRequest, fmt.Errorf("expected certificate, got precertificate")
+		}
+	}
+
+	// Before we send the unsequenced entry to the first stage, we need to check if it's a duplicate
+	// This is done by hashing the certificate fingerprint and checking if it exists in the dedupe map
+	dedupeKey := [16]byte(entry.CertificateFp[:16])
+	dedupeVal, err := d.bucket.GetDedupeEntry(ctx, dedupeKey, d.indexLayout)
+
+	var completeEntry sunlight.LogEntry
+
+	if err == nil {
+		// If we recieved a valid cache hit, then the certificate is a duplicate
+		d.metrics.dedupeHits.Inc()
+		completeEntry = entry.Sequence(dedupeVal.leafIndex, dedupeVal.timestamp)
+	} else {
+		// Otherwise, we need to send it to the sequencer
+		var code int
+		start := time.Now()
+		completeEntry, code, err = d.sequencer.sequence(ctx, entry)
+		if err != nil {
+			return nil, code, err
+		}
+		d.metrics.sequencingSeconds.Observe(time.Since(start).Seconds())
+	}
+
+	extension, err := sunlight.MarshalExtensions(sunlight.Extensions{LeafIndex: completeEntry.LeafIndex})
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to marshal extensions: %w", err)
+	}
+
+	sctSignature, err := sunlight.DigitallySign(d.signingKey, completeEntry.MerkleTreeLeaf())
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("unable to sign SCT: %w", err)
+	}
+
+	return &addChainResponse{
+		AddChainResponse: ct.AddChainResponse{
+			SCTVersion: ct.V1,
+			Timestamp:  uint64(completeEntry.Timestamp),
+			ID:         d.logID[:],
+			Extensions: base64.StdEncoding.EncodeToString(extension),
+			Signature:  sctSignature,
+		},
+		LeafIndex: completeEntry.LeafIndex,
+	}, http.StatusOK, nil
+}
+
+// validateChain runs the checks a submission has to pass before it can be sequenced,
+// and builds the unsequenced entry from the chain.
+func (d *stageZeroData) validateChain(reqBody io.ReadCloser) (entry sunlight.UnsequencedEntry, code int, err error) {
 	body, err := io.ReadAll(reqBody)
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("unable to read request body: %w", err)
+		return entry, http.StatusInternalServerError, fmt.Errorf("unable to read request body: %w", err)
 	}
 
 	var req struct {
@@ -89,10 +234,10 @@ func (d *stageZeroData) stageZero(ctx context.Context, reqBody io.ReadCloser, pr
 	}
 
 	if err := json.Unmarshal(body, &req); err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("unable to unmarshal request body: %w", err)
+		return entry, http.StatusBadRequest, fmt.Errorf("unable to unmarshal request body: %w", err)
 	}
 	if len(req.Chain) == 0 {
-		return nil, http.StatusBadRequest, fmt.Errorf("chain is empty")
+		return entry, http.StatusBadRequest, fmt.Errorf("chain is empty")
 	}
 
 	// TODO: What EKU parameters should be accepted by the log?
@@ -101,30 +246,20 @@ func (d *stageZeroData) stageZero(ctx context.Context, reqBody io.ReadCloser, pr
 	// validationOpts := ctfe.NewCertValidationOpts(d.roots, time.Time{},
 	// 	false, false, &d.notAfterStart, &d.notAfterLimit,
 	// 	false, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
-	validationOpts := ctfe.NewCertValidationOpts(d.roots, time.Time{},
+	validationOpts := ctfe.NewCertValidationOpts(d.settings.Load().roots, time.Time{},
 		false, false, &d.notAfterStart, &d.notAfterLimit,
 		false, nil)
 
 	chain, err := ctfe.ValidateChain(req.Chain, validationOpts)
 	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("unable to validate chain: %w", err)
+		return entry, http.StatusBadRequest, fmt.Errorf("unable to validate chain: %w", err)
 	}
 
 	isPrecert, err := ctfe.IsPrecertificate(chain[0])
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("invalid leaf certificate: %w", err)
+		return entry, http.StatusInternalServerError, fmt.Errorf("invalid leaf certificate: %w", err)
 	}
 
-	if isPrecert != precertEndpoint {
-		if precertEndpoint {
-			return nil, http.StatusBadRequest, fmt.Errorf("expected precertificate, got certificate")
-		} else {
-			return nil, http.StatusBadRequest, fmt.Errorf("expected certificate, got precertificate")
-		}
-	}
-
-	var entry sunlight.UnsequencedEntry
-
 	entry.IsPrecert = isPrecert
 	entry.CertificateFp = sha256.Sum256(chain[0].Raw)
 	entry.Chain = chain[1:]
@@ -149,71 +284,20 @@ func (d *stageZeroData) stageZero(ctx context.Context, reqBody io.ReadCloser, pr
 		// This function requires preIssuer to be nil if the issuer is not a preissuer
 		tbsCertficiate, err := x509.BuildPrecertTBS(chain[0].RawTBSCertificate, preIssuer)
 		if err != nil {
-			return nil, http.StatusInternalServerError, fmt.Errorf("unable to build precert TBS: %w", err)
+			return entry, http.StatusInternalServerError, fmt.Errorf("unable to build precert TBS: %w", err)
 		}
 
 		entry.Certificate = tbsCertficiate
 		entry.IssuerKeyHash = sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
 	}
 
-	// Before we send the unsequenced entry to the first stage, we need to check if it's a duplicate
-	// This is done by hashing the certificate fingerprint and checking if it exists in the dedupe map
-	dedupeKey := [16]byte(entry.CertificateFp[:16])
-	dedupeVal, err := d.bucket.GetDedupeEntry(ctx, dedupeKey, d.maskSize)
-
-	var completeEntry sunlight.LogEntry
-
-	if err == nil {
-		// If we recieved a valid cache hit, then the certificate is a duplicate
-		completeEntry = entry.Sequence(dedupeVal.leafIndex, dedupeVal.timestamp)
-	} else {
-		// Otherwise, we need to send it to the sequencer
-
-		// Send the unsequenced entry to the first stage
-		// This channel is buffered so it doesn't block if an attempt is made to send
-		// after the timeout fires.
-		returnPath := make(chan sunlight.LogEntry, 1)
-		d.stageOneTx <- UnsequencedEntryWithReturnPath{entry, returnPath}
-
-		// If we recieve something here, that means that the entry has been both sequenced
-		// and uploaded with a newly signed STH, so we can issue a SCT.
-		select {
-		case completeEntry = <-returnPath:
-		// Nominally, this should complete in under 2 seconds.
-		case <-time.After(5 * time.Second):
-			return nil, http.StatusServiceUnavailable, fmt.Errorf("timed out waiting for sequencer")
-		}
-	}
-
-	extension, err := sunlight.MarshalExtensions(sunlight.Extensions{LeafIndex: completeEntry.LeafIndex})
-	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("unable to marshal extensions: %w", err)
-	}
-
-	sctSignature, err := sunlight.DigitallySign(d.signingKey, completeEntry.MerkleTreeLeaf())
-	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("unable to sign SCT: %w", err)
-	}
-
-	response, err := json.Marshal(ct.AddChainResponse{
-		SCTVersion: ct.V1,
-		Timestamp:  uint64(completeEntry.Timestamp),
-		ID:         d.logID[:],
-		Extensions: base64.StdEncoding.EncodeToString(extension),
-		Signature:  sctSignature,
-	})
-	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("unable to marshal json response: %w", err)
-	}
-
-	return response, http.StatusOK, nil
+	return entry, http.StatusOK, nil
 }
 
 func (d *stageOneData) stageOne(
 	ctx context.Context,
 ) error {
 	const MAX_POOL_SIZE = 255
-	var FLUSH_INTERVAL = time.Millisecond * time.Duration(d.flushMs)
 
 	// This variable will be incremented for each log entry
 	sequence := d.startingSequence
@@ -224,6 +308,10 @@ func (d *stageOneData) stageOne(
 
 	// Loop over the channel and context
 	for {
+		// The intervals are read on every iteration, as they can change while the log runs
+		live := d.settings.Load()
+		FLUSH_INTERVAL, MIN_STH_INTERVAL := live.flushInterval, live.minSthInterval
+
 		select {
 
 		// Wait for the next log entry
@@ -232,6 +320,20 @@ func (d *stageOneData) stageOne(
 				return fmt.Errorf("stage one: stageOneRx channel closed")
 			}
 
+			// Nothing is sequenced once the log is frozen, even if the entry was picked
+			// over the freeze below
+			if d.lifecycle.isFrozen() {
+				close(entry.returnPath)
+				continue
+			}
+
+			// If the submitter has given up, don't use up a leaf on an entry nobody will get a SCT for
+			if entry.ctx.Err() != nil {
+				d.abandoned++
+				d.metrics.abandoned.Inc()
+				continue
+			}
+
 			// Sequence the unsequenced entry
 			logEntry := LogEntryWithReturnPath{
 				entry.entry.Sequence(sequence, time.Now().UnixMilli()),
@@ -251,6 +353,7 @@ func (d *stageOneData) stageOne(
 				// Clear the original pool
 				pool = pool[:0]
 				d.stageTwoTx <- closedPool
+				d.reportFlush(closedPool)
 
 				// Update the last flush time
 				lastFlushTime = time.Now()
@@ -258,6 +361,12 @@ func (d *stageOneData) stageOne(
 
 		// If the flush interval has passed, flush the pool
 		case <-time.After(FLUSH_INTERVAL):
+			// Nobody is waiting on an empty pool, so a quiet log only refreshes its STH
+			// once the minimum STH interval has passed
+			if len(pool) == 0 && time.Since(lastFlushTime) < MIN_STH_INTERVAL {
+				continue
+			}
+
 			// Create a copy of the pool
 			closedPool := make([]LogEntryWithReturnPath, len(pool))
 			copy(closedPool, pool)
@@ -265,16 +374,50 @@ func (d *stageOneData) stageOne(
 			// Clear the original pool
 			pool = pool[:0]
 			d.stageTwoTx <- closedPool
-			
+			d.reportFlush(closedPool)
+
 			// Update the last flush time
 			lastFlushTime = time.Now()
 
+		// The log has been frozen, so reject whatever is still buffered and stop. Only the
+		// entries that were sequenced before the freeze make it into the log.
+		case <-d.lifecycle.frozen:
+			for drained := false; !drained; {
+				select {
+				case entry := <-d.stageOneRx:
+					close(entry.returnPath)
+				default:
+					drained = true
+				}
+			}
+
+			// A read-only log gets one final STH that covers everything sequenced so far.
+			// A retired log never issues another STH, so there is no point flushing.
+			if d.lifecycle.State() == StateReadOnly {
+				d.stageTwoTx <- pool
+			}
+			close(d.stageTwoTx)
+			return nil
+
 		case <-ctx.Done():
 			return fmt.Errorf("stage one: context finished")
 		}
 	}
 }
 
+func (d *stageOneData) reportFlush(pool []LogEntryWithReturnPath) {
+	d.metrics.poolFlushes.Inc()
+	d.metrics.poolSize.Observe(float64(len(pool)))
+	otelPoolSize.Record(context.Background(), int64(len(pool)), metric.WithAttributes(attribute.String("log", d.metrics.name)))
+	if len(pool) > 0 {
+		slog.Debug("Flushed pool", "pool_start", pool[0].entry.LeafIndex, "pool_end", pool[len(pool)-1].entry.LeafIndex+1)
+	}
+	if d.abandoned > 0 {
+		slog.Warn("Dropped abandoned entries before sequencing", "count", d.abandoned)
+		d.abandoned = 0
+	}
+}
+
 // Error handling in this function is done by just bailing if *anything* goes wrong.
 // The best way to recover is to just reload the entire log.
 func (d *stageTwoData) stageTwo(
@@ -285,188 +428,243 @@ func (d *stageTwoData) stageTwo(
 		select {
 		case pool, ok := <-d.stageTwoRx:
 			if !ok {
+				// Stage one closes the channel once the log is frozen and the final pool is sent
+				if d.lifecycle.State() != StateUsable {
+					return nil
+				}
 				return fmt.Errorf("stage two: stageTwoRx channel closed")
 			}
 
-			// ** Upload the data tiles **
-			newHashes := make(map[int64]tlog.Hash)
-			// The newHashes map is a reference type, so adding elements to
-			// newHashes will let the hashReader function look them up.
-			hashReader := d.hashReader(newHashes)
-			// This value is written back to the struct the new sth is written.
-			updatedTreeSize := d.treeSize
-
-			if len(pool) != 0 {
-
-				// Errgroup to safely parallelize the uploads
-				g, gctx := errgroup.WithContext(ctx)
-
-				// The current tree size is the same as the index of the first leaf in the pool
-				oldTreeSize := pool[0].entry.LeafIndex
-				// LeafIndex is zero-indexed, so the tree size is the last leaf index + 1
-				newTreeSize := pool[len(pool)-1].entry.LeafIndex + 1
-				updatedTreeSize = newTreeSize
-
-				// these are the hashes of the merkle tree leaves and are needed later
-				recordHashes := make([]RecordHashUpload, 0, len(pool))
-
-				// This is the right most data tile
-				dataTile := d.edgeTiles[-1]
-				if dataTile.Tile.W > sunlight.TileWidth {
-					return fmt.Errorf("tile width is greater than the maximum width!! %d", dataTile.Tile.W)
-				} else if dataTile.Tile.W == sunlight.TileWidth {
-					// If the tile is full, reset it so we have a partial
-					// Reset the width to zero
-					dataTile.Tile.W = 0
-					// Increment the tile index
-					dataTile.Tile.N++
-					// Clear the bytes
-					dataTile.Bytes = []byte{}
-				}
-
-				for _, e := range pool {
-					recordHash := tlog.RecordHash(e.entry.MerkleTreeLeaf())
-					recordHashShort := [16]byte(recordHash[:16])
-					recordHashes = append(recordHashes, RecordHashUpload{
-						hash:      recordHashShort,
-						leafIndex: e.entry.LeafIndex,
-					})
-					hashes, err := tlog.StoredHashesForRecordHash(int64(e.entry.LeafIndex), recordHash, hashReader)
-					if err != nil {
-						return fmt.Errorf("failed to calculate new hashes for leaf %d: %w", e.entry.LeafIndex, err)
-					}
-					for i, hash := range hashes {
-						index := tlog.StoredHashIndex(0, int64(e.entry.LeafIndex)) + int64(i)
-						newHashes[index] = hash
-					}
-
-					dataTile.Bytes = sunlight.AppendTileLeaf(dataTile.Bytes, &e.entry)
-					dataTile.Tile.W++
-
-					// This means we have a full width tile that we can go ahead and upload
-					if dataTile.Tile.W > sunlight.TileWidth {
-						return fmt.Errorf("tile width is greater than the maximum width!!! %d", dataTile.Tile.W)
-					} else if dataTile.Tile.W == sunlight.TileWidth {
-						// Upload the tile
-						t := dataTile
-						g.Go(func() error { return d.bucket.SetTile(gctx, t.Tile, t.Bytes) })
-						// Reset the width to zero
-						dataTile.Tile.W = 0
-						// Increment the tile index
-						dataTile.Tile.N++
-						// Clear the bytes
-						dataTile.Bytes = []byte{}
-					}
-				}
-
-				// upload the partial data tile
-				if dataTile.Tile.W > 0 {
-					t := dataTile
-					g.Go(func() error { return d.bucket.SetTile(gctx, t.Tile, t.Bytes) })
-				}
-				d.edgeTiles[-1] = dataTile
-
-				// ** Upload the tree tiles **
-				// TODO: review if the treesize should be a int64 instead, to align with the tlog apis.
-				newEdgeTiles := maps.Clone(d.edgeTiles)
-				treeTiles := tlog.NewTiles(sunlight.TileHeight, int64(oldTreeSize), int64(newTreeSize))
-				for _, tile := range treeTiles {
-					data, err := tlog.ReadTileData(tile, hashReader)
-					if err != nil {
-						return fmt.Errorf("failed to read tile data for tile %v: %w", tile, err)
-					}
-					g.Go(func() error { return d.bucket.SetTile(gctx, tile, data) })
-					if err != nil {
-						return fmt.Errorf("failed to upload tile %v: %w", tile, err)
-					}
-					newEdgeTiles[tile.L] = tileWithBytes{tile, data}
-				}
-				d.edgeTiles = newEdgeTiles
-
-				// ** Upload the v1 leaf record hash mappings **
-				g.Go(func() error { return d.bucket.PutRecordHashes(gctx, recordHashes, d.maskSize) })
+			// Once retired, the log must not issue any more STHs
+			if d.lifecycle.State() == StateRetired {
+				return nil
+			}
 
-				// ** Upload new intermediate certificates **
-				for _, e := range pool {
-					for _, cert := range e.entry.Chain {
-						g.Go(func() error { return d.bucket.SetIssuer(gctx, cert) })
-					}
-				}
+			poolStart, poolEnd := d.treeSize, d.treeSize+uint64(len(pool))
+			if err := d.publishPool(ctx, pool); err != nil {
+				slog.ErrorContext(ctx, "Failed to publish pool", "pool_start", poolStart, "pool_end", poolEnd, "error", err)
+				return err
+			}
+			slog.DebugContext(ctx, "Published pool", "pool_start", poolStart, "pool_end", poolEnd)
 
-				err := g.Wait()
-				if err != nil {
-					return fmt.Errorf("failed to upload data: %w", err)
-				}
+		case <-ctx.Done():
+			return fmt.Errorf("stage two: context finished")
+		}
+	}
+}
 
-			}
+// publishPool uploads the tiles and indexes for a sequenced pool, publishes an STH
+// covering it, and then hands each entry back to stage zero to issue its SCT.
+func (d *stageTwoData) publishPool(ctx context.Context, pool []LogEntryWithReturnPath) error {
+	// ** Upload the data tiles **
+	newHashes := make(map[int64]tlog.Hash)
+	// The newHashes map is a reference type, so adding elements to
+	// newHashes will let the hashReader function look them up.
+	hashReader := d.hashReader(newHashes)
+	// This value is written back to the struct the new sth is written.
+	updatedTreeSize := d.treeSize
+
+	if len(pool) != 0 {
+
+		// Errgroup to safely parallelize the uploads
+		g, gctx := errgroup.WithContext(ctx)
+
+		// The current tree size is the same as the index of the first leaf in the pool
+		oldTreeSize := pool[0].entry.LeafIndex
+		// LeafIndex is zero-indexed, so the tree size is the last leaf index + 1
+		newTreeSize := pool[len(pool)-1].entry.LeafIndex + 1
+		updatedTreeSize = newTreeSize
+
+		// these are the hashes of the merkle tree leaves and are needed later
+		recordHashes := make([]RecordHashUpload, 0, len(pool))
+		// Counted for metrics, including the partial tile
+		dataTilesUploaded := 0
+
+		// This is the right most data tile
+		dataTile := d.edgeTiles[-1]
+		if dataTile.Tile.W > sunlight.TileWidth {
+			return fmt.Errorf("tile width is greater than the maximum width!! %d", dataTile.Tile.W)
+		} else if dataTile.Tile.W == sunlight.TileWidth {
+			// If the tile is full, reset it so we have a partial
+			// Reset the width to zero
+			dataTile.Tile.W = 0
+			// Increment the tile index
+			dataTile.Tile.N++
+			// Clear the bytes
+			dataTile.Bytes = []byte{}
+		}
 
-			// ** Upload a new STH **
-			rootHash, err := tlog.TreeHash(int64(updatedTreeSize), hashReader)
+		for _, e := range pool {
+			recordHash := tlog.RecordHash(e.entry.MerkleTreeLeaf())
+			recordHashShort := [16]byte(recordHash[:16])
+			recordHashes = append(recordHashes, RecordHashUpload{
+				hash:      recordHashShort,
+				leafIndex: e.entry.LeafIndex,
+			})
+			hashes, err := tlog.StoredHashesForRecordHash(int64(e.entry.LeafIndex), recordHash, hashReader)
 			if err != nil {
-				return fmt.Errorf("failed to calculate new root hash: %w", err)
+				return fmt.Errorf("failed to calculate new hashes for leaf %d: %w", e.entry.LeafIndex, err)
 			}
-
-			jsonBytes, err := sunlight.SignTreeHead(d.signingKey, updatedTreeSize, uint64(time.Now().UnixMilli()), rootHash)
-			if err != nil {
-				return fmt.Errorf("failed to generate a new STH: %w", err)
+			for i, hash := range hashes {
+				index := tlog.StoredHashIndex(0, int64(e.entry.LeafIndex)) + int64(i)
+				newHashes[index] = hash
 			}
 
-			err = d.bucket.SetSth(ctx, jsonBytes)
-			if err != nil {
-				return fmt.Errorf("failed to upload new STH: %w", err)
+			dataTile.Bytes = sunlight.AppendTileLeaf(dataTile.Bytes, &e.entry)
+			dataTile.Tile.W++
+
+			// This means we have a full width tile that we can go ahead and upload
+			if dataTile.Tile.W > sunlight.TileWidth {
+				return fmt.Errorf("tile width is greater than the maximum width!!! %d", dataTile.Tile.W)
+			} else if dataTile.Tile.W == sunlight.TileWidth {
+				// Upload the tile
+				t := dataTile
+				g.Go(d.timed(gctx, "data", func() error { return d.bucket.SetTile(gctx, t.Tile, t.Bytes) }))
+				dataTilesUploaded++
+				// Reset the width to zero
+				dataTile.Tile.W = 0
+				// Increment the tile index
+				dataTile.Tile.N++
+				// Clear the bytes
+				dataTile.Bytes = []byte{}
 			}
+		}
 
-			// we also upload a checkpoint based on the STH
-			checkpointBytes, err := sunlight.SignTreeHeadCheckpoint(d.checkpointOrigin, d.signingKey, int64(updatedTreeSize), time.Now().UnixMilli(), rootHash)
+		// upload the partial data tile
+		if dataTile.Tile.W > 0 {
+			t := dataTile
+			g.Go(d.timed(gctx, "data", func() error { return d.bucket.SetTile(gctx, t.Tile, t.Bytes) }))
+			dataTilesUploaded++
+		}
+		d.edgeTiles[-1] = dataTile
+
+		// ** Upload the tree tiles **
+		// TODO: review if the treesize should be a int64 instead, to align with the tlog apis.
+		newEdgeTiles := maps.Clone(d.edgeTiles)
+		treeTiles := tlog.NewTiles(sunlight.TileHeight, int64(oldTreeSize), int64(newTreeSize))
+		for _, tile := range treeTiles {
+			data, err := tlog.ReadTileData(tile, hashReader)
 			if err != nil {
-				return fmt.Errorf("failed to generate a new checkpoint: %w", err)
+				return fmt.Errorf("failed to read tile data for tile %v: %w", tile, err)
 			}
-
-			err = d.bucket.SetCheckpoint(ctx, checkpointBytes)
+			g.Go(d.timed(gctx, "tree", func() error { return d.bucket.SetTile(gctx, tile, data) }))
 			if err != nil {
-				return fmt.Errorf("failed to upload new checkpoint: %w", err)
+				return fmt.Errorf("failed to upload tile %v: %w", tile, err)
 			}
+			newEdgeTiles[tile.L] = tileWithBytes{tile, data}
+		}
+		d.edgeTiles = newEdgeTiles
 
-			// Update the tree size once the checkpoints are uploaded
-			d.treeSize = updatedTreeSize
-
-			// ** Upload the dedupe mappings **
-			// TODO: This isn't the best cache key, because it fails to distinguish between
-			// a certificate that is submitted with a different chain. This is a problem because
-			// I think the specific chain the certificate was submitted with also matters.
-			dedupeVals := make([]DedupeUpload, 0, len(pool))
-			for _, e := range pool {
-				hash := [16]byte(e.entry.CertificateFp[:16])
-				dedupeVals = append(dedupeVals, DedupeUpload{
-					hash:      hash,
-					leafIndex: e.entry.LeafIndex,
-					timestamp: e.entry.Timestamp,
-				})
-			}
-			err = d.bucket.PutDedupeEntries(ctx, dedupeVals, d.maskSize)
-			if err != nil {
-				return fmt.Errorf("failed to upload dedupe mappings: %w", err)
-			}
+		// ** Upload the v1 leaf record hash mappings **
+		g.Go(d.timed(gctx, "hashes", func() error { return d.bucket.PutRecordHashes(gctx, recordHashes, d.indexLayout) }))
 
-			// ** Everything is uploaded, return the log entries **
-			for _, entry := range pool {
-				entry.returnPath <- entry.entry
+		// ** Upload new intermediate certificates **
+		for _, e := range pool {
+			for _, cert := range e.entry.Chain {
+				g.Go(d.timed(gctx, "issuer", func() error { return d.bucket.SetIssuer(gctx, cert) }))
 			}
+		}
 
-		case <-ctx.Done():
-			return fmt.Errorf("stage two: context finished")
+		err := g.Wait()
+		if err != nil {
+			return fmt.Errorf("failed to upload data: %w", err)
 		}
+		d.metrics.dataTiles.Add(float64(dataTilesUploaded))
+		d.metrics.treeTiles.Add(float64(len(treeTiles)))
+
+	}
+
+	// ** Upload a new STH **
+	// Make sure no other instance has taken over since this one acquired the lock
+	if err := d.fence(ctx); err != nil {
+		return fmt.Errorf("refusing to publish STH: %w", err)
+	}
+
+	rootHash, err := tlog.TreeHash(int64(updatedTreeSize), hashReader)
+	if err != nil {
+		return fmt.Errorf("failed to calculate new root hash: %w", err)
+	}
+
+	sthTimestamp := time.Now().UnixMilli()
+	jsonBytes, err := sunlight.SignTreeHead(d.signingKey, updatedTreeSize, uint64(sthTimestamp), rootHash)
+	if err != nil {
+		return fmt.Errorf("failed to generate a new STH: %w", err)
 	}
+
+	// Archive the first STH for each tree size before publishing it, so a tree head for
+	// any size a client could have seen can be fetched again later. STHs re-signed for an
+	// empty pool only have a newer timestamp, and aren't kept.
+	if updatedTreeSize != d.treeSize {
+		err = d.timed(ctx, "sth", func() error { return d.bucket.ArchiveSth(ctx, updatedTreeSize, jsonBytes) })()
+		if err != nil {
+			return fmt.Errorf("failed to archive new STH: %w", err)
+		}
+	}
+
+	err = d.timed(ctx, "sth", func() error { return d.bucket.SetSth(ctx, jsonBytes) })()
+	if err != nil {
+		return fmt.Errorf("failed to upload new STH: %w", err)
+	}
+	d.metrics.lastSTH.Store(sthTimestamp)
+	d.metrics.recordMergeDelay(pool, sthTimestamp)
+
+	// we also upload a checkpoint based on the STH, with the same timestamp so that
+	// static-ct-api clients see the same tree head as RFC 6962 clients
+	checkpointBytes, err := sunlight.SignTreeHeadCheckpoint(d.checkpointOrigin, d.signingKey, int64(updatedTreeSize), sthTimestamp, rootHash, d.cosigners...)
+	if err != nil {
+		return fmt.Errorf("failed to generate a new checkpoint: %w", err)
+	}
+
+	tree := tlog.Tree{N: int64(updatedTreeSize), Hash: rootHash}
+	err = d.timed(ctx, "checkpoint", func() error { return d.witnesses.setCheckpoint(ctx, d.bucket, tree, checkpointBytes) })()
+	if err != nil {
+		return fmt.Errorf("failed to upload new checkpoint: %w", err)
+	}
+
+	// Update the tree size once the checkpoints are uploaded
+	d.treeSize = updatedTreeSize
+	d.purger.purge(ctx, updatedTreeSize)
+
+	// ** Upload the dedupe mappings **
+	// TODO: This isn't the best cache key, because it fails to distinguish between
+	// a certificate that is submitted with a different chain. This is a problem because
+	// I think the specific chain the certificate was submitted with also matters.
+	dedupeVals := make([]DedupeUpload, 0, len(pool))
+	for _, e := range pool {
+		hash := [16]byte(e.entry.CertificateFp[:16])
+		dedupeVals = append(dedupeVals, DedupeUpload{
+			hash:      hash,
+			leafIndex: e.entry.LeafIndex,
+			timestamp: e.entry.Timestamp,
+		})
+	}
+	err = d.timed(ctx, "dedupe", func() error { return d.bucket.PutDedupeEntries(ctx, dedupeVals, d.indexLayout) })()
+	if err != nil {
+		return fmt.Errorf("failed to upload dedupe mappings: %w", err)
+	}
+
+	// ** Everything is uploaded, return the log entries **
+	for _, entry := range pool {
+		entry.returnPath <- entry.entry
+	}
+
+	return nil
 }
 
 func (d *stageTwoData) hashReader(overlay map[int64]tlog.Hash) tlog.HashReaderFunc {
+	return edgeHashReader(d.edgeTiles, overlay)
+}
+
+// edgeHashReader reads the hashes of new entries from overlay, and the rest from the
+// edge tiles, which is all that is needed to add to the tree.
+func edgeHashReader(edgeTiles map[int]tileWithBytes, overlay map[int64]tlog.Hash) tlog.HashReaderFunc {
 	return func(indexes []int64) ([]tlog.Hash, error) {
 		hashes := make([]tlog.Hash, 0, len(indexes))
 		for _, index := range indexes {
 			if hash, ok := overlay[index]; ok {
 				hashes = append(hashes, hash)
 			} else {
-				tile := d.edgeTiles[tlog.TileForIndex(sunlight.TileHeight, index).L]
+				tile := edgeTiles[tlog.TileForIndex(sunlight.TileHeight, index).L]
 				hash, err := tlog.HashFromTile(tile.Tile, tile.Bytes, index)
 				if err != nil {
 					return nil, fmt.Errorf("index %d not in overlay and %w", index, err)
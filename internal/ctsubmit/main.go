@@ -3,34 +3,103 @@ package ctsubmit
 import (
 	"context"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"path"
+
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/server"
 )
 
 // This is seperated so we can run this in the integration test.
 // Tests don't need to export Otel to Honeycomb.
-func MainMain(ctx context.Context, listener net.Listener, kvpath, consulAddress string, startSignal chan<- struct{}) {
+func MainMain(ctx context.Context, listener net.Listener, kvpaths []string, coord coordination.Config, startSignal chan<- struct{}) {
+	if len(kvpaths) == 0 {
+		log.Fatal("Must provide a Consul KV path")
+	}
+
+	// A single log is served at the root. When multiple temporal shards are served
+	// from the same process, each one is routed by a prefix taken from the last
+	// element of its KV path, so itko/ct2025 is served at /ct2025/ct/v1/add-chain.
+	var handler http.Handler
+	var serverConfig server.Config
+	router := NewShardRouter()
+
+	// The logs are stopped and their locks released once the server has drained
+	runCtx, stopLogs := context.WithCancel(ctx)
+	var released []<-chan struct{}
+
+	for _, kvpath := range kvpaths {
+		if kvpath == "" {
+			log.Fatal("Must provide a Consul KV path")
+		}
+
+		// Create a new log object and start it. This blocks until the lock is acquired,
+		// so a second instance acts as a hot standby that takes over if the lock is lost.
+		slog.Info("Starting CT log", "kv_path", kvpath)
+
+		ctloghandle, logmux, done, err := LoadWithFailover(runCtx, kvpath, coord)
+		if err != nil {
+			log.Fatalf("Failed to create log object for %s: %v", kvpath, err)
+		}
+		released = append(released, done)
+		// Shards share a listener, so the first one's server limits apply to all of them
+		if len(released) == 1 {
+			serverConfig = ctloghandle.config.Server
+		}
+
+		if len(kvpaths) == 1 {
+			handler = logmux
+			// Front-ends reach the sequencer over gRPC, which needs HTTP/2 without TLS
+			serverConfig.H2C = ctloghandle.config.SequencerToken != ""
+		} else {
+			if err := router.Add("/"+path.Base(kvpath), ctloghandle, logmux); err != nil {
+				log.Fatalf("Failed to route log %s: %v", kvpath, err)
+			}
+			handler = router
+		}
+	}
+
+	if startSignal != nil {
+		startSignal <- struct{}{}
+	}
+
+	// Start the log
+	err := server.Serve(listener, handler, serverConfig, func() {
+		stopLogs()
+		for _, done := range released {
+			<-done
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// FrontendMain runs only stage zero, forwarding entries to the sequencer at sequencerURL.
+func FrontendMain(ctx context.Context, listener net.Listener, kvpath string, coord coordination.Config, sequencerURL string, startSignal chan<- struct{}) {
 	if kvpath == "" {
 		log.Fatal("Must provide a Consul KV path")
 	}
 
-	// Create a new log object
-	ctloghandle, err := LoadLog(ctx, kvpath, consulAddress)
+	ctloghandle, err := LoadFrontend(ctx, kvpath, coord, sequencerURL)
 	if err != nil {
-		log.Fatalf("Failed to create log object: %v", err)
+		log.Fatalf("Failed to create front-end for %s: %v", kvpath, err)
 	}
 
-	log.Println("Starting CT log")
+	slog.Info("Starting CT log front-end", "kv_path", kvpath)
 
 	mux, err := ctloghandle.Start(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to get log handler: %v", err)
+		log.Fatalf("Failed to get log handler for %s: %v", kvpath, err)
 	}
 
 	if startSignal != nil {
 		startSignal <- struct{}{}
 	}
 
-	// Start the log
-	log.Fatal(http.Serve(listener, mux))
+	if err := server.Serve(listener, mux, ctloghandle.config.Server, nil); err != nil {
+		log.Fatal(err)
+	}
 }
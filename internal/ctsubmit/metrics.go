@@ -0,0 +1,258 @@
+package ctsubmit
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Metrics are registered with the default Prometheus registry, and served by the binary
+// on a separate listener. Every metric is labeled with the log name, so that shards served
+// from the same process can be told apart.
+
+var (
+	submissionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_submissions_total",
+		Help: "add-chain and add-pre-chain requests, by endpoint and response code.",
+	}, []string{"log", "endpoint", "code"})
+
+	submissionSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_submission_duration_seconds",
+		Help:    "End to end latency of add-chain and add-pre-chain requests.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 1.5, 2, 3, 5},
+	}, []string{"log", "endpoint"})
+
+	sequencingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_sequencing_duration_seconds",
+		Help:    "Time from handing an entry to the sequencer until it is covered by a published STH.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 1.5, 2, 3, 5},
+	}, []string{"log"})
+
+	dedupeHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_dedupe_hits_total",
+		Help: "Submissions answered from the dedupe cache without being sequenced again.",
+	}, []string{"log"})
+
+	abandonedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_abandoned_entries_total",
+		Help: "Entries dropped before sequencing because the submitter gave up.",
+	}, []string{"log"})
+
+	poolFlushesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_pool_flushes_total",
+		Help: "Pools flushed from stage one to stage two.",
+	}, []string{"log"})
+
+	poolSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_pool_size",
+		Help:    "Number of entries in each flushed pool.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 9),
+	}, []string{"log"})
+
+	tilesUploadedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_tiles_uploaded_total",
+		Help: "Tiles uploaded by stage two, by kind.",
+	}, []string{"log", "kind"})
+
+	mergeDelaySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_merge_delay_seconds",
+		Help:    "Time from an entry's timestamp until it is covered by a published STH.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 1.5, 2, 3, 5, 10},
+	}, []string{"log"})
+
+	mergeDelaySLOAttainment = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "itko_merge_delay_slo_attainment",
+		Help: "Fraction of entries over the last hour merged within the merge delay SLO.",
+	}, []string{"log"})
+
+	signingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "itko_signing_duration_seconds",
+		Help:    "Latency of signatures made by a KMS or HSM, by signer type.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"log", "signer"})
+
+	signingErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "itko_signing_errors_total",
+		Help: "Signatures a KMS or HSM failed to make, by signer type.",
+	}, []string{"log", "signer"})
+)
+
+// logMetrics holds the metrics of a single log, with the log label already applied.
+type logMetrics struct {
+	name string
+
+	submissions       *prometheus.CounterVec
+	submissionSeconds prometheus.ObserverVec
+	sequencingSeconds prometheus.Observer
+	dedupeHits        prometheus.Counter
+	abandoned         prometheus.Counter
+	poolFlushes       prometheus.Counter
+	poolSize          prometheus.Observer
+	dataTiles         prometheus.Counter
+	treeTiles         prometheus.Counter
+	mergeDelaySeconds prometheus.Observer
+	sloAttainment     prometheus.Gauge
+	slo               *sloTracker
+
+	// Unix milliseconds of the latest STH, for the STH age gauge
+	lastSTH atomic.Int64
+}
+
+func newLogMetrics(name string, mergeDelaySLO time.Duration) *logMetrics {
+	labels := prometheus.Labels{"log": name}
+	return &logMetrics{
+		name:              name,
+		submissions:       submissionsTotal.MustCurryWith(labels),
+		submissionSeconds: submissionSeconds.MustCurryWith(labels),
+		sequencingSeconds: sequencingSeconds.WithLabelValues(name),
+		dedupeHits:        dedupeHitsTotal.WithLabelValues(name),
+		abandoned:         abandonedTotal.WithLabelValues(name),
+		poolFlushes:       poolFlushesTotal.WithLabelValues(name),
+		poolSize:          poolSize.WithLabelValues(name),
+		dataTiles:         tilesUploadedTotal.WithLabelValues(name, "data"),
+		treeTiles:         tilesUploadedTotal.WithLabelValues(name, "tree"),
+		mergeDelaySeconds: mergeDelaySeconds.WithLabelValues(name),
+		sloAttainment:     mergeDelaySLOAttainment.WithLabelValues(name),
+		slo:               &sloTracker{target: mergeDelaySLO},
+	}
+}
+
+// recordMergeDelay is called once a pool is covered by a published STH. Since SCTs are
+// only issued after that point, this is the delay the log's zero MMD claim rests on.
+func (m *logMetrics) recordMergeDelay(pool []LogEntryWithReturnPath, sthTimestamp int64) {
+	if len(pool) == 0 {
+		return
+	}
+	delays := make([]time.Duration, len(pool))
+	for i, e := range pool {
+		delays[i] = time.Duration(sthTimestamp-int64(e.entry.Timestamp)) * time.Millisecond
+		m.mergeDelaySeconds.Observe(delays[i].Seconds())
+	}
+	m.sloAttainment.Set(m.slo.record(time.UnixMilli(sthTimestamp), delays))
+}
+
+// --------------------------------------------------------------------------------------------
+
+// sloTracker keeps per minute counts of entries, and how many of them were merged
+// within the target, over a rolling hour.
+type sloTracker struct {
+	target  time.Duration
+	buckets [60]sloBucket
+}
+
+type sloBucket struct {
+	minute int64
+	total  uint64
+	within uint64
+}
+
+// record adds the delays of a pool and returns the attainment over the last hour.
+// Only stage two calls this, so it doesn't need to be locked.
+func (t *sloTracker) record(now time.Time, delays []time.Duration) float64 {
+	minute := now.Unix() / 60
+	b := &t.buckets[minute%int64(len(t.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	for _, d := range delays {
+		b.total++
+		if d <= t.target {
+			b.within++
+		}
+	}
+
+	var total, within uint64
+	for _, b := range t.buckets {
+		if minute-b.minute < int64(len(t.buckets)) {
+			total += b.total
+			within += b.within
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+	return float64(within) / float64(total)
+}
+
+// --------------------------------------------------------------------------------------------
+
+// The same pipeline is also instrumented with OpenTelemetry metrics, which are exported
+// over OTLP when a meter provider is configured, and are a no-op otherwise.
+
+var meter = otel.Meter("itko.dev/internal/ctsubmit")
+
+// Storage and Consul calls get their own spans, so a slow request can be attributed to
+// a specific upload or dedupe read. S3 calls are traced by the AWS SDK middleware instead.
+var tracer = otel.Tracer("itko.dev/internal/ctsubmit")
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+var (
+	otelPoolSize, _ = meter.Int64Histogram("itko.pool.size",
+		metric.WithDescription("Number of entries in each flushed pool."),
+		metric.WithExplicitBucketBoundaries(1, 2, 4, 8, 16, 32, 64, 128, 256))
+
+	otelUploadSeconds, _ = meter.Float64Histogram("itko.stage_two.upload.duration",
+		metric.WithDescription("Duration of stage two uploads, by the class of key being written."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5))
+
+	otelSigningSeconds, _ = meter.Float64Histogram("itko.signer.duration",
+		metric.WithDescription("Latency of signatures made by a KMS or HSM, by signer type."),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1))
+
+	otelQueueDepth, _ = meter.Int64ObservableGauge("itko.stage_one.queue.depth",
+		metric.WithDescription("Entries waiting to be sequenced by stage one."))
+
+	otelSTHAge, _ = meter.Float64ObservableGauge("itko.sth.age",
+		metric.WithDescription("Time since the latest STH was published."),
+		metric.WithUnit("s"))
+)
+
+// observe registers the gauges of a running log, until ctx is done.
+func (l *Log) observe(ctx context.Context) {
+	attrs := metric.WithAttributes(attribute.String("log", l.config.Name))
+	reg, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(otelQueueDepth, int64(len(l.stageOneData.stageOneRx)), attrs)
+		if sth := l.stageTwoData.metrics.lastSTH.Load(); sth != 0 {
+			o.ObserveFloat64(otelSTHAge, time.Since(time.UnixMilli(sth)).Seconds(), attrs)
+		}
+		return nil
+	}, otelQueueDepth, otelSTHAge)
+	if err != nil {
+		slog.Error("Unable to register metrics callback", "error", err)
+		return
+	}
+	<-ctx.Done()
+	reg.Unregister()
+}
+
+// timed wraps an upload, recording its duration under the given key class.
+func (d *stageTwoData) timed(ctx context.Context, class string, f func() error) func() error {
+	return func() error {
+		start := time.Now()
+		err := f()
+		otelUploadSeconds.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+			attribute.String("log", d.metrics.name),
+			attribute.String("class", class),
+		))
+		return err
+	}
+}
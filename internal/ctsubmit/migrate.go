@@ -0,0 +1,522 @@
+package ctsubmit
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"golang.org/x/mod/sumdb/tlog"
+	"golang.org/x/sync/errgroup"
+	"itko.dev/internal/sunlight"
+)
+
+// SunlightMigrationConfig is the Sunlight log MigrateSunlight copies from.
+type SunlightMigrationConfig struct {
+	// SourceUrl is the monitoring prefix of the Sunlight log, such as
+	// https://rome2025h1.sunlight.example/.
+	SourceUrl string
+	// SourceDirectory is a directory with the contents of the Sunlight log's bucket, which
+	// is read instead of SourceUrl if it is set.
+	SourceDirectory string
+	// SourceKey is the Sunlight log's DER public key, which its checkpoint is verified with.
+	SourceKey []byte
+	// Concurrency is the number of objects read or written at once. Defaults to 16.
+	Concurrency int
+}
+
+// The issuers of older versions of Sunlight are kept in a PEM bundle instead of under issuer/
+const sunlightIssuersBundle = "issuers.pem"
+
+// sunlightSource is the bucket of the Sunlight log being migrated.
+type sunlightSource struct {
+	get func(ctx context.Context, key string) ([]byte, error)
+	// tlogPaths is set if the tiles are in the tlog scheme of older versions of Sunlight,
+	// rather than the static-ct-api scheme itko also uses.
+	tlogPaths bool
+
+	bundleOnce sync.Once
+	bundle     map[[32]byte][]byte
+	bundleErr  error
+}
+
+// MigrateSunlight copies the Sunlight log mc into the bucket of gc, so that itko can take
+// over from it. Only the storage and index layout of gc are used, and Sunlight must be
+// stopped first. Sunlight and itko write the same data and tree tiles, which are copied
+// to the static-ct-api paths if the source has the older tlog ones, and the same issuers.
+// Sunlight's dedup cache is a local database rather than part of its bucket, so both of
+// itko's indexes are rebuilt from the data tiles instead. Every tile is checked against
+// the checkpoint as it is read, and the copied tiles are read back and checked again when
+// the indexes are rebuilt from them. The STH carrying the checkpoint's RFC 6962 signature
+// is published last, so a migration that fails can be run again from the start. The bucket
+// mustn't have any entries yet.
+func MigrateSunlight(ctx context.Context, gc GlobalConfig, mc SunlightMigrationConfig) error {
+	layout, err := gc.indexLayout()
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKIXPublicKey(mc.SourceKey)
+	if err != nil {
+		return fmt.Errorf("unable to parse source key: %w", err)
+	}
+	if err := checkSourceKey(gc, key); err != nil {
+		return err
+	}
+	concurrency := cmp.Or(mc.Concurrency, 16)
+	bucket := newBucket(gc)
+	source := &sunlightSource{get: httpGetter(mc.SourceUrl)}
+	if mc.SourceDirectory != "" {
+		fsStorage := NewFsStorage(mc.SourceDirectory)
+		source.get = fsStorage.Get
+	}
+
+	// Don't mix the Sunlight log into a log that is already there
+	if err := checkEmptyLog(ctx, bucket); err != nil {
+		return err
+	}
+
+	checkpoint, err := source.get(ctx, "checkpoint")
+	if err != nil {
+		return fmt.Errorf("unable to fetch source checkpoint: %w", err)
+	}
+	sth, c, err := sunlight.STHFromCheckpoint(checkpoint, key)
+	if err != nil {
+		return fmt.Errorf("invalid source checkpoint: %w", err)
+	}
+	tree := tlog.Tree{N: c.N, Hash: c.Hash}
+	slog.Info("Migrating Sunlight log", "origin", c.Origin, "tree_size", tree.N)
+
+	if tree.N > 0 {
+		if err := source.detectPaths(ctx, tree); err != nil {
+			return err
+		}
+		if err := source.copyTiles(ctx, bucket, tree, concurrency); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Rebuilding index records from the copied data tiles", "tree_size", tree.N)
+	hashes, dedupe, err := rebuildIndexes(ctx, bucket, tree, false, concurrency)
+	if err != nil {
+		return fmt.Errorf("copied tiles don't match the checkpoint: %w", err)
+	}
+	if _, _, err := writeIndexes(ctx, bucket, hashes, dedupe, layout, concurrency); err != nil {
+		return err
+	}
+
+	if err := bucket.ArchiveSth(ctx, uint64(tree.N), sth); err != nil {
+		return fmt.Errorf("unable to archive STH: %w", err)
+	}
+	if err := bucket.SetSth(ctx, sth); err != nil {
+		return fmt.Errorf("unable to upload STH: %w", err)
+	}
+	if err := bucket.SetCheckpoint(ctx, checkpoint); err != nil {
+		return fmt.Errorf("unable to upload checkpoint: %w", err)
+	}
+	slog.Info("Published Sunlight log's tree", "tree_size", tree.N)
+	return nil
+}
+
+// checkEmptyLog returns an error if the bucket already has a log with entries, so that
+// another log's aren't mixed into it. The STH of the empty tree that itko-setup writes is
+// fine, so a log can be set up before it is migrated into.
+func checkEmptyLog(ctx context.Context, bucket Bucket) error {
+	data, err := bucket.Get(ctx, "ct/v1/get-sth")
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to fetch STH: %w", err)
+	}
+	var sth ct.GetSTHResponse
+	if err := json.Unmarshal(data, &sth); err != nil {
+		return fmt.Errorf("unable to unmarshal STH: %w", err)
+	}
+	if sth.TreeSize > 0 {
+		return fmt.Errorf("the bucket already has a log with %d entries", sth.TreeSize)
+	}
+	return nil
+}
+
+// checkSourceKey returns an error if gc has a log ID that isn't the one of the source's
+// key, as the migrated log must keep signing with the key its tree heads are signed with.
+func checkSourceKey(gc GlobalConfig, key crypto.PublicKey) error {
+	if gc.LogID == "" {
+		return nil
+	}
+	logID, err := LogIDForKey(key)
+	if err != nil {
+		return err
+	}
+	if logID != gc.LogID {
+		return fmt.Errorf("the log ID of the source key is %s, but the log's is %s", logID, gc.LogID)
+	}
+	return nil
+}
+
+// detectPaths checks which scheme the source's tiles are in, by its first data tile.
+func (s *sunlightSource) detectPaths(ctx context.Context, tree tlog.Tree) error {
+	tile := tlog.Tile{H: sunlight.TileHeight, L: -1, N: 0, W: int(min(tree.N, sunlight.TileWidth))}
+	_, err := s.get(ctx, sunlight.Path(tile))
+	if err == nil {
+		return nil
+	} else if !isNotFound(err) {
+		return fmt.Errorf("unable to fetch %s: %w", sunlight.Path(tile), err)
+	}
+	if _, err := s.get(ctx, sunlight.TlogPath(tile)); err != nil {
+		return fmt.Errorf("unable to find the first data tile at %s or %s: %w", sunlight.Path(tile), sunlight.TlogPath(tile), err)
+	}
+	slog.Info("Source tiles are in the tlog scheme, and are copied to the static-ct-api paths")
+	s.tlogPaths = true
+	return nil
+}
+
+// tile reads a tile from the source by its static-ct-api path.
+func (s *sunlightSource) tile(ctx context.Context, path string) ([]byte, error) {
+	if s.tlogPaths {
+		var err error
+		if path, err = sunlight.PathToTlog(path); err != nil {
+			return nil, err
+		}
+	}
+	data, err := s.get(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// copyTiles copies the tree and data tiles of tree, and the issuers of its entries, to the
+// bucket. Each tile is checked against the tree before it is written.
+func (s *sunlightSource) copyTiles(ctx context.Context, bucket Bucket, tree tlog.Tree, concurrency int) error {
+	issuers, err := copyTree(ctx, tree, concurrency, s.tile, bucket.SetTile)
+	if err != nil {
+		return err
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, fp := range issuers {
+		g.Go(func() error {
+			der, err := s.issuer(gctx, fp)
+			if err != nil {
+				return err
+			}
+			return bucket.setIssuer(gctx, der)
+		})
+	}
+	return g.Wait()
+}
+
+// copyTree reads the tree and data tiles of tree by their static-ct-api paths with read,
+// and writes them with write, checking each against the tree before it is written. Every
+// entry must have a leaf_index extension, as static-ct-api requires. It returns the
+// fingerprints of the issuers of the entries.
+func copyTree(ctx context.Context, tree tlog.Tree, concurrency int, read func(ctx context.Context, path string) ([]byte, error), write func(ctx context.Context, tile tlog.Tile, data []byte) error) ([][32]byte, error) {
+	// The tiles above level zero are kept, as the TileHashReader would otherwise fetch
+	// them again for every data tile under them
+	var cache sync.Map
+	hashReader := tlog.TileHashReader(tree, &sunlight.TileReader{
+		Fetch: func(key string) ([]byte, error) {
+			if data, ok := cache.Load(key); ok {
+				return data.([]byte), nil
+			}
+			data, err := read(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(key, "tile/0/") {
+				cache.Store(key, data)
+			}
+			return data, nil
+		},
+		SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {},
+	})
+
+	tiles := tlog.NewTiles(sunlight.TileHeight, 0, tree.N)
+	var done atomic.Int64
+	stop := reportProgress("Copied tiles", &done, int64(len(tiles)))
+	defer stop()
+
+	var issuers sync.Map
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for _, tile := range tiles {
+		g.Go(func() error {
+			hashes, err := tlog.ReadTileData(tile, hashReader)
+			if err != nil {
+				return fmt.Errorf("unable to read %s: %w", sunlight.Path(tile), err)
+			}
+			if err := write(gctx, tile, hashes); err != nil {
+				return fmt.Errorf("unable to write %s: %w", sunlight.Path(tile), err)
+			}
+			if tile.L == 0 {
+				tile.L = -1
+				data, err := read(gctx, sunlight.Path(tile))
+				if err != nil {
+					return err
+				}
+				if err := verifyDataTile(tile, data, hashes, false); err != nil {
+					return err
+				}
+				for entry, err := range sunlight.ParseTileEntries(tile, data) {
+					if err != nil {
+						return err
+					}
+					for _, fp := range entry.ChainFp {
+						issuers.Store(fp, true)
+					}
+				}
+				if err := write(gctx, tile, data); err != nil {
+					return fmt.Errorf("unable to write %s: %w", sunlight.Path(tile), err)
+				}
+			}
+			done.Add(1)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var fps [][32]byte
+	issuers.Range(func(key, _ any) bool {
+		fps = append(fps, key.([32]byte))
+		return true
+	})
+	return fps, nil
+}
+
+// issuer reads the issuer with the fingerprint fp from the source, from the bundle if it
+// isn't under issuer/.
+func (s *sunlightSource) issuer(ctx context.Context, fp [32]byte) ([]byte, error) {
+	key := fmt.Sprintf("issuer/%x", fp)
+	der, err := s.get(ctx, key)
+	if isNotFound(err) {
+		s.bundleOnce.Do(func() { s.bundle, s.bundleErr = s.loadBundle(ctx) })
+		if s.bundleErr != nil {
+			return nil, s.bundleErr
+		}
+		var ok bool
+		if der, ok = s.bundle[fp]; !ok {
+			return nil, fmt.Errorf("issuer %x is in neither %s nor %s", fp, key, sunlightIssuersBundle)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s: %w", key, err)
+	}
+	if sha256.Sum256(der) != fp {
+		return nil, fmt.Errorf("issuer %x doesn't match its fingerprint", fp)
+	}
+	return der, nil
+}
+
+// loadBundle reads the issuers in the source's PEM bundle, by fingerprint.
+func (s *sunlightSource) loadBundle(ctx context.Context) (map[[32]byte][]byte, error) {
+	data, err := s.get(ctx, sunlightIssuersBundle)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s: %w", sunlightIssuersBundle, err)
+	}
+	bundle := make(map[[32]byte][]byte)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			bundle[sha256.Sum256(block.Bytes)] = block.Bytes
+		}
+	}
+	return bundle, nil
+}
+
+// httpGetter reads the objects under prefix over HTTP. A missing object is reported as
+// os.ErrNotExist, as it is by the storage.
+func httpGetter(prefix string) func(ctx context.Context, key string) ([]byte, error) {
+	client := &http.Client{Timeout: time.Minute}
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	return func(ctx context.Context, key string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", prefix+key, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "itko-migrate")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s: %w", prefix+key, os.ErrNotExist)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", prefix+key, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+}
+
+// TrillianMigrationConfig is the Trillian-backed CT log MigrateTrillian copies from.
+type TrillianMigrationConfig struct {
+	// SourceUrl is the prefix of the CTFE's RFC 6962 endpoints, such as
+	// https://ct.example.com/2025/. The STH, roots, and unless DB is set, the entries
+	// are read from it. It can be left out if both DB and STH are set.
+	SourceUrl string
+	// SourceKey is the log's DER public key, which its STHs are verified with.
+	SourceKey []byte
+	// DB is Trillian's MySQL database, or one restored from a dump of it, which the
+	// entries are read from instead of get-entries.
+	DB *sql.DB
+	// TreeID is the ID of the log's tree in DB.
+	TreeID int64
+	// STH is the get-sth response to migrate up to, such as the last one the log issued
+	// before it was frozen. Defaults to the CTFE's latest STH.
+	STH []byte
+	// Origin is the checkpoint origin of the migrated log. Defaults to the checkpoint
+	// origin of gc, or failing that SourceUrl without its scheme and trailing slash.
+	Origin string
+	// BatchSize is the number of entries read in each get-entries request or query.
+	// Defaults to 1000.
+	BatchSize int
+	// Concurrency is the number of requests or queries made at once. Defaults to 4.
+	Concurrency int
+}
+
+// Reads the entries of a tree in order, from the tables of Trillian's MySQL storage. The
+// CTFE stores the MerkleTreeLeaf as the LeafValue and the chain as the ExtraData, which
+// it returns as they are from get-entries.
+const trillianEntriesQuery = `SELECT s.SequenceNumber, l.LeafValue, l.ExtraData
+FROM SequencedLeafData s JOIN LeafData l ON s.TreeId = l.TreeId AND s.LeafIdentityHash = l.LeafIdentityHash
+WHERE s.TreeId = ? AND s.SequenceNumber >= ? AND s.SequenceNumber <= ?
+ORDER BY s.SequenceNumber`
+
+// MigrateTrillian copies the Trillian-backed CT log tc into the bucket of gc, so that itko
+// can take over from it with the same key. Only the storage, index layout, checkpoint
+// origin, and log ID of gc are used. The entries are mirrored as Mirror does, with their
+// leaves and extensions kept as they are so that the leaf hashes are the source's, up to
+// the STH, which is published once the root hash of the rebuilt tree matches it. Each
+// pool of entries is also checked with a consistency proof from the CTFE, if there is a
+// SourceUrl. For a clean cutover the log must be frozen first: if the CTFE has issued a
+// larger STH by the end, it is an error, and the migration can be run again without STH
+// to catch up. A migration that fails continues from where it got to when run again.
+// gc must have MirroredEntries set, so that the log can read the entries once it has
+// taken over.
+func MigrateTrillian(ctx context.Context, gc GlobalConfig, tc TrillianMigrationConfig) error {
+	if tc.SourceUrl == "" && (tc.DB == nil || tc.STH == nil) {
+		return fmt.Errorf("the source URL is needed unless both the database and the STH are given")
+	}
+	if !gc.MirroredEntries {
+		return fmt.Errorf("the log must have mirroredEntries set, as the migrated entries have no leaf_index extension")
+	}
+	origin := tc.Origin
+	if origin == "" && (gc.CheckpointOrigin != "" || gc.Name != "") {
+		var err error
+		if origin, err = gc.checkpointOrigin(); err != nil {
+			return err
+		}
+	}
+	if origin == "" && tc.SourceUrl == "" {
+		return fmt.Errorf("the origin is needed without the source URL")
+	}
+
+	m, err := newMirror(gc, MirrorConfig{
+		SourceUrl:   tc.SourceUrl,
+		SourceKey:   tc.SourceKey,
+		Origin:      origin,
+		BatchSize:   tc.BatchSize,
+		Concurrency: tc.Concurrency,
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkSourceKey(gc, m.key); err != nil {
+		return err
+	}
+	if tc.STH != nil {
+		if m.sth, err = parseSourceSTH(tc.STH, m.key); err != nil {
+			return err
+		}
+	}
+	if tc.DB != nil {
+		m.readEntries = trillianEntries(tc.DB, tc.TreeID)
+	}
+
+	if err := m.sync(ctx); err != nil {
+		return err
+	}
+	tree, err := loadTree(ctx, m.bucket)
+	if err != nil {
+		return err
+	}
+	if m.source != nil {
+		latest, err := m.source.GetSTH(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to fetch source STH: %w", err)
+		}
+		if int64(latest.TreeSize) != tree.N {
+			return fmt.Errorf("the source has issued an STH of size %d since the migration started at %d, so it isn't frozen", latest.TreeSize, tree.N)
+		}
+	}
+	slog.Info("Migrated tree matches the source's STH", "tree_size", tree.N, "root_hash", tree.Hash)
+	return nil
+}
+
+// parseSourceSTH parses a get-sth response, and verifies it with key.
+func parseSourceSTH(data []byte, key crypto.PublicKey) (*ct.SignedTreeHead, error) {
+	var resp ct.GetSTHResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal STH: %w", err)
+	}
+	sth, err := resp.ToSignedTreeHead()
+	if err != nil {
+		return nil, fmt.Errorf("invalid STH: %w", err)
+	}
+	verifier, err := ct.NewSignatureVerifier(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.VerifySTHSignature(*sth); err != nil {
+		return nil, fmt.Errorf("STH signature doesn't verify: %w", err)
+	}
+	return sth, nil
+}
+
+// trillianEntries reads the entries of the tree treeID from Trillian's database.
+func trillianEntries(db *sql.DB, treeID int64) func(ctx context.Context, start, end int64) ([]ct.LeafEntry, error) {
+	return func(ctx context.Context, start, end int64) ([]ct.LeafEntry, error) {
+		rows, err := db.QueryContext(ctx, trillianEntriesQuery, treeID, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("unable to query entries %d to %d: %w", start, end, err)
+		}
+		defer rows.Close()
+		var entries []ct.LeafEntry
+		for rows.Next() {
+			var sequenceNumber int64
+			var e ct.LeafEntry
+			if err := rows.Scan(&sequenceNumber, &e.LeafInput, &e.ExtraData); err != nil {
+				return nil, fmt.Errorf("unable to read entry: %w", err)
+			}
+			if index := start + int64(len(entries)); sequenceNumber != index {
+				return nil, fmt.Errorf("entry %d is missing from the database", index)
+			}
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("unable to query entries %d to %d: %w", start, end, err)
+		}
+		return entries, nil
+	}
+}
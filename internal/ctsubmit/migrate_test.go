@@ -0,0 +1,287 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+// testLog is a log written to a directory the way stage two writes it, without its
+// indexes or STH.
+type testLog struct {
+	dir     string
+	key     *ecdsa.PrivateKey
+	tree    tlog.Tree
+	entries []*sunlight.LogEntry
+	// The DER of the issuers, in fingerprint order
+	issuers [][]byte
+}
+
+// newTestLog writes a log of n entries, each issued by one of two issuers, with the tree
+// and data tiles, issuers and checkpoint.
+func newTestLog(t *testing.T, n int64) *testLog {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := sunlight.NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testLog{dir: t.TempDir(), key: key, issuers: [][]byte{[]byte("issuer a"), []byte("issuer b")}}
+	slices.SortFunc(l.issuers, func(a, b []byte) int {
+		fa, fb := sha256.Sum256(a), sha256.Sum256(b)
+		return bytes.Compare(fa[:], fb[:])
+	})
+	s := NewFsStorage(l.dir)
+	ctx := context.Background()
+	for _, der := range l.issuers {
+		if err := s.Set(ctx, fmt.Sprintf("issuer/%x", sha256.Sum256(der)), der); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stored []tlog.Hash
+	reader := tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+		hashes := make([]tlog.Hash, len(indexes))
+		for i, index := range indexes {
+			hashes[i] = stored[index]
+		}
+		return hashes, nil
+	})
+	for i := range n {
+		entry := &sunlight.LogEntry{
+			Certificate: []byte(fmt.Sprintf("certificate %d", i)),
+			ChainFp:     [][32]byte{sha256.Sum256(l.issuers[i%2])},
+			Timestamp:   1700000000000 + i,
+			LeafIndex:   uint64(i),
+		}
+		entry.CertificateFp = sha256.Sum256(entry.Certificate)
+		l.entries = append(l.entries, entry)
+		hashes, err := tlog.StoredHashesForRecordHash(i, tlog.RecordHash(entry.MerkleTreeLeaf()), reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, hashes...)
+	}
+	root, err := tlog.TreeHash(n, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.tree = tlog.Tree{N: n, Hash: root}
+
+	for _, tile := range tlog.NewTiles(sunlight.TileHeight, 0, n) {
+		data, err := tlog.ReadTileData(tile, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set(ctx, sunlight.Path(tile), data); err != nil {
+			t.Fatal(err)
+		}
+		if tile.L == 0 {
+			var leaves []byte
+			for _, entry := range l.entries[tile.N*sunlight.TileWidth : tile.N*sunlight.TileWidth+int64(tile.W)] {
+				leaves = sunlight.AppendTileLeaf(leaves, entry)
+			}
+			tile.L = -1
+			if err := s.Set(ctx, sunlight.Path(tile), leaves); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	checkpoint, err := sunlight.SignTreeHeadCheckpoint("example.com/log", signer, n, 1700000001000, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(ctx, "checkpoint", checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// tiles returns the paths of every tile of the log.
+func (l *testLog) tiles() []string {
+	var paths []string
+	for _, tile := range tlog.NewTiles(sunlight.TileHeight, 0, l.tree.N) {
+		paths = append(paths, sunlight.Path(tile))
+		if tile.L == 0 {
+			tile.L = -1
+			paths = append(paths, sunlight.Path(tile))
+		}
+	}
+	return paths
+}
+
+// checkCopy checks that dir has the tiles, issuers and checkpoint of the log as they are.
+func (l *testLog) checkCopy(t *testing.T, dir string) {
+	t.Helper()
+	keys := append(l.tiles(), "checkpoint")
+	for _, der := range l.issuers {
+		keys = append(keys, fmt.Sprintf("issuer/%x", sha256.Sum256(der)))
+	}
+	for _, key := range keys {
+		want, err := os.ReadFile(filepath.Join(l.dir, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, key))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s wasn't copied as it is: %v", key, err)
+		}
+	}
+}
+
+func TestMigrateSunlight(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether the source is at the tlog paths, with an issuer bundle, as older
+		// versions of Sunlight wrote it
+		older bool
+		// A file of the source that is corrupted
+		corrupt string
+		// Whether the target already has a log with entries
+		nonEmpty bool
+		// Whether the source key is another log's
+		otherKey bool
+		ok       bool
+	}{
+		{name: "static-ct-api paths", ok: true},
+		{name: "tlog paths and an issuer bundle", older: true, ok: true},
+		{name: "target has entries", nonEmpty: true},
+		{name: "other key", otherKey: true},
+		{name: "tree tile doesn't match the checkpoint", corrupt: "tile/0/000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLog(t, 300)
+			// The tiles end up at the static-ct-api paths, whichever scheme they came from
+			want := *l
+			want.dir = t.TempDir()
+			if err := os.CopyFS(want.dir, os.DirFS(l.dir)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt != "" {
+				corrupt(t, filepath.Join(l.dir, tt.corrupt))
+			}
+			if tt.older {
+				toOlderSunlight(t, l)
+			}
+			key := &l.key.PublicKey
+			if tt.otherKey {
+				other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				key = &other.PublicKey
+			}
+			der, err := x509.MarshalPKIXPublicKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gc := GlobalConfig{RootDirectory: t.TempDir(), MaskSize: 5}
+			if tt.nonEmpty {
+				if err := os.MkdirAll(filepath.Join(gc.RootDirectory, "ct/v1"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(gc.RootDirectory, "ct/v1/get-sth"), []byte(`{"tree_size":3}`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx := context.Background()
+			err = MigrateSunlight(ctx, gc, SunlightMigrationConfig{SourceDirectory: l.dir, SourceKey: der, Concurrency: 4})
+			if (err == nil) != tt.ok {
+				t.Fatalf("MigrateSunlight = %v", err)
+			}
+			if !tt.ok {
+				if _, err := os.Stat(filepath.Join(gc.RootDirectory, "checkpoint")); err == nil {
+					t.Error("a failed migration has a checkpoint")
+				}
+				return
+			}
+
+			want.checkCopy(t, gc.RootDirectory)
+
+			bucket := newBucket(gc)
+			layout, err := gc.indexLayout()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range []int{0, 255, 256, 299} {
+				entry := l.entries[i]
+				hash := tlog.RecordHash(entry.MerkleTreeLeaf())
+				record, err := bucket.GetRecordHash(ctx, [16]byte(hash[:16]), layout)
+				if err != nil || record.leafIndex != uint64(i) {
+					t.Errorf("hash index of leaf %d = %d, %v", i, record.leafIndex, err)
+				}
+				dedupe, err := bucket.GetDedupeEntry(ctx, [16]byte(entry.CertificateFp[:16]), layout)
+				if err != nil || dedupe.leafIndex != uint64(i) || dedupe.timestamp != entry.Timestamp {
+					t.Errorf("dedupe index of leaf %d = %+v, %v", i, dedupe, err)
+				}
+			}
+			sth, err := bucket.Get(ctx, "ct/v1/get-sth")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseSourceSTH(sth, &l.key.PublicKey); err != nil {
+				t.Errorf("migrated STH doesn't verify: %v", err)
+			}
+		})
+	}
+}
+
+// toOlderSunlight moves the tiles of l to the tlog paths, and its issuers to a bundle,
+// as older versions of Sunlight wrote them.
+func toOlderSunlight(t *testing.T, l *testLog) {
+	for _, path := range l.tiles() {
+		tlogPath, err := sunlight.PathToTlog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(l.dir, tlogPath)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(l.dir, path), filepath.Join(l.dir, tlogPath)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var bundle []byte
+	for _, der := range l.issuers {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	if err := os.RemoveAll(filepath.Join(l.dir, "issuer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(l.dir, sunlightIssuersBundle), bundle, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corrupt flips a bit in the middle of the file at path.
+func corrupt(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,517 @@
+package ctsubmit
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	ctclient "github.com/google/certificate-transparency-go/client"
+	"github.com/google/certificate-transparency-go/jsonclient"
+	"github.com/google/certificate-transparency-go/tls"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/mod/sumdb/tlog"
+	"golang.org/x/sync/errgroup"
+	"itko.dev/internal/sunlight"
+)
+
+// MirrorConfig is the log Mirror copies from.
+type MirrorConfig struct {
+	// SourceUrl is the prefix of the source log's RFC 6962 endpoints, such as
+	// https://ct.example.com/2025/.
+	SourceUrl string
+	// SourceKey is the source log's DER public key, which its STHs are verified with.
+	SourceKey []byte
+	// Origin is the checkpoint origin of the mirror. Defaults to SourceUrl without its
+	// scheme and trailing slash.
+	Origin string
+	// BatchSize is the number of entries asked for in each get-entries request. Logs
+	// return fewer if it is over their own limit. Defaults to 1000.
+	BatchSize int
+	// Concurrency is the number of get-entries requests made at once. Defaults to 4.
+	Concurrency int
+	// Follow, if set, keeps mirroring the source's new STHs at this interval, instead of
+	// returning once the mirror has caught up.
+	Follow time.Duration
+}
+
+// The mirror adds entries in pools of this many, and saves its progress after each one
+const mirrorPoolSize = 64 * sunlight.TileWidth
+
+// Where the tree the mirror has built so far is kept. It is ahead of the published STH
+// until the mirror catches up, and is where the mirror continues from when run again.
+const mirrorProgressKey = "int/mirror.json"
+
+type mirrorProgress struct {
+	TreeSize int64  `json:"treeSize"`
+	RootHash []byte `json:"rootHash"`
+}
+
+// mirror is the state of one run of Mirror.
+type mirror struct {
+	MirrorConfig
+	// source is nil if the source has no SourceUrl, in which case sth and readEntries
+	// must be set
+	source *ctclient.LogClient
+	key    crypto.PublicKey
+	bucket Bucket
+	layout sunlight.IndexLayout
+	// issuers already uploaded by this run, to skip checking for them again
+	issuers map[[32]byte]bool
+	// sth, if set, is the STH to mirror up to, instead of the source's latest one
+	sth *ct.SignedTreeHead
+	// readEntries reads the entries from start up to end, inclusive, as get-entries does.
+	// It may return fewer of them.
+	readEntries func(ctx context.Context, start, end int64) ([]ct.LeafEntry, error)
+}
+
+// Mirror copies the RFC 6962 log mc into the tiles, issuers, and indexes of the bucket of
+// gc, so that it can be served by the monitor. Only the storage and index layout of gc are
+// used. Each pool of entries is checked against the source's STH with a consistency proof
+// before the mirror moves on, and the source's STH is published as the mirror's once the
+// whole tree matches it, along with a checkpoint carrying the same signature.
+func Mirror(ctx context.Context, gc GlobalConfig, mc MirrorConfig) error {
+	m, err := newMirror(gc, mc)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := m.sync(ctx); err != nil {
+			return err
+		}
+		if mc.Follow == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(mc.Follow):
+		}
+	}
+}
+
+// newMirror sets up a run of Mirror, reading the source from its SourceUrl if it has one.
+func newMirror(gc GlobalConfig, mc MirrorConfig) (*mirror, error) {
+	layout, err := gc.indexLayout()
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(mc.SourceKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse source key: %w", err)
+	}
+
+	mc.Origin = cmp.Or(mc.Origin, strings.TrimSuffix(strings.TrimPrefix(mc.SourceUrl, "https://"), "/"))
+	mc.BatchSize = cmp.Or(mc.BatchSize, 1000)
+	mc.Concurrency = cmp.Or(mc.Concurrency, 4)
+	m := &mirror{
+		MirrorConfig: mc,
+		key:          key,
+		bucket:       newBucket(gc),
+		layout:       layout,
+		issuers:      make(map[[32]byte]bool),
+	}
+	if mc.SourceUrl != "" {
+		m.source, err = ctclient.New(mc.SourceUrl, &http.Client{Timeout: time.Minute}, jsonclient.Options{
+			PublicKeyDER: mc.SourceKey,
+			UserAgent:    "itko-mirror",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create client for %s: %w", mc.SourceUrl, err)
+		}
+		m.readEntries = m.getEntries
+	}
+	return m, nil
+}
+
+// sync mirrors the entries up to the source's latest STH, and publishes it.
+func (m *mirror) sync(ctx context.Context) error {
+	sth := m.sth
+	if sth == nil {
+		var err error
+		if sth, err = m.source.GetSTH(ctx); err != nil {
+			return fmt.Errorf("unable to fetch source STH: %w", err)
+		}
+	}
+	tree, err := m.progress(ctx)
+	if err != nil {
+		return err
+	}
+	if int64(sth.TreeSize) < tree.N {
+		return fmt.Errorf("source STH has tree size %d, but %d entries have already been mirrored", sth.TreeSize, tree.N)
+	}
+	slog.Info("Mirroring source", "source", m.SourceUrl, "tree_size", tree.N, "source_tree_size", sth.TreeSize)
+
+	edgeTiles, err := loadEdgeTiles(ctx, m.bucket, tree, true)
+	if err != nil {
+		return err
+	}
+	for tree.N < int64(sth.TreeSize) {
+		end := min(int64(sth.TreeSize), (tree.N/mirrorPoolSize+1)*mirrorPoolSize)
+		entries, err := m.fetch(ctx, tree.N, end)
+		if err != nil {
+			return err
+		}
+		newTree, err := m.publishPool(ctx, edgeTiles, tree, entries)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(ctx, newTree, sth); err != nil {
+			return err
+		}
+		tree = newTree
+		progress, err := json.Marshal(mirrorProgress{TreeSize: tree.N, RootHash: tree.Hash[:]})
+		if err != nil {
+			return err
+		}
+		if err := m.bucket.set(ctx, mirrorProgressKey, progress); err != nil {
+			return fmt.Errorf("unable to save progress: %w", err)
+		}
+		slog.Info("Mirrored entries", "tree_size", tree.N, "source_tree_size", sth.TreeSize)
+	}
+	if err := m.verify(ctx, tree, sth); err != nil {
+		return err
+	}
+	return m.publishSTH(ctx, sth)
+}
+
+// progress returns the tree mirrored so far, which is empty for a new mirror.
+func (m *mirror) progress(ctx context.Context) (tlog.Tree, error) {
+	data, err := m.bucket.Get(ctx, mirrorProgressKey)
+	if isNotFound(err) {
+		// Don't mix the source's entries into a log that is already there
+		return tlog.Tree{}, checkEmptyLog(ctx, m.bucket)
+	} else if err != nil {
+		return tlog.Tree{}, fmt.Errorf("unable to fetch progress: %w", err)
+	}
+	var progress mirrorProgress
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return tlog.Tree{}, fmt.Errorf("unable to unmarshal progress: %w", err)
+	}
+	if len(progress.RootHash) != tlog.HashSize {
+		return tlog.Tree{}, fmt.Errorf("invalid root hash in %s", mirrorProgressKey)
+	}
+	return tlog.Tree{N: progress.TreeSize, Hash: tlog.Hash(progress.RootHash)}, nil
+}
+
+// mirroredEntry is an entry read from the source, with the issuers of its chain.
+type mirroredEntry struct {
+	entry   *sunlight.LogEntry
+	issuers [][]byte
+}
+
+// fetch reads the entries from start up to end from the source, with up to Concurrency
+// get-entries requests at once.
+func (m *mirror) fetch(ctx context.Context, start, end int64) ([]mirroredEntry, error) {
+	entries := make([]mirroredEntry, end-start)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(m.Concurrency)
+	for batch := start; batch < end; batch += int64(m.BatchSize) {
+		batchEnd := min(end, batch+int64(m.BatchSize))
+		g.Go(func() error {
+			// The source may return fewer entries than asked for
+			for i := batch; i < batchEnd; {
+				leaves, err := m.readEntries(gctx, i, batchEnd-1)
+				if err != nil {
+					return err
+				}
+				if len(leaves) == 0 {
+					return fmt.Errorf("source returned no entries from %d", i)
+				}
+				for _, e := range leaves[:min(int64(len(leaves)), batchEnd-i)] {
+					entry, err := parseMirroredEntry(i, e.LeafInput, e.ExtraData)
+					if err != nil {
+						return fmt.Errorf("invalid entry %d: %w", i, err)
+					}
+					entries[i-start] = entry
+					i++
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// getEntries calls get-entries, retrying with backoff, as logs rate limit readers.
+func (m *mirror) getEntries(ctx context.Context, start, end int64) ([]ct.LeafEntry, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := m.source.GetRawEntries(ctx, start, end)
+		if err == nil {
+			return resp.Entries, nil
+		}
+		if attempt == 5 || ctx.Err() != nil {
+			return nil, fmt.Errorf("unable to fetch entries %d to %d: %w", start, end, err)
+		}
+		delay := time.Second << attempt
+		slog.Warn("Retrying get-entries", "start", start, "end", end, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// parseMirroredEntry turns the leaf_input and extra_data of a get-entries response into
+// the entry at index, as it is written to a data tile.
+func parseMirroredEntry(index int64, leafInput, extraData []byte) (mirroredEntry, error) {
+	e := &sunlight.LogEntry{LeafIndex: uint64(index)}
+	s := cryptobyte.String(leafInput)
+	var version, leafType uint8
+	var timestamp uint64
+	var entryType uint16
+	if !s.ReadUint8(&version) || !s.ReadUint8(&leafType) || !s.ReadUint64(&timestamp) || !s.ReadUint16(&entryType) {
+		return mirroredEntry{}, fmt.Errorf("truncated leaf_input")
+	}
+	if version != 0 || leafType != 0 {
+		return mirroredEntry{}, fmt.Errorf("unsupported leaf version %d and type %d", version, leafType)
+	}
+	if timestamp > math.MaxInt64 {
+		return mirroredEntry{}, fmt.Errorf("timestamp %d out of range", timestamp)
+	}
+	e.Timestamp = int64(timestamp)
+	switch entryType {
+	case 0: // x509_entry
+	case 1: // precert_entry
+		e.IsPrecert = true
+		if !s.CopyBytes(e.IssuerKeyHash[:]) {
+			return mirroredEntry{}, fmt.Errorf("truncated issuer_key_hash")
+		}
+	default:
+		return mirroredEntry{}, fmt.Errorf("unknown entry type %d", entryType)
+	}
+	var extensions []byte
+	if !s.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.Certificate)) ||
+		!s.ReadUint16LengthPrefixed((*cryptobyte.String)(&extensions)) || !s.Empty() {
+		return mirroredEntry{}, fmt.Errorf("invalid leaf_input")
+	}
+
+	extra := cryptobyte.String(extraData)
+	if e.IsPrecert && !extra.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.PreCertificate)) {
+		return mirroredEntry{}, fmt.Errorf("truncated pre_certificate")
+	}
+	var chain cryptobyte.String
+	if !extra.ReadUint24LengthPrefixed(&chain) || !extra.Empty() {
+		return mirroredEntry{}, fmt.Errorf("invalid extra_data")
+	}
+	var issuers [][]byte
+	for !chain.Empty() {
+		var cert []byte
+		if !chain.ReadUint24LengthPrefixed((*cryptobyte.String)(&cert)) {
+			return mirroredEntry{}, fmt.Errorf("invalid certificate chain")
+		}
+		issuers = append(issuers, cert)
+		e.ChainFp = append(e.ChainFp, sha256.Sum256(cert))
+	}
+	if e.IsPrecert {
+		e.CertificateFp = sha256.Sum256(e.PreCertificate)
+	} else {
+		e.CertificateFp = sha256.Sum256(e.Certificate)
+	}
+
+	// The extensions are kept as they are, so that the leaf hash is the source's. The
+	// entry must read back from a data tile as the same entry, which rules out
+	// extensions that aren't a list of extensions, or a leaf_index that doesn't match.
+	e.Mirrored = true
+	e.RawExtensions = extensions
+	read, _, err := sunlight.ReadMirroredTileLeaf(sunlight.AppendTileLeaf(nil, e))
+	if err != nil {
+		return mirroredEntry{}, fmt.Errorf("extensions can't be kept in a data tile: %w", err)
+	}
+	if !read.Mirrored && read.LeafIndex != uint64(index) {
+		return mirroredEntry{}, fmt.Errorf("leaf_index extension is %d", read.LeafIndex)
+	}
+	return mirroredEntry{entry: e, issuers: issuers}, nil
+}
+
+// publishPool uploads the data and tree tiles, issuers, and indexes of the entries that
+// follow tree, and returns the new tree. edgeTiles are updated to the new tree.
+func (m *mirror) publishPool(ctx context.Context, edgeTiles map[int]tileWithBytes, tree tlog.Tree, entries []mirroredEntry) (tlog.Tree, error) {
+	newHashes := make(map[int64]tlog.Hash)
+	hashReader := edgeHashReader(edgeTiles, newHashes)
+	newTreeSize := tree.N + int64(len(entries))
+
+	g, gctx := errgroup.WithContext(ctx)
+	recordHashes := make([]RecordHashUpload, 0, len(entries))
+	dedupeVals := make([]DedupeUpload, 0, len(entries))
+
+	dataTile := edgeTiles[-1]
+	if dataTile.Tile.W == sunlight.TileWidth {
+		dataTile = tileWithBytes{tlog.Tile{H: sunlight.TileHeight, L: -1, N: dataTile.Tile.N + 1}, []byte{}}
+	}
+	for i, e := range entries {
+		index := tree.N + int64(i)
+		recordHash := tlog.RecordHash(e.entry.MerkleTreeLeaf())
+		recordHashes = append(recordHashes, RecordHashUpload{hash: [16]byte(recordHash[:16]), leafIndex: uint64(index)})
+		dedupeVals = append(dedupeVals, DedupeUpload{hash: [16]byte(e.entry.CertificateFp[:16]), leafIndex: uint64(index), timestamp: e.entry.Timestamp})
+		hashes, err := tlog.StoredHashesForRecordHash(index, recordHash, hashReader)
+		if err != nil {
+			return tlog.Tree{}, fmt.Errorf("failed to calculate new hashes for leaf %d: %w", index, err)
+		}
+		for i, hash := range hashes {
+			newHashes[tlog.StoredHashIndex(0, index)+int64(i)] = hash
+		}
+
+		dataTile.Bytes = sunlight.AppendTileLeaf(dataTile.Bytes, e.entry)
+		dataTile.Tile.W++
+		if dataTile.Tile.W == sunlight.TileWidth || index == newTreeSize-1 {
+			t := dataTile
+			g.Go(func() error { return m.bucket.SetTile(gctx, t.Tile, t.Bytes) })
+		}
+		if dataTile.Tile.W == sunlight.TileWidth && index != newTreeSize-1 {
+			dataTile = tileWithBytes{tlog.Tile{H: sunlight.TileHeight, L: -1, N: dataTile.Tile.N + 1}, []byte{}}
+		}
+
+		for _, issuer := range e.issuers {
+			fingerprint := sha256.Sum256(issuer)
+			if m.issuers[fingerprint] {
+				continue
+			}
+			m.issuers[fingerprint] = true
+			g.Go(func() error { return m.bucket.setIssuer(gctx, issuer) })
+		}
+	}
+
+	newEdgeTiles := maps.Clone(edgeTiles)
+	newEdgeTiles[-1] = dataTile
+	for _, tile := range tlog.NewTiles(sunlight.TileHeight, tree.N, newTreeSize) {
+		data, err := tlog.ReadTileData(tile, hashReader)
+		if err != nil {
+			return tlog.Tree{}, fmt.Errorf("failed to read tile data for tile %v: %w", tile, err)
+		}
+		g.Go(func() error { return m.bucket.SetTile(gctx, tile, data) })
+		newEdgeTiles[tile.L] = tileWithBytes{tile, data}
+	}
+	g.Go(func() error { return m.bucket.PutRecordHashes(gctx, recordHashes, m.layout) })
+	g.Go(func() error { return m.bucket.PutDedupeEntries(gctx, dedupeVals, m.layout) })
+
+	rootHash, err := tlog.TreeHash(newTreeSize, hashReader)
+	if err != nil {
+		return tlog.Tree{}, fmt.Errorf("failed to calculate new root hash: %w", err)
+	}
+	if err := g.Wait(); err != nil {
+		return tlog.Tree{}, fmt.Errorf("failed to upload data: %w", err)
+	}
+	maps.Copy(edgeTiles, newEdgeTiles)
+	return tlog.Tree{N: newTreeSize, Hash: rootHash}, nil
+}
+
+// verify checks that tree is the source's tree at its size, by its consistency with the
+// source's STH.
+func (m *mirror) verify(ctx context.Context, tree tlog.Tree, sth *ct.SignedTreeHead) error {
+	sthTree := tlog.Tree{N: int64(sth.TreeSize), Hash: tlog.Hash(sth.SHA256RootHash)}
+	if tree.N == sthTree.N {
+		if tree.Hash != sthTree.Hash {
+			return fmt.Errorf("mirrored tree of size %d has root hash %s, but the source's is %s", tree.N, tree.Hash, sthTree.Hash)
+		}
+		return nil
+	}
+	if m.source == nil {
+		// Without the source's API, the tree can only be checked once it is complete
+		return nil
+	}
+	consistency, err := m.source.GetSTHConsistency(ctx, uint64(tree.N), sth.TreeSize)
+	if err != nil {
+		return fmt.Errorf("unable to fetch consistency proof from %d to %d: %w", tree.N, sth.TreeSize, err)
+	}
+	proof := make(tlog.TreeProof, 0, len(consistency))
+	for _, h := range consistency {
+		if len(h) != tlog.HashSize {
+			return fmt.Errorf("invalid hash in consistency proof from %d to %d", tree.N, sth.TreeSize)
+		}
+		proof = append(proof, tlog.Hash(h))
+	}
+	if err := tlog.CheckTree(proof, sthTree.N, sthTree.Hash, tree.N, tree.Hash); err != nil {
+		return fmt.Errorf("mirrored tree of size %d isn't consistent with the source's STH of size %d: %w", tree.N, sth.TreeSize, err)
+	}
+	return nil
+}
+
+// publishSTH publishes the source's STH, its roots if it has a SourceUrl, and a
+// checkpoint with the STH's signature, once the mirror has all of its entries.
+func (m *mirror) publishSTH(ctx context.Context, sth *ct.SignedTreeHead) error {
+	signature, err := tls.Marshal(sth.TreeHeadSignature)
+	if err != nil {
+		return fmt.Errorf("unable to marshal STH signature: %w", err)
+	}
+	resp := ct.GetSTHResponse{
+		TreeSize:          sth.TreeSize,
+		Timestamp:         sth.Timestamp,
+		SHA256RootHash:    sth.SHA256RootHash[:],
+		TreeHeadSignature: signature,
+	}
+	sthBytes, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := sunlight.CheckpointFromSTH(m.Origin, m.key, &resp)
+	if err != nil {
+		return fmt.Errorf("unable to make checkpoint: %w", err)
+	}
+
+	if m.source != nil {
+		if err := m.publishRoots(ctx); err != nil {
+			return err
+		}
+	}
+
+	// A newer STH of the same size replaces the published one, but not the archived one
+	var published ct.GetSTHResponse
+	data, err := m.bucket.Get(ctx, "ct/v1/get-sth")
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("unable to fetch published STH: %w", err)
+	} else if err == nil {
+		if err := json.Unmarshal(data, &published); err != nil {
+			return fmt.Errorf("unable to unmarshal published STH: %w", err)
+		}
+	}
+	if err != nil || published.TreeSize != sth.TreeSize {
+		if err := m.bucket.ArchiveSth(ctx, sth.TreeSize, sthBytes); err != nil {
+			return fmt.Errorf("unable to archive STH: %w", err)
+		}
+	}
+	if err := m.bucket.SetSth(ctx, sthBytes); err != nil {
+		return fmt.Errorf("unable to upload STH: %w", err)
+	}
+	if err := m.bucket.SetCheckpoint(ctx, checkpoint); err != nil {
+		return fmt.Errorf("unable to upload checkpoint: %w", err)
+	}
+	slog.Info("Published source STH", "tree_size", sth.TreeSize, "timestamp", sth.Timestamp)
+	return nil
+}
+
+// publishRoots publishes the roots the source accepts.
+func (m *mirror) publishRoots(ctx context.Context) error {
+	roots, err := m.source.GetAcceptedRoots(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to fetch source roots: %w", err)
+	}
+	var rootsResp struct {
+		Certificates [][]byte `json:"certificates"`
+	}
+	for _, root := range roots {
+		rootsResp.Certificates = append(rootsResp.Certificates, root.Data)
+	}
+	rootsBytes, err := json.Marshal(rootsResp)
+	if err != nil {
+		return err
+	}
+	if err := m.bucket.set(ctx, "ct/v1/get-roots", rootsBytes); err != nil {
+		return fmt.Errorf("unable to upload roots: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+	"itko.dev/internal/sunlight"
+)
+
+// testLeafInput is a leaf of a RFC 6962 log, and its extra_data.
+type testLeafInput struct {
+	version    uint8
+	entryType  uint16
+	cert       []byte
+	precert    []byte
+	extensions []byte
+	chain      [][]byte
+}
+
+func (l testLeafInput) marshal() (leafInput, extraData []byte) {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(l.version)
+	b.AddUint8(0 /* timestamped_entry */)
+	b.AddUint64(1700000000000)
+	b.AddUint16(l.entryType)
+	if l.entryType == 1 {
+		b.AddBytes(bytes.Repeat([]byte{0xaa}, 32))
+	}
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(l.cert) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(l.extensions) })
+
+	e := cryptobyte.NewBuilder(nil)
+	if l.entryType == 1 {
+		e.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(l.precert) })
+	}
+	e.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, cert := range l.chain {
+			b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(cert) })
+		}
+	})
+	return b.BytesOrPanic(), e.BytesOrPanic()
+}
+
+func TestParseMirroredEntry(t *testing.T) {
+	leafIndex := func(n uint64) []byte {
+		ext, err := sunlight.MarshalExtensions(sunlight.Extensions{LeafIndex: n})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ext
+	}
+	chain := [][]byte{[]byte("intermediate"), []byte("root")}
+
+	tests := []struct {
+		name string
+		leaf testLeafInput
+		// Appended to the leaf_input
+		suffix []byte
+		ok     bool
+	}{
+		{name: "certificate", leaf: testLeafInput{cert: []byte("certificate"), chain: chain}, ok: true},
+		{name: "precertificate", leaf: testLeafInput{entryType: 1, cert: []byte("tbs"), precert: []byte("precertificate"), chain: chain}, ok: true},
+		{name: "matching leaf_index", leaf: testLeafInput{cert: []byte("certificate"), extensions: leafIndex(42)}, ok: true},
+		{name: "other leaf_index", leaf: testLeafInput{cert: []byte("certificate"), extensions: leafIndex(41)}},
+		{name: "extensions that aren't a list", leaf: testLeafInput{cert: []byte("certificate"), extensions: []byte{0x00}}},
+		{name: "version 1", leaf: testLeafInput{version: 1, cert: []byte("certificate")}},
+		{name: "unknown entry type", leaf: testLeafInput{entryType: 2, cert: []byte("certificate")}},
+		{name: "trailing leaf_input", leaf: testLeafInput{cert: []byte("certificate")}, suffix: []byte{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leafInput, extraData := tt.leaf.marshal()
+			leafInput = append(leafInput, tt.suffix...)
+			got, err := parseMirroredEntry(42, leafInput, extraData)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseMirroredEntry = %v", err)
+			}
+			if !tt.ok {
+				return
+			}
+
+			e := got.entry
+			// The leaf hash must be the source's
+			if !bytes.Equal(e.MerkleTreeLeaf(), leafInput) {
+				t.Errorf("MerkleTreeLeaf = %x, want the leaf_input %x", e.MerkleTreeLeaf(), leafInput)
+			}
+			if e.LeafIndex != 42 || e.Timestamp != 1700000000000 || e.IsPrecert != (tt.leaf.entryType == 1) {
+				t.Errorf("entry = %d %d %v", e.LeafIndex, e.Timestamp, e.IsPrecert)
+			}
+			certificate := tt.leaf.cert
+			if e.IsPrecert {
+				certificate = tt.leaf.precert
+			}
+			if e.CertificateFp != sha256.Sum256(certificate) {
+				t.Errorf("CertificateFp = %x", e.CertificateFp)
+			}
+			if len(got.issuers) != len(tt.leaf.chain) || len(e.ChainFp) != len(tt.leaf.chain) {
+				t.Fatalf("%d issuers and %d fingerprints, want %d", len(got.issuers), len(e.ChainFp), len(tt.leaf.chain))
+			}
+			for i, cert := range tt.leaf.chain {
+				if !bytes.Equal(got.issuers[i], cert) || e.ChainFp[i] != sha256.Sum256(cert) {
+					t.Errorf("issuer %d = %q %x", i, got.issuers[i], e.ChainFp[i])
+				}
+			}
+
+			// It must read back from a data tile as the same entry
+			read, rest, err := sunlight.ReadMirroredTileLeaf(sunlight.AppendTileLeaf(nil, e))
+			if err != nil || len(rest) != 0 {
+				t.Fatalf("ReadMirroredTileLeaf = %v", err)
+			}
+			if !bytes.Equal(read.MerkleTreeLeaf(), leafInput) {
+				t.Errorf("entry read from a data tile has leaf %x", read.MerkleTreeLeaf())
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package ctsubmit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The log's key can be kept in an HSM, and used through its PKCS#11 module. The module
+// is loaded at runtime, so this needs a binary built with cgo. The PIN of the token is
+// read from ITKO_PKCS11_PIN, or from the file at pkcs11PinFile.
+
+// Sessions opened when pkcs11Sessions is not set. Each session signs one digest at a time.
+const defaultPkcs11Sessions = 4
+
+var oidP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+
+// pkcs11Pin returns the PIN of the token, from the environment or the file.
+func pkcs11Pin(pinFile string) (string, error) {
+	if pin := os.Getenv("ITKO_PKCS11_PIN"); pin != "" {
+		return pin, nil
+	}
+	if pinFile == "" {
+		return "", fmt.Errorf("PKCS#11 signer needs a PIN, in ITKO_PKCS11_PIN or pkcs11PinFile")
+	}
+	data, err := os.ReadFile(pinFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read PIN file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// pkcs11PublicKey parses the CKA_EC_PARAMS and CKA_EC_POINT attributes of a public key.
+// The point should be a DER OCTET STRING, but some modules return it bare.
+func pkcs11PublicKey(params, point []byte) (crypto.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if rest, err := asn1.Unmarshal(params, &oid); err != nil || len(rest) != 0 || !oid.Equal(oidP256) {
+		return nil, fmt.Errorf("PKCS#11 key is not a P-256 key")
+	}
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) != 0 {
+		raw = point
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), raw)
+	if x == nil {
+		return nil, fmt.Errorf("unable to parse PKCS#11 public key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
@@ -0,0 +1,293 @@
+//go:build cgo && unix
+
+package ctsubmit
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+
+// Only the parts of the PKCS#11 headers that are used. On Unix the structs are not packed.
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+
+typedef struct {
+	CK_ULONG type;
+	void *pValue;
+	CK_ULONG ulValueLen;
+} CK_ATTRIBUTE;
+
+typedef struct {
+	CK_ULONG mechanism;
+	void *pParameter;
+	CK_ULONG ulParameterLen;
+} CK_MECHANISM;
+
+typedef struct {
+	void *CreateMutex;
+	void *DestroyMutex;
+	void *LockMutex;
+	void *UnlockMutex;
+	CK_ULONG flags;
+	void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+#define CKF_OS_LOCKING_OK 0x2
+
+typedef struct {
+	void *handle;
+	CK_RV (*Initialize)(CK_C_INITIALIZE_ARGS *);
+	CK_RV (*OpenSession)(CK_ULONG, CK_ULONG, void *, void *, CK_ULONG *);
+	CK_RV (*Login)(CK_ULONG, CK_ULONG, unsigned char *, CK_ULONG);
+	CK_RV (*FindObjectsInit)(CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*FindObjects)(CK_ULONG, CK_ULONG *, CK_ULONG, CK_ULONG *);
+	CK_RV (*FindObjectsFinal)(CK_ULONG);
+	CK_RV (*GetAttributeValue)(CK_ULONG, CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*SignInit)(CK_ULONG, CK_MECHANISM *, CK_ULONG);
+	CK_RV (*Sign)(CK_ULONG, unsigned char *, CK_ULONG, unsigned char *, CK_ULONG *);
+} itko_pkcs11;
+
+static int itko_pkcs11_load(const char *path, itko_pkcs11 *m) {
+	m->handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (m->handle == NULL) {
+		return 0;
+	}
+	m->Initialize = dlsym(m->handle, "C_Initialize");
+	m->OpenSession = dlsym(m->handle, "C_OpenSession");
+	m->Login = dlsym(m->handle, "C_Login");
+	m->FindObjectsInit = dlsym(m->handle, "C_FindObjectsInit");
+	m->FindObjects = dlsym(m->handle, "C_FindObjects");
+	m->FindObjectsFinal = dlsym(m->handle, "C_FindObjectsFinal");
+	m->GetAttributeValue = dlsym(m->handle, "C_GetAttributeValue");
+	m->SignInit = dlsym(m->handle, "C_SignInit");
+	m->Sign = dlsym(m->handle, "C_Sign");
+	return m->Initialize && m->OpenSession && m->Login && m->FindObjectsInit && m->FindObjects &&
+		m->FindObjectsFinal && m->GetAttributeValue && m->SignInit && m->Sign;
+}
+
+static CK_RV itko_pkcs11_initialize(itko_pkcs11 *m) {
+	CK_C_INITIALIZE_ARGS args = {0};
+	args.flags = CKF_OS_LOCKING_OK;
+	return m->Initialize(&args);
+}
+
+static CK_RV itko_pkcs11_open_session(itko_pkcs11 *m, CK_ULONG slot, CK_ULONG *session) {
+	return m->OpenSession(slot, 0x4, NULL, NULL, session);
+}
+
+static CK_RV itko_pkcs11_login(itko_pkcs11 *m, CK_ULONG session, unsigned char *pin, CK_ULONG len) {
+	return m->Login(session, 1, pin, len);
+}
+
+// itko_pkcs11_find returns the objects of a class with a label, up to max of them.
+static CK_RV itko_pkcs11_find(itko_pkcs11 *m, CK_ULONG session, CK_ULONG *class, unsigned char *label,
+		CK_ULONG len, CK_ULONG *objects, CK_ULONG max, CK_ULONG *count) {
+	CK_ATTRIBUTE template[2] = {
+		{0x0, class, sizeof(CK_ULONG)},
+		{0x3, label, len},
+	};
+	CK_RV rv = m->FindObjectsInit(session, template, 2);
+	if (rv != 0) {
+		return rv;
+	}
+	rv = m->FindObjects(session, objects, max, count);
+	CK_RV final = m->FindObjectsFinal(session);
+	return rv != 0 ? rv : final;
+}
+
+// itko_pkcs11_attribute reads an attribute into value, which has room for *len bytes.
+static CK_RV itko_pkcs11_attribute(itko_pkcs11 *m, CK_ULONG session, CK_ULONG object, CK_ULONG type,
+		unsigned char *value, CK_ULONG *len) {
+	CK_ATTRIBUTE template = {type, value, *len};
+	CK_RV rv = m->GetAttributeValue(session, object, &template, 1);
+	*len = template.ulValueLen;
+	return rv;
+}
+
+static CK_RV itko_pkcs11_sign(itko_pkcs11 *m, CK_ULONG session, CK_ULONG key, unsigned char *digest,
+		CK_ULONG len, unsigned char *sig, CK_ULONG *sigLen) {
+	CK_MECHANISM mechanism = {0x1041, NULL, 0};
+	CK_RV rv = m->SignInit(session, &mechanism, key);
+	if (rv != 0) {
+		return rv;
+	}
+	return m->Sign(session, digest, len, sig, sigLen);
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+const (
+	ckoPublicKey  = 2
+	ckoPrivateKey = 3
+	ckaEcParams   = 0x180
+	ckaEcPoint    = 0x181
+
+	ckrOk                         = 0
+	ckrUserAlreadyLoggedIn        = 0x100
+	ckrCryptokiAlreadyInitialized = 0x191
+
+	maxPkcs11AttributeLength = 256
+	maxPkcs11SignatureLength = 132
+)
+
+// The module is loaded and initialized once per path, as several logs in a process can
+// share a token.
+var (
+	pkcs11ModulesMu sync.Mutex
+	pkcs11Modules   = map[string]*C.itko_pkcs11{}
+)
+
+type pkcs11Signer struct {
+	module *C.itko_pkcs11
+	key    C.CK_ULONG
+	public crypto.PublicKey
+	// Idle sessions, each of which can run one signing operation at a time
+	sessions chan C.CK_ULONG
+}
+
+func loadPkcs11Module(path string) (*C.itko_pkcs11, error) {
+	pkcs11ModulesMu.Lock()
+	defer pkcs11ModulesMu.Unlock()
+	if m, ok := pkcs11Modules[path]; ok {
+		return m, nil
+	}
+
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	m := (*C.itko_pkcs11)(C.calloc(1, C.sizeof_itko_pkcs11))
+	if C.itko_pkcs11_load(cPath, m) == 0 {
+		defer C.free(unsafe.Pointer(m))
+		if m.handle == nil {
+			return nil, fmt.Errorf("unable to load PKCS#11 module %s: %s", path, C.GoString(C.dlerror()))
+		}
+		return nil, fmt.Errorf("PKCS#11 module %s does not export the functions needed to sign", path)
+	}
+	if rv := C.itko_pkcs11_initialize(m); rv != ckrOk && rv != ckrCryptokiAlreadyInitialized {
+		C.free(unsafe.Pointer(m))
+		return nil, pkcs11Error("C_Initialize", rv)
+	}
+	pkcs11Modules[path] = m
+	return m, nil
+}
+
+func newPkcs11Signer(c SignerConfig) (*pkcs11Signer, error) {
+	if c.Pkcs11Module == "" || c.Pkcs11KeyLabel == "" {
+		return nil, fmt.Errorf("PKCS#11 signer needs pkcs11Module and pkcs11KeyLabel")
+	}
+	pin, err := pkcs11Pin(c.Pkcs11PinFile)
+	if err != nil {
+		return nil, err
+	}
+	m, err := loadPkcs11Module(c.Pkcs11Module)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := c.Pkcs11Sessions
+	if sessions <= 0 {
+		sessions = defaultPkcs11Sessions
+	}
+	s := &pkcs11Signer{module: m, sessions: make(chan C.CK_ULONG, sessions)}
+	for range sessions {
+		var session C.CK_ULONG
+		if rv := C.itko_pkcs11_open_session(m, C.CK_ULONG(c.Pkcs11Slot), &session); rv != ckrOk {
+			return nil, pkcs11Error("C_OpenSession", rv)
+		}
+		s.sessions <- session
+	}
+
+	// Logging in applies to every session of the application with the token
+	session := <-s.sessions
+	defer func() { s.sessions <- session }()
+	cPin := C.CBytes([]byte(pin))
+	defer C.free(cPin)
+	if rv := C.itko_pkcs11_login(m, session, (*C.uchar)(cPin), C.CK_ULONG(len(pin))); rv != ckrOk && rv != ckrUserAlreadyLoggedIn {
+		return nil, pkcs11Error("C_Login", rv)
+	}
+
+	if s.key, err = s.find(session, ckoPrivateKey, c.Pkcs11KeyLabel); err != nil {
+		return nil, err
+	}
+	public, err := s.find(session, ckoPublicKey, c.Pkcs11KeyLabel)
+	if err != nil {
+		return nil, err
+	}
+	params, err := s.attribute(session, public, ckaEcParams)
+	if err != nil {
+		return nil, err
+	}
+	point, err := s.attribute(session, public, ckaEcPoint)
+	if err != nil {
+		return nil, err
+	}
+	if s.public, err = pkcs11PublicKey(params, point); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// find returns the only key of a class with the label.
+func (s *pkcs11Signer) find(session C.CK_ULONG, class C.CK_ULONG, label string) (C.CK_ULONG, error) {
+	// Everything passed to the module is allocated in C, as the template holds pointers
+	cClass := (*C.CK_ULONG)(C.malloc(C.sizeof_CK_ULONG))
+	defer C.free(unsafe.Pointer(cClass))
+	*cClass = class
+	cLabel := C.CBytes([]byte(label))
+	defer C.free(cLabel)
+	objects := (*[2]C.CK_ULONG)(C.malloc(2 * C.sizeof_CK_ULONG))
+	defer C.free(unsafe.Pointer(objects))
+
+	var count C.CK_ULONG
+	rv := C.itko_pkcs11_find(s.module, session, cClass, (*C.uchar)(cLabel), C.CK_ULONG(len(label)), &objects[0], 2, &count)
+	if rv != ckrOk {
+		return 0, pkcs11Error("C_FindObjects", rv)
+	}
+	if count != 1 {
+		kind := "private"
+		if class == ckoPublicKey {
+			kind = "public"
+		}
+		return 0, fmt.Errorf("found %d PKCS#11 %s keys labeled %q, expected exactly one", count, kind, label)
+	}
+	return objects[0], nil
+}
+
+func (s *pkcs11Signer) attribute(session, object, typ C.CK_ULONG) ([]byte, error) {
+	value := C.malloc(maxPkcs11AttributeLength)
+	defer C.free(value)
+	length := C.CK_ULONG(maxPkcs11AttributeLength)
+	if rv := C.itko_pkcs11_attribute(s.module, session, object, typ, (*C.uchar)(value), &length); rv != ckrOk {
+		return nil, pkcs11Error("C_GetAttributeValue", rv)
+	}
+	return C.GoBytes(value, C.int(length)), nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey { return s.public }
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != 32 {
+		return nil, fmt.Errorf("PKCS#11 key only signs SHA-256 digests")
+	}
+	session := <-s.sessions
+	defer func() { s.sessions <- session }()
+
+	var sig [maxPkcs11SignatureLength]byte
+	sigLen := C.CK_ULONG(len(sig))
+	rv := C.itko_pkcs11_sign(s.module, session, s.key, (*C.uchar)(&digest[0]), C.CK_ULONG(len(digest)), (*C.uchar)(&sig[0]), &sigLen)
+	if rv != ckrOk {
+		return nil, pkcs11Error("C_Sign", rv)
+	}
+	return rawSignature(sig[:sigLen])
+}
+
+func pkcs11Error(function string, rv C.CK_RV) error {
+	return fmt.Errorf("PKCS#11 %s failed: CKR 0x%08x", function, uint64(rv))
+}
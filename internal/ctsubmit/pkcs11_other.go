@@ -0,0 +1,12 @@
+//go:build !cgo || !unix
+
+package ctsubmit
+
+import (
+	"crypto"
+	"fmt"
+)
+
+func newPkcs11Signer(c SignerConfig) (crypto.Signer, error) {
+	return nil, fmt.Errorf("PKCS#11 signer needs a binary built with cgo")
+}
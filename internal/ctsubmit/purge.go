@@ -0,0 +1,71 @@
+package ctsubmit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"itko.dev/internal/sunlight"
+)
+
+type PurgeConfig struct {
+	// The Fastly service caching the bucket or the monitor, and an API token allowed to
+	// purge it. Nothing is purged if either is empty.
+	FastlyServiceId string `json:"fastlyServiceId"`
+	FastlyApiToken  string `json:"fastlyApiToken"`
+}
+
+const fastlyApiUrl = "https://api.fastly.com"
+
+// The objects replaced by every publish
+var purgeKeys = []string{sunlight.SurrogateKeySTH, sunlight.SurrogateKeyCheckpoint, sunlight.SurrogateKeyPartialTile}
+
+// purger purges the STH, checkpoint, and partial tiles from the CDN after each publish,
+// so the CDN can cache them for longer without serving a stale tree head.
+type purger struct {
+	config PurgeConfig
+	client *http.Client
+}
+
+func newPurger(c PurgeConfig) *purger {
+	if c.FastlyServiceId == "" || c.FastlyApiToken == "" {
+		return nil
+	}
+	return &purger{config: c, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// purge runs in the background, so a slow or failing API never holds up stage two. The
+// objects are still correct without it, they are just served until their TTL runs out.
+func (p *purger) purge(ctx context.Context, treeSize uint64) {
+	if p == nil {
+		return
+	}
+	go func() {
+		if err := p.purgeKeys(context.WithoutCancel(ctx)); err != nil {
+			slog.WarnContext(ctx, "Unable to purge the CDN", "tree_size", treeSize, "error", err)
+		}
+	}()
+}
+
+func (p *purger) purgeKeys(ctx context.Context) error {
+	url := fmt.Sprintf("%s/service/%s/purge", fastlyApiUrl, p.config.FastlyServiceId)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", p.config.FastlyApiToken)
+	req.Header.Set("Surrogate-Key", strings.Join(purgeKeys, " "))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("purge returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package ctsubmit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"itko.dev/internal/server"
+	"itko.dev/internal/sunlight"
+)
+
+// When natsUrl is set, front-ends publish entries to a JetStream work queue instead of
+// calling the sequencer directly, so a burst of submissions or a sequencer failover is
+// absorbed by the queue rather than by the load balancer.
+//
+// The front-end still has to wait for the entry to be sequenced, because the SCT embeds
+// the leaf index. The sequencer publishes the result to a reply subject carried in a
+// header of the queued message, and the front-end gives up after the usual 5 seconds.
+// A message that is redelivered after the sequencer crashed is answered from the dedupe
+// cache if it was already sequenced, so it doesn't end up in the log twice.
+
+const (
+	queueReplyHeader     = "Itko-Reply"
+	queueStatusHeader    = "Itko-Status"
+	queueRequestIDHeader = "Itko-Request-Id"
+)
+
+func queueSubject(stream string) string {
+	return stream + ".entries"
+}
+
+func connectQueue(gc GlobalConfig) (*nats.Conn, jetstream.JetStream, error) {
+	if gc.NatsStream == "" {
+		return nil, nil, fmt.Errorf("natsStream must be set when natsUrl is set")
+	}
+	nc, err := nats.Connect(gc.NatsUrl, nats.Name(gc.Name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to NATS: %w", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, nil, fmt.Errorf("unable to create JetStream context: %w", err)
+	}
+	return nc, js, nil
+}
+
+// --------------------------------------------------------------------------------------------
+
+type queueSequencer struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	stream string
+}
+
+func newQueueSequencer(gc GlobalConfig) (*queueSequencer, error) {
+	nc, js, err := connectQueue(gc)
+	if err != nil {
+		return nil, err
+	}
+	return &queueSequencer{nc, js, gc.NatsStream}, nil
+}
+
+func (s *queueSequencer) sequence(ctx context.Context, entry sunlight.UnsequencedEntry) (sunlight.LogEntry, int, error) {
+	body, err := json.Marshal(newSequenceRequest(entry))
+	if err != nil {
+		return sunlight.LogEntry{}, http.StatusInternalServerError, fmt.Errorf("unable to marshal sequence request: %w", err)
+	}
+
+	// Same deadline as the local sequencer
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Subscribe before publishing so the reply can't be missed
+	inbox := s.nc.NewRespInbox()
+	sub, err := s.nc.SubscribeSync(inbox)
+	if err != nil {
+		return sunlight.LogEntry{}, http.StatusServiceUnavailable, fmt.Errorf("unable to subscribe to reply inbox: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	msg := nats.NewMsg(queueSubject(s.stream))
+	msg.Data = body
+	msg.Header.Set(queueReplyHeader, inbox)
+	msg.Header.Set(queueRequestIDHeader, server.RequestIDFromContext(ctx))
+	if _, err := s.js.PublishMsg(ctx, msg); err != nil {
+		return sunlight.LogEntry{}, http.StatusServiceUnavailable, fmt.Errorf("unable to publish entry to queue: %w", err)
+	}
+
+	reply, err := sub.NextMsgWithContext(ctx)
+	if err != nil {
+		return sunlight.LogEntry{}, http.StatusServiceUnavailable, fmt.Errorf("timed out waiting for sequencer")
+	}
+
+	code, err := strconv.Atoi(reply.Header.Get(queueStatusHeader))
+	if err != nil {
+		return sunlight.LogEntry{}, http.StatusInternalServerError, fmt.Errorf("invalid status in sequencer reply: %w", err)
+	}
+	if code != http.StatusOK {
+		// Pass the sequencer's verdict through, so that a frozen log still returns a 403
+		return sunlight.LogEntry{}, code, fmt.Errorf("sequencer returned %d: %s", code, string(reply.Data))
+	}
+
+	var seqResp SequenceResponse
+	if err := json.Unmarshal(reply.Data, &seqResp); err != nil {
+		return sunlight.LogEntry{}, http.StatusInternalServerError, fmt.Errorf("unable to unmarshal sequencer response: %w", err)
+	}
+	return entry.Sequence(seqResp.LeafIndex, seqResp.Timestamp), http.StatusOK, nil
+}
+
+// --------------------------------------------------------------------------------------------
+
+// consumeQueue runs on the process holding the lock, feeding entries from the queue into
+// stage one until the context is cancelled.
+func (d *stageZeroData) consumeQueue(ctx context.Context, gc GlobalConfig) error {
+	nc, js, err := connectQueue(gc)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      gc.NatsStream,
+		Subjects:  []string{queueSubject(gc.NatsStream)},
+		Retention: jetstream.WorkQueuePolicy,
+		// Nobody is waiting for an entry this old anymore
+		MaxAge: time.Minute,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create stream: %w", err)
+	}
+
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:   "sequencer",
+		AckPolicy: jetstream.AckExplicitPolicy,
+		// If the sequencer dies, redeliver after the front-end would have given up anyway
+		AckWait: 10 * time.Second,
+		// Enough to fill a few pools
+		MaxAckPending: 4096,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create consumer: %w", err)
+	}
+
+	cc, err := consumer.Consume(func(msg jetstream.Msg) {
+		// Each entry blocks until its pool is published, so handle them concurrently
+		go d.handleQueueMsg(ctx, nc, msg)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to consume from queue: %w", err)
+	}
+	defer cc.Stop()
+
+	slog.Info("Consuming entries from NATS", "stream", gc.NatsStream)
+	<-ctx.Done()
+	return nil
+}
+
+func (d *stageZeroData) handleQueueMsg(ctx context.Context, nc *nats.Conn, msg jetstream.Msg) {
+	if id := msg.Headers().Get(queueRequestIDHeader); id != "" {
+		ctx = server.ContextWithRequestID(ctx, id)
+	}
+	code, body, retry := d.sequenceQueueMsg(ctx, msg.Data())
+
+	// Only let the entry be redelivered if stage one never took it. Once it has, it may
+	// still be sequenced after the sequencer gave up on it, and a redelivery that comes
+	// before its pool is published wouldn't be found in the dedupe cache, so it would end
+	// up in the log twice. The submitter has been told to retry either way.
+	if retry {
+		if err := msg.Nak(); err != nil {
+			slog.WarnContext(ctx, "Unable to nak queued entry", "error", err)
+		}
+	} else {
+		if err := msg.Ack(); err != nil {
+			slog.WarnContext(ctx, "Unable to ack queued entry", "error", err)
+		}
+	}
+
+	replyTo := msg.Headers().Get(queueReplyHeader)
+	if replyTo == "" {
+		return
+	}
+	reply := nats.NewMsg(replyTo)
+	reply.Header.Set(queueStatusHeader, strconv.Itoa(code))
+	reply.Data = body
+	if err := nc.PublishMsg(reply); err != nil {
+		slog.WarnContext(ctx, "Unable to reply to queued entry", "error", err)
+	}
+}
+
+// sequenceQueueMsg sequences a queued entry, and returns the status and body of the reply
+// to the front-end. retry is set if the entry should be redelivered, which is only the case
+// if it failed before stage one took it, and wasn't rejected outright or throttled.
+func (d *stageZeroData) sequenceQueueMsg(ctx context.Context, data []byte) (code int, body []byte, retry bool) {
+	var req SequenceRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return http.StatusBadRequest, []byte(fmt.Sprintf("unable to unmarshal queued entry: %v", err)), false
+	}
+	entry, err := req.entry()
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error()), false
+	}
+
+	// The message may be a redelivery of an entry that was already sequenced
+	var completeEntry sunlight.LogEntry
+	dedupeVal, err := d.bucket.GetDedupeEntry(ctx, [16]byte(entry.CertificateFp[:16]), d.indexLayout)
+	if err == nil {
+		completeEntry = entry.Sequence(dedupeVal.leafIndex, dedupeVal.timestamp)
+	} else {
+		completeEntry, code, err = d.sequencer.sequence(ctx, entry)
+		if err != nil {
+			slog.WarnContext(ctx, "Unable to sequence queued entry", "code", code, "error", err)
+			// A rejected or throttled entry is final, and one that stage one took may
+			// still be sequenced
+			final := code == http.StatusBadRequest || code == http.StatusForbidden || code == http.StatusTooManyRequests
+			return code, []byte(err.Error()), !final && !errors.Is(err, errMaybeSequenced)
+		}
+	}
+
+	body, err = json.Marshal(SequenceResponse{
+		LeafIndex: completeEntry.LeafIndex,
+		Timestamp: completeEntry.Timestamp,
+	})
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error()), false
+	}
+	return http.StatusOK, body, false
+}
@@ -0,0 +1,133 @@
+package ctsubmit
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"itko.dev/internal/sunlight"
+)
+
+// queueMsg is a queued entry that records whether it was acked or naked.
+type queueMsg struct {
+	jetstream.Msg
+	data         []byte
+	acked, naked bool
+}
+
+func (m *queueMsg) Data() []byte         { return m.data }
+func (m *queueMsg) Headers() nats.Header { return nats.Header{} }
+func (m *queueMsg) Ack() error           { m.acked = true; return nil }
+func (m *queueMsg) Nak() error           { m.naked = true; return nil }
+
+func TestHandleQueueMsg(t *testing.T) {
+	layout := sunlight.IndexLayout{Mask: 5}
+	cert := []byte("certificate")
+	data, err := json.Marshal(SequenceRequest{Certificate: cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		// Runs stage one, which gets every entry the sequencer sends it
+		stageOne func(rx <-chan UnsequencedEntryWithReturnPath)
+		state    LifecycleState
+		// Whether the entry is already in the dedupe cache
+		sequenced bool
+		code      int
+		nak       bool
+	}{
+		{
+			name: "sequenced",
+			data: data,
+			stageOne: func(rx <-chan UnsequencedEntryWithReturnPath) {
+				e := <-rx
+				e.returnPath <- e.entry.Sequence(7, 1700000000000)
+			},
+			code: http.StatusOK,
+		},
+		{
+			name:      "redelivered after it was sequenced",
+			data:      data,
+			stageOne:  func(rx <-chan UnsequencedEntryWithReturnPath) {},
+			sequenced: true,
+			code:      http.StatusOK,
+		},
+		{
+			// Stage one may still sequence it, so a redelivery could put it in the log twice
+			name: "taken by stage one and abandoned",
+			data: data,
+			stageOne: func(rx <-chan UnsequencedEntryWithReturnPath) {
+				<-rx
+			},
+			code: http.StatusServiceUnavailable,
+		},
+		{
+			name:     "never taken by stage one",
+			data:     data,
+			stageOne: func(rx <-chan UnsequencedEntryWithReturnPath) {},
+			code:     http.StatusServiceUnavailable,
+			nak:      true,
+		},
+		{
+			name:     "frozen",
+			data:     data,
+			stageOne: func(rx <-chan UnsequencedEntryWithReturnPath) {},
+			state:    StateReadOnly,
+			code:     http.StatusForbidden,
+		},
+		{
+			name:     "invalid",
+			data:     []byte("{"),
+			stageOne: func(rx <-chan UnsequencedEntryWithReturnPath) {},
+			code:     http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemStorage()
+			if tt.sequenced {
+				fp := sha256.Sum256(cert)
+				record := DedupeUpload{hash: [16]byte(fp[:16]), leafIndex: 7, timestamp: 1700000000000}
+				s.objects["int/dedupe/"+layout.Path(fp[:16])] = append(sunlight.IndexHeader(DDURecordSize), record.ToBytes()...)
+			}
+			stageOneTx := make(chan UnsequencedEntryWithReturnPath)
+			go tt.stageOne(stageOneTx)
+			d := &stageZeroData{
+				sequencer:   &localSequencer{stageOneTx: stageOneTx, lifecycle: newLifecycle(cmp.Or(tt.state, StateUsable))},
+				bucket:      Bucket{S: s},
+				indexLayout: layout,
+			}
+
+			// Shorter than the time the sequencer waits for room in stage one
+			ctx, cancel := context.WithTimeout(context.Background(), enqueueTimeout/4)
+			defer cancel()
+			code, body, _ := d.sequenceQueueMsg(ctx, tt.data)
+			if code != tt.code {
+				t.Fatalf("sequenceQueueMsg = %d %s, want %d", code, body, tt.code)
+			}
+			if code == http.StatusOK {
+				var resp SequenceResponse
+				if err := json.Unmarshal(body, &resp); err != nil || resp.LeafIndex != 7 {
+					t.Errorf("reply = %s, %v, want leaf index 7", body, err)
+				}
+			}
+
+			msg := &queueMsg{data: tt.data}
+			go tt.stageOne(stageOneTx)
+			ctx, cancel = context.WithTimeout(context.Background(), enqueueTimeout/4)
+			defer cancel()
+			d.handleQueueMsg(ctx, nil, msg)
+			if msg.naked != tt.nak || msg.acked == tt.nak {
+				t.Errorf("entry was acked %v and naked %v, want naked %v", msg.acked, msg.naked, tt.nak)
+			}
+		})
+	}
+}
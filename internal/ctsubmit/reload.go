@@ -0,0 +1,200 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509util"
+)
+
+// Most of the config is only read when the log is loaded, because changing it under a
+// running log, such as the key or the bucket, would break it. The fields in settings only
+// change how the log behaves from one moment to the next, so they are applied as soon as
+// the config changes. Changes to any other field are logged, and take effect the next
+// time the log is loaded, after a restart or a failover.
+
+// The roots live in the bucket rather than the KV store, so they are polled for changes
+const rootsPollInterval = time.Minute
+
+// settings are the parts of the config that are applied while the log is running.
+// They are swapped out as a whole, so readers see a consistent set.
+type settings struct {
+	flushInterval  time.Duration
+	minSthInterval time.Duration
+	// Only rotated, as the admin endpoints are not served without a token
+	adminToken string
+	roots      *x509util.PEMCertPool
+	rootsBytes []byte
+}
+
+// reloadableFields are the JSON names of the fields in settings.
+var reloadableFields = map[string]bool{
+	"flushMs":          true,
+	"minSthIntervalMs": true,
+	"adminToken":       true,
+}
+
+func newSettings(gc GlobalConfig, roots *x509util.PEMCertPool, rootsBytes []byte) *settings {
+	return &settings{
+		flushInterval:  time.Duration(gc.FlushMs) * time.Millisecond,
+		minSthInterval: time.Duration(gc.MinSthIntervalMs) * time.Millisecond,
+		adminToken:     gc.AdminToken,
+		roots:          roots,
+		rootsBytes:     rootsBytes,
+	}
+}
+
+// fetchRoots reads the roots the log accepts from the bucket, along with the raw object
+// so that later reads can tell whether they changed.
+func fetchRoots(ctx context.Context, bucket Bucket) (*x509util.PEMCertPool, []byte, error) {
+	var res struct {
+		Certificates [][]byte `json:"certificates"`
+	}
+	raw, err := bucket.Get(ctx, "ct/v1/get-roots")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to fetch roots: %v", err)
+	}
+	err = json.Unmarshal(raw, &res)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to unmarshal roots: %v", err)
+	}
+
+	// iterate over the certificates and add them to the pool
+	r := x509util.NewPEMCertPool()
+	for _, certBytes := range res.Certificates {
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse certificate: %v", err)
+		}
+		r.AddCert(cert)
+	}
+	return r, raw, nil
+}
+
+// watchConfig follows the config key, and applies the fields in settings when it changes.
+func (l *Log) watchConfig(ctx context.Context) {
+	var waitIndex uint64
+	for {
+		e, err := l.store.Watch(ctx, l.kvpath+"/config", waitIndex)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.ErrorContext(ctx, "Unable to watch configuration", "kv_path", l.kvpath, "error", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		// The first read returns the config the log was loaded with
+		first := waitIndex == 0
+		waitIndex = e.Index
+		if first || !e.Exists() {
+			continue
+		}
+
+		var gc GlobalConfig
+		err = l.coord.DecodeConfig(e.Value, &gc)
+		if err == nil {
+			err = gc.Validate()
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Ignoring invalid configuration", "kv_path", l.kvpath, "error", err)
+			continue
+		}
+		l.applyConfig(ctx, gc)
+	}
+}
+
+// applyConfig applies the fields of gc that can change while the log is running, and
+// logs the ones that can't.
+func (l *Log) applyConfig(ctx context.Context, gc GlobalConfig) {
+	if restart := restartFields(l.config, gc); len(restart) > 0 {
+		slog.WarnContext(ctx, "Configuration changed in fields that only take effect once the log is reloaded",
+			"kv_path", l.kvpath, "fields", strings.Join(restart, ","))
+	}
+
+	current := l.settings.Load()
+	next := newSettings(gc, current.roots, current.rootsBytes)
+	if next.flushInterval <= 0 {
+		slog.WarnContext(ctx, "Refusing to apply flushMs, it must be positive", "kv_path", l.kvpath, "flush_ms", gc.FlushMs)
+		next.flushInterval = current.flushInterval
+	}
+	if (next.adminToken == "") != (current.adminToken == "") {
+		// Setting or clearing the token adds or removes the endpoints, so it is reported
+		// by restartFields instead
+		next.adminToken = current.adminToken
+	}
+	if next.flushInterval == current.flushInterval && next.minSthInterval == current.minSthInterval && next.adminToken == current.adminToken {
+		return
+	}
+	l.settings.Store(next)
+	slog.InfoContext(ctx, "Applied configuration change", "kv_path", l.kvpath,
+		"flush_interval", next.flushInterval, "min_sth_interval", next.minSthInterval,
+		"admin_token_rotated", next.adminToken != current.adminToken)
+
+	if !l.frontend && next.flushInterval != current.flushInterval {
+		err := l.stageZeroData.bucket.SetLogInfo(ctx, LogInfo{
+			Name:          l.config.Name,
+			NotAfterStart: l.config.NotAfterStart,
+			NotAfterLimit: l.config.NotAfterLimit,
+			FlushMs:       gc.FlushMs,
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "Unable to publish log info", "kv_path", l.kvpath, "error", err)
+		}
+	}
+}
+
+// restartFields returns the JSON names of the fields that differ between a and b, other
+// than the ones that are applied while the log is running.
+func restartFields(a, b GlobalConfig) []string {
+	var fields []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		name, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("json"), ",")
+		if reloadableFields[name] || reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	if (a.AdminToken == "") != (b.AdminToken == "") {
+		fields = append(fields, "adminToken")
+	}
+	return fields
+}
+
+// watchRoots polls the roots object, and starts accepting chains to the new roots as
+// soon as it changes.
+func (l *Log) watchRoots(ctx context.Context) {
+	ticker := time.NewTicker(rootsPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		roots, raw, err := fetchRoots(ctx, l.stageZeroData.bucket)
+		if err != nil {
+			slog.WarnContext(ctx, "Unable to reload roots", "kv_path", l.kvpath, "error", err)
+			continue
+		}
+		current := l.settings.Load()
+		if bytes.Equal(raw, current.rootsBytes) {
+			continue
+		}
+		next := *current
+		next.roots, next.rootsBytes = roots, raw
+		// A config change could have been applied since the load, so only swap if not
+		if l.settings.CompareAndSwap(current, &next) {
+			slog.InfoContext(ctx, "Reloaded roots", "kv_path", l.kvpath, "count", len(roots.RawCertificates()))
+		}
+	}
+}
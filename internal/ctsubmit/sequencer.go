@@ -0,0 +1,405 @@
+package ctsubmit
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"itko.dev/internal/coordination"
+	"itko.dev/internal/server"
+	"itko.dev/internal/sunlight"
+)
+
+// A sequencer takes an entry that has passed stage zero, and returns it once it has been
+// sequenced and covered by a published STH. This is either stage one in the same process,
+// or a remote process holding the Consul lock when stage zero runs as a stateless front-end.
+type sequencer interface {
+	sequence(ctx context.Context, entry sunlight.UnsequencedEntry) (sunlight.LogEntry, int, error)
+}
+
+// --------------------------------------------------------------------------------------------
+
+type localSequencer struct {
+	stageOneTx chan<- UnsequencedEntryWithReturnPath
+	lifecycle  *lifecycle
+}
+
+func (s *localSequencer) sequence(ctx context.Context, entry sunlight.UnsequencedEntry) (sunlight.LogEntry, int, error) {
+	// Nominally, this should complete in under 2 seconds. The deadline is passed along
+	// with the entry, so stage one won't sequence it if it is still buffered by then.
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// Send the unsequenced entry to the first stage
+	// This channel is buffered so it doesn't block if an attempt is made to send
+	// after the timeout fires.
+	returnPath := make(chan sunlight.LogEntry, 1)
+	full := time.NewTimer(enqueueTimeout)
+	defer full.Stop()
+	// A select picks at random between the cases that are ready, so the send below could
+	// still win once the log is frozen
+	if s.lifecycle.isFrozen() {
+		return sunlight.LogEntry{}, http.StatusForbidden, s.lifecycle.notUsable()
+	}
+	select {
+	case s.stageOneTx <- UnsequencedEntryWithReturnPath{ctx, entry, returnPath}:
+	case <-s.lifecycle.frozen:
+		return sunlight.LogEntry{}, http.StatusForbidden, s.lifecycle.notUsable()
+	case <-full.C:
+		// Stage one is keeping up, but there is more coming in than fits in a pool
+		// every flush interval, so ask the client to slow down
+		return sunlight.LogEntry{}, http.StatusTooManyRequests, ErrPoolFull
+	case <-ctx.Done():
+		return sunlight.LogEntry{}, http.StatusServiceUnavailable, sequenceAbandoned(ctx)
+	}
+
+	// If we recieve something here, that means that the entry has been both sequenced
+	// and uploaded with a newly signed STH, so we can issue a SCT. Stage one closes the
+	// return path instead if the log was frozen before it got to the entry.
+	select {
+	case completeEntry, ok := <-returnPath:
+		if !ok {
+			return sunlight.LogEntry{}, http.StatusForbidden, s.lifecycle.notUsable()
+		}
+		return completeEntry, http.StatusOK, nil
+	case <-s.lifecycle.stopped:
+		// The entry may have been answered just before the pipeline stopped, but once it
+		// has, an entry it hasn't answered never will be
+		select {
+		case completeEntry, ok := <-returnPath:
+			if ok {
+				return completeEntry, http.StatusOK, nil
+			}
+		default:
+		}
+		return sunlight.LogEntry{}, http.StatusForbidden, s.lifecycle.notUsable()
+	case <-ctx.Done():
+		return sunlight.LogEntry{}, http.StatusServiceUnavailable, fmt.Errorf("%w: %w", sequenceAbandoned(ctx), errMaybeSequenced)
+	}
+}
+
+// If there is no room for an entry in the stage one channel after this long, the
+// submission is rejected with a 429 rather than waiting for the full deadline.
+const enqueueTimeout = time.Second
+
+var ErrPoolFull = errors.New("pool full")
+
+// errMaybeSequenced is wrapped by the error of a sequencer that gave up on an entry after
+// stage one took it. Stage one may already have put it in a pool, so it can still end up
+// in the log, and it mustn't be sequenced again until it would be found in the dedupe cache.
+var errMaybeSequenced = errors.New("entry may still be sequenced")
+
+// Once an entry is queued, a timeout means stage one or two can't make progress, which
+// is a 503 rather than something the client caused.
+func sequenceAbandoned(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out waiting for sequencer")
+	}
+	return fmt.Errorf("request abandoned while waiting for sequencer: %w", ctx.Err())
+}
+
+// --------------------------------------------------------------------------------------------
+
+// SequenceRequest is the message a front-end sends to the sequencer. Only the fields
+// that can't be derived from the others are sent, and the fingerprints are recomputed
+// by the sequencer.
+type SequenceRequest struct {
+	Certificate    []byte   `json:"certificate"`
+	IsPrecert      bool     `json:"isPrecert"`
+	IssuerKeyHash  []byte   `json:"issuerKeyHash,omitempty"`
+	PreCertificate []byte   `json:"preCertificate,omitempty"`
+	Chain          [][]byte `json:"chain"`
+}
+
+type SequenceResponse struct {
+	LeafIndex uint64 `json:"leafIndex"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// The sequencer's internal API is a single gRPC method. A front-end keeps one HTTP/2
+// connection open to the sequencer, and every entry it forwards is a stream on that
+// connection. The messages are encoded as JSON, so there is no generated code to keep
+// in sync, and they are the same as the ones sent through the queue.
+const sequenceMethod = "/itko.internal.v1.Sequencer/Sequence"
+
+// jsonCodec encodes gRPC messages as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+type sequencerServer interface {
+	sequenceRPC(ctx context.Context, req *SequenceRequest) (*SequenceResponse, error)
+}
+
+var sequencerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "itko.internal.v1.Sequencer",
+	HandlerType: (*sequencerServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Sequence",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			req := new(SequenceRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			return srv.(sequencerServer).sequenceRPC(ctx, req)
+		},
+	}},
+}
+
+// The sequencer's verdict is sent as the closest gRPC code, so that the front-end can
+// return the same status to the client, and a frozen log still returns a 403.
+var sequenceCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusInternalServerError: codes.Internal,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+func sequenceStatus(code int, err error) error {
+	c, ok := sequenceCodes[code]
+	if !ok {
+		c = codes.Unknown
+	}
+	return status.Error(c, err.Error())
+}
+
+// sequenceHTTPStatus is the inverse of sequenceStatus. Anything else, including a
+// deadline, means the sequencer couldn't be reached or didn't answer in time.
+func sequenceHTTPStatus(err error) int {
+	c := status.Code(err)
+	for code, sc := range sequenceCodes {
+		if sc == c {
+			return code
+		}
+	}
+	return http.StatusServiceUnavailable
+}
+
+// remoteSequencer forwards entries to the process holding the Consul lock, so that
+// any number of stage zero front-ends can be run behind a load balancer.
+type remoteSequencer struct {
+	conn  *grpc.ClientConn
+	token string
+}
+
+// newRemoteSequencer connects to the sequencer at sequencerURL. An https URL connects
+// with TLS, and an http one with HTTP/2 over cleartext.
+func newRemoteSequencer(sequencerURL, token string) (*remoteSequencer, error) {
+	u, err := url.Parse(sequencerURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse sequencer URL: %w", err)
+	}
+	var creds credentials.TransportCredentials
+	port := u.Port()
+	switch u.Scheme {
+	case "https":
+		creds = credentials.NewTLS(&tls.Config{})
+		port = cmp.Or(port, "443")
+	case "http":
+		creds = insecure.NewCredentials()
+		port = cmp.Or(port, "80")
+	default:
+		return nil, fmt.Errorf("sequencer URL must be http or https: %s", sequencerURL)
+	}
+
+	conn, err := grpc.NewClient("dns:///"+net.JoinHostPort(u.Hostname(), port),
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create sequencer client: %w", err)
+	}
+	return &remoteSequencer{conn: conn, token: token}, nil
+}
+
+func newSequenceRequest(entry sunlight.UnsequencedEntry) SequenceRequest {
+	req := SequenceRequest{
+		Certificate:    entry.Certificate,
+		IsPrecert:      entry.IsPrecert,
+		PreCertificate: entry.PreCertificate,
+		Chain:          make([][]byte, 0, len(entry.Chain)),
+	}
+	if entry.IsPrecert {
+		req.IssuerKeyHash = entry.IssuerKeyHash[:]
+	}
+	for _, cert := range entry.Chain {
+		req.Chain = append(req.Chain, cert.Raw)
+	}
+	return req
+}
+
+// entry rebuilds the unsequenced entry, recomputing the fingerprints.
+func (req SequenceRequest) entry() (sunlight.UnsequencedEntry, error) {
+	var entry sunlight.UnsequencedEntry
+	entry.Certificate = req.Certificate
+	entry.IsPrecert = req.IsPrecert
+	entry.PreCertificate = req.PreCertificate
+	if entry.IsPrecert {
+		if len(req.IssuerKeyHash) != 32 {
+			return entry, fmt.Errorf("issuerKeyHash must be 32 bytes")
+		}
+		copy(entry.IssuerKeyHash[:], req.IssuerKeyHash)
+		entry.CertificateFp = sha256.Sum256(entry.PreCertificate)
+	} else {
+		entry.CertificateFp = sha256.Sum256(entry.Certificate)
+	}
+	for _, der := range req.Chain {
+		cert, err := x509.ParseCertificate(der)
+		if x509.IsFatal(err) {
+			return entry, fmt.Errorf("unable to parse chain certificate: %w", err)
+		}
+		entry.Chain = append(entry.Chain, cert)
+		entry.ChainFp = append(entry.ChainFp, sha256.Sum256(der))
+	}
+	return entry, nil
+}
+
+func (s *remoteSequencer) sequence(ctx context.Context, entry sunlight.UnsequencedEntry) (sunlight.LogEntry, int, error) {
+	// Same deadline as the local sequencer
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	md := metadata.Pairs("authorization", "Bearer "+s.token)
+	if id := server.RequestIDFromContext(ctx); id != "" {
+		md.Append("x-request-id", id)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	req := newSequenceRequest(entry)
+	var resp SequenceResponse
+	if err := s.conn.Invoke(ctx, sequenceMethod, &req, &resp); err != nil {
+		return sunlight.LogEntry{}, sequenceHTTPStatus(err), fmt.Errorf("sequencer returned %w", err)
+	}
+	return entry.Sequence(resp.LeafIndex, resp.Timestamp), http.StatusOK, nil
+}
+
+// sequencerService serves the sequencer's API on the process holding the lock.
+type sequencerService struct {
+	d     *stageZeroData
+	token string
+}
+
+// Front-ends have already validated the chain, so the entry is trusted as is.
+func (s *sequencerService) sequenceRPC(ctx context.Context, req *SequenceRequest) (*SequenceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var reqToken string
+	ok := false
+	if v := md.Get("authorization"); len(v) == 1 {
+		reqToken, ok = strings.CutPrefix(v[0], "Bearer ")
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(reqToken), []byte(s.token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if v := md.Get("x-request-id"); len(v) == 1 {
+		ctx = server.ContextWithRequestID(ctx, v[0])
+	}
+
+	entry, err := req.entry()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	completeEntry, code, err := s.d.sequencer.sequence(ctx, entry)
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to sequence entry", "code", code, "error", err)
+		return nil, sequenceStatus(code, err)
+	}
+	return &SequenceResponse{
+		LeafIndex: completeEntry.LeafIndex,
+		Timestamp: completeEntry.Timestamp,
+	}, nil
+}
+
+// sequenceHandler serves the sequencer's gRPC API. It needs HTTP/2, which the server
+// accepts over cleartext as well as TLS.
+func (d *stageZeroData) sequenceHandler(token string) http.Handler {
+	srv := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}))
+	srv.RegisterService(&sequencerServiceDesc, &sequencerService{d: d, token: token})
+	return srv
+}
+
+// --------------------------------------------------------------------------------------------
+
+// LoadFrontend loads only stage zero of a log, sending entries to the sequencer at
+// sequencerURL, or through the queue if natsUrl is set, instead of running stage one
+// and two itself. It doesn't take the lock, so any number of front-ends can run at once.
+func LoadFrontend(ctx context.Context, kvpath string, coord coordination.Config, sequencerURL string) (*Log, error) {
+	store, err := coordination.New(coord)
+	if err != nil {
+		return nil, err
+	}
+
+	gc, err := fetchConfig(ctx, store, coord, kvpath)
+	if err != nil {
+		return nil, err
+	}
+	if gc.NatsUrl == "" && gc.SequencerToken == "" {
+		return nil, fmt.Errorf("sequencerToken or natsUrl must be set to run a front-end")
+	}
+
+	l := &Log{
+		config:   gc,
+		store:    store,
+		coord:    coord,
+		kvpath:   kvpath,
+		frontend: true,
+	}
+	{
+		state, _, err := l.fetchLifecycleState(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch lifecycle state: %v", err)
+		}
+		l.lifecycle = newLifecycle(state)
+		slog.Info("Loaded lifecycle state", "kv_path", kvpath, "state", state)
+	}
+
+	// The front-end signs SCTs, so it needs the key too
+	key, err := LoadSigner(gc)
+	if err != nil {
+		return nil, err
+	}
+
+	stageZero, err := loadStageZero(ctx, gc, newBucket(gc), key, l.lifecycle)
+	if err != nil {
+		return nil, err
+	}
+	if gc.NatsUrl != "" {
+		stageZero.sequencer, err = newQueueSequencer(gc)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		stageZero.sequencer, err = newRemoteSequencer(sequencerURL, gc.SequencerToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stageZero.metrics = newLogMetrics(gc.Name, gc.mergeDelaySLO())
+	l.settings = stageZero.settings
+	l.stageZeroData = stageZero
+
+	slog.Info("Front-end loaded successfully", "kv_path", kvpath)
+	return l, nil
+}
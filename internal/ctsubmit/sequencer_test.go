@@ -0,0 +1,188 @@
+package ctsubmit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"itko.dev/internal/server"
+	"itko.dev/internal/sunlight"
+)
+
+// testPipeline runs stage one with a stage two that answers every entry as soon as it
+// gets its pool, and returns the number of entries stage two got.
+func testPipeline(t *testing.T, stageOneRx chan UnsequencedEntryWithReturnPath, lc *lifecycle) *atomic.Int64 {
+	t.Helper()
+	s := new(atomic.Pointer[settings])
+	s.Store(&settings{flushInterval: time.Hour, minSthInterval: time.Hour})
+	stageTwoTx := make(chan []LogEntryWithReturnPath, 1)
+	d := &stageOneData{
+		stageOneRx: stageOneRx,
+		stageTwoTx: stageTwoTx,
+		settings:   s,
+		lifecycle:  lc,
+		metrics:    newLogMetrics(t.Name(), time.Second),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go d.stageOne(ctx)
+
+	var sequenced atomic.Int64
+	go func() {
+		for pool := range stageTwoTx {
+			for _, e := range pool {
+				sequenced.Add(1)
+				e.returnPath <- e.entry
+			}
+		}
+		close(lc.stopped)
+	}()
+	return &sequenced
+}
+
+func TestSequenceAfterFreeze(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether the entries are sent before the freeze, and left in stage one's buffer
+		buffered bool
+	}{
+		{"submitted after the freeze", false},
+		{"buffered at the freeze", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const entries = 50
+			lc := newLifecycle(StateUsable)
+			stageOneRx := make(chan UnsequencedEntryWithReturnPath, entries)
+			s := &localSequencer{stageOneTx: stageOneRx, lifecycle: lc}
+
+			var sequenced *atomic.Int64
+			if !tt.buffered {
+				sequenced = testPipeline(t, stageOneRx, lc)
+				lc.transition(StateReadOnly)
+				<-lc.stopped
+			}
+
+			var wg sync.WaitGroup
+			codes := make([]int, entries)
+			errs := make([]error, entries)
+			for i := range entries {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+					defer cancel()
+					_, codes[i], errs[i] = s.sequence(ctx, sunlight.UnsequencedEntry{Certificate: []byte{byte(i)}})
+				}()
+			}
+
+			if tt.buffered {
+				for len(stageOneRx) < entries {
+					time.Sleep(time.Millisecond)
+				}
+				lc.transition(StateReadOnly)
+				sequenced = testPipeline(t, stageOneRx, lc)
+			}
+			wg.Wait()
+
+			for i := range entries {
+				if codes[i] != http.StatusForbidden || !errors.Is(errs[i], ErrLogNotUsable) {
+					t.Errorf("entry %d: sequence = %d, %v, want a 403", i, codes[i], errs[i])
+				}
+			}
+			if n := sequenced.Load(); n != 0 {
+				t.Errorf("%d entries were sequenced after the freeze", n)
+			}
+		})
+	}
+}
+
+// sequencerFunc adapts a function to a sequencer.
+type sequencerFunc func(ctx context.Context, entry sunlight.UnsequencedEntry) (sunlight.LogEntry, int, error)
+
+func (f sequencerFunc) sequence(ctx context.Context, entry sunlight.UnsequencedEntry) (sunlight.LogEntry, int, error) {
+	return f(ctx, entry)
+}
+
+func TestRemoteSequencer(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		// The sequencer's verdict, or 0 if it shouldn't be asked
+		code int
+		want int
+	}{
+		{"sequenced", "token", http.StatusOK, http.StatusOK},
+		{"frozen", "token", http.StatusForbidden, http.StatusForbidden},
+		{"pool full", "token", http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{"unavailable", "token", http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"wrong token", "other", 0, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked := false
+			d := &stageZeroData{sequencer: sequencerFunc(func(ctx context.Context, entry sunlight.UnsequencedEntry) (sunlight.LogEntry, int, error) {
+				asked = true
+				if string(entry.Certificate) != "certificate" {
+					t.Errorf("sequencer got certificate %q", entry.Certificate)
+				}
+				if server.RequestIDFromContext(ctx) != "request" {
+					t.Errorf("request ID = %q, want it passed along", server.RequestIDFromContext(ctx))
+				}
+				if tt.code != http.StatusOK {
+					return sunlight.LogEntry{}, tt.code, fmt.Errorf("verdict %d", tt.code)
+				}
+				return entry.Sequence(7, 1700000000000), http.StatusOK, nil
+			})}
+
+			// Served the same way as the log, over cleartext
+			mux := http.NewServeMux()
+			mux.Handle("POST /itko.internal.v1.Sequencer/", d.sequenceHandler("token"))
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv, err := server.New(mux, server.Config{H2C: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.Serve(l)
+			t.Cleanup(func() { srv.Close() })
+
+			s, err := newRemoteSequencer("http://"+l.Addr().String(), tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.conn.Close() })
+
+			ctx := server.ContextWithRequestID(context.Background(), "request")
+			entry, code, err := s.sequence(ctx, sunlight.UnsequencedEntry{Certificate: []byte("certificate")})
+			if code != tt.want {
+				t.Fatalf("sequence = %d, %v, want %d", code, err, tt.want)
+			}
+			if asked != (tt.code != 0) {
+				t.Errorf("sequencer asked %v, want %v", asked, tt.code != 0)
+			}
+			if code == http.StatusOK && (err != nil || entry.LeafIndex != 7 || entry.Timestamp != 1700000000000) {
+				t.Errorf("sequence = %+v, %v, want leaf index 7", entry, err)
+			}
+		})
+	}
+}
+
+func TestNewRemoteSequencer(t *testing.T) {
+	for _, u := range []string{"http://sequencer.internal", "https://sequencer.internal:8443/", "http://[::1]:8080"} {
+		if _, err := newRemoteSequencer(u, "token"); err != nil {
+			t.Errorf("newRemoteSequencer(%q) = %v", u, err)
+		}
+	}
+	if _, err := newRemoteSequencer("sequencer.internal:8080", "token"); err == nil {
+		t.Error("newRemoteSequencer succeeded without a scheme")
+	}
+}
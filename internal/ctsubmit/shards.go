@@ -0,0 +1,154 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+)
+
+// ShardRouter serves several temporal shards from one HTTP server.
+// Each shard is reachable under its own prefix, such as /ct2025/ct/v1/add-chain.
+// Submissions to the unprefixed /ct/v1/add-chain, /ct/v1/add-pre-chain, and /ct/v1/validate
+// endpoints are routed to whichever shard's temporal window contains the leaf's notAfter,
+// so CAs don't need to know about the shard boundaries.
+type ShardRouter struct {
+	mu     sync.RWMutex
+	mux    *http.ServeMux
+	shards []shard
+	// The largest body size limit of any shard
+	maxBodyBytes int64
+}
+
+type shard struct {
+	prefix        string
+	notAfterStart time.Time
+	notAfterLimit time.Time
+	handler       http.Handler
+	// The lifecycle state of the shard, or false while it is failing over
+	state func() (LifecycleState, bool)
+}
+
+func NewShardRouter() *ShardRouter {
+	return &ShardRouter{mux: http.NewServeMux()}
+}
+
+// Add mounts a started log under the given prefix. It is safe to call while serving.
+func (s *ShardRouter) Add(prefix string, l *Log, handler http.Handler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.shards {
+		if other.prefix == prefix {
+			return fmt.Errorf("a shard is already served at %s", prefix)
+		}
+	}
+
+	state := func() (LifecycleState, bool) { return l.lifecycle.State(), true }
+	if fh, ok := handler.(*failoverHandler); ok {
+		// The log is reloaded after a failover, so ask whichever instance is serving it
+		state = fh.lifecycleState
+	}
+	s.shards = append(s.shards, shard{
+		prefix:        prefix,
+		notAfterStart: l.stageZeroData.notAfterStart,
+		notAfterLimit: l.stageZeroData.notAfterLimit,
+		handler:       handler,
+		state:         state,
+	})
+	s.maxBodyBytes = max(s.maxBodyBytes, l.config.submitMaxBodyBytes())
+	s.mux.Handle(prefix+"/", http.StripPrefix(prefix, handler))
+	return nil
+}
+
+func (s *ShardRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && (r.URL.Path == "/ct/v1/add-chain" || r.URL.Path == "/ct/v1/add-pre-chain" || r.URL.Path == "/ct/v1/validate") {
+		s.routeByNotAfter(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == "/readyz" {
+		s.readyz(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// readyz reports the process as ready while any shard accepts submissions. Every temporal
+// shard is eventually frozen, so the others don't count against it.
+func (s *ShardRouter) readyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	shards := s.shards
+	s.mu.RUnlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	var reasons []string
+	for _, sh := range shards {
+		state, ok := sh.state()
+		switch {
+		case !ok:
+			reasons = append(reasons, fmt.Sprintf("%s is failing over", sh.prefix))
+		case state != StateUsable:
+			reasons = append(reasons, fmt.Sprintf("%s is %s", sh.prefix, state))
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, "ok")
+			return
+		}
+	}
+	http.Error(w, "no shard accepts submissions: "+strings.Join(reasons, ", "), http.StatusServiceUnavailable)
+}
+
+func (s *ShardRouter) routeByNotAfter(w http.ResponseWriter, r *http.Request) {
+	// The body has to be read to find the leaf, so it is buffered and handed on to the shard.
+	// Each shard enforces its own limit as well, so this only needs to stop unbounded bodies.
+	s.mu.RLock()
+	limit := s.maxBodyBytes
+	s.mu.RUnlock()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Chain [][]byte `json:"chain"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, fmt.Sprintf("unable to unmarshal request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Chain) == 0 {
+		http.Error(w, "chain is empty", http.StatusBadRequest)
+		return
+	}
+	leaf, err := x509.ParseCertificate(req.Chain[0])
+	if x509.IsFatal(err) {
+		http.Error(w, fmt.Sprintf("unable to parse leaf certificate: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	var handler http.Handler
+	for _, sh := range s.shards {
+		if !leaf.NotAfter.Before(sh.notAfterStart) && leaf.NotAfter.Before(sh.notAfterLimit) {
+			handler = sh.handler
+			break
+		}
+	}
+	s.mu.RUnlock()
+
+	if handler == nil {
+		http.Error(w, fmt.Sprintf("no shard accepts certificates expiring at %s", leaf.NotAfter.Format(time.RFC3339)), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	handler.ServeHTTP(w, r)
+}
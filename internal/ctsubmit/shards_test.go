@@ -0,0 +1,35 @@
+package ctsubmit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShardRouterReadyz(t *testing.T) {
+	usable := func() (LifecycleState, bool) { return StateUsable, true }
+	retired := func() (LifecycleState, bool) { return StateRetired, true }
+	failingOver := func() (LifecycleState, bool) { return "", false }
+
+	tests := []struct {
+		name   string
+		states []func() (LifecycleState, bool)
+		want   int
+	}{
+		{"all usable", []func() (LifecycleState, bool){usable, usable}, http.StatusOK},
+		{"earlier shard retired", []func() (LifecycleState, bool){retired, usable}, http.StatusOK},
+		{"other shard failing over", []func() (LifecycleState, bool){failingOver, usable}, http.StatusOK},
+		{"all frozen", []func() (LifecycleState, bool){retired, failingOver}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		s := NewShardRouter()
+		for _, state := range tt.states {
+			s.shards = append(s.shards, shard{prefix: "/ct", state: state})
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: readyz = %d %q, want %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+}
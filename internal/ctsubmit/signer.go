@@ -0,0 +1,216 @@
+package ctsubmit
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"itko.dev/internal/sunlight"
+)
+
+type SignerConfig struct {
+	// Where the log's key is kept. Empty or "file" for the PEM file at keyPath, "gcp-kms"
+	// for Google Cloud KMS, "azure-key-vault" for Azure Key Vault, or "pkcs11" for an HSM.
+	// Keys in a KMS or HSM must be P-256 ECDSA keys.
+	Type string `json:"type"`
+
+	// The key version to sign with in Cloud KMS, as
+	// projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>
+	GcpKeyVersion string `json:"gcpKeyVersion"`
+
+	// The key to sign with in Key Vault, including its version, as
+	// https://<vault>.vault.azure.net/keys/<name>/<version>
+	AzureKeyId string `json:"azureKeyId"`
+
+	// The PKCS#11 module of the HSM, such as /usr/lib/softhsm/libsofthsm2.so, the ID of the
+	// slot holding the token, and the label of the key pair to sign with.
+	Pkcs11Module   string `json:"pkcs11Module"`
+	Pkcs11Slot     uint   `json:"pkcs11Slot"`
+	Pkcs11KeyLabel string `json:"pkcs11KeyLabel"`
+	// File holding the user PIN of the token, unless it is set in ITKO_PKCS11_PIN
+	Pkcs11PinFile string `json:"pkcs11PinFile"`
+	// Sessions opened with the token, which bounds how many signatures are made at once
+	Pkcs11Sessions int `json:"pkcs11Sessions"`
+}
+
+const (
+	SignerFile          = "file"
+	SignerGcpKms        = "gcp-kms"
+	SignerAzureKeyVault = "azure-key-vault"
+	SignerPkcs11        = "pkcs11"
+)
+
+// Remote signers are called with this timeout, as crypto.Signer takes no context
+const remoteSignerTimeout = 10 * time.Second
+
+// LoadSigner returns the log's signer, as configured by the signer section, and checks
+// that its public key matches the configured log ID.
+func LoadSigner(gc GlobalConfig) (*sunlight.Signer, error) {
+	signer, err := NewSigner(gc)
+	if err != nil {
+		return nil, err
+	}
+
+	logID, err := LogIDForKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	// sanity check to make sure wrong private key is not accidentally used
+	if logID != gc.LogID {
+		return nil, fmt.Errorf("log ID does not match: %s != %s", logID, gc.LogID)
+	}
+	return signer, nil
+}
+
+// NewSigner returns the log's signer, as configured by the signer section.
+func NewSigner(gc GlobalConfig) (*sunlight.Signer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteSignerTimeout)
+	defer cancel()
+
+	var signer crypto.Signer
+	var err error
+	switch gc.Signer.Type {
+	case "", SignerFile:
+		signer, err = ReadSigningKey(gc.KeyPath, gc.KeyPassphraseFile)
+	case SignerGcpKms:
+		signer, err = newGcpKmsSigner(ctx, gc.Signer.GcpKeyVersion)
+	case SignerAzureKeyVault:
+		signer, err = newAzureKeyVaultSigner(ctx, gc.Signer.AzureKeyId)
+	case SignerPkcs11:
+		signer, err = newPkcs11Signer(gc.Signer)
+	default:
+		return nil, fmt.Errorf("unknown signer type %q", gc.Signer.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if gc.Signer.Type != "" && gc.Signer.Type != SignerFile {
+		// Local keys are not wrapped, so that they are still signed with deterministically
+		signer = newTimedSigner(signer, gc.Name, gc.Signer.Type)
+	}
+	s, err := sunlight.NewSigner(signer)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported log key: %w", err)
+	}
+	return s, nil
+}
+
+// timedSigner records the latency and failures of a remote signer. Every SCT is signed
+// as it is issued, so this bounds the submission rate the log can sustain.
+type timedSigner struct {
+	crypto.Signer
+	attrs   metric.MeasurementOption
+	seconds prometheus.Observer
+	errors  prometheus.Counter
+}
+
+func newTimedSigner(signer crypto.Signer, name, typ string) *timedSigner {
+	return &timedSigner{
+		Signer:  signer,
+		attrs:   metric.WithAttributes(attribute.String("log", name), attribute.String("signer", typ)),
+		seconds: signingSeconds.WithLabelValues(name, typ),
+		errors:  signingErrorsTotal.WithLabelValues(name, typ),
+	}
+}
+
+func (s *timedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	start := time.Now()
+	sig, err := s.Signer.Sign(rand, digest, opts)
+	elapsed := time.Since(start).Seconds()
+	s.seconds.Observe(elapsed)
+	otelSigningSeconds.Record(context.Background(), elapsed, s.attrs)
+	if err != nil {
+		s.errors.Inc()
+	}
+	return sig, err
+}
+
+// LogIDForKey returns the base64 log ID of a public key, the SHA-256 of its DER encoding.
+func LogIDForKey(pub crypto.PublicKey) (string, error) {
+	pkix, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal public key: %w", err)
+	}
+	logSha := sha256.Sum256(pkix)
+	return base64.StdEncoding.EncodeToString(logSha[:]), nil
+}
+
+// rawSignature converts a P-256 signature of r and s concatenated, as returned by some
+// signing services, to the ASN.1 encoding expected from a crypto.Signer.
+func rawSignature(raw []byte) ([]byte, error) {
+	if len(raw) != 64 {
+		return nil, fmt.Errorf("malformed signature of %d bytes", len(raw))
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(raw[:32]), new(big.Int).SetBytes(raw[32:])})
+}
+
+// tokenSource caches an OAuth access token for a cloud API until shortly before it expires.
+type tokenSource struct {
+	fetch func(ctx context.Context) (oauthToken, error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	// Azure's instance metadata service returns this as a string
+	ExpiresIn json.RawMessage `json:"expires_in"`
+}
+
+func (t *tokenSource) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+
+	token, err := t.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to get access token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("unable to get access token: empty response")
+	}
+	expiresIn, err := strconv.Atoi(strings.Trim(string(token.ExpiresIn), `"`))
+	if err != nil {
+		expiresIn = 300
+	}
+	t.token = token.AccessToken
+	t.expiry = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return t.token, nil
+}
+
+// doJSON makes a request and decodes the JSON response into out.
+func doJSON(client *http.Client, req *http.Request, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
@@ -14,7 +14,11 @@ import (
 	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	// s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"itko.dev/internal/sunlight"
 )
 
 type Storage interface {
@@ -28,30 +32,62 @@ type Storage interface {
 type S3Storage struct {
 	client *s3.Client
 	bucket string
+	opts   S3Options
 }
 
-func NewS3Storage(region, bucket, endpoint, username, password string) S3Storage {
+// S3Options are the settings that S3-compatible providers differ on.
+type S3Options struct {
+	// path or virtual. Anything other than virtual is path style.
+	AddressingStyle   string
+	ChecksumAlgorithm string
+	ValidateChecksums bool
+	UseAccelerate     bool
+}
+
+// S3Options returns the S3 options of the config.
+func (gc GlobalConfig) S3Options() S3Options {
+	return S3Options{
+		AddressingStyle:   gc.S3AddressingStyle,
+		ChecksumAlgorithm: gc.S3ChecksumAlgorithm,
+		ValidateChecksums: gc.S3ValidateChecksums,
+		UseAccelerate:     gc.S3UseAccelerate,
+	}
+}
+
+func NewS3Storage(region, bucket, endpoint, username, password string, opts S3Options) S3Storage {
+	return S3Storage{
+		client: NewS3Client(region, endpoint, username, password, opts),
+		bucket: bucket,
+		opts:   opts,
+	}
+}
+
+// NewS3Client returns the client S3Storage uses, for managing the bucket itself.
+func NewS3Client(region, endpoint, username, password string, opts S3Options) *s3.Client {
 	s3Config := aws.Config{
 		Credentials:  credentials.NewStaticCredentialsProvider(username, password, ""),
 		BaseEndpoint: aws.String(endpoint),
 		Region:       region,
 	}
 
-	client := s3.NewFromConfig(s3Config, func(o *s3.Options) {
-		o.UsePathStyle = true
-	})
+	otelaws.AppendMiddlewares(&s3Config.APIOptions)
 
-	return S3Storage{
-		client: client,
-		bucket: bucket,
-	}
+	return s3.NewFromConfig(s3Config, func(o *s3.Options) {
+		o.UsePathStyle = opts.AddressingStyle != "virtual"
+		o.UseAccelerate = opts.UseAccelerate
+	})
 }
 
 func (b *S3Storage) Get(ctx context.Context, key string) ([]byte, error) {
-	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(b.bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if b.opts.ValidateChecksums {
+		// Objects without a checksum are returned without being checked
+		input.ChecksumMode = s3types.ChecksumModeEnabled
+	}
+	output, err := b.client.GetObject(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -64,11 +100,25 @@ func (b *S3Storage) Get(ctx context.Context, key string) ([]byte, error) {
 }
 
 func (b *S3Storage) Set(ctx context.Context, key string, data []byte) error {
-	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket: aws.String(b.bucket),
 		Key:    aws.String(key),
 		Body:   bytes.NewReader(data),
-	})
+	}
+	// So the bucket can serve the monitoring prefix directly
+	if contentType, cacheControl := sunlight.ObjectHeaders(key); contentType != "" {
+		input.ContentType = aws.String(contentType)
+		input.CacheControl = aws.String(cacheControl)
+	}
+	// Returned as x-amz-meta-surrogate-key, for a CDN in front of the bucket to tag the
+	// object with
+	if surrogateKey := sunlight.SurrogateKey(key); surrogateKey != "" {
+		input.Metadata = map[string]string{"surrogate-key": surrogateKey}
+	}
+	if b.opts.ChecksumAlgorithm != "" {
+		input.ChecksumAlgorithm = s3types.ChecksumAlgorithm(b.opts.ChecksumAlgorithm)
+	}
+	_, err := b.client.PutObject(ctx, input)
 	return err
 }
 
@@ -99,22 +149,28 @@ func NewFsStorage(rootDirectory string) FsStorage {
 	}
 }
 
-func (f *FsStorage) Get(ctx context.Context, key string) ([]byte, error) {
+func (f *FsStorage) Get(ctx context.Context, key string) (data []byte, err error) {
+	_, span := tracer.Start(ctx, "fs.get", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
 	filePath := f.root + "/" + key
 
 	// try and read the file using os.Readfile
-	data, err := os.ReadFile(filePath)
+	data, err = os.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
-func (f *FsStorage) Set(ctx context.Context, key string, data []byte) error {
+func (f *FsStorage) Set(ctx context.Context, key string, data []byte) (err error) {
+	_, span := tracer.Start(ctx, "fs.set", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
 	filePath := f.root + "/" + key
 
 	// Attempt to write the file
-	err := os.WriteFile(filePath, data, 0644)
+	err = os.WriteFile(filePath, data, 0644)
 	if err == nil {
 		// No error, file written successfully
 		return nil
@@ -139,10 +195,13 @@ func (f *FsStorage) Set(ctx context.Context, key string, data []byte) error {
 	return err
 }
 
-func (f *FsStorage) Exists(ctx context.Context, key string) (bool, error) {
+func (f *FsStorage) Exists(ctx context.Context, key string) (exists bool, err error) {
+	_, span := tracer.Start(ctx, "fs.exists", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
 	filePath := f.root + "/" + key
 
-	_, err := os.Stat(filePath)
+	_, err = os.Stat(filePath)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return false, nil
@@ -0,0 +1,67 @@
+package ctsubmit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// ValidateResponse is the verdict returned by POST /ct/v1/validate.
+type ValidateResponse struct {
+	// Whether add-chain or add-pre-chain would accept the chain right now
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	// Which endpoint the chain has to be submitted to
+	IsPrecert bool `json:"isPrecert"`
+	// If the certificate has already been logged, the existing leaf index is returned
+	Duplicate bool    `json:"duplicate"`
+	LeafIndex *uint64 `json:"leafIndex,omitempty"`
+}
+
+// validate runs the same checks as add-chain and add-pre-chain, including the dedupe
+// lookup, without sequencing the entry or issuing a SCT. This lets CAs pre-flight
+// unusual chains without adding anything to the log.
+//
+// The request body is the same as add-chain, and either a certificate or precertificate
+// chain is accepted. Rejected chains still return a 200, with the reason in the body, but
+// a dedupe index that can't be read is a 503.
+func (d *stageZeroData) validate(w http.ResponseWriter, r *http.Request) {
+	var resp ValidateResponse
+
+	entry, code, err := d.validateChain(r.Body)
+	switch {
+	case err != nil && code >= 500:
+		slog.ErrorContext(r.Context(), "Unable to validate chain", "error", err)
+		http.Error(w, err.Error(), code)
+		return
+	case err != nil:
+		resp.Error = err.Error()
+	default:
+		resp.Valid = true
+		resp.IsPrecert = entry.IsPrecert
+
+		// Only a certificate that is missing from the index is new. If the index can't be
+		// read, whether it is a duplicate isn't known, so there is no verdict.
+		dedupeVal, err := d.bucket.GetDedupeEntry(r.Context(), [16]byte(entry.CertificateFp[:16]), d.indexLayout)
+		switch {
+		case err == nil:
+			resp.Duplicate = true
+			resp.LeafIndex = &dedupeVal.leafIndex
+		case !isNotFound(err):
+			slog.ErrorContext(r.Context(), "Unable to look up duplicate", "error", err)
+			http.Error(w, fmt.Sprintf("unable to look up duplicate: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		if state := d.lifecycle.State(); state != StateUsable {
+			resp.Valid = false
+			resp.Error = ErrLogNotUsable.Error() + ": log is " + string(state)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.WarnContext(r.Context(), "Error writing response", "error", err)
+	}
+}
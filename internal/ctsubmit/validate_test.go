@@ -0,0 +1,142 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509util"
+	"itko.dev/internal/sunlight"
+)
+
+// testChain returns a leaf certificate and the pool of the root that issued it.
+func testChain(t *testing.T) (leaf []byte, roots *x509util.PEMCertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, root, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509util.NewPEMCertPool()
+	if !roots.AppendCertsFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})) {
+		t.Fatal("unable to add root")
+	}
+	return leaf, roots
+}
+
+// brokenStorage is a Storage that can't be read.
+type brokenStorage struct{ *memStorage }
+
+func (brokenStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.New("connection reset")
+}
+
+func TestValidateDedupeLookup(t *testing.T) {
+	layout := sunlight.IndexLayout{Mask: 5}
+	leaf, roots := testChain(t)
+	fp := sha256.Sum256(leaf)
+	path := "int/dedupe/" + layout.Path(fp[:16])
+	record := DedupeUpload{hash: [16]byte(fp[:16]), leafIndex: 7, timestamp: 1700000000000}
+	other := DedupeUpload{hash: [16]byte{fp[0], fp[1], fp[2], 0xff}, leafIndex: 8}
+
+	tests := []struct {
+		name    string
+		objects map[string][]byte
+		broken  bool
+		code    int
+		// The leaf index of the duplicate, or -1 if it isn't one
+		duplicate int64
+	}{
+		{"new", nil, false, http.StatusOK, -1},
+		{"not in its file", map[string][]byte{path: append(sunlight.IndexHeader(DDURecordSize), other.ToBytes()...)}, false, http.StatusOK, -1},
+		{"duplicate", map[string][]byte{path: append(sunlight.IndexHeader(DDURecordSize), record.ToBytes()...)}, false, http.StatusOK, 7},
+		{"unreadable index", nil, true, http.StatusServiceUnavailable, -1},
+		{"corrupt index", map[string][]byte{path: []byte("corrupt")}, false, http.StatusServiceUnavailable, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemStorage()
+			for k, v := range tt.objects {
+				s.objects[k] = v
+			}
+			var storage Storage = s
+			if tt.broken {
+				storage = brokenStorage{s}
+			}
+			d := &stageZeroData{
+				settings:      new(atomic.Pointer[settings]),
+				notAfterLimit: time.Now().Add(48 * time.Hour),
+				bucket:        Bucket{S: storage},
+				indexLayout:   layout,
+				lifecycle:     newLifecycle(StateUsable),
+			}
+			d.settings.Store(&settings{roots: roots})
+
+			body, err := json.Marshal(map[string][][]byte{"chain": {leaf}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			d.validate(w, httptest.NewRequest(http.MethodPost, "/ct/v1/validate", bytes.NewReader(body)))
+			if w.Code != tt.code {
+				t.Fatalf("validate = %d %s, want %d", w.Code, w.Body, tt.code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp ValidateResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !resp.Valid {
+				t.Fatalf("chain is not valid: %s", resp.Error)
+			}
+			switch {
+			case tt.duplicate < 0 && (resp.Duplicate || resp.LeafIndex != nil):
+				t.Errorf("new certificate reported as a duplicate: %s", w.Body)
+			case tt.duplicate >= 0 && (!resp.Duplicate || resp.LeafIndex == nil || *resp.LeafIndex != uint64(tt.duplicate)):
+				t.Errorf("duplicate reported as %s, want leaf index %d", w.Body, tt.duplicate)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package ctsubmit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+	"itko.dev/internal/sunlight"
+)
+
+type WitnessConfig struct {
+	// URL prefix of the witness. Checkpoints are POSTed to <url>/add-checkpoint.
+	Url string `json:"url"`
+	// The witness's verifier key, as <name>+<key hash>+<base64 key>. If set, its
+	// cosignatures are checked before they are published.
+	VerifierKey string `json:"verifierKey"`
+}
+
+// After a checkpoint is published, it is sent to each witness over the c2sp.org/tlog-witness
+// protocol, and the checkpoint is published again with their cosignatures. This happens in
+// the background, so a slow or unreachable witness never delays SCTs. If a newer checkpoint
+// has been published by the time the cosignatures come back, they are dropped, and the
+// newer checkpoint is witnessed instead.
+
+const witnessTimeout = 10 * time.Second
+
+type witness struct {
+	config   WitnessConfig
+	verifier note.Verifier
+	// The size of the last checkpoint the witness cosigned, which the next consistency
+	// proof starts from. Starts at zero, and is corrected by the witness if it knows better.
+	size int64
+}
+
+type witnessRequest struct {
+	tree       tlog.Tree
+	checkpoint []byte
+}
+
+type witnesser struct {
+	witnesses []*witness
+	bucket    Bucket
+	fence     func(context.Context) error
+	client    *http.Client
+	// Only the latest checkpoint is worth witnessing
+	pending chan witnessRequest
+
+	// Held while a checkpoint is uploaded, so a cosigned checkpoint never replaces a newer one
+	mu     sync.Mutex
+	latest []byte
+}
+
+func newWitnesser(gc GlobalConfig, bucket Bucket, fence func(context.Context) error) (*witnesser, error) {
+	if len(gc.Witnesses) == 0 {
+		return nil, nil
+	}
+	w := &witnesser{
+		bucket:  bucket,
+		fence:   fence,
+		client:  &http.Client{Timeout: witnessTimeout},
+		pending: make(chan witnessRequest, 1),
+	}
+	for _, c := range gc.Witnesses {
+		wit := &witness{config: c}
+		if c.VerifierKey != "" {
+			v, err := parseCosignatureVerifierKey(c.VerifierKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid verifier key for witness %s: %w", c.Url, err)
+			}
+			wit.verifier = v
+		}
+		w.witnesses = append(w.witnesses, wit)
+	}
+	return w, nil
+}
+
+// parseCosignatureVerifierKey parses a vkey for a tlog-cosignature/v1 Ed25519 key.
+func parseCosignatureVerifierKey(vkey string) (note.Verifier, error) {
+	name, rest, ok := strings.Cut(vkey, "+")
+	if !ok {
+		return nil, fmt.Errorf("malformed verifier key")
+	}
+	hashStr, keyStr, ok := strings.Cut(rest, "+")
+	if !ok {
+		return nil, fmt.Errorf("malformed verifier key")
+	}
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil || len(key) != 1+ed25519.PublicKeySize || key[0] != 0x04 {
+		return nil, fmt.Errorf("not a tlog-cosignature/v1 key")
+	}
+	v := sunlight.NewCosignatureVerifier(name, ed25519.PublicKey(key[1:]))
+	if hash, err := strconv.ParseUint(hashStr, 16, 32); err != nil || uint32(hash) != v.KeyHash() {
+		return nil, fmt.Errorf("key hash does not match key")
+	}
+	return v, nil
+}
+
+// setCheckpoint publishes a checkpoint and queues it to be witnessed. A nil witnesser only
+// publishes it.
+func (w *witnesser) setCheckpoint(ctx context.Context, bucket Bucket, tree tlog.Tree, checkpoint []byte) error {
+	if w == nil {
+		return bucket.SetCheckpoint(ctx, checkpoint)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := bucket.SetCheckpoint(ctx, checkpoint); err != nil {
+		return err
+	}
+	w.latest = checkpoint
+
+	// Replace whatever hasn't been picked up yet. Stage two is the only sender.
+	select {
+	case <-w.pending:
+	default:
+	}
+	w.pending <- witnessRequest{tree: tree, checkpoint: checkpoint}
+	return nil
+}
+
+func (w *witnesser) run(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-w.pending:
+			if err := w.witness(ctx, req); err != nil {
+				slog.WarnContext(ctx, "Unable to publish cosigned checkpoint", "tree_size", req.tree.N, "error", err)
+			}
+		}
+	}
+}
+
+// witness collects cosignatures from every witness and publishes them with the checkpoint,
+// unless it has been superseded.
+func (w *witnesser) witness(ctx context.Context, req witnessRequest) error {
+	reader := tlog.TileHashReader(req.tree, &sunlight.TileReader{
+		Fetch: func(key string) ([]byte, error) {
+			return w.bucket.Get(ctx, key)
+		},
+		SaveTilesInt: func(tiles []tlog.Tile, data [][]byte) {},
+	})
+
+	var mu sync.Mutex
+	var sigs [][]byte
+	var wg sync.WaitGroup
+	for _, wit := range w.witnesses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cosigs, err := w.addCheckpoint(ctx, wit, req, reader)
+			if err != nil {
+				slog.WarnContext(ctx, "Witness did not cosign checkpoint", "witness", wit.config.Url, "tree_size", req.tree.N, "error", err)
+				return
+			}
+			mu.Lock()
+			sigs = append(sigs, cosigs...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(sigs) == 0 {
+		return nil
+	}
+
+	cosigned, err := sunlight.AddCosignatures(req.checkpoint, sigs)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !bytes.Equal(w.latest, req.checkpoint) {
+		return nil
+	}
+	if err := w.fence(ctx); err != nil {
+		return err
+	}
+	if err := w.bucket.SetCheckpoint(ctx, cosigned); err != nil {
+		return err
+	}
+	w.latest = cosigned
+	return nil
+}
+
+// addCheckpoint sends the checkpoint to a witness, with a consistency proof from the last
+// checkpoint it cosigned, and returns its signature lines. If the witness has seen a
+// different size, it says so, and the request is made again from that size.
+func (w *witnesser) addCheckpoint(ctx context.Context, wit *witness, req witnessRequest, reader tlog.HashReader) ([][]byte, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if wit.size > req.tree.N {
+			return nil, fmt.Errorf("witness has seen size %d, which is larger than %d", wit.size, req.tree.N)
+		}
+
+		var body bytes.Buffer
+		fmt.Fprintf(&body, "old %d\n", wit.size)
+		if wit.size > 0 && wit.size < req.tree.N {
+			proof, err := tlog.ProveTree(req.tree.N, wit.size, reader)
+			if err != nil {
+				return nil, fmt.Errorf("unable to prove consistency from %d: %w", wit.size, err)
+			}
+			for _, h := range proof {
+				fmt.Fprintf(&body, "%s\n", base64.StdEncoding.EncodeToString(h[:]))
+			}
+		}
+		body.WriteString("\n")
+		body.Write(req.checkpoint)
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(wit.config.Url, "/")+"/add-checkpoint", &body)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := w.client.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusConflict:
+			// The body is the size of the latest checkpoint the witness has for the log
+			size, err := strconv.ParseInt(strings.TrimSpace(string(respBody)), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("witness returned a conflict without a size: %q", respBody)
+			}
+			wit.size = size
+			continue
+		default:
+			return nil, fmt.Errorf("witness returned %s: %s", resp.Status, bytes.TrimSpace(respBody))
+		}
+
+		var sigs [][]byte
+		for _, line := range bytes.SplitAfter(respBody, []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			sigs = append(sigs, line)
+		}
+		if wit.verifier != nil {
+			cosigned, err := sunlight.AddCosignatures(req.checkpoint, sigs)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := note.Open(cosigned, note.VerifierList(wit.verifier)); err != nil {
+				return nil, fmt.Errorf("cosignature does not verify: %w", err)
+			}
+		}
+		wit.size = req.tree.N
+		return sigs, nil
+	}
+	return nil, fmt.Errorf("witness still disagrees about its size")
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package server
+
+import "syscall"
+
+// SO_REUSEPORT isn't available, so the old process has to exit before the new one can listen.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
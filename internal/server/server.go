@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+)
+
+// Config holds the HTTP server limits shared by itko-submit and itko-monitor.
+// Any value left at zero uses the default below.
+type Config struct {
+	// How long a client has to send the request headers. This is what stops slow-loris.
+	ReadHeaderTimeoutMs int `json:"readHeaderTimeoutMs"`
+	// How long a client has to send the whole request, including the body.
+	ReadTimeoutMs int `json:"readTimeoutMs"`
+	// How long the handler has to write the response. Must be longer than the
+	// longest get-entries response takes to download on a slow connection.
+	WriteTimeoutMs int `json:"writeTimeoutMs"`
+	// How long an idle keep-alive connection is kept open.
+	IdleTimeoutMs int `json:"idleTimeoutMs"`
+	// The maximum number of simultaneous connections. Zero means no limit.
+	MaxConnections int `json:"maxConnections"`
+	// How long in-flight requests are given to finish after a SIGTERM.
+	DrainTimeoutMs int `json:"drainTimeoutMs"`
+
+	// Serve cleartext HTTP/2 as well, for a sequencer that front-ends reach over gRPC
+	// without TLS in front of it. Not read from the config, but set by the server that
+	// needs it.
+	H2C bool `json:"-"`
+}
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+func duration(ms int, def time.Duration) time.Duration {
+	if ms <= 0 {
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// New creates a server for handler with the limits from c.
+func New(handler http.Handler, c Config) (*http.Server, error) {
+	srv := &http.Server{
+		Handler:           WithRequestID(handler),
+		ReadHeaderTimeout: duration(c.ReadHeaderTimeoutMs, defaultReadHeaderTimeout),
+		ReadTimeout:       duration(c.ReadTimeoutMs, defaultReadTimeout),
+		WriteTimeout:      duration(c.WriteTimeoutMs, defaultWriteTimeout),
+		IdleTimeout:       duration(c.IdleTimeoutMs, defaultIdleTimeout),
+	}
+	if c.H2C {
+		// Configuring the HTTP/2 server on srv as well means Shutdown drains the
+		// cleartext HTTP/2 connections too
+		h2s := &http2.Server{}
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			return nil, fmt.Errorf("unable to configure HTTP/2: %w", err)
+		}
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	}
+	return srv, nil
+}
+
+// LimitListener applies the connection limit from c to l.
+func LimitListener(l net.Listener, c Config) net.Listener {
+	if c.MaxConnections > 0 {
+		return netutil.LimitListener(l, c.MaxConnections)
+	}
+	return l
+}
+
+// --------------------------------------------------------------------------------------------
+
+// Deploys work by starting the new process next to the old one. Both bind the same port
+// with SO_REUSEPORT, and the new process waits on the Consul lock as a hot standby.
+// When the old process gets a SIGTERM, it stops accepting connections, lets in-flight
+// submissions finish and get their SCTs, and then releases the lock instead of waiting
+// for the session to expire. The new process picks up the lock and starts serving the
+// connections that were queued on its listener in the meantime.
+
+// How long in-flight requests are given to finish by default. An add-chain request never
+// waits on the sequencer for more than 5 seconds.
+const defaultDrainTimeout = 10 * time.Second
+
+// Listen binds address with SO_REUSEPORT where it is supported, so a new process can
+// start listening before the old one has exited. An address of unix:<path> listens on a
+// Unix socket instead, and systemd or systemd:<name> uses a socket passed in by systemd.
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return listenUnix(path)
+	}
+	if address == "systemd" || strings.HasPrefix(address, "systemd:") {
+		return listenSystemd(strings.TrimPrefix(strings.TrimPrefix(address, "systemd"), ":"))
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// listenUnix replaces any socket left at path. A process that is still listening on it
+// keeps its connections, but new ones go to this process, which makes for the same
+// handover as SO_REUSEPORT.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed by whoever replaces it, not when this process exits
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	return l, nil
+}
+
+// Serve serves handler on listener until the process receives a SIGINT or SIGTERM.
+// It then drains in-flight requests, and calls stop before returning.
+func Serve(listener net.Listener, handler http.Handler, c Config, stop func()) error {
+	srv, err := New(handler, c)
+	if err != nil {
+		return err
+	}
+	listener = LimitListener(listener, c)
+
+	sigCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-sigCtx.Done()
+		slog.Info("Shutting down, draining in-flight requests")
+
+		ctx, cancel := context.WithTimeout(context.Background(), duration(c.DrainTimeoutMs, defaultDrainTimeout))
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("Unable to drain all requests", "error", err)
+		}
+	}()
+
+	err = srv.Serve(listener)
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-drained
+
+	if stop != nil {
+		stop()
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With socket activation, systemd binds the listeners and passes them to the process
+// as file descriptors, starting at 3. Connections queue on the socket while the service
+// restarts, so none are refused, without running two processes at once.
+// See sd_listen_fds(3).
+
+const listenFdsStart = 3
+
+var systemdListeners = sync.OnceValues(func() ([]*os.File, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets were passed in by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("no sockets were passed in by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*os.File, n)
+	for i := range files {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(listenFdsStart+i), name)
+	}
+	return files, nil
+})
+
+// listenSystemd returns the socket named name with FileDescriptorName= in the socket
+// unit, or the first socket if name is empty.
+func listenSystemd(name string) (net.Listener, error) {
+	files, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if name == "" || f.Name() == name {
+			l, err := net.FileListener(f)
+			if err != nil {
+				return nil, fmt.Errorf("socket %s from systemd: %w", f.Name(), err)
+			}
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no socket named %s was passed in by systemd", name)
+}
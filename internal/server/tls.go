@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLS lets itko-submit and itko-monitor terminate TLS themselves, for deployments that
+// don't need a separate terminator. The certificate is either read from files, which are
+// reloaded on a SIGHUP or when they change, or obtained from an ACME CA such as Let's
+// Encrypt with the tls-alpn-01 challenge, which is answered on the same listener.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+
+	// Hostnames to obtain certificates for over ACME, if CertFile isn't set
+	ACMEHosts []string
+	// Where ACME accounts and certificates are kept, so they survive a restart
+	ACMECacheDir string
+	ACMEEmail    string
+	// Defaults to Let's Encrypt
+	ACMEDirectoryURL string
+}
+
+// How often the certificate files are checked for changes
+const certPollInterval = 30 * time.Second
+
+// RegisterFlags adds the -tls and -acme flags, which set t, to fs.
+func (t *TLS) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&t.CertFile, "tls-cert-file", "", "PEM certificate chain to serve TLS with. Reloaded on a SIGHUP or when it changes.")
+	fs.StringVar(&t.KeyFile, "tls-key-file", "", "PEM key of -tls-cert-file.")
+	fs.Func("acme-hosts", "Comma separated list of hostnames to obtain certificates for from an ACME CA, instead of -tls-cert-file.", func(hosts string) error {
+		t.ACMEHosts = strings.Split(hosts, ",")
+		return nil
+	})
+	fs.StringVar(&t.ACMECacheDir, "acme-cache-dir", "", "Directory the ACME account and certificates are kept in. Must be set with -acme-hosts.")
+	fs.StringVar(&t.ACMEEmail, "acme-email", "", "Contact email of the ACME account.")
+	fs.StringVar(&t.ACMEDirectoryURL, "acme-directory-url", "", "Directory URL of the ACME CA. Defaults to Let's Encrypt.")
+}
+
+// Enabled reports whether TLS is configured.
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || len(t.ACMEHosts) > 0
+}
+
+// Listener wraps l to serve TLS, if it is enabled.
+func (t TLS) Listener(l net.Listener) (net.Listener, error) {
+	if !t.Enabled() {
+		return l, nil
+	}
+
+	var config *tls.Config
+	switch {
+	case t.CertFile != "" && len(t.ACMEHosts) > 0:
+		return nil, errors.New("only one of -tls-cert-file and -acme-hosts can be set")
+	case t.CertFile != "":
+		reloader, err := newCertReloader(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		go reloader.watch()
+		config = &tls.Config{GetCertificate: reloader.getCertificate}
+	default:
+		if t.ACMECacheDir == "" {
+			return nil, errors.New("-acme-cache-dir must be set with -acme-hosts")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(t.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(t.ACMEHosts...),
+			Email:      t.ACMEEmail,
+		}
+		if t.ACMEDirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: t.ACMEDirectoryURL}
+		}
+		config = m.TLSConfig()
+	}
+
+	config.MinVersion = tls.VersionTLS12
+	// HTTP/2 is only negotiated if it is offered
+	config.NextProtos = append([]string{"h2", "http/1.1"}, config.NextProtos...)
+	return tls.NewListener(l, config), nil
+}
+
+// certReloader serves the certificate in certFile, and reloads it when it changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("unable to read TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modified = info.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate on a SIGHUP, or once the file's modification time
+// changes. If it can't be loaded, the previous one is kept.
+func (r *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(r.certFile)
+			r.mu.RLock()
+			unchanged := err == nil && info.ModTime().Equal(r.modified)
+			r.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+
+		if err := r.reload(); err != nil {
+			slog.Error("Unable to reload TLS certificate, keeping the current one", "error", err)
+			continue
+		}
+		slog.Info("Reloaded TLS certificate", "file", r.certFile)
+	}
+}
@@ -17,11 +17,13 @@ package sunlight
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -36,8 +38,8 @@ import (
 )
 
 // signTreeHead signs the tree and returns a checkpoint according to
-// c2sp.org/checkpoint.
-func SignTreeHeadCheckpoint(origin string, privKey *ecdsa.PrivateKey, treeSize, timestamp int64, sha256RootHash [32]byte) (checkpoint []byte, err error) {
+// c2sp.org/checkpoint. Any cosigners add their signatures after the log's.
+func SignTreeHeadCheckpoint(origin string, privKey *Signer, treeSize, timestamp int64, sha256RootHash [32]byte, cosigners ...note.Signer) (checkpoint []byte, err error) {
 	sthBytes, err := ct.SerializeSTHSignatureInput(ct.SignedTreeHead{
 		Version:        ct.V1,
 		TreeSize:       uint64(treeSize),
@@ -78,13 +80,90 @@ func SignTreeHeadCheckpoint(origin string, privKey *ecdsa.PrivateKey, treeSize,
 			Origin: origin,
 			Tree:   tlog.Tree{N: treeSize, Hash: sha256RootHash},
 		}),
-	}, signer)
+	}, append([]note.Signer{signer}, cosigners...)...)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't sign note: %w", err)
 	}
 	return signedNote, nil
 }
 
+// CheckpointFromSTH returns the checkpoint of a RFC 6962 STH, signed by the log with the
+// public key pub. The checkpoint signature is the STH's signature with its timestamp, so
+// a mirror of the log, which doesn't have its key, can publish the same checkpoint. It
+// is an error if the STH's signature doesn't verify.
+func CheckpointFromSTH(origin string, pub crypto.PublicKey, sth *ct.GetSTHResponse) ([]byte, error) {
+	if len(sth.SHA256RootHash) != tlog.HashSize {
+		return nil, fmt.Errorf("invalid root hash length %d", len(sth.SHA256RootHash))
+	}
+	var b cryptobyte.Builder
+	b.AddUint64(sth.Timestamp)
+	b.AddBytes(sth.TreeHeadSignature)
+	sig, err := b.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode RFC6962NoteSignature: %w", err)
+	}
+
+	v, err := NewRFC6962Verifier(origin, pub, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't construct verifier: %w", err)
+	}
+	signedNote, err := note.Sign(&note.Note{
+		Text: FormatCheckpoint(Checkpoint{
+			Origin: origin,
+			Tree:   tlog.Tree{N: int64(sth.TreeSize), Hash: tlog.Hash(sth.SHA256RootHash)},
+		}),
+	}, &injectedSigner{v, sig})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign note: %w", err)
+	}
+	if _, err := note.Open(signedNote, note.VerifierList(v)); err != nil {
+		return nil, fmt.Errorf("STH signature doesn't verify: %w", err)
+	}
+	return signedNote, nil
+}
+
+// STHFromCheckpoint is the reverse of CheckpointFromSTH. It returns the RFC 6962 STH of a
+// checkpoint with a RFC6962NoteSignature from the log with the public key pub, marshalled
+// as a get-sth response, along with the checkpoint. It is an error if the checkpoint has
+// no such signature that verifies.
+func STHFromCheckpoint(checkpoint []byte, pub crypto.PublicKey) ([]byte, Checkpoint, error) {
+	origin, _, _ := strings.Cut(string(checkpoint), "\n")
+	v, err := NewRFC6962Verifier(origin, pub, nil)
+	if err != nil {
+		return nil, Checkpoint{}, fmt.Errorf("couldn't construct verifier: %w", err)
+	}
+	n, err := note.Open(checkpoint, note.VerifierList(v))
+	if err != nil {
+		return nil, Checkpoint{}, fmt.Errorf("checkpoint signature doesn't verify: %w", err)
+	}
+	c, err := ParseCheckpoint(n.Text)
+	if err != nil {
+		return nil, Checkpoint{}, err
+	}
+	for _, s := range n.Sigs {
+		if s.Hash != v.KeyHash() || s.Name != v.Name() {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Base64)
+		if err != nil {
+			return nil, Checkpoint{}, fmt.Errorf("couldn't decode signature: %w", err)
+		}
+		// The key hash of the verified signature is in the first four bytes
+		sig = sig[4:]
+		sth, err := json.Marshal(ct.GetSTHResponse{
+			TreeSize:          uint64(c.N),
+			Timestamp:         binary.BigEndian.Uint64(sig[:8]),
+			SHA256RootHash:    c.Hash[:],
+			TreeHeadSignature: sig[8:],
+		})
+		if err != nil {
+			return nil, Checkpoint{}, err
+		}
+		return sth, c, nil
+	}
+	return nil, Checkpoint{}, errors.New("checkpoint has no RFC 6962 signature")
+}
+
 type injectedSigner struct {
 	v   note.Verifier
 	sig []byte
@@ -192,7 +271,7 @@ func NewRFC6962Verifier(name string, key crypto.PublicKey, tf func(uint64)) (not
 		var signature []byte
 		s := cryptobyte.String(sig)
 		if !s.ReadUint64(&timestamp) ||
-			!s.ReadUint8(&hashAlg) || hashAlg != 4 || !s.ReadUint8(&sigAlg) ||
+			!s.ReadUint8(&hashAlg) || !s.ReadUint8(&sigAlg) ||
 			!s.ReadUint16LengthPrefixed((*cryptobyte.String)(&signature)) ||
 			!s.Empty() {
 			return false
@@ -215,18 +294,24 @@ func NewRFC6962Verifier(name string, key crypto.PublicKey, tf func(uint64)) (not
 			return false
 		}
 
+		alg := SignatureAlgorithm{Hash: hashAlg, Signature: sigAlg}
 		digest := sha256.Sum256(sthBytes)
 		switch key := key.(type) {
 		case *rsa.PublicKey:
-			if sigAlg != 1 {
+			if alg != RSAWithSHA256 {
 				return false
 			}
-			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
 		case *ecdsa.PublicKey:
-			if sigAlg != 3 {
+			if alg != ECDSAWithSHA256 {
 				return false
 			}
 			return ecdsa.VerifyASN1(key, digest[:], signature)
+		case ed25519.PublicKey:
+			if alg != Ed25519 {
+				return false
+			}
+			return ed25519.Verify(key, sthBytes, signature)
 		default:
 			return false
 		}
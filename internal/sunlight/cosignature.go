@@ -0,0 +1,120 @@
+package sunlight
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+// Cosignatures as defined by c2sp.org/tlog-cosignature. A cosigner, such as a witness,
+// signs the checkpoint along with the time it saw it, and its signature is added to the
+// checkpoint as another signature line.
+
+const algCosignatureV1 = 0x04
+
+// CosignatureKeyHash is the key hash of a tlog-cosignature/v1 key.
+func CosignatureKeyHash(name string, key ed25519.PublicKey) uint32 {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte("\n"))
+	h.Write([]byte{algCosignatureV1})
+	h.Write(key)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// CosignatureVerifierKey returns the vkey of a tlog-cosignature/v1 key, which is how
+// witnesses and monitors are told about a cosigner.
+func CosignatureVerifierKey(name string, key ed25519.PublicKey) string {
+	return fmt.Sprintf("%s+%08x+%s", name, CosignatureKeyHash(name, key),
+		base64.StdEncoding.EncodeToString(append([]byte{algCosignatureV1}, key...)))
+}
+
+// cosignedMessage is the message a cosigner signs for a checkpoint at a timestamp.
+func cosignedMessage(text []byte, timestamp uint64) []byte {
+	msg := []byte("cosignature/v1\ntime " + strconv.FormatUint(timestamp, 10) + "\n")
+	return append(msg, text...)
+}
+
+// Cosigner is a note.Signer producing tlog-cosignature/v1 signatures, which can be passed
+// to SignTreeHeadCheckpoint.
+type Cosigner struct {
+	name string
+	key  ed25519.PrivateKey
+	hash uint32
+}
+
+func NewCosigner(name string, key ed25519.PrivateKey) (*Cosigner, error) {
+	if !isValidName(name) {
+		return nil, fmt.Errorf("invalid cosigner name %q", name)
+	}
+	return &Cosigner{name: name, key: key, hash: CosignatureKeyHash(name, key.Public().(ed25519.PublicKey))}, nil
+}
+
+func (c *Cosigner) Name() string    { return c.name }
+func (c *Cosigner) KeyHash() uint32 { return c.hash }
+
+func (c *Cosigner) Sign(msg []byte) ([]byte, error) {
+	timestamp := uint64(time.Now().Unix())
+	sig := ed25519.Sign(c.key, cosignedMessage(msg, timestamp))
+	return append(binary.BigEndian.AppendUint64(nil, timestamp), sig...), nil
+}
+
+// Verifier returns a verifier for the cosigner's signatures.
+func (c *Cosigner) Verifier() note.Verifier {
+	return &CosignatureVerifier{name: c.name, key: c.key.Public().(ed25519.PublicKey), hash: c.hash}
+}
+
+// CosignatureVerifier verifies tlog-cosignature/v1 signatures.
+type CosignatureVerifier struct {
+	name string
+	key  ed25519.PublicKey
+	hash uint32
+}
+
+func NewCosignatureVerifier(name string, key ed25519.PublicKey) *CosignatureVerifier {
+	return &CosignatureVerifier{name: name, key: key, hash: CosignatureKeyHash(name, key)}
+}
+
+func (v *CosignatureVerifier) Name() string    { return v.name }
+func (v *CosignatureVerifier) KeyHash() uint32 { return v.hash }
+
+func (v *CosignatureVerifier) Verify(msg, sig []byte) bool {
+	if len(sig) != 8+ed25519.SignatureSize {
+		return false
+	}
+	timestamp := binary.BigEndian.Uint64(sig[:8])
+	return ed25519.Verify(v.key, cosignedMessage(msg, timestamp), sig[8:])
+}
+
+// AddCosignatures appends signature lines, such as those returned by a witness, to a
+// signed checkpoint. Lines already on the checkpoint are not added again.
+func AddCosignatures(checkpoint []byte, sigs [][]byte) ([]byte, error) {
+	if len(checkpoint) == 0 || checkpoint[len(checkpoint)-1] != '\n' {
+		return nil, errors.New("checkpoint must end with a newline")
+	}
+	existing := make(map[string]bool)
+	for _, line := range bytes.Split(checkpoint, []byte("\n")) {
+		existing[string(line)] = true
+	}
+
+	out := append([]byte(nil), checkpoint...)
+	for _, sig := range sigs {
+		if len(sig) < 4 || string(sig[:4]) != "— " || sig[len(sig)-1] != '\n' {
+			return nil, fmt.Errorf("malformed signature line %q", sig)
+		}
+		if existing[string(sig[:len(sig)-1])] {
+			continue
+		}
+		existing[string(sig[:len(sig)-1])] = true
+		out = append(out, sig...)
+	}
+	return out, nil
+}
@@ -0,0 +1,129 @@
+package sunlight
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestCosignature(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cosigner, err := NewCosigner("witness.example/w1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("example.com/log\n10\nAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n")
+	sig, err := cosigner.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier note.Verifier
+		msg      []byte
+		sig      []byte
+		want     bool
+	}{
+		{"own verifier", cosigner.Verifier(), msg, sig, true},
+		{"verifier from the public key", NewCosignatureVerifier("witness.example/w1", key.Public().(ed25519.PublicKey)), msg, sig, true},
+		{"other message", cosigner.Verifier(), append(bytes.Clone(msg), "extension\n"...), sig, false},
+		{"other key", NewCosignatureVerifier("witness.example/w1", otherKey.Public().(ed25519.PublicKey)), msg, sig, false},
+		{"without a timestamp", cosigner.Verifier(), msg, sig[8:], false},
+	}
+	for _, tt := range tests {
+		if got := tt.verifier.Verify(tt.msg, tt.sig); got != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if cosigner.KeyHash() != cosigner.Verifier().KeyHash() {
+		t.Error("the cosigner and its verifier have different key hashes")
+	}
+	vkey := CosignatureVerifierKey("witness.example/w1", key.Public().(ed25519.PublicKey))
+	if _, err := note.NewVerifier(vkey); err == nil {
+		// The note package only knows Ed25519 keys, so it must not take a cosignature key
+		// for one and verify its signatures the wrong way
+		t.Errorf("note.NewVerifier accepted the cosignature key %q", vkey)
+	}
+	if _, err := NewCosigner("has space", key); err == nil {
+		t.Error("NewCosigner accepted an invalid name")
+	}
+}
+
+func TestCosignedCheckpoint(t *testing.T) {
+	logKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(logKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cosigner, err := NewCosigner("witness.example/w1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const origin = "example.com/log"
+	checkpoint, err := SignTreeHeadCheckpoint(origin, signer, 10, 1700000000000, [32]byte{1}, cosigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logVerifier, err := NewRFC6962Verifier(origin, logKey.Public(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := note.Open(checkpoint, note.VerifierList(logVerifier, cosigner.Verifier()))
+	if err != nil {
+		t.Fatalf("checkpoint doesn't verify: %v", err)
+	}
+	if len(n.Sigs) != 2 {
+		t.Errorf("checkpoint has %d verified signatures, want the log's and the cosigner's", len(n.Sigs))
+	}
+
+	// A witness returns its cosignature as a signature line for the log to add
+	plain, err := SignTreeHeadCheckpoint(origin, signer, 10, 1700000000000, [32]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := checkpoint[len(plain):]
+	if !strings.HasPrefix(string(line), "— witness.example/w1 ") {
+		t.Fatalf("cosignature line = %q", line)
+	}
+	tests := []struct {
+		name       string
+		checkpoint []byte
+		sigs       [][]byte
+		// Nil if the signatures are rejected
+		want []byte
+	}{
+		{"added", plain, [][]byte{line}, checkpoint},
+		{"already there", checkpoint, [][]byte{line}, checkpoint},
+		{"no newline", plain, [][]byte{line[:len(line)-1]}, nil},
+		{"not a signature line", plain, [][]byte{[]byte("witness.example/w1 abc\n")}, nil},
+	}
+	for _, tt := range tests {
+		got, err := AddCosignatures(tt.checkpoint, tt.sigs)
+		if (err == nil) != (tt.want != nil) || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: AddCosignatures = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
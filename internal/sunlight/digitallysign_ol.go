@@ -17,6 +17,7 @@ package sunlight
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/sha256"
 
 	"golang.org/x/crypto/cryptobyte"
@@ -32,16 +33,27 @@ import (
 //
 // We use deterministic RFC 6979 ECDSA signatures so that when fetching a
 // previous SCT's timestamp and index from the deduplication cache, the new SCT
-// we produce is identical.
-func DigitallySign(k *ecdsa.PrivateKey, msg []byte) ([]byte, error) {
-	h := sha256.Sum256(msg)
-	sig, err := rfc6979.Sign(k, h[:], crypto.SHA256)
+// we produce is identical. Keys held in a KMS can't sign deterministically, so
+// with those the new SCT has a different, but equally valid, signature. Ed25519
+// signatures are always deterministic.
+func DigitallySign(k *Signer, msg []byte) ([]byte, error) {
+	var sig []byte
+	var err error
+	if k.Algorithm == Ed25519 {
+		sig, err = k.Sign(rand.Reader, msg, crypto.Hash(0))
+	} else if priv, ok := k.Signer.(*ecdsa.PrivateKey); ok {
+		h := sha256.Sum256(msg)
+		sig, err = rfc6979.Sign(priv, h[:], crypto.SHA256)
+	} else {
+		h := sha256.Sum256(msg)
+		sig, err = k.Sign(rand.Reader, h[:], crypto.SHA256)
+	}
 	if err != nil {
 		return nil, err
 	}
 	var b cryptobyte.Builder
-	b.AddUint8(4 /* hash = sha256 */)
-	b.AddUint8(3 /* signature = ecdsa */)
+	b.AddUint8(k.Algorithm.Hash)
+	b.AddUint8(k.Algorithm.Signature)
 	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes(sig)
 	})
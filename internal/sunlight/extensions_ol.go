@@ -24,6 +24,17 @@ import (
 // TimestampedEntry, according to c2sp.org/sunlight.
 type Extensions struct {
 	LeafIndex uint64
+
+	// Unknown holds any other extensions, in the order they were read, so that
+	// entries written by a newer version round-trip with the same leaf hash.
+	// They are written after leaf_index.
+	Unknown []UnknownExtension
+}
+
+// UnknownExtension is an extension other than leaf_index.
+type UnknownExtension struct {
+	Type uint8
+	Data []byte
 }
 
 func MarshalExtensions(e Extensions) ([]byte, error) {
@@ -50,12 +61,27 @@ func MarshalExtensions(e Extensions) ([]byte, error) {
 		}
 		addUint40(b, uint64(e.LeafIndex))
 	})
+	for _, u := range e.Unknown {
+		if u.Type == 0 {
+			return nil, errors.New("duplicate leaf_index extension")
+		}
+		b.AddUint8(u.Type)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(u.Data)
+		})
+	}
 	return b.Bytes()
 }
 
-// ParseExtensions parse a CTExtensions field, ignoring unknown extensions.
-// It is an error if the leaf_index extension is missing.
+// errMissingLeafIndex is returned by ParseExtensions for extensions without a
+// leaf_index, such as those of an entry mirrored from a RFC 6962 log.
+var errMissingLeafIndex = errors.New("missing leaf_index extension")
+
+// ParseExtensions parse a CTExtensions field, keeping unknown extensions in
+// Unknown. It is an error if the leaf_index extension is missing or repeated.
 func ParseExtensions(extensions []byte) (Extensions, error) {
+	var e Extensions
+	found := false
 	b := cryptobyte.String(extensions)
 	for !b.Empty() {
 		var extensionType uint8
@@ -64,14 +90,21 @@ func ParseExtensions(extensions []byte) (Extensions, error) {
 			return Extensions{}, errors.New("invalid extension")
 		}
 		if extensionType == 0 /* leaf_index */ {
-			var e Extensions
+			if found {
+				return Extensions{}, errors.New("duplicate leaf_index extension")
+			}
 			if !readUint40(&extension, &e.LeafIndex) || !extension.Empty() {
 				return Extensions{}, errors.New("invalid leaf_index extension")
 			}
-			return e, nil
+			found = true
+			continue
 		}
+		e.Unknown = append(e.Unknown, UnknownExtension{Type: extensionType, Data: extension})
+	}
+	if !found {
+		return Extensions{}, errMissingLeafIndex
 	}
-	return Extensions{}, errors.New("missing leaf_index extension")
+	return e, nil
 }
 
 // addUint40 appends a big-endian, 40-bit value to the byte string.
@@ -0,0 +1,112 @@
+package sunlight
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The hash to index and dedupe files are sorted lists of fixed size records, each
+// starting with a truncated hash. Since version 1, they start with an 8 byte header:
+// the magic "itko", the format version and the record size, both as little endian
+// uint16s. Files written before the header was added are just the records.
+
+const (
+	IndexVersion    = 1
+	IndexHeaderSize = 8
+)
+
+var indexMagic = []byte("itko")
+
+// IndexHeader returns the header for a file of records of the given size.
+func IndexHeader(recordSize int) []byte {
+	header := make([]byte, IndexHeaderSize)
+	copy(header, indexMagic)
+	binary.LittleEndian.PutUint16(header[4:], IndexVersion)
+	binary.LittleEndian.PutUint16(header[6:], uint16(recordSize))
+	return header
+}
+
+// IndexRecords strips the header from an index file, if it has one, and returns the records.
+func IndexRecords(file []byte, recordSize int) ([]byte, error) {
+	// The header size isn't a multiple of any record size, so a file without one
+	// can never be mistaken for one that has it.
+	if len(file)%recordSize == 0 {
+		return file, nil
+	}
+	if len(file) < IndexHeaderSize || !bytes.Equal(file[:4], indexMagic) {
+		return nil, fmt.Errorf("invalid index file of %d bytes", len(file))
+	}
+	if version := binary.LittleEndian.Uint16(file[4:]); version != IndexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	if size := binary.LittleEndian.Uint16(file[6:]); int(size) != recordSize {
+		return nil, fmt.Errorf("index record size is %d, expected %d", size, recordSize)
+	}
+	records := file[IndexHeaderSize:]
+	if len(records)%recordSize != 0 {
+		return nil, fmt.Errorf("truncated index file of %d bytes", len(file))
+	}
+	return records, nil
+}
+
+// SearchIndex binary searches the sorted records for hash, which is compared against
+// the start of each record. It returns the index of the first record that is not
+// less than hash, which is where hash would be inserted, and whether that record matches.
+func SearchIndex(records []byte, recordSize int, hash []byte) (int, bool) {
+	count := len(records) / recordSize
+	i := sort.Search(count, func(i int) bool {
+		return bytes.Compare(records[i*recordSize:i*recordSize+len(hash)], hash) >= 0
+	})
+	found := i < count && bytes.Equal(records[i*recordSize:i*recordSize+len(hash)], hash)
+	return i, found
+}
+
+// IndexLayout maps a hash to the k-anon file it is kept in, under int/hashes/ or
+// int/dedupe/. Version 0 is the original layout, the first Mask hex digits of the hash
+// split into directories of two, such as ab/cd/e. Version 1 starts with "v1/" and splits
+// the digits into directories of SegmentSize, so the fanout of each directory can be
+// chosen. The files aren't moved when the layout changes, so it is fixed for a log
+// unless the index is rebuilt.
+type IndexLayout struct {
+	Version     int
+	Mask        int
+	SegmentSize int
+}
+
+const DefaultIndexSegmentSize = 2
+
+// Validate checks that the layout is one this version can read and write.
+func (l IndexLayout) Validate() error {
+	if l.Mask < 1 || l.Mask > 32 {
+		return fmt.Errorf("mask size %d must be between 1 and 32", l.Mask)
+	}
+	switch l.Version {
+	case 0:
+		if l.SegmentSize != 0 && l.SegmentSize != DefaultIndexSegmentSize {
+			return fmt.Errorf("index layout version 0 always uses a segment size of %d", DefaultIndexSegmentSize)
+		}
+	case 1:
+		if l.SegmentSize < 0 || l.SegmentSize > l.Mask {
+			return fmt.Errorf("segment size %d must be between 1 and the mask size", l.SegmentSize)
+		}
+	default:
+		return fmt.Errorf("unsupported index layout version %d", l.Version)
+	}
+	return nil
+}
+
+// Path returns the path of the k-anon file for a hash, relative to the index directory.
+func (l IndexLayout) Path(h []byte) string {
+	if l.Version == 0 {
+		return KAnonHashPath(h, l.Mask)
+	}
+	size := l.SegmentSize
+	if size == 0 {
+		size = DefaultIndexSegmentSize
+	}
+	return "v" + strconv.Itoa(l.Version) + "/" + kAnonSegments(hex.EncodeToString(h)[:l.Mask], size)
+}
@@ -0,0 +1,105 @@
+package sunlight
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	const recordSize = 5
+	// Records of a 2 byte hash followed by 3 bytes of value
+	records := []byte{
+		0x10, 0x00, 1, 1, 1,
+		0x20, 0x00, 2, 2, 2,
+		0x20, 0x01, 3, 3, 3,
+		0xf0, 0xff, 4, 4, 4,
+	}
+
+	tests := []struct {
+		name    string
+		records []byte
+		hash    []byte
+		i       int
+		found   bool
+	}{
+		{"first", records, []byte{0x10, 0x00}, 0, true},
+		{"middle", records, []byte{0x20, 0x01}, 2, true},
+		{"last", records, []byte{0xf0, 0xff}, 3, true},
+		{"before the first", records, []byte{0x00, 0x01}, 0, false},
+		{"between", records, []byte{0x15, 0x00}, 1, false},
+		{"after the last", records, []byte{0xff, 0xff}, 4, false},
+		{"prefix of a record", records, []byte{0x20}, 1, true},
+		{"single record", records[:recordSize], []byte{0x10, 0x00}, 0, true},
+		{"empty file", nil, []byte{0x10, 0x00}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i, found := SearchIndex(tt.records, recordSize, tt.hash)
+			if i != tt.i || found != tt.found {
+				t.Errorf("SearchIndex = %d, %v, want %d, %v", i, found, tt.i, tt.found)
+			}
+		})
+	}
+}
+
+func TestIndexRecords(t *testing.T) {
+	record := bytes.Repeat([]byte{0xaa}, 21)
+	header := IndexHeader(21)
+	otherVersion := append([]byte("itko\x02"), header[5:]...)
+
+	tests := []struct {
+		name string
+		file []byte
+		// The number of records, or -1 if the file is rejected
+		want int
+	}{
+		{"header", slices.Concat(header, record, record), 2},
+		{"header only", header, 0},
+		{"no header", slices.Concat(record, record, record), 3},
+		{"empty file", nil, 0},
+		{"truncated", slices.Concat(header, record, record[:10]), -1},
+		{"other version", slices.Concat(otherVersion, record), -1},
+		{"other record size", slices.Concat(IndexHeader(20), record), -1},
+	}
+	for _, tt := range tests {
+		records, err := IndexRecords(tt.file, 21)
+		if (err == nil) != (tt.want >= 0) || (err == nil && !bytes.Equal(records, bytes.Repeat(record, tt.want))) {
+			t.Errorf("%s: IndexRecords = %d bytes, %v, want %d records", tt.name, len(records), err, tt.want)
+		}
+	}
+}
+
+func TestIndexLayoutPath(t *testing.T) {
+	hash := []byte{0xab, 0xcd, 0xef, 0x01}
+	tests := []struct {
+		layout IndexLayout
+		want   string
+	}{
+		{IndexLayout{Mask: 5}, "ab/cd/e"},
+		{IndexLayout{Mask: 4}, "ab/cd"},
+		{IndexLayout{Version: 1, Mask: 5}, "v1/ab/cd/e"},
+		{IndexLayout{Version: 1, Mask: 6, SegmentSize: 3}, "v1/abc/def"},
+		{IndexLayout{Version: 1, Mask: 3, SegmentSize: 1}, "v1/a/b/c"},
+	}
+	for _, tt := range tests {
+		if err := tt.layout.Validate(); err != nil {
+			t.Errorf("%+v: Validate = %v", tt.layout, err)
+		}
+		if got := tt.layout.Path(hash); got != tt.want {
+			t.Errorf("%+v: Path = %q, want %q", tt.layout, got, tt.want)
+		}
+	}
+
+	for _, l := range []IndexLayout{
+		{Mask: 0},
+		{Mask: 33},
+		{Mask: 5, SegmentSize: 3},
+		{Version: 1, Mask: 4, SegmentSize: 5},
+		{Version: 2, Mask: 5},
+	} {
+		if err := l.Validate(); err == nil {
+			t.Errorf("%+v: Validate succeeded", l)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package sunlight
 
 import (
-	"crypto/ecdsa"
 	"encoding/hex"
 	"encoding/json"
+	"strconv"
 	"strings"
 
 	ct "github.com/google/certificate-transparency-go"
@@ -25,7 +25,7 @@ func (p UnsequencedEntry) Sequence(leafIndex uint64, timestamp int64) LogEntry {
 }
 
 // SignTreeHead takes in the parameters to create a signed tree head and returns the JSON-encoded response.
-func SignTreeHead(k *ecdsa.PrivateKey, treeSize, timestamp uint64, sha256RootHash [32]byte) ([]byte, error) {
+func SignTreeHead(k *Signer, treeSize, timestamp uint64, sha256RootHash [32]byte) ([]byte, error) {
 	sthBytes, err := ct.SerializeSTHSignatureInput(ct.SignedTreeHead{
 		Version:        ct.V1,
 		TreeSize:       treeSize,
@@ -54,17 +54,20 @@ func SignTreeHead(k *ecdsa.PrivateKey, treeSize, timestamp uint64, sha256RootHas
 	return jsonBytes, err
 }
 
+// KAnonHashPath is the path of the k-anon file for a hash in layout version 0.
 func KAnonHashPath(h []byte, mask int) string {
-	hash := hex.EncodeToString(h[:])[0:mask]
+	return kAnonSegments(hex.EncodeToString(h[:])[0:mask], 2)
+}
 
-	// Split the hash into 2-character segments separated by slashes.
+// kAnonSegments splits the hex digits of a hash into segments separated by slashes.
+func kAnonSegments(hash string, size int) string {
 	var builder strings.Builder
 	n := len(hash)
-	for i := 0; i < n; i += 2 {
+	for i := 0; i < n; i += size {
 		if i > 0 {
 			builder.WriteString("/")
 		}
-		end := i + 2
+		end := i + size
 		if end > n {
 			end = n
 		}
@@ -72,3 +75,24 @@ func KAnonHashPath(h []byte, mask int) string {
 	}
 	return builder.String()
 }
+
+// STHIndexPageSize is the range of tree sizes covered by one page of the STH index.
+const STHIndexPageSize = 1 << 16
+
+// STHPath is where the STH for a tree size is archived. Only the first STH
+// issued for each tree size is kept.
+func STHPath(treeSize uint64) string {
+	return "sth/" + strconv.FormatUint(treeSize, 10)
+}
+
+// STHIndexPath is the page of the STH index listing the archived tree sizes
+// in [page*STHIndexPageSize, (page+1)*STHIndexPageSize), as a JSON array.
+func STHIndexPath(page uint64) string {
+	return "sth/index/" + strconv.FormatUint(page, 10)
+}
+
+// IsValidOrigin reports whether a checkpoint origin can be used as a note key name,
+// which the checkpoint is signed under.
+func IsValidOrigin(origin string) bool {
+	return isValidName(origin)
+}
@@ -0,0 +1,94 @@
+package sunlight
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Tiles are stored under the c2sp.org/static-ct-api scheme written by Path, such as
+// tile/0/x001/234.p/5 and tile/data/x001/234. The golang.org/x/mod/sumdb/tlog scheme
+// also has the tile height in the path, such as tile/8/0/x001/234.p/5 and
+// tile/8/data/x001/234. It is never stored, but tooling built on tlog uses it.
+
+// ParsePath parses a tile path in the scheme written by Path. Only the canonical form
+// of each path is accepted, so every tile has exactly one path.
+func ParsePath(path string) (tlog.Tile, error) {
+	tile := tlog.Tile{H: TileHeight, W: TileWidth}
+	parts := strings.Split(strings.TrimPrefix(path, "tile/"), "/")
+	if !strings.HasPrefix(path, "tile/") || len(parts) < 2 {
+		return tile, fmt.Errorf("invalid tile path")
+	}
+
+	if parts[0] == "data" {
+		tile.L = -1
+	} else {
+		l, err := strconv.Atoi(parts[0])
+		if err != nil || l < 0 {
+			return tile, fmt.Errorf("invalid tile level")
+		}
+		tile.L = l
+	}
+	parts = parts[1:]
+
+	if len(parts) >= 2 && strings.HasSuffix(parts[len(parts)-2], ".p") {
+		w, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil || w < 1 || w >= TileWidth {
+			return tile, fmt.Errorf("invalid tile width")
+		}
+		tile.W = w
+		parts = parts[:len(parts)-1]
+		parts[len(parts)-1] = strings.TrimSuffix(parts[len(parts)-1], ".p")
+	}
+
+	for _, part := range parts {
+		n, err := strconv.ParseInt(strings.TrimPrefix(part, "x"), 10, 64)
+		if err != nil || n < 0 || n >= pathBase {
+			return tile, fmt.Errorf("invalid tile index")
+		}
+		tile.N = tile.N*pathBase + n
+	}
+
+	if Path(tile) != path {
+		return tile, fmt.Errorf("tile path is not canonical")
+	}
+	return tile, nil
+}
+
+// TlogPath returns the path of a tile in the tlog scheme.
+func TlogPath(t tlog.Tile) string {
+	return t.Path()
+}
+
+// ParseTlogPath parses a tile path in the tlog scheme. The tile must have the height
+// used by itko.
+func ParseTlogPath(path string) (tlog.Tile, error) {
+	tile, err := tlog.ParseTilePath(path)
+	if err != nil {
+		return tile, err
+	}
+	if tile.H != TileHeight {
+		return tile, fmt.Errorf("tile height %d is not %d", tile.H, TileHeight)
+	}
+	return tile, nil
+}
+
+// TlogToPath converts a path in the tlog scheme to the scheme written by Path.
+func TlogToPath(path string) (string, error) {
+	tile, err := ParseTlogPath(path)
+	if err != nil {
+		return "", err
+	}
+	return Path(tile), nil
+}
+
+// PathToTlog converts a path in the scheme written by Path to the tlog scheme.
+func PathToTlog(path string) (string, error) {
+	tile, err := ParsePath(path)
+	if err != nil {
+		return "", err
+	}
+	return TlogPath(tile), nil
+}
@@ -0,0 +1,69 @@
+package sunlight
+
+import (
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		tile tlog.Tile
+		tlog string
+	}{
+		{"tile/0/000", tlog.Tile{H: TileHeight, L: 0, N: 0, W: TileWidth}, "tile/8/0/000"},
+		{"tile/2/x001/234", tlog.Tile{H: TileHeight, L: 2, N: 1234, W: TileWidth}, "tile/8/2/x001/234"},
+		{"tile/0/x001/x234/567.p/5", tlog.Tile{H: TileHeight, L: 0, N: 1234567, W: 5}, "tile/8/0/x001/x234/567.p/5"},
+		{"tile/data/x001/234", tlog.Tile{H: TileHeight, L: -1, N: 1234, W: TileWidth}, "tile/8/data/x001/234"},
+		{"tile/data/000.p/255", tlog.Tile{H: TileHeight, L: -1, N: 0, W: 255}, "tile/8/data/000.p/255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			tile, err := ParsePath(tt.path)
+			if err != nil {
+				t.Fatalf("ParsePath = %v", err)
+			}
+			if tile != tt.tile {
+				t.Errorf("ParsePath = %+v, want %+v", tile, tt.tile)
+			}
+			if got := Path(tile); got != tt.path {
+				t.Errorf("Path = %q, want %q", got, tt.path)
+			}
+			if got, err := PathToTlog(tt.path); err != nil || got != tt.tlog {
+				t.Errorf("PathToTlog = %q, %v, want %q", got, err, tt.tlog)
+			}
+			if got, err := TlogToPath(tt.tlog); err != nil || got != tt.path {
+				t.Errorf("TlogToPath = %q, %v, want %q", got, err, tt.path)
+			}
+		})
+	}
+}
+
+func TestParsePathInvalid(t *testing.T) {
+	for _, path := range []string{
+		"",
+		"tile/",
+		"tile/0",
+		"tiles/0/000",
+		"tile/-1/000",
+		"tile/x/000",
+		"tile/0/1234",
+		"tile/0/x000/234",
+		"tile/0/x1/234",
+		"tile/0/23",
+		"tile/0/000.p/0",
+		"tile/0/000.p/256",
+		"tile/0/000.p/x",
+		"tile/0/000/",
+		"tile/data/-01",
+	} {
+		if tile, err := ParsePath(path); err == nil {
+			t.Errorf("ParsePath(%q) = %+v, want an error", path, tile)
+		}
+	}
+
+	if _, err := ParseTlogPath("tile/4/0/000"); err == nil {
+		t.Error("ParseTlogPath accepted a tile of another height")
+	}
+}
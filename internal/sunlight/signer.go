@@ -0,0 +1,72 @@
+package sunlight
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+)
+
+// SignatureAlgorithm is the SignatureAndHashAlgorithm of an RFC 5246 DigitallySigned
+// struct, which tells verifiers how a log's SCTs and tree heads are signed.
+type SignatureAlgorithm struct {
+	Hash      uint8
+	Signature uint8
+}
+
+var (
+	ECDSAWithSHA256 = SignatureAlgorithm{Hash: 4, Signature: 3}
+	RSAWithSHA256   = SignatureAlgorithm{Hash: 4, Signature: 1}
+	// Ed25519 hashes the message itself, and is identified as in RFC 8446 and RFC 9162
+	Ed25519 = SignatureAlgorithm{Hash: 8, Signature: 7}
+)
+
+func (a SignatureAlgorithm) String() string {
+	switch a {
+	case ECDSAWithSHA256:
+		return "ECDSA P-256 with SHA-256"
+	case RSAWithSHA256:
+		return "RSA with SHA-256"
+	case Ed25519:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("unknown algorithm %d/%d", a.Hash, a.Signature)
+}
+
+// SignatureAlgorithmForKey returns the algorithm a log with the public key signs with.
+func SignatureAlgorithmForKey(pub crypto.PublicKey) (SignatureAlgorithm, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return SignatureAlgorithm{}, fmt.Errorf("ECDSA keys must be on P-256, not %s", pub.Curve.Params().Name)
+		}
+		return ECDSAWithSHA256, nil
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return SignatureAlgorithm{}, fmt.Errorf("RSA keys must be at least 2048 bits, not %d", pub.N.BitLen())
+		}
+		return RSAWithSHA256, nil
+	case ed25519.PublicKey:
+		return Ed25519, nil
+	}
+	return SignatureAlgorithm{}, fmt.Errorf("unsupported key type %T", pub)
+}
+
+// Signer signs a log's SCTs and tree heads. It pairs a crypto.Signer, which can be a
+// local key or one held in a KMS or HSM, with the algorithm of its key, so that callers
+// don't need to know what kind of key the log has.
+type Signer struct {
+	crypto.Signer
+	Algorithm SignatureAlgorithm
+}
+
+// NewSigner returns a Signer for k, if its key is of a supported type.
+func NewSigner(k crypto.Signer) (*Signer, error) {
+	alg, err := SignatureAlgorithmForKey(k.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{Signer: k, Algorithm: alg}, nil
+}
@@ -0,0 +1,60 @@
+package sunlight
+
+import "strings"
+
+// Headers required or recommended by c2sp.org/static-ct-api for the files in the bucket.
+// They are set on the objects when they are uploaded, so a bucket or CDN serving the
+// monitoring prefix directly gets them too, and the monitor uses the same values.
+const (
+	CacheImmutable = "public, max-age=31536000, immutable"
+	// Partial tiles never change, but they are superseded by a wider tile within a flush
+	// interval or two, so there is no point in caching them for long.
+	CachePartialTile = "public, max-age=60"
+	// The checkpoint and STH change every flush interval
+	CacheRevalidate = "no-cache"
+)
+
+// ObjectHeaders returns the Content-Type and Cache-Control for a key in the bucket.
+// Both are empty for the internal files under int/.
+func ObjectHeaders(key string) (contentType, cacheControl string) {
+	switch {
+	case key == "checkpoint":
+		return "text/plain; charset=utf-8", CacheRevalidate
+	case key == "ct/v1/get-sth":
+		return "application/json", CacheRevalidate
+	case strings.HasPrefix(key, "tile/") && strings.Contains(key, ".p/"):
+		return "application/octet-stream", CachePartialTile
+	case strings.HasPrefix(key, "tile/"):
+		return "application/octet-stream", CacheImmutable
+	case strings.HasPrefix(key, "issuer/"):
+		return "application/pkix-cert", CacheImmutable
+	case strings.HasPrefix(key, "sth/index/"):
+		return "application/json", CacheRevalidate
+	case strings.HasPrefix(key, "sth/"):
+		return "application/json", CacheImmutable
+	}
+	return "", ""
+}
+
+// Surrogate keys for the objects that are replaced every time an STH is published. A CDN
+// that tags them with these keys can cache them for longer, and have stage two purge them
+// when a new STH is published.
+const (
+	SurrogateKeySTH         = "sth"
+	SurrogateKeyCheckpoint  = "checkpoint"
+	SurrogateKeyPartialTile = "partial-tile"
+)
+
+// SurrogateKey returns the surrogate key for a key in the bucket, or an empty string if
+// the object is never replaced.
+func SurrogateKey(key string) string {
+	switch {
+	case key == "checkpoint":
+		return SurrogateKeyCheckpoint
+	case key == "ct/v1/get-sth":
+		return SurrogateKeySTH
+	case strings.HasPrefix(key, "tile/") && strings.Contains(key, ".p/"):
+		return SurrogateKeyPartialTile
+	}
+	return ""
+}
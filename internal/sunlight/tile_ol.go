@@ -15,8 +15,11 @@
 package sunlight
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"iter"
 	"math"
 
 	"github.com/google/certificate-transparency-go/x509"
@@ -95,6 +98,19 @@ type LogEntry struct {
 	// LeafIndex is the zero-based index of the leaf in the log.
 	// It must be between 0 and 2^40-1.
 	LeafIndex uint64
+
+	// UnknownExtensions are extensions other than leaf_index read from a data
+	// tile. They are written back after leaf_index, and are part of the leaf hash.
+	UnknownExtensions []UnknownExtension
+
+	// Mirrored is true for an entry copied from a RFC 6962 log, whose CTExtensions
+	// have no leaf_index. They are kept in RawExtensions and written back as they are,
+	// instead of LeafIndex and UnknownExtensions, so that the leaf hash stays the same.
+	// The LeafIndex of a mirrored entry is its position in the log, which is only
+	// known when the data tile is parsed with ParseMirroredTileEntries. Only the
+	// Mirrored functions read entries without a leaf_index, the others reject them.
+	Mirrored      bool
+	RawExtensions []byte
 }
 
 // MerkleTreeLeaf returns a RFC 6962 MerkleTreeLeaf.
@@ -124,7 +140,7 @@ func (e *LogEntry) MerkleTreeLeaf() []byte {
 			b.AddBytes(e.Certificate)
 		})
 	}
-	addExtensions(b, e.LeafIndex)
+	addExtensions(b, e)
 	return b.BytesOrPanic()
 }
 
@@ -140,48 +156,70 @@ func (e *LogEntry) MerkleTreeLeaf() []byte {
 // opaque Fingerprint[32];
 
 // ReadTileLeaf reads a LogEntry from a data tile, and returns the remaining
-// data in the tile.
+// data in the tile. The entry's byte slices alias the tile. It is an error if
+// the entry has no leaf_index extension.
 func ReadTileLeaf(tile []byte) (e *LogEntry, rest []byte, err error) {
+	return readTileLeaf(tile, false)
+}
+
+// ReadMirroredTileLeaf is ReadTileLeaf for the data tiles of a log with entries
+// mirrored from a RFC 6962 log. An entry without a leaf_index extension is read
+// as a Mirrored entry, instead of being an error.
+func ReadMirroredTileLeaf(tile []byte) (e *LogEntry, rest []byte, err error) {
+	return readTileLeaf(tile, true)
+}
+
+func readTileLeaf(tile []byte, mirrored bool) (e *LogEntry, rest []byte, err error) {
 	e = &LogEntry{}
 	s := cryptobyte.String(tile)
 	var timestamp uint64
 	var entryType uint16
 	var extensions cryptobyte.String
-	if !s.ReadUint64(&timestamp) || !s.ReadUint16(&entryType) || timestamp > math.MaxInt64 {
-		return nil, s, fmt.Errorf("invalid data tile")
+	if !s.ReadUint64(&timestamp) || !s.ReadUint16(&entryType) {
+		return nil, nil, fmt.Errorf("invalid data tile: truncated timestamped_entry")
+	}
+	if timestamp > math.MaxInt64 {
+		return nil, nil, fmt.Errorf("invalid data tile: timestamp %d out of range", timestamp)
 	}
 	e.Timestamp = int64(timestamp)
 	switch entryType {
 	case 0: // x509_entry
-		if !s.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.Certificate)) ||
-			!s.ReadUint16LengthPrefixed(&extensions) {
-			return nil, s, fmt.Errorf("invalid data tile x509_entry")
+		if !s.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.Certificate)) {
+			return nil, nil, fmt.Errorf("invalid data tile x509_entry: truncated certificate")
+		}
+		if !s.ReadUint16LengthPrefixed(&extensions) {
+			return nil, nil, fmt.Errorf("invalid data tile x509_entry: truncated extensions")
 		}
 	case 1: // precert_entry
 		e.IsPrecert = true
-		if !s.CopyBytes(e.IssuerKeyHash[:]) ||
-			!s.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.Certificate)) ||
-			!s.ReadUint16LengthPrefixed(&extensions) ||
-			!s.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.PreCertificate)) {
-			return nil, s, fmt.Errorf("invalid data tile precert_entry")
+		if !s.CopyBytes(e.IssuerKeyHash[:]) {
+			return nil, nil, fmt.Errorf("invalid data tile precert_entry: truncated issuer_key_hash")
+		}
+		if !s.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.Certificate)) {
+			return nil, nil, fmt.Errorf("invalid data tile precert_entry: truncated tbs_certificate")
+		}
+		if !s.ReadUint16LengthPrefixed(&extensions) {
+			return nil, nil, fmt.Errorf("invalid data tile precert_entry: truncated extensions")
+		}
+		if !s.ReadUint24LengthPrefixed((*cryptobyte.String)(&e.PreCertificate)) {
+			return nil, nil, fmt.Errorf("invalid data tile precert_entry: truncated pre_certificate")
 		}
 	default:
-		return nil, s, fmt.Errorf("invalid data tile: unknown type %d", entryType)
+		return nil, nil, fmt.Errorf("invalid data tile: unknown type %d", entryType)
 	}
 
-	// look at first byte to determine the length of the chain
-	var fingerprintBytes uint16
-	if !s.ReadUint16(&fingerprintBytes) {
-		return nil, s, fmt.Errorf("invalid data tile precert_entry")
+	// A Fingerprint is always 32 bytes, and the length prefix counts bytes
+	var chain cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&chain) {
+		return nil, nil, fmt.Errorf("invalid data tile chain: truncated")
 	}
-	var fingerprintCount = fingerprintBytes / 32
-	// then, try to read out that many fingerprints
-	e.ChainFp = make([][32]byte, 0, fingerprintCount)
-	for i := uint16(0); i < fingerprintCount; i++ {
+	if len(chain)%32 != 0 {
+		return nil, nil, fmt.Errorf("invalid data tile chain: length %d is not a multiple of 32", len(chain))
+	}
+	e.ChainFp = make([][32]byte, 0, len(chain)/32)
+	for !chain.Empty() {
 		var fingerprint [32]byte
-		if !s.CopyBytes(fingerprint[:]) {
-			return nil, s, fmt.Errorf("invalid data tile precert_entry")
-		}
+		chain.CopyBytes(fingerprint[:])
 		e.ChainFp = append(e.ChainFp, fingerprint)
 	}
 	if e.IsPrecert {
@@ -190,17 +228,74 @@ func ReadTileLeaf(tile []byte) (e *LogEntry, rest []byte, err error) {
 		e.CertificateFp = sha256.Sum256(e.Certificate)
 	}
 
-	var extensionType uint8
-	var extensionData cryptobyte.String
-	if !extensions.ReadUint8(&extensionType) || extensionType != 0 ||
-		!extensions.ReadUint16LengthPrefixed(&extensionData) ||
-		!readUint40(&extensionData, &e.LeafIndex) || !extensionData.Empty() ||
-		!extensions.Empty() {
-		return nil, s, fmt.Errorf("invalid data tile extensions")
+	ext, err := ParseExtensions(extensions)
+	if mirrored && errors.Is(err, errMissingLeafIndex) {
+		e.Mirrored = true
+		e.RawExtensions = extensions
+		return e, s, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid data tile extensions: %w", err)
+	}
+	e.LeafIndex = ext.LeafIndex
+	e.UnknownExtensions = ext.Unknown
+	// The leaf hash is computed from the extensions as they are written back, so
+	// they must already be in that order
+	if len(ext.Unknown) > 0 {
+		if canonical, err := MarshalExtensions(ext); err != nil || !bytes.Equal(canonical, extensions) {
+			return nil, nil, fmt.Errorf("invalid data tile extensions: leaf_index must come first")
+		}
 	}
 	return e, s, nil
 }
 
+// ParseDataTile iterates over the entries of a data tile. If an entry can't be parsed,
+// the error says which entry and where it starts, and iteration stops.
+func ParseDataTile(tile []byte) iter.Seq2[*LogEntry, error] {
+	return parseDataTile(tile, false)
+}
+
+func parseDataTile(tile []byte, mirrored bool) iter.Seq2[*LogEntry, error] {
+	return func(yield func(*LogEntry, error) bool) {
+		rest := tile
+		for i := 0; len(rest) > 0; i++ {
+			offset := len(tile) - len(rest)
+			entry, nextRest, err := readTileLeaf(rest, mirrored)
+			if err != nil {
+				yield(nil, fmt.Errorf("entry %d at byte %d: %w", i, offset, err))
+				return
+			}
+			if !yield(entry, nil) {
+				return
+			}
+			rest = nextRest
+		}
+	}
+}
+
+// ParseTileEntries is ParseDataTile for the data tile t.
+func ParseTileEntries(t tlog.Tile, data []byte) iter.Seq2[*LogEntry, error] {
+	return ParseDataTile(data)
+}
+
+// ParseMirroredTileEntries is ParseTileEntries for a log with entries mirrored from a
+// RFC 6962 log, as read by ReadMirroredTileLeaf. The LeafIndex of mirrored entries is
+// set from their position in t.
+func ParseMirroredTileEntries(t tlog.Tile, data []byte) iter.Seq2[*LogEntry, error] {
+	return func(yield func(*LogEntry, error) bool) {
+		index := uint64(t.N) * TileWidth
+		for entry, err := range parseDataTile(data, true) {
+			if entry != nil && entry.Mirrored {
+				entry.LeafIndex = index
+			}
+			if !yield(entry, err) {
+				return
+			}
+			index++
+		}
+	}
+}
+
 // AppendTileLeaf appends a LogEntry to a data tile.
 func AppendTileLeaf(t []byte, e *LogEntry) []byte {
 	b := cryptobyte.NewBuilder(t)
@@ -217,7 +312,7 @@ func AppendTileLeaf(t []byte, e *LogEntry) []byte {
 			b.AddBytes(e.Certificate)
 		})
 	}
-	addExtensions(b, e.LeafIndex)
+	addExtensions(b, e)
 	if e.IsPrecert {
 		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
 			b.AddBytes(e.PreCertificate)
@@ -232,9 +327,13 @@ func AppendTileLeaf(t []byte, e *LogEntry) []byte {
 	return b.BytesOrPanic()
 }
 
-func addExtensions(b *cryptobyte.Builder, leafIndex uint64) {
+func addExtensions(b *cryptobyte.Builder, e *LogEntry) {
 	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-		ext, err := MarshalExtensions(Extensions{LeafIndex: leafIndex})
+		if e.Mirrored {
+			b.AddBytes(e.RawExtensions)
+			return
+		}
+		ext, err := MarshalExtensions(Extensions{LeafIndex: e.LeafIndex, Unknown: e.UnknownExtensions})
 		if err != nil {
 			b.SetError(err)
 			return
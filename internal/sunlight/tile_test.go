@@ -0,0 +1,153 @@
+package sunlight
+
+import (
+	"bytes"
+	"iter"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func seedTile() []byte {
+	var tile []byte
+	tile = AppendTileLeaf(tile, &LogEntry{
+		Certificate: []byte("certificate"),
+		ChainFp:     [][32]byte{{1}, {2}},
+		Timestamp:   1700000000000,
+		LeafIndex:   0,
+	})
+	tile = AppendTileLeaf(tile, &LogEntry{
+		Certificate:    []byte("tbs certificate"),
+		IsPrecert:      true,
+		IssuerKeyHash:  [32]byte{3},
+		PreCertificate: []byte("precertificate"),
+		ChainFp:        [][32]byte{{4}},
+		Timestamp:      1700000000001,
+		LeafIndex:      1,
+	})
+	tile = AppendTileLeaf(tile, &LogEntry{
+		Certificate:       []byte("certificate"),
+		Timestamp:         1700000000002,
+		LeafIndex:         2,
+		UnknownExtensions: []UnknownExtension{{Type: 7, Data: []byte("extension")}},
+	})
+	return tile
+}
+
+// FuzzParseDataTile checks that parsing never panics or reads out of bounds, and that
+// every entry it accepts is written back byte for byte, as the leaf hash depends on it.
+func FuzzParseDataTile(f *testing.F) {
+	tile := seedTile()
+	f.Add(tile)
+	f.Add(tile[:len(tile)-1])
+	f.Add([]byte{})
+	f.Add(make([]byte, 10))
+	// A chain whose length isn't a multiple of 32
+	entry := AppendTileLeaf(nil, &LogEntry{Certificate: []byte{0}})
+	f.Add(append(entry[:len(entry)-2], 0, 5, 1, 2, 3, 4, 5))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var written []byte
+		for entry, err := range ParseDataTile(data) {
+			if err != nil {
+				return
+			}
+			written = AppendTileLeaf(written, entry)
+		}
+		if !bytes.Equal(written, data) {
+			t.Fatalf("entries were not written back as they were read:\n%x\n%x", data, written)
+		}
+	})
+}
+
+func TestParseDataTileError(t *testing.T) {
+	tile := seedTile()
+	n := 0
+	var lastErr error
+	for _, err := range ParseDataTile(tile[:len(tile)-1]) {
+		if err != nil {
+			lastErr = err
+			break
+		}
+		n++
+	}
+	if n != 2 || lastErr == nil {
+		t.Fatalf("got %d entries and error %v, expected 2 entries and an error", n, lastErr)
+	}
+}
+
+func TestParseMirroredTileEntries(t *testing.T) {
+	// A data tile of a log migrated from Trillian, whose first entry has no extensions,
+	// and whose second has ones without a leaf_index, followed by one of its own
+	tile := AppendTileLeaf(nil, &LogEntry{Certificate: []byte("certificate"), Timestamp: 1, Mirrored: true})
+	tile = AppendTileLeaf(tile, &LogEntry{Certificate: []byte("certificate"), Timestamp: 2, Mirrored: true, RawExtensions: []byte{7, 0, 1, 'x'}})
+	tile = AppendTileLeaf(tile, &LogEntry{Certificate: []byte("certificate"), Timestamp: 3, LeafIndex: TileWidth + 2})
+	tileID := tlog.Tile{H: TileHeight, L: -1, N: 1, W: 3}
+
+	tests := []struct {
+		name  string
+		parse func(tlog.Tile, []byte) iter.Seq2[*LogEntry, error]
+		// The number of entries read before the error, or -1 if there is none
+		failAt int
+	}{
+		{"strict", ParseTileEntries, 0},
+		{"mirrored", ParseMirroredTileEntries, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries []*LogEntry
+			var parseErr error
+			for entry, err := range tt.parse(tileID, tile) {
+				if err != nil {
+					parseErr = err
+					break
+				}
+				entries = append(entries, entry)
+			}
+			if tt.failAt >= 0 {
+				if parseErr == nil || !strings.Contains(parseErr.Error(), "missing leaf_index") {
+					t.Fatalf("got error %v, want a missing leaf_index error", parseErr)
+				}
+				if len(entries) != tt.failAt {
+					t.Fatalf("got %d entries before the error, want %d", len(entries), tt.failAt)
+				}
+				return
+			}
+			if parseErr != nil {
+				t.Fatal(parseErr)
+			}
+			var written []byte
+			for i, entry := range entries {
+				if want := uint64(TileWidth + i); entry.LeafIndex != want {
+					t.Errorf("entry %d has leaf index %d, want %d", i, entry.LeafIndex, want)
+				}
+				if entry.Mirrored != (i < 2) {
+					t.Errorf("entry %d has Mirrored %v", i, entry.Mirrored)
+				}
+				written = AppendTileLeaf(written, entry)
+			}
+			if !bytes.Equal(written, tile) {
+				t.Errorf("entries were not written back as they were read")
+			}
+		})
+	}
+}
+
+func TestReadMirroredTileLeaf(t *testing.T) {
+	leaf := AppendTileLeaf(nil, &LogEntry{Certificate: []byte("certificate"), Mirrored: true})
+	if _, _, err := ReadTileLeaf(leaf); err == nil {
+		t.Error("ReadTileLeaf read an entry without a leaf_index")
+	}
+	e, rest, err := ReadMirroredTileLeaf(leaf)
+	if err != nil || len(rest) != 0 || !e.Mirrored {
+		t.Errorf("ReadMirroredTileLeaf = %+v, %d bytes left, %v, want a mirrored entry", e, len(rest), err)
+	}
+	// Entries with a leaf_index read the same either way
+	leaf = AppendTileLeaf(nil, &LogEntry{Certificate: []byte("certificate"), LeafIndex: 5})
+	for _, read := range []func([]byte) (*LogEntry, []byte, error){ReadTileLeaf, ReadMirroredTileLeaf} {
+		if e, _, err := read(leaf); err != nil || e.Mirrored || e.LeafIndex != 5 {
+			t.Errorf("read = %+v, %v, want leaf index 5", e, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// The exporters read their endpoint, headers, and TLS settings from the standard
+// OTEL_EXPORTER_OTLP_* environment variables, so for metrics only the protocol is
+// chosen here. Traces can also be given an endpoint explicitly.
+
+// SetupMetrics installs a global meter provider exporting over OTLP with the given
+// protocol, either "grpc" or "http". If protocol is empty, metrics stay a no-op.
+// The returned function flushes and stops the exporter.
+func SetupMetrics(ctx context.Context, protocol string, interval time.Duration) (func(context.Context) error, error) {
+	var exp sdkmetric.Exporter
+	var err error
+	switch protocol {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "grpc":
+		exp, err = otlpmetricgrpc.New(ctx)
+	case "http":
+		exp, err = otlpmetrichttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, must be grpc or http", protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OTLP metric exporter: %w", err)
+	}
+
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(interval))),
+	)
+	otel.SetMeterProvider(mp)
+	return mp.Shutdown, nil
+}
+
+// TraceConfig selects where and how much to trace. If Protocol is empty, tracing is
+// left as a no-op, which is how the integration tests run.
+type TraceConfig struct {
+	// Either "grpc" or "http"
+	Protocol string
+	// Full URL of the collector, such as http://localhost:4318. If empty, the exporter
+	// uses OTEL_EXPORTER_OTLP_ENDPOINT, or the OTLP default for the protocol.
+	Endpoint string
+	// Fraction of new traces to sample, between 0 and 1. Requests that arrive with a
+	// sampled parent span are always traced.
+	SampleRate  float64
+	ServiceName string
+}
+
+// SetupTraces installs a global tracer provider exporting over OTLP, along with the W3C
+// trace context propagators. The returned function flushes and stops the exporter.
+func SetupTraces(ctx context.Context, c TraceConfig) (func(context.Context) error, error) {
+	var client otlptrace.Client
+	switch c.Protocol {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "grpc":
+		var opts []otlptracegrpc.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(c.Endpoint))
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	case "http":
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(c.Endpoint))
+		}
+		client = otlptracehttp.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, must be grpc or http", c.Protocol)
+	}
+
+	exp, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OTLP trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", c.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRate))),
+	)
+	otel.SetTracerProvider(tp)
+
+	// Propagate trace context and baggage, so a front-end's spans are joined up
+	// with the sequencer's
+	otel.SetTextMapPropagator(
+		propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		),
+	)
+
+	return tp.Shutdown, nil
+}